@@ -0,0 +1,250 @@
+// Package alert watches prices and indicators for the simple conditions
+// people keep asking the bot about: a price crossing a level, a move of
+// some percent within a window, or an indicator above or below a level.
+//
+// Alerts are defined in the configuration or through the control API, are
+// evaluated on the price stream of PRICE_<EX>_<pair> and on the indicator
+// records, and are delivered by the notifiers. A one-shot alert is removed
+// when it fires, a re-arming one fires again once its condition resets.
+// The watched alerts are kept in redis, so a restart neither loses the
+// ones added through the API nor brings back the removed ones.
+package alert
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/spf13/viper"
+)
+
+// Alert kinds
+const (
+	KindCross = "crosses"
+	KindAbove = "above"
+	KindBelow = "below"
+	KindMove  = "moves"
+)
+
+// Kinds lists the valid kinds
+var Kinds = []string{KindCross, KindAbove, KindBelow, KindMove}
+
+const (
+	defaultTimeframe = 30
+
+	// WatchesKey keeps the watched alerts of an exchange
+	WatchesKey = "%s_ALERTS"
+)
+
+// Alert is a condition on the price of a pair, or on one of its indicators
+// when Indicator is set. Level is a price or indicator value, a percentage
+// for KindMove, which also needs a Window such as "1h". Indicators are read
+// from the records of Timeframe minutes.
+type Alert struct {
+	ID        string          `json:"id"`
+	Exchange  string          `json:"exchange,omitempty"`
+	Pair      string          `json:"pair"`
+	Indicator string          `json:"indicator,omitempty"`
+	Timeframe int             `json:"timeframe,omitempty"`
+	Kind      string          `json:"kind"`
+	Level     float64         `json:"level"`
+	Window    string          `json:"window,omitempty"`
+	Rearm     bool            `json:"rearm,omitempty"`
+	Severity  notify.Severity `json:"severity"`
+}
+
+func (alert Alert) String() string {
+	subject := alert.Pair
+	if alert.Indicator != "" {
+		subject = fmt.Sprintf("%s %s", alert.Pair, alert.Indicator)
+	}
+
+	level := strconv.FormatFloat(alert.Level, 'f', -1, 64)
+	if alert.Kind == KindMove {
+		return fmt.Sprintf("%s %s %s%% within %s", subject, alert.Kind, level, alert.Window)
+	}
+	return fmt.Sprintf("%s %s %s", subject, alert.Kind, level)
+}
+
+// Parse reads an alert written as people ask for it:
+//
+//	BTCUSD crosses 10000
+//	BTCUSD above 10000
+//	ETHBTC moves 5% within 1h
+//	BTCUSD ATRP above 3
+//
+// The percentage of a move can be written as ±5% or +-5%, either way is
+// watched anyway.
+func Parse(rule string) (Alert, error) {
+	fields := strings.Fields(rule)
+
+	alert := Alert{}
+	if len(fields) < 3 {
+		return alert, fmt.Errorf("bad alert %q: expected <pair> [indicator] <kind> <level>", rule)
+	}
+
+	alert.Pair = strings.ToUpper(fields[0])
+	fields = fields[1:]
+
+	if !isKind(strings.ToLower(fields[0])) {
+		alert.Indicator = fields[0]
+		fields = fields[1:]
+	}
+
+	if len(fields) < 2 {
+		return alert, fmt.Errorf("bad alert %q: expected <pair> [indicator] <kind> <level>", rule)
+	}
+
+	alert.Kind = strings.ToLower(fields[0])
+
+	levelStr := strings.TrimSuffix(fields[1], "%")
+	levelStr = strings.TrimPrefix(strings.TrimPrefix(levelStr, "±"), "+-")
+	level, err := strconv.ParseFloat(levelStr, 64)
+	if err != nil {
+		return alert, fmt.Errorf("bad level in alert %q: %s", rule, fields[1])
+	}
+	alert.Level = level
+	fields = fields[2:]
+
+	if len(fields) > 0 && strings.ToLower(fields[0]) == "within" {
+		fields = fields[1:]
+	}
+	if len(fields) == 1 {
+		alert.Window = fields[0]
+	} else if len(fields) > 1 {
+		return alert, fmt.Errorf("bad alert %q: unexpected %s", rule, strings.Join(fields, " "))
+	}
+
+	return alert, alert.validate()
+}
+
+func isKind(kind string) bool {
+	for _, valid := range Kinds {
+		if kind == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the alert can be watched
+func (alert Alert) validate() error {
+	if alert.Pair == "" {
+		return fmt.Errorf("alert without pair")
+	}
+	if !isKind(alert.Kind) {
+		return fmt.Errorf("unknown alert kind %q, expected one of %s", alert.Kind, strings.Join(Kinds, ", "))
+	}
+	if alert.Indicator != "" {
+		if _, ok := indicatorValue(movingstats.Indicators{}, alert.Indicator); !ok {
+			return fmt.Errorf("unknown indicator: %s", alert.Indicator)
+		}
+	}
+
+	window, err := alert.window()
+	if err != nil {
+		return err
+	}
+
+	if alert.Kind == KindMove {
+		if alert.Level <= 0 {
+			return fmt.Errorf("alert %s: a move needs a positive percentage", alert)
+		}
+		if window <= 0 {
+			return fmt.Errorf("alert %s: a move needs a window", alert)
+		}
+	}
+
+	return nil
+}
+
+// window parses the window of a move
+func (alert Alert) window() (time.Duration, error) {
+	if alert.Window == "" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(alert.Window)
+	if err != nil {
+		return 0, fmt.Errorf("bad window of alert %s: %s", alert.ID, err.Error())
+	}
+	return window, nil
+}
+
+// indicatorValue reads an indicator by its field or json name, ATRP or atrp
+func indicatorValue(indicators movingstats.Indicators, name string) (float64, bool) {
+	value := reflect.ValueOf(indicators)
+	kind := value.Type()
+
+	for i := 0; i < kind.NumField(); i++ {
+		field := kind.Field(i)
+		if field.Type.Kind() != reflect.Float64 {
+			continue
+		}
+		if strings.EqualFold(field.Name, name) || strings.EqualFold(field.Tag.Get("json"), name) {
+			return value.Field(i).Float(), true
+		}
+	}
+
+	return 0, false
+}
+
+// Config of the alert service. Timeframe is the indicator records used by
+// default, Key where the watched alerts are kept, WatchesKey by default.
+type Config struct {
+	Exchange  string
+	Key       string
+	Timeframe int
+	Alerts    []Alert
+}
+
+// LoadConfig reads the alerts of the configuration, named by their table.
+// It returns false when there are none.
+//
+//	[alerts]
+//	timeframe = 30
+//
+//	[alerts.rules.btc10k]
+//	rule = "BTCUSD crosses 10000"
+//	rearm = true
+//	severity = "warning"
+//
+//	[alerts.rules.volatility]
+//	rule = "BTCUSD ATRP above 3"
+//	timeframe = 120
+func LoadConfig(exchange string) (Config, bool, error) {
+	config := Config{Exchange: strings.ToUpper(exchange)}
+	config.Key = viper.GetString("alerts.key")
+	config.Timeframe = viper.GetInt("alerts.timeframe")
+
+	if !viper.IsSet("alerts") {
+		return config, false, nil
+	}
+
+	for name := range viper.GetStringMap("alerts.rules") {
+		key := fmt.Sprintf("alerts.rules.%s", name)
+
+		alert, err := Parse(viper.GetString(key + ".rule"))
+		if err != nil {
+			return config, false, fmt.Errorf("alert %s: %s", name, err.Error())
+		}
+
+		severity, err := notify.ParseSeverity(viper.GetString(key + ".severity"))
+		if err != nil {
+			return config, false, fmt.Errorf("alert %s: %s", name, err.Error())
+		}
+
+		alert.ID = name
+		alert.Exchange = strings.ToUpper(viper.GetString(key + ".exchange"))
+		alert.Timeframe = viper.GetInt(key + ".timeframe")
+		alert.Rearm = viper.GetBool(key + ".rearm")
+		alert.Severity = severity
+
+		config.Alerts = append(config.Alerts, alert)
+	}
+
+	return config, true, nil
+}
@@ -0,0 +1,390 @@
+package alert_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/alert"
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/spf13/viper"
+)
+
+var kr *kredis.Kredis
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	kr = kredis.NewKredis(1)
+	kr.Start()
+
+	os.Exit(m.Run())
+}
+
+// recorder keeps the events it is notified
+type recorder struct {
+	mu     sync.Mutex
+	events []notify.Event
+}
+
+func (rc *recorder) Notify(event notify.Event) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.events = append(rc.events, event)
+	return nil
+}
+
+func (rc *recorder) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.events)
+}
+
+func newService(t *testing.T, alerts ...string) (*alert.Service, *recorder, *clock.Simulated) {
+	config := alert.Config{Exchange: "CEXIO", Key: fmt.Sprintf("TEST_ALERTS_%d", rand.Int63())}
+	for i, rule := range alerts {
+		definition, err := alert.Parse(rule)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		definition.ID = fmt.Sprintf("A%d", i)
+		config.Alerts = append(config.Alerts, definition)
+	}
+
+	rc := &recorder{}
+	as, err := alert.NewService(config, kr, rc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	clk := clock.NewSimulated(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	as.SetClock(clk)
+
+	return as, rc, clk
+}
+
+func TestParse(t *testing.T) {
+
+	cases := map[string]alert.Alert{
+		"BTCUSD crosses 10000":       {Pair: "BTCUSD", Kind: alert.KindCross, Level: 10000},
+		"ethbtc moves ±5% within 1h": {Pair: "ETHBTC", Kind: alert.KindMove, Level: 5, Window: "1h"},
+		"ETHBTC moves +-2.5% 30m":    {Pair: "ETHBTC", Kind: alert.KindMove, Level: 2.5, Window: "30m"},
+		"BTCUSD ATRP above 3":        {Pair: "BTCUSD", Indicator: "ATRP", Kind: alert.KindAbove, Level: 3},
+		"BTCUSD below 9000":          {Pair: "BTCUSD", Kind: alert.KindBelow, Level: 9000},
+	}
+	for rule, expected := range cases {
+		parsed, err := alert.Parse(rule)
+		if err != nil {
+			t.Errorf("Parsing %q: %s", rule, err.Error())
+			continue
+		}
+		if parsed != expected {
+			t.Errorf("Parsing %q: expected %v got %v", rule, expected, parsed)
+		}
+	}
+
+	if parsed, _ := alert.Parse("ETHBTC moves 5% within 1h"); parsed.String() != "ETHBTC moves 5% within 1h" {
+		t.Error("Bad alert string: ", parsed.String())
+	}
+
+	bad := []string{
+		"BTCUSD crosses",
+		"BTCUSD jumps 10000",
+		"BTCUSD crosses ten",
+		"ETHBTC moves 5%",
+		"ETHBTC moves 5% within an hour",
+		"BTCUSD FOO above 3",
+	}
+	for _, rule := range bad {
+		if _, err := alert.Parse(rule); err == nil {
+			t.Errorf("Bad alert %q parsed", rule)
+		}
+	}
+}
+
+func TestCross(t *testing.T) {
+
+	as, rc, _ := newService(t, "BTCUSD crosses 10000")
+
+	as.Price("CEXIO", "BTCUSD", 10100)
+	as.Price("CEXIO", "ETHUSD", 9000)
+	if rc.count() != 0 {
+		t.Fatal("Alert fired without crossing")
+	}
+
+	as.Price("CEXIO", "BTCUSD", 9900)
+	if rc.count() != 1 {
+		t.Fatal("Cross down not notified")
+	}
+	event := rc.events[0]
+	if event.Type != notify.EventAlert || event.Pair != "BTCUSD" || event.Price != 9900 ||
+		!strings.Contains(event.Message, "BTCUSD crosses 10000") {
+		t.Error("Bad alert event: ", event, event.Message)
+	}
+
+	// One-shot
+	as.Price("CEXIO", "BTCUSD", 10100)
+	if rc.count() != 1 || len(as.Alerts()) != 0 {
+		t.Error("One-shot alert fired again: ", rc.count(), as.Alerts())
+	}
+
+	// Re-arming fires on every cross
+	definition, _ := alert.Parse("BTCUSD crosses 10000")
+	definition.Rearm = true
+	if _, err := as.Add(definition); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, price := range []float64{9900, 10000, 9990, 9980, 10050} {
+		as.Price("CEXIO", "BTCUSD", price)
+	}
+	if rc.count() != 4 {
+		t.Error("Re-arming cross not notified every time: ", rc.count())
+	}
+}
+
+func TestMove(t *testing.T) {
+
+	as, rc, clk := newService(t, "ETHBTC moves 5% within 1h")
+	definition, _ := alert.Parse("ETHBTC moves 5% within 1h")
+	definition.ID = "rearm"
+	definition.Rearm = true
+	as.Add(definition)
+
+	// Slow moves are not alerts
+	for _, price := range []float64{0.100, 0.103, 0.106} {
+		as.Price("CEXIO", "ETHBTC", price)
+		clk.Advance(40 * time.Minute)
+	}
+	if rc.count() != 0 {
+		t.Fatal("Slow move notified: ", rc.count())
+	}
+
+	// Down 5% from the top of the last hour
+	as.Price("CEXIO", "ETHBTC", 0.1005)
+	if rc.count() != 2 {
+		t.Fatal("Move not notified by both alerts: ", rc.count())
+	}
+	if !strings.Contains(rc.events[0].Message, "-5.19%") {
+		t.Error("Bad move message: ", rc.events[0].Message)
+	}
+
+	// The re-armed move starts over
+	clk.Advance(time.Minute)
+	as.Price("CEXIO", "ETHBTC", 0.1040)
+	if rc.count() != 2 {
+		t.Error("Move notified without moving 5%: ", rc.count())
+	}
+	clk.Advance(time.Minute)
+	as.Price("CEXIO", "ETHBTC", 0.1060)
+	if rc.count() != 3 || len(as.Alerts()) != 1 {
+		t.Error("Re-armed move not notified: ", rc.count(), as.Alerts())
+	}
+}
+
+func TestIndicatorAndCheck(t *testing.T) {
+
+	pair := fmt.Sprintf("T%dUSD", rand.Intn(1000000))
+
+	as, rc, _ := newService(t, pair+" ATRP above 3", pair+" below 100")
+	definition, _ := alert.Parse(pair + " ATRP above 3")
+	definition.ID = "rearm"
+	definition.Rearm = true
+	as.Add(definition)
+
+	if alerts := as.Alerts(); len(alerts) != 3 || alerts[0].Timeframe != 30 || alerts[0].Exchange != "CEXIO" {
+		t.Fatal("Bad alerts: ", alerts)
+	}
+
+	// Nothing in redis yet
+	as.Check()
+	if rc.count() != 0 {
+		t.Fatal("Alerts fired without data: ", rc.count())
+	}
+
+	push := func(atrp float64) {
+		indicatorsJSON, _ := json.Marshal(movingstats.Indicators{ATRP: atrp})
+		if err := kr.AddStringLong("CEXIO", pair+"_MS_30_INDICATORS", string(indicatorsJSON)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	for _, atrp := range []float64{2, 3.5, 4, 2.5, 3.2} {
+		push(atrp)
+		as.Check()
+	}
+	if rc.count() != 3 {
+		t.Error("Bad ATRP alerts, one-shot and re-armed: ", rc.count())
+	}
+
+	if err := kr.Set(fmt.Sprintf("PRICE_CEXIO_%s", pair), "99.5"); err != nil {
+		t.Fatal(err.Error())
+	}
+	as.Check()
+	if rc.count() != 4 || rc.events[3].Price != 99.5 {
+		t.Error("Price alert not checked: ", rc.count())
+	}
+
+	if err := as.Remove("rearm"); err != nil || len(as.Alerts()) != 0 {
+		t.Error("Alert not removed: ", err, as.Alerts())
+	}
+	if err := as.Remove("rearm"); err == nil {
+		t.Error("Unknown alert removed")
+	}
+}
+
+func TestRunOnLeaseHolder(t *testing.T) {
+
+	pair := fmt.Sprintf("T%dUSD", rand.Intn(1000000))
+
+	as, rc, _ := newService(t, pair+" below 100")
+
+	key := fmt.Sprintf("TEST_LEADER_ALERTS_%d", rand.Int63())
+	leaseA := leader.NewLease(kr, key, leader.Config{ID: "a", TTL: time.Minute, Renew: 20 * time.Second})
+	leaseB := leader.NewLease(kr, key, leader.Config{ID: "b", TTL: time.Minute, Renew: 20 * time.Second})
+	if !leaseA.Acquire() || leaseB.Acquire() {
+		t.Fatal("Lease not taken by a alone")
+	}
+	defer leaseA.Release()
+	as.SetLease(leaseB)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go as.Run(stop)
+
+	// Every price update is published
+	update := func() {
+		if err := kr.Update("CEXIO", pair, "99.5"); err != nil {
+			t.Fatal(err.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// ------------------------------
+	// The standby does not evaluate
+	// ------------------------------
+	for i := 0; i < 10; i++ {
+		update()
+	}
+	if as.Leading() || rc.count() != 0 {
+		t.Fatal("Alert checked on standby: ", rc.count())
+	}
+
+	// ------------------------------
+	// Once taken over, it does
+	// ------------------------------
+	if err := leaseA.Release(); err != nil || !leaseB.Acquire() {
+		t.Fatal("Lease not taken over: ", err)
+	}
+	defer leaseB.Release()
+
+	for i := 0; i < 100 && rc.count() == 0; i++ {
+		update()
+	}
+	if rc.count() != 1 {
+		t.Error("Alert not evaluated by the lease holder: ", rc.count())
+	}
+}
+
+func TestSavedAlerts(t *testing.T) {
+
+	config := alert.Config{Exchange: "CEXIO", Key: fmt.Sprintf("TEST_ALERTS_%d", rand.Int63())}
+	for _, rule := range []string{"BTCUSD crosses 10000", "BTCUSD above 12000"} {
+		definition, _ := alert.Parse(rule)
+		definition.ID = fmt.Sprintf("rule%d", len(config.Alerts))
+		config.Alerts = append(config.Alerts, definition)
+	}
+
+	as, err := alert.NewService(config, kr, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	definition, _ := alert.Parse("ETHBTC moves 5% within 1h")
+	added, err := as.Add(definition)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The one-shot cross fires
+	as.Price("CEXIO", "BTCUSD", 9000)
+	as.Price("CEXIO", "BTCUSD", 11000)
+
+	// ------------------------------
+	// A restart keeps the added one
+	// and not the fired one
+	// ------------------------------
+	restarted, err := alert.NewService(config, kr, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	alerts := restarted.Alerts()
+	if len(alerts) != 2 || alerts[0].ID != added.ID || alerts[1].ID != "rule1" {
+		t.Fatal("Bad restored alerts: ", alerts)
+	}
+
+	if err := restarted.Remove("rule1"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	restarted, err = alert.NewService(config, kr, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if alerts := restarted.Alerts(); len(alerts) != 1 || alerts[0].ID != added.ID {
+		t.Error("Removed alert restored: ", alerts)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	viper.Set("alerts.key", fmt.Sprintf("TEST_ALERTS_%d", rand.Int63()))
+	viper.Set("alerts.timeframe", 60)
+	viper.Set("alerts.rules.btc10k.rule", "BTCUSD crosses 10000")
+	viper.Set("alerts.rules.btc10k.rearm", true)
+	viper.Set("alerts.rules.btc10k.severity", "warning")
+	viper.Set("alerts.rules.volatility.rule", "BTCUSD ATRP above 3")
+	defer viper.Reset()
+
+	config, ok, err := alert.LoadConfig("cexio")
+	if err != nil || !ok {
+		t.Fatal("Alerts not loaded: ", err)
+	}
+
+	as, err := alert.NewService(config, kr, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	alerts := as.Alerts()
+	if len(alerts) != 2 || alerts[0].ID != "btc10k" || !alerts[0].Rearm || alerts[0].Severity != notify.Warning {
+		t.Fatal("Bad loaded alerts: ", alerts)
+	}
+	if alerts[1].Timeframe != 60 || alerts[1].Exchange != "CEXIO" {
+		t.Error("Bad defaults of the loaded alert: ", alerts[1])
+	}
+
+	if _, err := as.Add(alerts[0]); err == nil {
+		t.Error("Duplicated alert added")
+	}
+	if added, err := as.Add(alert.Alert{Pair: "ETHBTC", Kind: alert.KindAbove, Level: 0.1}); err != nil || added.ID == "" {
+		t.Error("Alert without ID not added: ", added, err)
+	}
+
+	viper.Set("alerts.rules.bad.rule", "BTCUSD jumps")
+	if _, _, err := alert.LoadConfig("cexio"); err == nil {
+		t.Error("Bad alert loaded")
+	}
+}
@@ -0,0 +1,535 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	"github.com/lagarciag/tayni/notify"
+	log "github.com/sirupsen/logrus"
+)
+
+type sample struct {
+	date  time.Time
+	value float64
+}
+
+// watch is the evaluation state of an alert
+type watch struct {
+	alert   Alert
+	window  time.Duration
+	armed   bool
+	seen    bool
+	last    float64
+	samples []sample
+}
+
+// observe evaluates a new value, it returns what happened when the alert
+// fires
+func (wt *watch) observe(value float64, now time.Time) (string, bool) {
+	level := wt.alert.Level
+
+	switch wt.alert.Kind {
+	case KindCross:
+		last, seen := wt.last, wt.seen
+		wt.last, wt.seen = value, true
+		if seen && (last >= level) != (value >= level) {
+			return fmt.Sprintf("from %f to %f", last, value), true
+		}
+
+	case KindAbove, KindBelow:
+		hit := value > level
+		if wt.alert.Kind == KindBelow {
+			hit = value < level
+		}
+		if !hit {
+			wt.armed = true
+			return "", false
+		}
+		if wt.armed {
+			wt.armed = false
+			return fmt.Sprintf("at %f", value), true
+		}
+
+	case KindMove:
+		recent := wt.samples[:0]
+		for _, old := range wt.samples {
+			if now.Sub(old.date) <= wt.window {
+				recent = append(recent, old)
+			}
+		}
+		wt.samples = append(recent, sample{date: now, value: value})
+
+		low, high := value, value
+		for _, old := range wt.samples {
+			low = math.Min(low, old.value)
+			high = math.Max(high, old.value)
+		}
+
+		change := 0.0
+		if low > 0 && (value-low)/low*100 >= level {
+			change = (value - low) / low * 100
+		} else if high > 0 && (high-value)/high*100 >= level {
+			change = (value - high) / high * 100
+		}
+		if change != 0 {
+			// A re-armed move starts over from here
+			wt.samples = []sample{{date: now, value: value}}
+			return fmt.Sprintf("%+.2f%% to %f", change, value), true
+		}
+	}
+
+	return "", false
+}
+
+// Service evaluates the alerts and notifies the ones that fire.
+type Service struct {
+	config     Config
+	kr         *kredis.Kredis
+	subscriber *kredis.Kredis
+	notifier   notify.Notifier
+	clock      clock.Clock
+	lease      *leader.Lease
+	mu         *sync.Mutex
+	watches    map[string]*watch
+	removed    map[string]bool
+	channels   map[string]source
+	sequence   int
+}
+
+// source is a price, or the indicator records of timeframe minutes
+type source struct {
+	exchange  string
+	pair      string
+	timeframe int
+}
+
+// channel is where the updates of the source are published
+func (src source) channel() string {
+	if src.timeframe == 0 {
+		return fmt.Sprintf("PRICE_%s_%s", src.exchange, src.pair)
+	}
+	return fmt.Sprintf("%s_%s_MS_%d_INDICATORS", src.exchange, src.pair, src.timeframe)
+}
+
+func (alert Alert) source() source {
+	src := source{exchange: alert.Exchange, pair: alert.Pair}
+	if alert.Indicator != "" {
+		src.timeframe = alert.Timeframe
+	}
+	return src
+}
+
+// saved are the watched alerts kept in redis, and the configured ones that
+// were removed or fired
+type saved struct {
+	Alerts  []Alert  `json:"alerts"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// NewService creates the service of config, reading the prices and the
+// indicators from kr. The alerts saved by a previous run are watched
+// again, a configured alert that fired or was removed is not.
+func NewService(config Config, kr *kredis.Kredis, notifier notify.Notifier) (*Service, error) {
+	if config.Timeframe <= 0 {
+		config.Timeframe = defaultTimeframe
+	}
+	if config.Key == "" {
+		config.Key = fmt.Sprintf(WatchesKey, config.Exchange)
+	}
+
+	as := &Service{}
+	as.config = config
+	as.kr = kr
+	as.notifier = notifier
+	as.clock = clock.New()
+	as.mu = &sync.Mutex{}
+	as.watches = make(map[string]*watch)
+	as.removed = make(map[string]bool)
+	as.channels = make(map[string]source)
+
+	if err := as.restore(); err != nil {
+		return nil, err
+	}
+
+	configured := make(map[string]bool)
+	for _, alert := range config.Alerts {
+		configured[alert.ID] = true
+		if as.removed[alert.ID] {
+			continue
+		}
+		delete(as.watches, alert.ID)
+		if _, err := as.add(alert); err != nil {
+			return nil, err
+		}
+	}
+
+	for id := range as.removed {
+		if !configured[id] {
+			delete(as.removed, id)
+		}
+	}
+
+	as.mu.Lock()
+	as.save()
+	as.mu.Unlock()
+
+	return as, nil
+}
+
+// restore watches the alerts saved in redis
+func (as *Service) restore() error {
+	if as.kr == nil {
+		return nil
+	}
+
+	savedJSON, err := as.kr.GetString(as.config.Key)
+	if err != nil || savedJSON == "" {
+		return nil
+	}
+
+	state := saved{}
+	if err := json.Unmarshal([]byte(savedJSON), &state); err != nil {
+		return fmt.Errorf("bad saved alerts in %s: %s", as.config.Key, err.Error())
+	}
+
+	for _, alert := range state.Alerts {
+		if _, err := as.add(alert); err != nil {
+			log.Errorf("Saved alert %s dropped: %s", alert.ID, err.Error())
+		}
+	}
+	for _, id := range state.Removed {
+		as.removed[id] = true
+	}
+
+	log.Infof("Alerts restored from %s: %d", as.config.Key, len(state.Alerts))
+	return nil
+}
+
+// save keeps the watched alerts in redis, as.mu must be held
+func (as *Service) save() {
+	if as.kr == nil {
+		return
+	}
+
+	state := saved{Alerts: []Alert{}}
+	for _, wt := range as.watches {
+		state.Alerts = append(state.Alerts, wt.alert)
+	}
+	sort.Slice(state.Alerts, func(i, j int) bool { return state.Alerts[i].ID < state.Alerts[j].ID })
+	for id := range as.removed {
+		state.Removed = append(state.Removed, id)
+	}
+	sort.Strings(state.Removed)
+
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		log.Error("Marshaling alerts: ", err.Error())
+		return
+	}
+	if err := as.kr.Set(as.config.Key, string(stateJSON)); err != nil {
+		log.Errorf("Saving alerts in %s: %s", as.config.Key, err.Error())
+	}
+}
+
+// SetClock sets the clock used to time the moves.
+func (as *Service) SetClock(clk clock.Clock) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.clock = clk
+}
+
+// SetLease makes the service evaluate the alerts only while the lease is
+// held, so a standby does not notify them again.
+func (as *Service) SetLease(ls *leader.Lease) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.lease = ls
+}
+
+// Leading tells if this instance evaluates the alerts.
+func (as *Service) Leading() bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.lease == nil || as.lease.Held()
+}
+
+// Add watches an alert, an ID is given when it has none. It returns the
+// alert as watched.
+func (as *Service) Add(alert Alert) (Alert, error) {
+	alert, err := as.add(alert)
+	if err != nil {
+		return alert, err
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	delete(as.removed, alert.ID)
+	as.save()
+
+	return alert, nil
+}
+
+// add watches an alert without saving it
+func (as *Service) add(alert Alert) (Alert, error) {
+	alert.Pair = strings.ToUpper(alert.Pair)
+	alert.Kind = strings.ToLower(alert.Kind)
+	alert.Exchange = strings.ToUpper(alert.Exchange)
+	if alert.Exchange == "" {
+		alert.Exchange = as.config.Exchange
+	}
+	if alert.Indicator != "" && alert.Timeframe <= 0 {
+		alert.Timeframe = as.config.Timeframe
+	}
+
+	if err := alert.validate(); err != nil {
+		return alert, err
+	}
+	window, _ := alert.window()
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if alert.ID == "" {
+		for alert.ID == "" || as.watches[alert.ID] != nil {
+			as.sequence++
+			alert.ID = fmt.Sprintf("alert%d", as.sequence)
+		}
+	}
+	if _, ok := as.watches[alert.ID]; ok {
+		return alert, fmt.Errorf("alert %s already exists", alert.ID)
+	}
+
+	as.watches[alert.ID] = &watch{alert: alert, window: window, armed: true}
+	as.subscribe(alert.source())
+
+	log.Infof("Alert %s: %s", alert.ID, alert)
+	return alert, nil
+}
+
+// subscribe listens to the updates of src once Run started, as.mu must be
+// held
+func (as *Service) subscribe(src source) {
+	channel := src.channel()
+	if as.subscriber == nil {
+		return
+	}
+	if _, ok := as.channels[channel]; ok {
+		return
+	}
+	as.channels[channel] = src
+	as.subscriber.SubscribeLookup(channel)
+}
+
+// Remove stops watching an alert.
+func (as *Service) Remove(id string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if _, ok := as.watches[id]; !ok {
+		return fmt.Errorf("unknown alert: %s", id)
+	}
+	delete(as.watches, id)
+	as.removed[id] = true
+	as.save()
+	return nil
+}
+
+// Alerts returns the watched alerts by ID.
+func (as *Service) Alerts() []Alert {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(as.watches))
+	for _, wt := range as.watches {
+		alerts = append(alerts, wt.alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].ID < alerts[j].ID })
+	return alerts
+}
+
+type fired struct {
+	alert  Alert
+	what   string
+	value  float64
+	source string
+}
+
+// evaluate observes a value on the watches selected by match
+func (as *Service) evaluate(value float64, source string, match func(alert Alert) bool) {
+	as.mu.Lock()
+	now := as.clock.Now()
+
+	var fires []fired
+	for id, wt := range as.watches {
+		if !match(wt.alert) {
+			continue
+		}
+		what, ok := wt.observe(value, now)
+		if !ok {
+			continue
+		}
+		fires = append(fires, fired{alert: wt.alert, what: what, value: value, source: source})
+		if !wt.alert.Rearm {
+			delete(as.watches, id)
+			as.removed[id] = true
+		}
+	}
+	if len(fires) > 0 {
+		as.save()
+	}
+	as.mu.Unlock()
+
+	for _, fire := range fires {
+		as.notify(fire, now)
+	}
+}
+
+func (as *Service) notify(fire fired, now time.Time) {
+	log.Warnf("Alert %s fired: %s %s", fire.alert.ID, fire.alert, fire.what)
+
+	if as.notifier == nil {
+		return
+	}
+
+	event := notify.Event{Type: notify.EventAlert, Severity: fire.alert.Severity, Pair: fire.alert.Pair,
+		Title: fire.alert.String(), Date: now}
+	event.Message = fmt.Sprintf("Alert %s: %s, %s %s", fire.alert.ID, fire.alert, fire.source, fire.what)
+	if fire.alert.Indicator == "" {
+		event.Price = fire.value
+	}
+
+	if err := as.notifier.Notify(event); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// Price evaluates the price alerts of pair with a new price.
+func (as *Service) Price(exchange, pair string, price float64) {
+	exchange, pair = strings.ToUpper(exchange), strings.ToUpper(pair)
+	as.evaluate(price, "price", func(alert Alert) bool {
+		return alert.Indicator == "" && alert.Exchange == exchange && alert.Pair == pair
+	})
+}
+
+// Indicators evaluates the indicator alerts of pair with a new record of
+// timeframe minutes.
+func (as *Service) Indicators(exchange, pair string, timeframe int, indicators movingstats.Indicators) {
+	exchange, pair = strings.ToUpper(exchange), strings.ToUpper(pair)
+
+	as.mu.Lock()
+	names := make(map[string]bool)
+	for _, wt := range as.watches {
+		alert := wt.alert
+		if alert.Indicator != "" && alert.Exchange == exchange && alert.Pair == pair && alert.Timeframe == timeframe {
+			names[alert.Indicator] = true
+		}
+	}
+	as.mu.Unlock()
+
+	for name := range names {
+		value, _ := indicatorValue(indicators, name)
+		as.evaluate(value, name, func(alert Alert) bool {
+			return alert.Indicator == name && alert.Exchange == exchange && alert.Pair == pair &&
+				alert.Timeframe == timeframe
+		})
+	}
+}
+
+// Check reads the last price and indicators of every watched pair and
+// evaluates the alerts.
+func (as *Service) Check() {
+	sources := make(map[source]bool)
+	for _, alert := range as.Alerts() {
+		sources[alert.source()] = true
+	}
+
+	for src := range sources {
+		if src.timeframe == 0 {
+			key := src.channel()
+			priceStr, err := as.kr.GetString(key)
+			if err != nil {
+				log.Debugf("No price for alerts in %s: %s", key, err.Error())
+				continue
+			}
+			as.update(src, priceStr)
+			continue
+		}
+
+		key := src.channel()
+		indicatorsJSON, err := as.kr.GetRawString(key, 0)
+		if err != nil {
+			log.Errorf("Reading %s for alerts: %s", key, err.Error())
+			continue
+		}
+		as.update(src, indicatorsJSON)
+	}
+}
+
+// update evaluates the alerts of src with a price or an indicators record
+func (as *Service) update(src source, value string) {
+	if src.timeframe == 0 {
+		price, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Errorf("Bad price for alerts in %s: %s", src.channel(), value)
+			return
+		}
+		as.Price(src.exchange, src.pair, price)
+		return
+	}
+
+	indicators := movingstats.Indicators{}
+	if err := json.Unmarshal([]byte(value), &indicators); err != nil {
+		log.Debugf("No indicators for alerts in %s", src.channel())
+		return
+	}
+	as.Indicators(src.exchange, src.pair, src.timeframe, indicators)
+}
+
+// Run evaluates the alerts on every price update and indicators record
+// until stop is closed, while leading. The updates are received on a redis
+// connection of its own.
+func (as *Service) Run(stop chan struct{}) {
+	subscriber := kredis.NewKredis(1)
+	subscriber.Start()
+	go subscriber.SubscriberMonitor()
+
+	as.mu.Lock()
+	as.subscriber = subscriber
+	for _, wt := range as.watches {
+		as.subscribe(wt.alert.source())
+	}
+	as.mu.Unlock()
+
+	// Start from the current values
+	if as.Leading() {
+		as.Check()
+	}
+
+	updates := subscriber.SubscriberChann()
+	for {
+		select {
+		case <-stop:
+			return
+		case message := <-updates:
+			if !as.Leading() {
+				continue
+			}
+			as.mu.Lock()
+			src, ok := as.channels[message[0]]
+			as.mu.Unlock()
+			if ok {
+				as.update(src, message[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,451 @@
+// Package breaker halts new entries when trading goes wrong: too much
+// realized loss in a day, too many losing trades in a row, a stale price
+// feed or a spike of exchange errors. Operators can also trip it by hand
+// with the kill switch. While tripped positions can still be exited.
+//
+// The trip is kept in redis so it is shared by every trading process and
+// survives restarts, it stays until an operator resets it.
+package breaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/notify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// DefaultKey is the redis key of the breaker state when none is configured
+const DefaultKey = "TRADING_BREAKER"
+
+// Trip reasons
+const (
+	ReasonKill       = "kill_switch"
+	ReasonDailyLoss  = "daily_loss"
+	ReasonLosses     = "consecutive_losses"
+	ReasonStalePrice = "stale_price"
+	ReasonErrorRate  = "error_rate"
+)
+
+const (
+	dayLayout          = "2006-01-02"
+	defaultErrorWindow = 10 * time.Minute
+	defaultMinRequests = 5
+)
+
+// Config of the breaker. The daily losses are limited per quote currency
+// of the traded pairs, as they can not be added up, a currency without
+// limit or a zero limit is not checked. Processes sharing Key share the
+// breaker.
+type Config struct {
+	Key                  string
+	MaxDailyLoss         map[string]float64
+	MaxConsecutiveLosses int
+	MaxPriceAge          time.Duration
+	MaxErrorRate         float64
+	ErrorWindow          time.Duration
+	MinRequests          int
+}
+
+// LoadConfig reads the breaker configuration. It returns false when the
+// breaker is not configured.
+//
+//	[breaker]
+//	key = "TRADING_BREAKER"
+//	max_consecutive_losses = 4
+//	max_price_age = "5m"
+//	max_error_rate = 0.5
+//	error_window = "10m"
+//	min_requests = 5
+//
+//	[breaker.max_daily_loss]
+//	USD = 200.0
+//	BTC = 0.02
+func LoadConfig() (Config, bool, error) {
+	if !viper.IsSet("breaker") {
+		return Config{}, false, nil
+	}
+
+	config := Config{}
+	config.Key = viper.GetString("breaker.key")
+	config.MaxDailyLoss = make(map[string]float64)
+
+	if viper.IsSet("breaker.max_daily_loss") {
+		limits, ok := viper.Get("breaker.max_daily_loss").(map[string]interface{})
+		if !ok {
+			return config, false, fmt.Errorf("breaker max_daily_loss needs a limit per quote currency")
+		}
+		for currency, limit := range limits {
+			switch value := limit.(type) {
+			case float64:
+				config.MaxDailyLoss[strings.ToUpper(currency)] = value
+			case int64:
+				config.MaxDailyLoss[strings.ToUpper(currency)] = float64(value)
+			case int:
+				config.MaxDailyLoss[strings.ToUpper(currency)] = float64(value)
+			default:
+				return config, false, fmt.Errorf("breaker max_daily_loss of %s: not a number: %v", currency, limit)
+			}
+		}
+	}
+
+	config.MaxConsecutiveLosses = viper.GetInt("breaker.max_consecutive_losses")
+	config.MaxPriceAge = viper.GetDuration("breaker.max_price_age")
+	config.MaxErrorRate = viper.GetFloat64("breaker.max_error_rate")
+	config.ErrorWindow = viper.GetDuration("breaker.error_window")
+	config.MinRequests = viper.GetInt("breaker.min_requests")
+
+	return config, true, nil
+}
+
+// State is the persisted state of the breaker. DailyPnL is the realized
+// profit and loss of Day by quote currency, it starts over on the next
+// one.
+type State struct {
+	Tripped           bool               `json:"tripped"`
+	Manual            bool               `json:"manual"`
+	Reason            string             `json:"reason,omitempty"`
+	Date              time.Time          `json:"date,omitempty"`
+	Day               string             `json:"day"`
+	DailyPnL          map[string]float64 `json:"daily_pnl_by_quote,omitempty"`
+	ConsecutiveLosses int                `json:"consecutive_losses"`
+}
+
+type request struct {
+	date   time.Time
+	failed bool
+}
+
+// Breaker decides if new positions can be opened.
+type Breaker struct {
+	config   Config
+	kr       *kredis.Kredis
+	clock    clock.Clock
+	mu       *sync.Mutex
+	started  time.Time
+	prices   map[string]time.Time
+	requests []request
+	notifier notify.Notifier
+}
+
+// New creates a breaker keeping its state in kr.
+func New(config Config, kr *kredis.Kredis) *Breaker {
+	if config.Key == "" {
+		config.Key = DefaultKey
+	}
+	if config.ErrorWindow <= 0 {
+		config.ErrorWindow = defaultErrorWindow
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultMinRequests
+	}
+
+	brk := &Breaker{}
+	brk.config = config
+	brk.kr = kr
+	brk.clock = clock.New()
+	brk.mu = &sync.Mutex{}
+	brk.started = brk.clock.Now()
+	brk.prices = make(map[string]time.Time)
+	return brk
+}
+
+// Load creates the configured breaker with its own redis connection. It
+// returns false when the breaker is not configured.
+func Load() (*Breaker, bool, error) {
+	config, ok, err := LoadConfig()
+	if !ok {
+		return nil, false, err
+	}
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	return New(config, kr), true, nil
+}
+
+// Key returns the redis key of the breaker state.
+func (brk *Breaker) Key() string {
+	return brk.config.Key
+}
+
+// SetClock sets the clock used for the days, price ages and error window.
+func (brk *Breaker) SetClock(clk clock.Clock) {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	brk.clock = clk
+	brk.started = clk.Now()
+}
+
+// SetNotifier makes the trips and resets notified as breaker events.
+func (brk *Breaker) SetNotifier(notifier notify.Notifier) {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	brk.notifier = notifier
+}
+
+// notify sends an event without holding up the breaker
+func (brk *Breaker) notify(event notify.Event) {
+	if brk.notifier == nil {
+		return
+	}
+	event.Type = notify.EventBreaker
+	event.Date = brk.clock.Now()
+	go brk.notifier.Notify(event)
+}
+
+// load reads the persisted state, a missing state is a closed breaker.
+func (brk *Breaker) load() State {
+	state := State{}
+
+	stateJSON, err := brk.kr.GetString(brk.config.Key)
+	if err != nil || stateJSON == "" {
+		return state
+	}
+
+	if err := json.Unmarshal([]byte(stateJSON), &state); err != nil {
+		log.Error("Bad breaker state: ", err.Error())
+		return State{}
+	}
+
+	return state
+}
+
+func (brk *Breaker) save(state State) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return brk.kr.Set(brk.config.Key, string(stateJSON))
+}
+
+// today loads the state with the loss counters of the current day.
+func (brk *Breaker) today() State {
+	state := brk.load()
+	day := brk.clock.Now().UTC().Format(dayLayout)
+	if state.Day != day {
+		state.Day = day
+		state.DailyPnL = nil
+	}
+	if state.DailyPnL == nil {
+		state.DailyPnL = make(map[string]float64)
+	}
+	return state
+}
+
+func (brk *Breaker) trip(state *State, reason string, manual bool) {
+	if state.Tripped {
+		return
+	}
+	state.Tripped = true
+	state.Manual = manual
+	state.Reason = reason
+	state.Date = brk.clock.Now()
+
+	message := `
+	----------------------------------------------------
+	TRADING BREAKER TRIPPED: %s
+	----------------------------------------------------
+	`
+	log.Errorf(message, reason)
+
+	brk.notify(notify.Event{Severity: notify.Critical, Title: "Trading breaker tripped",
+		Message: fmt.Sprintf("Trading breaker tripped: %s, only exits are allowed", reason)})
+}
+
+// State returns the persisted state of the breaker.
+func (brk *Breaker) State() State {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	return brk.today()
+}
+
+// Kill trips the breaker by hand. It stays tripped across restarts until
+// Reset.
+func (brk *Breaker) Kill(reason string) error {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+
+	if reason == "" {
+		reason = ReasonKill
+	}
+
+	state := brk.today()
+	state.Tripped = false
+	brk.trip(&state, reason, true)
+	return brk.save(state)
+}
+
+// Reset closes the breaker and clears the consecutive losses. The daily
+// profit and loss is kept, so after a daily loss trip the next loss of the
+// day trips it again.
+func (brk *Breaker) Reset() error {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+
+	state := brk.today()
+	state.Tripped = false
+	state.Manual = false
+	state.Reason = ""
+	state.Date = time.Time{}
+	state.ConsecutiveLosses = 0
+	brk.requests = nil
+
+	log.Warn("Trading breaker reset")
+
+	brk.notify(notify.Event{Severity: notify.Warning, Title: "Trading breaker reset",
+		Message: "Trading breaker reset, new positions are allowed"})
+
+	return brk.save(state)
+}
+
+// Allow returns an error when a new position can not be opened on pair.
+// A stale price is not latched, it only blocks until the feed is back. An
+// empty pair skips the price feed check.
+func (brk *Breaker) Allow(pair string) error {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+
+	state := brk.load()
+	if state.Tripped {
+		return fmt.Errorf("trading breaker tripped: %s", state.Reason)
+	}
+
+	if pair == "" || brk.config.MaxPriceAge <= 0 {
+		return nil
+	}
+
+	// ------------------------------------
+	// A pair never priced is stale once
+	// the feed had time to deliver
+	// ------------------------------------
+	last, ok := brk.prices[pair]
+	if !ok {
+		last = brk.started
+	}
+
+	if age := brk.clock.Now().Sub(last); age > brk.config.MaxPriceAge {
+		return fmt.Errorf("%s: price of %s is %s old", ReasonStalePrice, pair, age)
+	}
+
+	return nil
+}
+
+// RecordPrice notes a price update of pair.
+func (brk *Breaker) RecordPrice(pair string) {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	brk.prices[pair] = brk.clock.Now()
+}
+
+// RecordTrade adds the realized profit or loss of a closed trade, in the
+// quote currency, to the day and trips on the daily loss of the currency
+// or the consecutive losses limits.
+func (brk *Breaker) RecordTrade(quote string, pnl float64) error {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+
+	state := brk.today()
+
+	quote = strings.ToUpper(quote)
+	state.DailyPnL[quote] += pnl
+	if pnl < 0 {
+		state.ConsecutiveLosses++
+	} else {
+		state.ConsecutiveLosses = 0
+	}
+
+	if limit := brk.config.MaxDailyLoss[quote]; limit > 0 && -state.DailyPnL[quote] >= limit {
+		brk.trip(&state, ReasonDailyLoss, false)
+	}
+
+	if brk.config.MaxConsecutiveLosses > 0 && state.ConsecutiveLosses >= brk.config.MaxConsecutiveLosses {
+		brk.trip(&state, ReasonLosses, false)
+	}
+
+	return brk.save(state)
+}
+
+// RecordRequest counts an exchange request and trips when the error rate
+// of the window goes over the limit.
+func (brk *Breaker) RecordRequest(err error) {
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+
+	if brk.config.MaxErrorRate <= 0 {
+		return
+	}
+
+	now := brk.clock.Now()
+	brk.requests = append(brk.requests, request{date: now, failed: err != nil})
+
+	start := 0
+	for start < len(brk.requests) && now.Sub(brk.requests[start].date) > brk.config.ErrorWindow {
+		start++
+	}
+	brk.requests = brk.requests[start:]
+
+	if len(brk.requests) < brk.config.MinRequests {
+		return
+	}
+
+	failed := 0
+	for _, req := range brk.requests {
+		if req.failed {
+			failed++
+		}
+	}
+
+	if rate := float64(failed) / float64(len(brk.requests)); rate < brk.config.MaxErrorRate {
+		return
+	}
+
+	state := brk.today()
+	if state.Tripped {
+		return
+	}
+
+	brk.trip(&state, ReasonErrorRate, false)
+	if err := brk.save(state); err != nil {
+		log.Error("Saving breaker state: ", err.Error())
+	}
+}
+
+// ---------------------
+// Executor error rate
+// ---------------------
+
+type watched struct {
+	executor execution.Executor
+	brk      *Breaker
+}
+
+// Watch returns an executor that counts the requests to executor.
+func (brk *Breaker) Watch(executor execution.Executor) execution.Executor {
+	return &watched{executor: executor, brk: brk}
+}
+
+func (w *watched) Place(request execution.OrderRequest) (execution.Order, error) {
+	order, err := w.executor.Place(request)
+	w.brk.RecordRequest(err)
+	return order, err
+}
+
+func (w *watched) Order(ID string) (execution.Order, error) {
+	order, err := w.executor.Order(ID)
+	w.brk.RecordRequest(err)
+	return order, err
+}
+
+func (w *watched) Cancel(ID string) error {
+	err := w.executor.Cancel(ID)
+	w.brk.RecordRequest(err)
+	return err
+}
@@ -0,0 +1,317 @@
+package breaker_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/spf13/viper"
+)
+
+var kr *kredis.Kredis
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	kr = kredis.NewKredis(1)
+	kr.Start()
+
+	os.Exit(m.Run())
+}
+
+// newBreaker returns a closed breaker with a key of its own
+func newBreaker(t *testing.T, config breaker.Config) (*breaker.Breaker, *clock.Simulated) {
+	if config.Key == "" {
+		config.Key = fmt.Sprintf("TEST_BREAKER_%d", rand.Int63())
+	}
+
+	clk := clock.NewSimulated(time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC))
+
+	brk := breaker.New(config, kr)
+	brk.SetClock(clk)
+
+	if err := brk.Allow(""); err != nil {
+		t.Fatal("New breaker should be closed: ", err.Error())
+	}
+
+	return brk, clk
+}
+
+func TestKillSwitch(t *testing.T) {
+
+	brk, _ := newBreaker(t, breaker.Config{})
+
+	if err := brk.Kill(""); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := brk.Allow("BTCUSD"); err == nil {
+		t.Error("Killed breaker should refuse entries")
+	}
+
+	state := brk.State()
+	if !state.Manual || state.Reason != breaker.ReasonKill {
+		t.Errorf("Bad kill state: %+v", state)
+	}
+
+	if err := brk.Reset(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := brk.Allow("BTCUSD"); err != nil {
+		t.Error("Reset breaker should allow entries: ", err.Error())
+	}
+}
+
+func TestKillSwitchPersisted(t *testing.T) {
+
+	brk, _ := newBreaker(t, breaker.Config{})
+	other, _ := newBreaker(t, breaker.Config{})
+
+	errorNotExpected(t, brk.Kill("maintenance"))
+
+	// A restart, or another process, with the same key
+	restarted := breaker.New(breaker.Config{Key: brk.Key()}, kr)
+
+	if err := restarted.Allow(""); err == nil {
+		t.Error("Kill switch should survive a restart")
+	}
+
+	if reason := restarted.State().Reason; reason != "maintenance" {
+		t.Error("Bad kill reason: ", reason)
+	}
+
+	errorNotExpected(t, other.Allow(""))
+}
+
+func TestDailyLoss(t *testing.T) {
+
+	brk, clk := newBreaker(t, breaker.Config{MaxDailyLoss: map[string]float64{"USD": 100, "BTC": 0.01}})
+
+	for _, pnl := range []float64{-40, 30, -50} {
+		errorNotExpected(t, brk.RecordTrade("USD", pnl))
+	}
+
+	if err := brk.Allow(""); err != nil {
+		t.Error("60 of loss is under the limit: ", err.Error())
+	}
+
+	// Yesterday losses do not count
+	clk.Advance(24 * time.Hour)
+
+	errorNotExpected(t, brk.RecordTrade("USD", -60))
+	errorNotExpected(t, brk.Allow(""))
+
+	// Losses in another quote currency are not added up
+	errorNotExpected(t, brk.RecordTrade("BTC", -0.005))
+	errorNotExpected(t, brk.RecordTrade("ETH", -50))
+	errorNotExpected(t, brk.Allow(""))
+
+	if pnl := brk.State().DailyPnL; pnl["USD"] != -60 || pnl["BTC"] != -0.005 || pnl["ETH"] != -50 {
+		t.Error("Bad daily PnL by quote: ", pnl)
+	}
+
+	errorNotExpected(t, brk.RecordTrade("USD", -40))
+
+	if err := brk.Allow(""); err == nil {
+		t.Error("Daily loss of 100 should trip the breaker")
+	}
+
+	if reason := brk.State().Reason; reason != breaker.ReasonDailyLoss {
+		t.Error("Bad trip reason: ", reason)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	viper.Set("breaker.max_daily_loss.usd", 200)
+	viper.Set("breaker.max_daily_loss.btc", 0.02)
+	defer viper.Reset()
+
+	config, ok, err := breaker.LoadConfig()
+	if err != nil || !ok {
+		t.Fatal("Breaker not loaded: ", err)
+	}
+	if config.MaxDailyLoss["USD"] != 200 || config.MaxDailyLoss["BTC"] != 0.02 {
+		t.Error("Bad daily loss limits: ", config.MaxDailyLoss)
+	}
+
+	// One limit for every currency can not be compared
+	viper.Reset()
+	viper.Set("breaker.max_daily_loss", 200.0)
+	if _, _, err := breaker.LoadConfig(); err == nil {
+		t.Error("Daily loss limit without currency loaded")
+	}
+}
+
+func TestConsecutiveLosses(t *testing.T) {
+
+	brk, _ := newBreaker(t, breaker.Config{MaxConsecutiveLosses: 3})
+
+	for _, pnl := range []float64{-1, -1, 2, -1, -1} {
+		errorNotExpected(t, brk.RecordTrade("USD", pnl))
+	}
+
+	errorNotExpected(t, brk.Allow(""))
+
+	errorNotExpected(t, brk.RecordTrade("USD", -1))
+
+	if err := brk.Allow(""); err == nil {
+		t.Error("3 losses in a row should trip the breaker")
+	}
+
+	// Latched until reset, even after a win
+	errorNotExpected(t, brk.RecordTrade("USD", 10))
+	if err := brk.Allow(""); err == nil {
+		t.Error("Breaker should stay tripped until reset")
+	}
+
+	errorNotExpected(t, brk.Reset())
+	errorNotExpected(t, brk.Allow(""))
+
+	if losses := brk.State().ConsecutiveLosses; losses != 0 {
+		t.Error("Reset should clear the consecutive losses: ", losses)
+	}
+}
+
+func TestStalePrice(t *testing.T) {
+
+	brk, clk := newBreaker(t, breaker.Config{MaxPriceAge: time.Minute})
+
+	// The feed has a minute to deliver the first price
+	errorNotExpected(t, brk.Allow("BTCUSD"))
+
+	clk.Advance(2 * time.Minute)
+
+	if err := brk.Allow("BTCUSD"); err == nil {
+		t.Error("Never priced pair should be stale")
+	}
+
+	brk.RecordPrice("BTCUSD")
+	errorNotExpected(t, brk.Allow("BTCUSD"))
+
+	clk.Advance(2 * time.Minute)
+
+	if err := brk.Allow("BTCUSD"); err == nil {
+		t.Error("Price of two minutes should be stale")
+	}
+
+	// Not latched
+	brk.RecordPrice("BTCUSD")
+	errorNotExpected(t, brk.Allow("BTCUSD"))
+
+	if brk.State().Tripped {
+		t.Error("A stale price should not trip the breaker")
+	}
+}
+
+type failingExecutor struct {
+	fail bool
+}
+
+func (fe *failingExecutor) Place(request execution.OrderRequest) (execution.Order, error) {
+	if fe.fail {
+		return execution.Order{}, errors.New("exchange down")
+	}
+	return execution.Order{ID: "1"}, nil
+}
+
+func (fe *failingExecutor) Order(ID string) (execution.Order, error) {
+	return execution.Order{ID: ID}, nil
+}
+
+func (fe *failingExecutor) Cancel(ID string) error {
+	return nil
+}
+
+func TestErrorRate(t *testing.T) {
+
+	brk, clk := newBreaker(t, breaker.Config{MaxErrorRate: 0.5, ErrorWindow: time.Minute, MinRequests: 4})
+
+	fe := &failingExecutor{}
+	executor := brk.Watch(fe)
+
+	// Old errors leave the window
+	fe.fail = true
+	for i := 0; i < 3; i++ {
+		executor.Place(execution.OrderRequest{})
+	}
+	clk.Advance(2 * time.Minute)
+
+	fe.fail = false
+	for i := 0; i < 3; i++ {
+		executor.Place(execution.OrderRequest{})
+	}
+
+	errorNotExpected(t, brk.Allow(""))
+
+	fe.fail = true
+	executor.Place(execution.OrderRequest{})
+	executor.Place(execution.OrderRequest{})
+
+	errorNotExpected(t, brk.Allow(""))
+
+	executor.Place(execution.OrderRequest{})
+
+	if err := brk.Allow(""); err == nil {
+		t.Error("Error rate over 50% should trip the breaker")
+	}
+
+	if reason := brk.State().Reason; reason != breaker.ReasonErrorRate {
+		t.Error("Bad trip reason: ", reason)
+	}
+}
+
+// chanNotifier forwards the events to a channel
+type chanNotifier chan notify.Event
+
+func (cn chanNotifier) Notify(event notify.Event) error {
+	cn <- event
+	return nil
+}
+
+func TestBreakerNotify(t *testing.T) {
+
+	brk, _ := newBreaker(t, breaker.Config{})
+
+	events := make(chanNotifier, 2)
+	brk.SetNotifier(events)
+
+	errorNotExpected(t, brk.Kill("maintenance"))
+	errorNotExpected(t, brk.Reset())
+
+	// The events are sent in the background, in any order
+	severities := make(map[notify.Severity]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			if event.Type != notify.EventBreaker {
+				t.Error("Bad breaker event: ", event)
+			}
+			severities[event.Severity] = true
+		case <-time.After(time.Second):
+			t.Fatal("Breaker event not notified")
+		}
+	}
+
+	if !severities[notify.Critical] || !severities[notify.Warning] {
+		t.Error("Trip and reset not notified: ", severities)
+	}
+}
+
+func errorNotExpected(t *testing.T, err error) {
+	if err != nil {
+		t.Error("Error not expected: ", err.Error())
+	}
+}
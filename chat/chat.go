@@ -0,0 +1,498 @@
+// Package chat is the inbound command interface of the trader, so the
+// on-call person can see and steer it from a chat channel. Chat platforms
+// post slash commands to its webhook, the replies come from the live redis
+// data and the trader state:
+//
+//	/status [pair]     state and position of one or all pairs
+//	/price <pair>      last price
+//	/signals <pair>    buy and sell signals of every timeframe
+//	/pause <pair>      stop following the signals
+//	/resume <pair>     go back to holding or trading after a pause
+//	/flatten [pair]    sell the held positions, of every pair by default
+//	/help              this list
+//
+// A single umbrella command also works, "/tayni price BTCUSD". Commands
+// must carry the verification token of the platform, and its request
+// signature when a signing secret is configured, and come from one of the
+// allow-listed senders.
+package chat
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lagarciag/tayni/control"
+	"github.com/lagarciag/tayni/kredis"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Commands
+const (
+	CommandStatus  = "status"
+	CommandPrice   = "price"
+	CommandSignals = "signals"
+	CommandPause   = "pause"
+	CommandResume  = "resume"
+	CommandFlatten = "flatten"
+	CommandHelp    = "help"
+)
+
+const (
+	// DefaultListen is the address of the webhook when none is configured
+	DefaultListen = "127.0.0.1:8766"
+	// DefaultPath is the path of the webhook when none is configured
+	DefaultPath = "/chat"
+	// signatureAge is how old a signed request can be, older ones are
+	// refused as replays
+	signatureAge = 5 * time.Minute
+)
+
+const help = `/status [pair]   state and position of one or all pairs
+/price <pair>    last price
+/signals <pair>  buy and sell signals of every timeframe
+/pause <pair>    stop following the signals
+/resume <pair>   go back to holding or trading after a pause
+/flatten [pair]  sell the held positions, of every pair by default`
+
+// Config of the chat webhook. Senders are the user IDs allowed to issue
+// commands, names are not as users can rename themselves, Token the verification token of the platform, required.
+// Secret is the signing secret of the platform, when set the requests must
+// be signed with it. Signals are read for the Timeframes of Exchange.
+type Config struct {
+	Listen     string
+	Path       string
+	Token      string
+	Secret     string
+	Senders    []string
+	Exchange   string
+	Timeframes []int
+}
+
+// LoadConfig reads the chat configuration. It returns false when the chat
+// commands are not configured, the bot refuses to start without a token.
+// The exchange is the first one configured by
+// default, the timeframes are minute_strategies.
+//
+//	[chat]
+//	listen = "127.0.0.1:8766"
+//	path = "/chat"
+//	token = "verification token of the slash command"
+//	secret = "signing secret of the app"
+//	senders = ["U024BE7LH", "W012A3CDE"]
+//	exchange = "cexio"
+func LoadConfig() (Config, bool) {
+	if !viper.IsSet("chat") {
+		return Config{}, false
+	}
+
+	config := Config{}
+	config.Listen = viper.GetString("chat.listen")
+	config.Path = viper.GetString("chat.path")
+	config.Token = viper.GetString("chat.token")
+	config.Secret = viper.GetString("chat.secret")
+	config.Senders = viper.GetStringSlice("chat.senders")
+	config.Exchange = strings.ToUpper(viper.GetString("chat.exchange"))
+
+	if config.Listen == "" {
+		config.Listen = DefaultListen
+	}
+	if config.Path == "" {
+		config.Path = DefaultPath
+	}
+
+	if config.Exchange == "" {
+		var exchanges []string
+		for exchange := range viper.GetStringMap("exchange") {
+			exchanges = append(exchanges, strings.ToUpper(exchange))
+		}
+		sort.Strings(exchanges)
+		if len(exchanges) > 0 {
+			config.Exchange = exchanges[0]
+		}
+	}
+
+	if timeframes, ok := viper.Get("minute_strategies").([]interface{}); ok {
+		for _, timeframe := range timeframes {
+			switch minutes := timeframe.(type) {
+			case int64:
+				config.Timeframes = append(config.Timeframes, int(minutes))
+			case int:
+				config.Timeframes = append(config.Timeframes, minutes)
+			}
+		}
+	}
+
+	return config, true
+}
+
+// Bot serves the chat commands of a controller.
+type Bot struct {
+	config     Config
+	controller control.Controller
+	kr         *kredis.Kredis
+	listener   net.Listener
+}
+
+// NewBot creates the chat bot of controller, reading the live data from kr.
+func NewBot(config Config, controller control.Controller, kr *kredis.Kredis) (*Bot, error) {
+	if config.Token == "" {
+		return nil, fmt.Errorf("chat commands without token")
+	}
+	if len(config.Senders) == 0 {
+		return nil, fmt.Errorf("chat commands without allowed senders")
+	}
+	if config.Path == "" {
+		config.Path = DefaultPath
+	}
+
+	bot := &Bot{}
+	bot.config = config
+	bot.controller = controller
+	bot.kr = kr
+
+	return bot, nil
+}
+
+// Start listens on the configured address and serves in the background.
+func (bot *Bot) Start() error {
+	listener, err := net.Listen("tcp", bot.config.Listen)
+	if err != nil {
+		return fmt.Errorf("chat webhook: %s", err.Error())
+	}
+	bot.listener = listener
+
+	log.Infof("Chat webhook listening on: %s%s", listener.Addr().String(), bot.config.Path)
+
+	go func() {
+		if err := http.Serve(listener, bot); err != nil {
+			log.Warn("Chat webhook stopped: ", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// Addr returns the address the webhook listens on.
+func (bot *Bot) Addr() string {
+	if bot.listener == nil {
+		return ""
+	}
+	return bot.listener.Addr().String()
+}
+
+// Stop closes the listener.
+func (bot *Bot) Stop() error {
+	if bot.listener == nil {
+		return nil
+	}
+	return bot.listener.Close()
+}
+
+// request is a slash command as the platforms post it, form encoded or
+// JSON
+type request struct {
+	Token    string `json:"token"`
+	UserID   string `json:"user_id"`
+	UserName string `json:"user_name"`
+	User     string `json:"user"`
+	Command  string `json:"command"`
+	Text     string `json:"text"`
+}
+
+func parseRequest(r *http.Request, body []byte) (request, error) {
+	req := request{}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(bytes.NewReader(body)).Decode(&req)
+		return req, err
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return req, err
+	}
+	req.Token = form.Get("token")
+	req.UserID = form.Get("user_id")
+	req.UserName = form.Get("user_name")
+	req.User = form.Get("user")
+	req.Command = form.Get("command")
+	req.Text = form.Get("text")
+	return req, nil
+}
+
+// Sign returns the signature of a request body sent at timestamp, as the
+// platform puts it in the X-Slack-Signature header:
+// v0=hex(hmac_sha256(secret, "v0:<timestamp>:<body>")).
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signed tells if the request is signed with the secret, recently enough
+// not to be a replay
+func (bot *Bot) signed(r *http.Request, body []byte) bool {
+	if bot.config.Secret == "" {
+		return true
+	}
+
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(seconds, 0)); math.Abs(float64(age)) > float64(signatureAge) {
+		return false
+	}
+
+	signature := Sign(bot.config.Secret, timestamp, body)
+	return hmac.Equal([]byte(r.Header.Get("X-Slack-Signature")), []byte(signature))
+}
+
+func (req request) sender() string {
+	for _, sender := range []string{req.UserName, req.User, req.UserID} {
+		if sender != "" {
+			return sender
+		}
+	}
+	return ""
+}
+
+// allowed tells if the request carries the token and comes from the user
+// ID of an allowed sender, both are required
+func (bot *Bot) allowed(req request) bool {
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(bot.config.Token)) != 1 {
+		return false
+	}
+
+	if req.UserID == "" {
+		return false
+	}
+	for _, allowed := range bot.config.Senders {
+		if req.UserID == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// reply is understood by Slack and Mattermost alike
+type reply struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+func writeReply(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(reply{ResponseType: "in_channel", Text: text}); err != nil {
+		log.Error("Chat reply: ", err.Error())
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (bot *Bot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != bot.config.Path {
+		writeReply(w, http.StatusNotFound, "unknown path: "+r.URL.Path)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeReply(w, http.StatusMethodNotAllowed, "commands need POST")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeReply(w, http.StatusBadRequest, "bad command: "+err.Error())
+		return
+	}
+
+	if !bot.signed(r, body) {
+		log.Warn("Unsigned chat command from: ", r.RemoteAddr)
+		writeReply(w, http.StatusUnauthorized, "bad request signature")
+		return
+	}
+
+	req, err := parseRequest(r, body)
+	if err != nil {
+		writeReply(w, http.StatusBadRequest, "bad command: "+err.Error())
+		return
+	}
+
+	if !bot.allowed(req) {
+		log.Warnf("Chat command %q refused to %q from %s", strings.TrimSpace(req.Command+" "+req.Text), req.sender(), r.RemoteAddr)
+		writeReply(w, http.StatusForbidden, "you are not allowed to command tayni")
+		return
+	}
+
+	writeReply(w, http.StatusOK, bot.Run(req.sender(), req.Command+" "+req.Text))
+}
+
+// Run runs a command line of sender and returns the reply.
+func (bot *Bot) Run(sender, line string) string {
+	fields := strings.Fields(strings.ToLower(line))
+	for i := range fields {
+		fields[i] = strings.TrimPrefix(fields[i], "/")
+	}
+
+	// An umbrella command, /tayni price BTCUSD
+	if len(fields) > 1 && !known(fields[0]) {
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 || !known(fields[0]) {
+		return "unknown command, try:\n" + help
+	}
+
+	command, args := fields[0], fields[1:]
+	pair := ""
+	if len(args) > 0 {
+		pair = strings.ToUpper(args[0])
+	}
+
+	switch command {
+	case CommandStatus:
+		return bot.status(pair)
+	case CommandPrice:
+		return bot.price(pair)
+	case CommandSignals:
+		return bot.signals(pair)
+	case CommandPause, CommandResume, CommandFlatten:
+		log.Warnf("Chat %s of %s from %s", command, pair, sender)
+		return bot.command(command, pair)
+	}
+
+	return help
+}
+
+func known(command string) bool {
+	switch command {
+	case CommandStatus, CommandPrice, CommandSignals, CommandPause, CommandResume, CommandFlatten, CommandHelp:
+		return true
+	}
+	return false
+}
+
+func (bot *Bot) status(pair string) string {
+	pairs := []string{pair}
+	if pair == "" || pair == strings.ToUpper(control.AllPairs) {
+		pairs = bot.controller.Pairs()
+	}
+
+	lines := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		status, err := bot.controller.Status(pair)
+		if err != nil {
+			return err.Error()
+		}
+
+		// The status is the JSON of the pair context
+		statusJSON, err := json.Marshal(status)
+		if err != nil {
+			return err.Error()
+		}
+		context := struct {
+			State    string  `json:"state"`
+			Position float64 `json:"position"`
+			Entry    float64 `json:"entry"`
+		}{}
+		if err := json.Unmarshal(statusJSON, &context); err != nil {
+			lines = append(lines, fmt.Sprintf("%s: %s", pair, string(statusJSON)))
+			continue
+		}
+
+		line := fmt.Sprintf("%s: %s", pair, context.State)
+		if context.Position > 0 {
+			line += fmt.Sprintf(", position %f at %f", context.Position, context.Entry)
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (bot *Bot) price(pair string) string {
+	if pair == "" {
+		return "price needs a pair"
+	}
+
+	key := fmt.Sprintf("PRICE_%s_%s", bot.config.Exchange, pair)
+	price, err := bot.kr.GetString(key)
+	if err != nil {
+		return fmt.Sprintf("no price of %s", pair)
+	}
+	return fmt.Sprintf("%s: %s", pair, price)
+}
+
+func (bot *Bot) signals(pair string) string {
+	if pair == "" {
+		return "signals needs a pair"
+	}
+
+	signal := func(key string) string {
+		value, err := bot.kr.GetString(key)
+		if err != nil {
+			return "-"
+		}
+		return value
+	}
+
+	lines := []string{pair + ":"}
+	for _, timeframe := range bot.config.Timeframes {
+		key := fmt.Sprintf("%s_%s_MS_%d", bot.config.Exchange, pair, timeframe)
+		lines = append(lines, fmt.Sprintf("%dm buy %s sell %s", timeframe, signal(key+"_BUY"), signal(key+"_SELL")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (bot *Bot) command(command, pair string) string {
+	action := control.ActionPause
+	switch command {
+	case CommandResume:
+		action = control.ActionResume
+	case CommandFlatten:
+		action = control.ActionSell
+		if pair == "" {
+			pair = control.AllPairs
+		}
+	}
+
+	if pair == "" {
+		return command + " needs a pair"
+	}
+
+	pairs := []string{pair}
+	if strings.EqualFold(pair, control.AllPairs) {
+		pairs = bot.controller.Pairs()
+	}
+
+	lines := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if err := bot.controller.Command(pair, action); err != nil {
+			log.Errorf("Chat %s of %s: %s", command, pair, err.Error())
+			lines = append(lines, fmt.Sprintf("%s: %s failed, %s", pair, command, err.Error()))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s done", pair, command))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,298 @@
+package chat_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/chat"
+	"github.com/lagarciag/tayni/control"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/spf13/viper"
+)
+
+var kr *kredis.Kredis
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	kr = kredis.NewKredis(1)
+	kr.Start()
+
+	os.Exit(m.Run())
+}
+
+// fakeController keeps a state per pair, ETHBTC refuses to sell
+type fakeController struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func (fc *fakeController) Pairs() []string {
+	return []string{"BTCUSD", "ETHBTC"}
+}
+
+func (fc *fakeController) Status(pair string) (interface{}, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	state, ok := fc.states[pair]
+	if !ok {
+		return nil, fmt.Errorf("unknown pair: %s", pair)
+	}
+	status := map[string]interface{}{"state": state}
+	if state == "HoldState" {
+		status["position"] = 0.5
+		status["entry"] = 10000.0
+	}
+	return status, nil
+}
+
+func (fc *fakeController) Command(pair, action string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if pair == "ETHBTC" && action == control.ActionSell {
+		return fmt.Errorf("nothing to sell")
+	}
+	fc.states[pair] = action
+	return nil
+}
+
+func (fc *fakeController) state(pair string) string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.states[pair]
+}
+
+// post sends a slash command as Slack and Mattermost do
+func post(t *testing.T, server *httptest.Server, user, command, text string) (int, string) {
+	form := url.Values{}
+	form.Set("token", "VERIFY")
+	form.Set("user_id", user)
+	form.Set("command", command)
+	form.Set("text", text)
+
+	resp, err := http.PostForm(server.URL+chat.DefaultPath, form)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+
+	reply := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal("Bad reply: ", err.Error())
+	}
+	return resp.StatusCode, reply["text"]
+}
+
+func newChat(t *testing.T, exchange string) (*fakeController, *httptest.Server) {
+	fc := &fakeController{states: map[string]string{"BTCUSD": "HoldState", "ETHBTC": "TradingState"}}
+
+	config := chat.Config{Token: "VERIFY", Senders: []string{"U024BE7LH"}, Exchange: exchange, Timeframes: []int{30, 60}}
+	bot, err := chat.NewBot(config, fc, kr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return fc, httptest.NewServer(bot)
+}
+
+func TestChatAuth(t *testing.T) {
+
+	if _, err := chat.NewBot(chat.Config{Token: "VERIFY"}, &fakeController{}, kr); err == nil {
+		t.Error("Bot without senders should be refused")
+	}
+	if _, err := chat.NewBot(chat.Config{Senders: []string{"oncall"}}, &fakeController{}, kr); err == nil {
+		t.Error("Bot without token should be refused")
+	}
+
+	fc, server := newChat(t, "CEXIO")
+	defer server.Close()
+
+	if status, _ := post(t, server, "U999INTRU", "/pause", "BTCUSD"); status != http.StatusForbidden {
+		t.Error("Unknown sender allowed: ", status)
+	}
+
+	// Names can be changed by anyone, only the ID counts
+	form := url.Values{"user_id": {"U999INTRU"}, "user_name": {"U024BE7LH"}, "user": {"U024BE7LH"},
+		"command": {"/pause"}, "text": {"BTCUSD"}, "token": {"VERIFY"}}
+	resp, err := http.PostForm(server.URL+chat.DefaultPath, form)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Sender allowed by name: ", resp.StatusCode)
+	}
+
+	if status, _ := post(t, server, "u024be7lh", "/pause", "BTCUSD"); status != http.StatusForbidden {
+		t.Error("Sender ID matched regardless of case: ", status)
+	}
+
+	form = url.Values{"user_id": {"U024BE7LH"}, "command": {"/pause"}, "text": {"BTCUSD"}, "token": {"BAD"}}
+	resp, err = http.PostForm(server.URL+chat.DefaultPath, form)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Bad token allowed: ", resp.StatusCode)
+	}
+
+	// Allowed sender without token
+	form.Del("token")
+	resp, err = http.PostForm(server.URL+chat.DefaultPath, form)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Missing token allowed: ", resp.StatusCode)
+	}
+
+	if fc.state("BTCUSD") != "HoldState" {
+		t.Error("Refused command ran")
+	}
+}
+
+func TestChatSignature(t *testing.T) {
+
+	fc := &fakeController{states: map[string]string{"BTCUSD": "HoldState", "ETHBTC": "TradingState"}}
+	config := chat.Config{Token: "VERIFY", Secret: "SIGNING", Senders: []string{"U024BE7LH"}}
+	bot, err := chat.NewBot(config, fc, kr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server := httptest.NewServer(bot)
+	defer server.Close()
+
+	body := url.Values{"token": {"VERIFY"}, "user_id": {"U024BE7LH"}, "command": {"/pause"}, "text": {"BTCUSD"}}.Encode()
+
+	send := func(timestamp, signature string) int {
+		request, err := http.NewRequest(http.MethodPost, server.URL+chat.DefaultPath, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		request.Header.Set("X-Slack-Signature", signature)
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	old := fmt.Sprintf("%d", time.Now().Add(-time.Hour).Unix())
+
+	if status := send(now, ""); status != http.StatusUnauthorized {
+		t.Error("Unsigned command allowed: ", status)
+	}
+	if status := send(now, chat.Sign("WRONG", now, []byte(body))); status != http.StatusUnauthorized {
+		t.Error("Badly signed command allowed: ", status)
+	}
+	if status := send(old, chat.Sign("SIGNING", old, []byte(body))); status != http.StatusUnauthorized {
+		t.Error("Replayed command allowed: ", status)
+	}
+	if fc.state("BTCUSD") != "HoldState" {
+		t.Fatal("Refused command ran")
+	}
+
+	if status := send(now, chat.Sign("SIGNING", now, []byte(body))); status != http.StatusOK {
+		t.Error("Signed command refused: ", status)
+	}
+	if fc.state("BTCUSD") != control.ActionPause {
+		t.Error("Signed command did not run: ", fc.state("BTCUSD"))
+	}
+}
+
+func TestChatCommands(t *testing.T) {
+
+	exchange := fmt.Sprintf("TEST%d", rand.Intn(1000000))
+
+	fc, server := newChat(t, exchange)
+	defer server.Close()
+
+	kr.Set(fmt.Sprintf("PRICE_%s_BTCUSD", exchange), "10012.5")
+	kr.Set(fmt.Sprintf("%s_ETHBTC_MS_30_BUY", exchange), "true")
+	kr.Set(fmt.Sprintf("%s_ETHBTC_MS_30_SELL", exchange), "false")
+
+	cases := []struct {
+		command, text, expected string
+	}{
+		{"/status", "", "BTCUSD: HoldState, position 0.500000 at 10000.000000\nETHBTC: TradingState"},
+		{"/status", "ethbtc", "ETHBTC: TradingState"},
+		{"/price", "BTCUSD", "BTCUSD: 10012.5"},
+		{"/price", "XRPUSD", "no price of XRPUSD"},
+		{"/signals", "ETHBTC", "ETHBTC:\n30m buy true sell false\n60m buy - sell -"},
+		{"/tayni", "price BTCUSD", "BTCUSD: 10012.5"},
+		{"/price", "", "price needs a pair"},
+	}
+	for _, tc := range cases {
+		status, text := post(t, server, "U024BE7LH", tc.command, tc.text)
+		if status != http.StatusOK || text != tc.expected {
+			t.Errorf("%s %s: expected %q got %d %q", tc.command, tc.text, tc.expected, status, text)
+		}
+	}
+
+	if _, text := post(t, server, "U024BE7LH", "/explode", ""); !strings.Contains(text, "/flatten") {
+		t.Error("Unknown command without help: ", text)
+	}
+
+	if _, text := post(t, server, "U024BE7LH", "/pause", "ETHBTC"); text != "ETHBTC: pause done" || fc.state("ETHBTC") != control.ActionPause {
+		t.Error("Bad pause: ", text)
+	}
+
+	// Flatten reports the pairs that failed
+	_, text := post(t, server, "U024BE7LH", "/flatten", "")
+	if !strings.Contains(text, "BTCUSD: flatten done") || !strings.Contains(text, "ETHBTC: flatten failed, nothing to sell") {
+		t.Error("Bad flatten: ", text)
+	}
+
+	// Plain JSON posts work too
+	body, _ := json.Marshal(map[string]string{"user_id": "U024BE7LH", "token": "VERIFY", "text": "/resume ETHBTC"})
+	resp, err := http.Post(server.URL+chat.DefaultPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	reply := map[string]string{}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	if reply["text"] != "ETHBTC: resume done" || fc.state("ETHBTC") != control.ActionResume {
+		t.Error("Bad JSON resume: ", reply)
+	}
+}
+
+func TestChatLoadConfig(t *testing.T) {
+
+	if _, ok := chat.LoadConfig(); ok {
+		t.Fatal("Chat configured without a chat section")
+	}
+
+	viper.Set("minute_strategies", []interface{}{int64(30), int64(60)})
+	viper.Set("exchange.cexio.pairs", []string{"BTCUSD"})
+	viper.Set("chat.senders", []string{"oncall"})
+	defer viper.Reset()
+
+	config, ok := chat.LoadConfig()
+	if !ok {
+		t.Fatal("Chat not configured")
+	}
+	if config.Listen != chat.DefaultListen || config.Path != chat.DefaultPath || config.Exchange != "CEXIO" ||
+		len(config.Timeframes) != 2 || len(config.Senders) != 1 {
+		t.Error("Bad chat config: ", config)
+	}
+}
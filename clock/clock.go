@@ -0,0 +1,222 @@
+// Package clock abstracts time so that the statistician and the collectors
+// can run either on the wall clock or on a simulated clock for tests and
+// replays.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the time functions used by tayni services.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the subset of time.Ticker used by tayni services.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// --------------------
+// Wall clock
+// --------------------
+
+type realClock struct{}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+// New returns a Clock backed by the time package.
+func New() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+func (rt *realTicker) C() <-chan time.Time {
+	return rt.ticker.C
+}
+
+func (rt *realTicker) Stop() {
+	rt.ticker.Stop()
+}
+
+// --------------------
+// Simulated clock
+// --------------------
+
+// Simulated is a Clock that only moves when told to. Sleep blocks like a
+// timer from After until the replay driver advances the clock past its
+// deadline, so no sleeper moves the time of the others.
+type Simulated struct {
+	mu      *sync.Mutex
+	now     time.Time
+	tickers []*simulatedTicker
+	timers  []*simulatedTimer
+}
+
+type simulatedTicker struct {
+	clock   *Simulated
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+type simulatedTimer struct {
+	c        chan time.Time
+	deadline time.Time
+}
+
+// NewSimulated returns a simulated clock set to start.
+func NewSimulated(start time.Time) *Simulated {
+	sc := &Simulated{}
+	sc.mu = &sync.Mutex{}
+	sc.now = start
+	return sc
+}
+
+func (sc *Simulated) Now() time.Time {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.now
+}
+
+// Sleep blocks until the clock is advanced by at least d.
+func (sc *Simulated) Sleep(d time.Duration) {
+	<-sc.After(d)
+}
+
+func (sc *Simulated) After(d time.Duration) <-chan time.Time {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	timer := &simulatedTimer{c: make(chan time.Time, 1), deadline: sc.now.Add(d)}
+	if d <= 0 {
+		timer.c <- sc.now
+		return timer.c
+	}
+	sc.timers = append(sc.timers, timer)
+	return timer.c
+}
+
+func (sc *Simulated) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	ticker := &simulatedTicker{clock: sc, c: make(chan time.Time, 1), period: d, next: sc.now.Add(d)}
+	sc.tickers = append(sc.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward by d, firing every ticker and timer that
+// expires on the way. Like time.Ticker, a ticker whose channel is full drops
+// the tick.
+func (sc *Simulated) Advance(d time.Duration) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.now = sc.now.Add(d)
+
+	for _, ticker := range sc.tickers {
+		for !ticker.stopped && !ticker.next.After(sc.now) {
+			select {
+			case ticker.c <- ticker.next:
+			default:
+			}
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+	}
+
+	pending := sc.timers[:0]
+	for _, timer := range sc.timers {
+		if timer.deadline.After(sc.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- timer.deadline
+	}
+	sc.timers = pending
+}
+
+// Waiters returns the count of timers and sleepers still waiting.
+func (sc *Simulated) Waiters() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.timers)
+}
+
+// AdvanceNext moves the clock to the earliest deadline of the timers and
+// sleepers, firing it. It returns false when nothing waits.
+func (sc *Simulated) AdvanceNext() bool {
+	sc.mu.Lock()
+	if len(sc.timers) == 0 {
+		sc.mu.Unlock()
+		return false
+	}
+	next := sc.timers[0].deadline
+	for _, timer := range sc.timers[1:] {
+		if timer.deadline.Before(next) {
+			next = timer.deadline
+		}
+	}
+	d := next.Sub(sc.now)
+	sc.mu.Unlock()
+
+	sc.Advance(d)
+	return true
+}
+
+// Drive advances the clock to the next deadline as soon as a timer or a
+// sleeper waits, until stop is called. It is for tests that only need the
+// sleepers not to block, replays advance the clock themselves.
+func (sc *Simulated) Drive() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if !sc.AdvanceNext() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (st *simulatedTicker) C() <-chan time.Time {
+	return st.c
+}
+
+func (st *simulatedTicker) Stop() {
+	st.clock.mu.Lock()
+	st.stopped = true
+	st.clock.mu.Unlock()
+}
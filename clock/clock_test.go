@@ -0,0 +1,128 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+)
+
+func TestSimulatedNowAndSleep(t *testing.T) {
+
+	start := time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewSimulated(start)
+
+	if !clk.Now().Equal(start) {
+		t.Error("bad start time: ", clk.Now())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		clk.Sleep(time.Hour)
+		close(done)
+	}()
+
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Short of the deadline
+	clk.Advance(59 * time.Minute)
+
+	select {
+	case <-done:
+		t.Error("sleep returned before the clock was advanced")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if !clk.AdvanceNext() {
+		t.Fatal("sleeper not waiting")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sleep did not return once the clock was advanced")
+	}
+
+	if !clk.Now().Equal(start.Add(time.Hour)) {
+		t.Error("bad time after sleep: ", clk.Now())
+	}
+
+	if clk.AdvanceNext() {
+		t.Error("nothing should be waiting")
+	}
+}
+
+func TestSimulatedTicker(t *testing.T) {
+
+	start := time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewSimulated(start)
+
+	ticker := clk.NewTicker(10 * time.Second)
+
+	clk.Advance(9 * time.Second)
+
+	select {
+	case <-ticker.C():
+		t.Error("ticker fired early")
+	default:
+	}
+
+	clk.Advance(time.Second)
+
+	select {
+	case tick := <-ticker.C():
+		if !tick.Equal(start.Add(10 * time.Second)) {
+			t.Error("bad tick time: ", tick)
+		}
+	default:
+		t.Error("ticker did not fire")
+	}
+
+	ticker.Stop()
+	clk.Advance(time.Minute)
+
+	select {
+	case <-ticker.C():
+		t.Error("stopped ticker fired")
+	default:
+	}
+}
+
+func TestSimulatedAfter(t *testing.T) {
+
+	clk := clock.NewSimulated(time.Now())
+
+	after := clk.After(time.Minute)
+
+	clk.Advance(30 * time.Second)
+
+	select {
+	case <-after:
+		t.Error("timer fired early")
+	default:
+	}
+
+	clk.Advance(30 * time.Second)
+
+	select {
+	case <-after:
+	default:
+		t.Error("timer did not fire")
+	}
+}
+
+func TestRealClock(t *testing.T) {
+
+	clk := clock.New()
+
+	before := time.Now()
+	if clk.Now().Before(before) {
+		t.Error("real clock behind time.Now")
+	}
+
+	ticker := clk.NewTicker(time.Millisecond)
+	<-ticker.C()
+	ticker.Stop()
+}
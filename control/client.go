@@ -0,0 +1,115 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lagarciag/tayni/alert"
+)
+
+// Client calls the control API of a running trader.
+type Client struct {
+	URL    string
+	Token  string
+	client *http.Client
+}
+
+// NewClient creates a client of the control API at address, a host:port or
+// a URL.
+func NewClient(address, token string) *Client {
+	cl := &Client{}
+	cl.URL = strings.TrimSuffix(address, "/")
+	if !strings.HasPrefix(cl.URL, "http") {
+		cl.URL = "http://" + cl.URL
+	}
+	cl.Token = token
+	cl.client = &http.Client{Timeout: 30 * time.Second}
+	return cl
+}
+
+func (cl *Client) do(method, path string, payload, value interface{}) error {
+	var reader io.Reader
+	if payload != nil {
+		payloadJSON, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payloadJSON)
+	}
+
+	request, err := http.NewRequest(method, cl.URL+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+cl.Token)
+	if payload != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := cl.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("control API: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		apiError := map[string]string{}
+		if err := json.Unmarshal(body, &apiError); err == nil && apiError["error"] != "" {
+			return fmt.Errorf("control API: %s", apiError["error"])
+		}
+		return fmt.Errorf("control API: %s", response.Status)
+	}
+
+	return json.Unmarshal(body, value)
+}
+
+// Status returns the state of a pair, of all the pairs when pair is empty
+// or AllPairs, indexed by pair.
+func (cl *Client) Status(pair string) (map[string]json.RawMessage, error) {
+	path := "/status"
+	if pair != "" {
+		path += "/" + pair
+	}
+
+	statuses := make(map[string]json.RawMessage)
+	err := cl.do(http.MethodGet, path, nil, &statuses)
+	return statuses, err
+}
+
+// Command runs an action on a pair, or on all of them with AllPairs.
+func (cl *Client) Command(action, pair string) (Result, error) {
+	result := Result{}
+	err := cl.do(http.MethodPost, fmt.Sprintf("/%s/%s", action, pair), nil, &result)
+	return result, err
+}
+
+// Alerts returns the alerts of the trader.
+func (cl *Client) Alerts() ([]alert.Alert, error) {
+	var alerts []alert.Alert
+	err := cl.do(http.MethodGet, "/alerts", nil, &alerts)
+	return alerts, err
+}
+
+// AddAlert adds an alert, it returns it with its ID.
+func (cl *Client) AddAlert(definition alert.Alert) (alert.Alert, error) {
+	added := alert.Alert{}
+	err := cl.do(http.MethodPost, "/alerts", definition, &added)
+	return added, err
+}
+
+// RemoveAlert removes an alert.
+func (cl *Client) RemoveAlert(id string) error {
+	removed := map[string]string{}
+	return cl.do(http.MethodDelete, "/alerts/"+id, nil, &removed)
+}
@@ -0,0 +1,304 @@
+// Package control is the local control plane of the trader. Operators
+// pause, resume, force or flatten pairs through an HTTP API authenticated
+// with a shared token, the Client is used by the command line.
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lagarciag/tayni/alert"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Actions on a pair
+const (
+	ActionPause  = "pause"
+	ActionResume = "resume"
+	ActionHold   = "hold"
+	ActionTrade  = "trade"
+	ActionSell   = "sell"
+)
+
+// AllPairs targets every pair of the trader
+const AllPairs = "all"
+
+// DefaultListen is the address of the control API when none is configured
+const DefaultListen = "127.0.0.1:8765"
+
+// Actions lists the valid actions
+var Actions = []string{ActionPause, ActionResume, ActionHold, ActionTrade, ActionSell}
+
+// Controller is the trader as seen by the control plane.
+type Controller interface {
+	Pairs() []string
+	Status(pair string) (interface{}, error)
+	Command(pair, action string) error
+}
+
+// Alerter manages the price and indicator alerts, see the alert package.
+type Alerter interface {
+	Alerts() []alert.Alert
+	Add(definition alert.Alert) (alert.Alert, error)
+	Remove(id string) error
+}
+
+// Config of the control API. Listen should stay on a local address, the
+// API refuses to start without a token.
+type Config struct {
+	Listen string
+	Token  string
+}
+
+// LoadConfig reads the control configuration. It returns false when the
+// control API is not configured.
+//
+//	[control]
+//	listen = "127.0.0.1:8765"
+//	token = "a long random string"
+func LoadConfig() (Config, bool) {
+	if !viper.IsSet("control") {
+		return Config{}, false
+	}
+
+	config := Config{}
+	config.Listen = viper.GetString("control.listen")
+	config.Token = viper.GetString("control.token")
+
+	if config.Listen == "" {
+		config.Listen = DefaultListen
+	}
+
+	return config, true
+}
+
+// Result is the response to a command. Errors are per pair so flattening
+// all the pairs reports the ones that could not be sold.
+type Result struct {
+	Action string            `json:"action"`
+	Done   []string          `json:"done"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Server serves the control API:
+//
+//	GET    /status            state of every pair
+//	GET    /status/<pair>     state of a pair
+//	POST   /<action>/<pair>   action on a pair, or on all of them
+//	GET    /alerts            the alerts
+//	POST   /alerts            add the alert of the JSON body
+//	DELETE /alerts/<id>       remove an alert
+type Server struct {
+	config     Config
+	controller Controller
+	alerter    Alerter
+	listener   net.Listener
+}
+
+// NewServer creates the control API of controller.
+func NewServer(config Config, controller Controller) (*Server, error) {
+	if config.Token == "" {
+		return nil, fmt.Errorf("control API without token")
+	}
+
+	cs := &Server{}
+	cs.config = config
+	cs.controller = controller
+
+	return cs, nil
+}
+
+// SetAlerts serves the alerts of alerter.
+func (cs *Server) SetAlerts(alerter Alerter) {
+	cs.alerter = alerter
+}
+
+// Start listens on the configured address and serves in the background.
+func (cs *Server) Start() error {
+	listener, err := net.Listen("tcp", cs.config.Listen)
+	if err != nil {
+		return fmt.Errorf("control API: %s", err.Error())
+	}
+	cs.listener = listener
+
+	log.Info("Control API listening on: ", listener.Addr().String())
+
+	go func() {
+		if err := http.Serve(listener, cs); err != nil {
+			log.Warn("Control API stopped: ", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// Addr returns the address the API listens on.
+func (cs *Server) Addr() string {
+	if cs.listener == nil {
+		return ""
+	}
+	return cs.listener.Addr().String()
+}
+
+// Stop closes the listener.
+func (cs *Server) Stop() error {
+	if cs.listener == nil {
+		return nil
+	}
+	return cs.listener.Close()
+}
+
+func (cs *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cs.config.Token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Error("Control API response: ", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// ServeHTTP implements http.Handler.
+func (cs *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !cs.authorized(r) {
+		log.Warn("Unauthorized control request from: ", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if parts[0] == "status" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "status needs GET")
+			return
+		}
+		cs.serveStatus(w, parts[1:])
+		return
+	}
+
+	if parts[0] == "alerts" {
+		cs.serveAlerts(w, r, parts[1:])
+		return
+	}
+
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "unknown path: "+r.URL.Path)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "actions need POST")
+		return
+	}
+
+	action, pair := parts[0], parts[1]
+
+	known := false
+	for _, valid := range Actions {
+		if action == valid {
+			known = true
+		}
+	}
+
+	if !known {
+		writeError(w, http.StatusNotFound, "unknown action: "+action)
+		return
+	}
+
+	log.Warnf("Control %s of %s from %s", action, pair, r.RemoteAddr)
+
+	writeJSON(w, http.StatusOK, cs.command(action, pair))
+}
+
+func (cs *Server) serveStatus(w http.ResponseWriter, pairs []string) {
+
+	if len(pairs) == 0 || pairs[0] == AllPairs {
+		pairs = cs.controller.Pairs()
+	}
+
+	statuses := make(map[string]interface{})
+
+	for _, pair := range pairs {
+		status, err := cs.controller.Status(pair)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		statuses[pair] = status
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (cs *Server) serveAlerts(w http.ResponseWriter, r *http.Request, ids []string) {
+
+	if cs.alerter == nil {
+		writeError(w, http.StatusNotFound, "alerts are not served")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(ids) == 0:
+		writeJSON(w, http.StatusOK, cs.alerter.Alerts())
+
+	case r.Method == http.MethodPost && len(ids) == 0:
+		definition := alert.Alert{}
+		if err := json.NewDecoder(r.Body).Decode(&definition); err != nil {
+			writeError(w, http.StatusBadRequest, "bad alert: "+err.Error())
+			return
+		}
+		added, err := cs.alerter.Add(definition)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Warnf("Control alert %s added from %s: %s", added.ID, r.RemoteAddr, added)
+		writeJSON(w, http.StatusOK, added)
+
+	case r.Method == http.MethodDelete && len(ids) == 1:
+		if err := cs.alerter.Remove(ids[0]); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Warnf("Control alert %s removed from %s", ids[0], r.RemoteAddr)
+		writeJSON(w, http.StatusOK, map[string]string{"removed": ids[0]})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "alerts take GET, POST or DELETE /alerts/<id>")
+	}
+}
+
+func (cs *Server) command(action, pair string) Result {
+
+	pairs := []string{pair}
+	if pair == AllPairs {
+		pairs = cs.controller.Pairs()
+	}
+
+	result := Result{Action: action, Done: []string{}, Errors: make(map[string]string)}
+
+	for _, pair := range pairs {
+		if err := cs.controller.Command(pair, action); err != nil {
+			log.Errorf("Control %s of %s: %s", action, pair, err.Error())
+			result.Errors[pair] = err.Error()
+			continue
+		}
+		result.Done = append(result.Done, pair)
+	}
+
+	return result
+}
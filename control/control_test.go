@@ -0,0 +1,177 @@
+package control_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/alert"
+	"github.com/lagarciag/tayni/control"
+)
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	os.Exit(m.Run())
+}
+
+// fakeController keeps a state per pair, ETHBTC refuses to sell
+type fakeController struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func (fc *fakeController) Pairs() []string {
+	return []string{"BTCUSD", "ETHBTC"}
+}
+
+func (fc *fakeController) Status(pair string) (interface{}, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	state, ok := fc.states[pair]
+	if !ok {
+		return nil, fmt.Errorf("unknown pair: %s", pair)
+	}
+	return map[string]string{"state": state}, nil
+}
+
+func (fc *fakeController) Command(pair, action string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if pair == "ETHBTC" && action == control.ActionSell {
+		return fmt.Errorf("nothing to sell")
+	}
+	fc.states[pair] = action
+	return nil
+}
+
+func newControl(t *testing.T) (*fakeController, *httptest.Server) {
+	fc := &fakeController{states: map[string]string{"BTCUSD": "HoldState", "ETHBTC": "TradingState"}}
+
+	server, err := control.NewServer(control.Config{Token: "SECRET"}, fc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return fc, httptest.NewServer(server)
+}
+
+func TestControlAuth(t *testing.T) {
+
+	if _, err := control.NewServer(control.Config{}, &fakeController{}); err == nil {
+		t.Error("Server without token should be refused")
+	}
+
+	_, server := newControl(t)
+	defer server.Close()
+
+	if _, err := control.NewClient(server.URL, "BAD").Status(""); err == nil {
+		t.Error("Expected unauthorized error")
+	}
+}
+
+func TestControlCommands(t *testing.T) {
+
+	fc, server := newControl(t)
+	defer server.Close()
+
+	client := control.NewClient(server.URL, "SECRET")
+
+	statuses, err := client.Status("")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	status := map[string]string{}
+	if err := json.Unmarshal(statuses["BTCUSD"], &status); err != nil || status["state"] != "HoldState" || len(statuses) != 2 {
+		t.Error("Bad status: ", statuses, err)
+	}
+
+	result, err := client.Command(control.ActionPause, "BTCUSD")
+	if err != nil || len(result.Done) != 1 || fc.states["BTCUSD"] != control.ActionPause {
+		t.Error("Bad pause: ", result, err)
+	}
+
+	// Flatten reports the pairs that failed
+	result, err = client.Command(control.ActionSell, control.AllPairs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(result.Done) != 1 || result.Errors["ETHBTC"] == "" {
+		t.Error("Bad flatten result: ", result)
+	}
+
+	if _, err := client.Command("explode", "BTCUSD"); err == nil {
+		t.Error("Expected unknown action error")
+	}
+
+	if _, err := client.Status("XRPUSD"); err == nil {
+		t.Error("Expected unknown pair error")
+	}
+}
+
+func TestControlAlerts(t *testing.T) {
+
+	_, server := newControl(t)
+	defer server.Close()
+
+	client := control.NewClient(server.URL, "SECRET")
+
+	if _, err := client.Alerts(); err == nil {
+		t.Error("Expected alerts off error")
+	}
+
+	fc := &fakeController{states: map[string]string{}}
+	cs, err := control.NewServer(control.Config{Token: "SECRET"}, fc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	alerts, err := alert.NewService(alert.Config{Exchange: "CEXIO"}, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cs.SetAlerts(alerts)
+
+	server = httptest.NewServer(cs)
+	defer server.Close()
+
+	client = control.NewClient(server.URL, "SECRET")
+
+	definition, _ := alert.Parse("BTCUSD crosses 10000")
+	definition.Rearm = true
+	added, err := client.AddAlert(definition)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if added.ID == "" || added.Exchange != "CEXIO" || !added.Rearm {
+		t.Error("Bad added alert: ", added)
+	}
+
+	if _, err := client.AddAlert(alert.Alert{Pair: "BTCUSD", Kind: "jumps"}); err == nil {
+		t.Error("Expected bad alert error")
+	}
+
+	listed, err := client.Alerts()
+	if err != nil || len(listed) != 1 || listed[0].ID != added.ID {
+		t.Error("Bad alerts: ", listed, err)
+	}
+
+	if err := client.RemoveAlert(added.ID); err != nil {
+		t.Error(err.Error())
+	}
+	if err := client.RemoveAlert(added.ID); err == nil {
+		t.Error("Expected unknown alert error")
+	}
+	if listed, _ := client.Alerts(); len(listed) != 0 {
+		t.Error("Alert not removed: ", listed)
+	}
+}
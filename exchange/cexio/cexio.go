@@ -14,6 +14,7 @@ import (
 	"strconv"
 
 	"github.com/coreos/go-systemd/daemon"
+	"github.com/lagarciag/tayni/clock"
 	"github.com/lagarciag/tayni/kredis"
 	"github.com/lagarciag/tayni/statistician"
 )
@@ -24,6 +25,9 @@ type CollectorConfig struct {
 	Pairs        []string
 	SampleRate   int
 	HistoryCount int
+
+	// Clock drives sampling, defaults to the wall clock when nil
+	Clock clock.Clock
 }
 
 type Bot struct {
@@ -37,6 +41,7 @@ type Bot struct {
 
 	apiLock *sync.Mutex
 	kr      *kredis.Kredis
+	clock   clock.Clock
 
 	ticksPerMinute int
 	btcUsdBase     float64
@@ -48,8 +53,8 @@ type Bot struct {
 	// --------------------
 	// Control Structures
 	// --------------------
-	priceUpdateTimer map[string]*time.Ticker
-	statsUpdateTimer map[string]*time.Ticker
+	priceUpdateTimer map[string]clock.Ticker
+	statsUpdateTimer map[string]clock.Ticker
 	shutdownCond     *sync.Cond
 	priceUpdaterCond *sync.Cond
 	apiError         chan error
@@ -66,8 +71,13 @@ func NewBot(config CollectorConfig, kr *kredis.Kredis) (bot *Bot) {
 	//--------------------------------
 	bot = &Bot{}
 
-	bot.priceUpdateTimer = make(map[string]*time.Ticker)
-	bot.statsUpdateTimer = make(map[string]*time.Ticker)
+	bot.priceUpdateTimer = make(map[string]clock.Ticker)
+	bot.statsUpdateTimer = make(map[string]clock.Ticker)
+
+	bot.clock = config.Clock
+	if bot.clock == nil {
+		bot.clock = clock.New()
+	}
 
 	bot.historyCount = config.HistoryCount
 	bot.name = "CEXIO"
@@ -102,6 +112,7 @@ func NewBot(config CollectorConfig, kr *kredis.Kredis) (bot *Bot) {
 
 	for _, pairName := range bot.pairs {
 		bot.stats[pairName] = statistician.NewStatistician(bot.name, pairName, bot.kr, false, bot.sampleRate)
+		bot.stats[pairName].SetClock(bot.clock)
 	}
 
 	return bot
@@ -139,7 +150,7 @@ func (bot *Bot) exchangeStart() {
 	log.Info("Price Update timer set to : ", priceUdateTimer)
 
 	for _, pair := range bot.pairs {
-		bot.priceUpdateTimer[fmt.Sprintf("CEXIO_%s", pair)] = time.NewTicker(priceUdateTimer)
+		bot.priceUpdateTimer[fmt.Sprintf("CEXIO_%s", pair)] = bot.clock.NewTicker(priceUdateTimer)
 	}
 
 	go bot.exchangeConnect()
@@ -152,7 +163,8 @@ func (bot *Bot) statsStart() {
 	statsUpdateTimer := (time.Second * time.Duration(bot.sampleRate))
 
 	for _, pair := range bot.pairs {
-		bot.statsUpdateTimer[fmt.Sprintf("CEXIO_%s", pair)] = time.NewTicker(statsUpdateTimer)
+		bot.statsUpdateTimer[fmt.Sprintf("CEXIO_%s", pair)] = bot.clock.NewTicker(statsUpdateTimer)
+		bot.stats[pair].Start()
 	}
 
 	go bot.statsCollector()
@@ -181,7 +193,7 @@ func (bot *Bot) PublicRestart() {
 	}
 
 	close(bot.apiStop)
-	time.Sleep(time.Second * 2)
+	bot.clock.Sleep(time.Second * 2)
 	log.Info("All conections closed, restarting...")
 
 	bot.apiStop = make(chan bool)
@@ -222,7 +234,7 @@ func (bot *Bot) Start() {
 	go bot.monitorTicker("BTC", "USD")
 
 	for {
-		time.Sleep(time.Second)
+		bot.clock.Sleep(time.Second)
 	}
 
 }
@@ -265,7 +277,7 @@ func (bot *Bot) statsCollector() {
 
 func (bot *Bot) MonitorPrice() {
 	currentPrice := "0"
-	monTimer := time.NewTicker(time.Second)
+	monTimer := bot.clock.NewTicker(time.Second)
 	priceLock := &sync.Mutex{}
 	emaMapLock := &sync.Mutex{}
 
@@ -324,7 +336,7 @@ func (bot *Bot) MonitorPrice() {
 				return
 			}
 
-		case <-monTimer.C:
+		case <-monTimer.C():
 			{
 
 				for key := range priceUpdateMap {
@@ -414,7 +426,7 @@ func (bot *Bot) UpdatePriceLists(exchange, pair string) {
 	// re-enable Db updates for statistician & friends
 	// -----------------------------------------------
 	bot.stats[pair].SetDbUpdates(true)
-	time.Sleep(time.Second)
+	bot.clock.Sleep(time.Second)
 
 	// ----------------------------------------
 	// Send broadcast to enable writing to db
@@ -429,7 +441,7 @@ func (bot *Bot) priceUpdater(exchange, pair string) {
 
 	timer := bot.statsUpdateTimer[fmt.Sprintf("CEXIO_%s", pair)]
 
-	for _ = range timer.C {
+	for range timer.C() {
 		//valueStr, err := bot.kr.UpdateList(exchange, pair)
 
 		valueInterface, err := bot.kr.GetPriceValue(exchange, pair)
@@ -506,6 +518,10 @@ func (bot *Bot) Stop() {
 		log.Fatal("error while stoping bot:", err.Error())
 	}
 	close(bot.fullStop)
+
+	for _, pair := range bot.pairs {
+		bot.stats[pair].Stop()
+	}
 	log.Info("Bot is down")
 }
 
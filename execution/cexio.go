@@ -0,0 +1,510 @@
+package execution
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const cexioBaseURL = "https://cex.io/api"
+
+// CexioConfig holds the CEX.IO REST API credentials.
+type CexioConfig struct {
+	Key     string
+	Secret  string
+	UserID  string
+	BaseURL string
+	Timeout time.Duration
+}
+
+// Cexio places orders through the CEX.IO private REST API. The request
+// price of every placed order is kept as long as the client orders, to
+// convert the market buys the exchange reports in the quote currency.
+type Cexio struct {
+	config    CexioConfig
+	client    *http.Client
+	mu        *sync.Mutex
+	lastNonce int64
+	prices    map[string]requestPrice
+}
+
+type requestPrice struct {
+	price  float64
+	placed time.Time
+}
+
+// NewCexio creates a CEX.IO executor.
+func NewCexio(config CexioConfig) *Cexio {
+	if config.BaseURL == "" {
+		config.BaseURL = cexioBaseURL
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+
+	cx := &Cexio{}
+	cx.config = config
+	cx.client = &http.Client{Timeout: config.Timeout}
+	cx.mu = &sync.Mutex{}
+	cx.prices = make(map[string]requestPrice)
+	return cx
+}
+
+// cexioFloat decodes the numbers CEX.IO sends either as strings or numbers.
+type cexioFloat float64
+
+func (cf *cexioFloat) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "" || text == "null" {
+		*cf = 0
+		return nil
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return err
+	}
+	*cf = cexioFloat(value)
+	return nil
+}
+
+type cexioOrder struct {
+	Error   string      `json:"error"`
+	ID      json.Number `json:"id"`
+	Time    json.Number `json:"time"`
+	Type    string      `json:"type"`
+	Amount  cexioFloat  `json:"amount"`
+	Price   cexioFloat  `json:"price"`
+	Pending cexioFloat  `json:"pending"`
+	Remains cexioFloat  `json:"remains"`
+	Status  string      `json:"status"`
+	Symbol1 string      `json:"symbol1"`
+	Symbol2 string      `json:"symbol2"`
+	// Market orders are filled on placement
+	Complete bool `json:"complete"`
+}
+
+// cexioTotals are the traded totals CEX.IO reports under keys named after
+// the currencies of the pair: "ta:USD" and "tta:USD" are the quote amounts
+// traded as maker and taker, "a:BTC:cds" the base amount traded.
+type cexioTotals map[string]json.RawMessage
+
+func (totals cexioTotals) get(key string) float64 {
+	var value cexioFloat
+	if raw, ok := totals[key]; ok && json.Unmarshal(raw, &value) == nil {
+		return float64(value)
+	}
+	return 0
+}
+
+// decodeOrder decodes an order together with its traded totals
+func decodeOrder(raw json.RawMessage, order interface{}) (cexioTotals, error) {
+	if err := json.Unmarshal(raw, order); err != nil {
+		return nil, err
+	}
+	totals := cexioTotals{}
+	if err := json.Unmarshal(raw, &totals); err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+// normalize converts an order as CEX.IO reports it to base units. Market
+// orders have no price, theirs is the average of the traded totals, or the
+// request price when nothing was traded yet. Market buys are in the quote
+// currency and are converted with that price.
+func (cx *Cexio) normalize(order *Order, totals cexioTotals) error {
+	if order.Type != Market {
+		return nil
+	}
+
+	base, quote, err := SplitPair(order.Pair)
+	if err != nil {
+		return err
+	}
+
+	quoteTraded := totals.get("ta:"+quote) + totals.get("tta:"+quote)
+	baseTraded := totals.get("a:" + base + ":cds")
+
+	if quoteTraded > 0 && baseTraded > 0 {
+		order.Price = quoteTraded / baseTraded
+	} else {
+		cx.mu.Lock()
+		order.Price = cx.prices[order.ID].price
+		cx.mu.Unlock()
+	}
+
+	if order.Side != Buy {
+		return nil
+	}
+
+	if order.Price <= 0 {
+		return fmt.Errorf("cexio market buy %s: no price to convert %f %s", order.ID, order.Amount, quote)
+	}
+
+	order.Amount = order.Amount / order.Price
+	if baseTraded > 0 {
+		order.Filled = baseTraded
+	} else {
+		order.Filled = order.Filled / order.Price
+	}
+
+	return nil
+}
+
+// nonce must grow on every private call
+func (cx *Cexio) nonce() string {
+	cx.mu.Lock()
+	defer cx.mu.Unlock()
+
+	nonce := time.Now().UnixNano() / int64(time.Millisecond)
+	if nonce <= cx.lastNonce {
+		nonce = cx.lastNonce + 1
+	}
+	cx.lastNonce = nonce
+	return strconv.FormatInt(nonce, 10)
+}
+
+func (cx *Cexio) signature(nonce string) string {
+	mac := hmac.New(sha256.New, []byte(cx.config.Secret))
+	mac.Write([]byte(nonce + cx.config.UserID + cx.config.Key))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (cx *Cexio) post(path string, params url.Values, response interface{}) error {
+	nonce := cx.nonce()
+	params.Set("key", cx.config.Key)
+	params.Set("nonce", nonce)
+	params.Set("signature", cx.signature(nonce))
+
+	resp, err := cx.client.PostForm(cx.config.BaseURL+path, params)
+	if err != nil {
+		return fmt.Errorf("cexio %s: %s", path, err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cexio %s: %s", path, err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cexio %s: %s %s", path, resp.Status, string(body))
+	}
+
+	if err := json.Unmarshal(body, response); err != nil {
+		// errors come back as {"error": "..."} whatever the call
+		apiError := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(body, &apiError) == nil && apiError.Error != "" {
+			return fmt.Errorf("cexio %s: %s", path, apiError.Error)
+		}
+		return fmt.Errorf("cexio %s: %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// Balances returns the available balance of every currency, empty when
+// CEX.IO can not tell them.
+func (cx *Cexio) Balances() map[string]float64 {
+	balances := make(map[string]float64)
+
+	// Currencies come along timestamp and username
+	response := map[string]json.RawMessage{}
+	if err := cx.post("/balance/", url.Values{}, &response); err != nil {
+		log.Error(err.Error())
+		return balances
+	}
+	if apiError, ok := response["error"]; ok {
+		log.Error("cexio /balance/: ", string(apiError))
+		return balances
+	}
+
+	for currency, raw := range response {
+		balance := struct {
+			Available cexioFloat `json:"available"`
+		}{}
+		if err := json.Unmarshal(raw, &balance); err != nil {
+			continue
+		}
+		balances[strings.ToUpper(currency)] = float64(balance.Available)
+	}
+
+	return balances
+}
+
+// Place sends a new order. CEX.IO takes market buy amounts in the quote
+// currency, the request amount is converted with the request price.
+func (cx *Cexio) Place(request OrderRequest) (Order, error) {
+	base, quote, err := SplitPair(request.Pair)
+	if err != nil {
+		return Order{}, err
+	}
+
+	amount := request.Amount
+
+	params := url.Values{}
+	params.Set("type", string(request.Side))
+
+	if request.Type == Market {
+		params.Set("order_type", string(Market))
+		if request.Side == Buy {
+			amount = request.Amount * request.Price
+		}
+	} else {
+		params.Set("price", strconv.FormatFloat(request.Price, 'f', -1, 64))
+	}
+	params.Set("amount", strconv.FormatFloat(amount, 'f', -1, 64))
+
+	response := cexioOrder{}
+	if err := cx.post(fmt.Sprintf("/place_order/%s/%s/", base, quote), params, &response); err != nil {
+		return Order{}, err
+	}
+
+	if response.Error != "" {
+		return Order{}, fmt.Errorf("cexio place_order: %s", response.Error)
+	}
+
+	cx.SetRequestPrice(response.ID.String(), request.Price, time.Now())
+
+	order := Order{
+		ID:      response.ID.String(),
+		Pair:    request.Pair,
+		Side:    request.Side,
+		Type:    request.Type,
+		Amount:  request.Amount,
+		Price:   request.Price,
+		Status:  StatusNew,
+		Created: time.Now(),
+	}
+
+	if response.Complete {
+		order.Filled = order.Amount
+		order.Status = StatusFilled
+	} else if filled := float64(response.Amount - response.Pending); filled > 0 && request.Type == Limit {
+		order.Filled = filled
+		order.Status = StatusPartiallyFilled
+	}
+
+	return order, nil
+}
+
+// SetRequestPrice keeps the request price of an order, forgetting the ones
+// older than the client orders.
+func (cx *Cexio) SetRequestPrice(ID string, price float64, placed time.Time) {
+	cx.mu.Lock()
+	defer cx.mu.Unlock()
+
+	for oldID, old := range cx.prices {
+		if time.Since(old.placed) > clientOrdersRetention {
+			delete(cx.prices, oldID)
+		}
+	}
+
+	if time.Since(placed) <= clientOrdersRetention {
+		cx.prices[ID] = requestPrice{price: price, placed: placed}
+	}
+}
+
+// Order returns the current state of an order.
+func (cx *Cexio) Order(ID string) (Order, error) {
+	params := url.Values{}
+	params.Set("id", ID)
+
+	var raw json.RawMessage
+	if err := cx.post("/get_order/", params, &raw); err != nil {
+		return Order{}, err
+	}
+
+	response := cexioOrder{}
+	totals, err := decodeOrder(raw, &response)
+	if err != nil {
+		return Order{}, fmt.Errorf("cexio get_order: %s", err.Error())
+	}
+
+	if response.Error != "" {
+		return Order{}, fmt.Errorf("cexio get_order: %s", response.Error)
+	}
+
+	order := Order{
+		ID:     response.ID.String(),
+		Pair:   response.Symbol1 + response.Symbol2,
+		Side:   Side(response.Type),
+		Amount: float64(response.Amount),
+		Price:  float64(response.Price),
+		Filled: float64(response.Amount - response.Remains),
+	}
+
+	if order.Price == 0 {
+		order.Type = Market
+	} else {
+		order.Type = Limit
+	}
+
+	if ms, err := response.Time.Int64(); err == nil {
+		order.Created = time.Unix(0, ms*int64(time.Millisecond))
+	}
+
+	order.Status = cexioStatus(response.Status, order.Filled)
+
+	if err := cx.normalize(&order, totals); err != nil {
+		return Order{}, err
+	}
+
+	return order, nil
+}
+
+func cexioStatus(status string, filled float64) OrderStatus {
+	switch status {
+	case "d":
+		return StatusFilled
+	case "c", "cd":
+		return StatusCancelled
+	}
+	if filled > 0 {
+		return StatusPartiallyFilled
+	}
+	return StatusNew
+}
+
+// cexioArchivedOrder is an order of the history, dated with a timestamp
+// string instead of milliseconds.
+type cexioArchivedOrder struct {
+	ID      json.Number `json:"id"`
+	Type    string      `json:"type"`
+	Time    string      `json:"time"`
+	Amount  cexioFloat  `json:"amount"`
+	Price   cexioFloat  `json:"price"`
+	Remains cexioFloat  `json:"remains"`
+	Status  string      `json:"status"`
+}
+
+// OpenOrders returns the open orders of pair.
+func (cx *Cexio) OpenOrders(pair string) ([]Order, error) {
+	base, quote, err := SplitPair(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	var response []json.RawMessage
+	if err := cx.post(fmt.Sprintf("/open_orders/%s/%s/", base, quote), url.Values{}, &response); err != nil {
+		return nil, err
+	}
+
+	orders := make([]Order, 0, len(response))
+	for _, raw := range response {
+		open := cexioOrder{}
+		totals, err := decodeOrder(raw, &open)
+		if err != nil {
+			return nil, fmt.Errorf("cexio open_orders: %s", err.Error())
+		}
+
+		order := Order{
+			ID:     open.ID.String(),
+			Pair:   pair,
+			Side:   Side(open.Type),
+			Type:   Limit,
+			Amount: float64(open.Amount),
+			Price:  float64(open.Price),
+			Filled: float64(open.Amount - open.Pending),
+		}
+		if order.Price == 0 {
+			order.Type = Market
+		}
+		order.Status = cexioStatus("a", order.Filled)
+		if ms, err := open.Time.Int64(); err == nil {
+			order.Created = time.Unix(0, ms*int64(time.Millisecond))
+		}
+		if err := cx.normalize(&order, totals); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, nil
+}
+
+// History returns the orders of pair archived since a date.
+func (cx *Cexio) History(pair string, since time.Time) ([]Order, error) {
+	base, quote, err := SplitPair(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("dateFrom", strconv.FormatInt(since.Unix(), 10))
+
+	var response []json.RawMessage
+	if err := cx.post(fmt.Sprintf("/archived_orders/%s/%s/", base, quote), params, &response); err != nil {
+		return nil, err
+	}
+
+	orders := make([]Order, 0, len(response))
+	for _, raw := range response {
+		archived := cexioArchivedOrder{}
+		totals, err := decodeOrder(raw, &archived)
+		if err != nil {
+			return nil, fmt.Errorf("cexio archived_orders: %s", err.Error())
+		}
+
+		order := Order{
+			ID:     archived.ID.String(),
+			Pair:   pair,
+			Side:   Side(archived.Type),
+			Amount: float64(archived.Amount),
+			Price:  float64(archived.Price),
+			Filled: float64(archived.Amount - archived.Remains),
+		}
+		if order.Price == 0 {
+			order.Type = Market
+		} else {
+			order.Type = Limit
+		}
+		order.Status = cexioStatus(archived.Status, order.Filled)
+		if created, err := time.Parse(time.RFC3339, archived.Time); err == nil {
+			order.Created = created
+		}
+		if err := cx.normalize(&order, totals); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, nil
+}
+
+// Cancel cancels an open order.
+func (cx *Cexio) Cancel(ID string) error {
+	params := url.Values{}
+	params.Set("id", ID)
+
+	var response interface{}
+	if err := cx.post("/cancel_order/", params, &response); err != nil {
+		return err
+	}
+
+	switch value := response.(type) {
+	case bool:
+		if value {
+			return nil
+		}
+	case map[string]interface{}:
+		if apiError, ok := value["error"]; ok {
+			return fmt.Errorf("cexio cancel_order %s: %v", ID, apiError)
+		}
+	}
+
+	return fmt.Errorf("cexio cancel_order %s: %v", ID, response)
+}
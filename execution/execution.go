@@ -0,0 +1,309 @@
+// Package execution places and tracks orders for the trade FSM. A backend
+// implements Executor for one exchange, Track follows an order until the
+// exchange reports it filled or cancelled.
+package execution
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/kredis"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Side of an order
+type Side string
+
+const (
+	Buy  Side = "buy"
+	Sell Side = "sell"
+)
+
+// OrderType is market or limit
+type OrderType string
+
+const (
+	Market OrderType = "market"
+	Limit  OrderType = "limit"
+)
+
+// OrderStatus as reported by the exchange
+type OrderStatus string
+
+const (
+	StatusNew             OrderStatus = "new"
+	StatusPartiallyFilled OrderStatus = "partially_filled"
+	StatusFilled          OrderStatus = "filled"
+	StatusCancelled       OrderStatus = "cancelled"
+	StatusRejected        OrderStatus = "rejected"
+)
+
+// Final is true when the exchange will not fill the order any further.
+func (status OrderStatus) Final() bool {
+	return status == StatusFilled || status == StatusCancelled || status == StatusRejected
+}
+
+// OrderRequest describes the order to place. Amount is always in the base
+// currency of the pair, Price is only used by limit orders. ClientID, when
+// set, identifies the request across retries, see Submitter.
+type OrderRequest struct {
+	Pair     string
+	Side     Side
+	Type     OrderType
+	Amount   float64
+	Price    float64
+	ClientID string
+}
+
+// ClientOrderID derives the client ID of the order placed by a transition
+// of pair. sequence counts the orders of the pair, so the same order gets
+// the same ID when it is retried or resumed after a restart.
+func ClientOrderID(pair, transition string, sequence int) string {
+	return fmt.Sprintf("%s-%s-%d", pair, transition, sequence)
+}
+
+// Order is the exchange view of a placed order. Fee is in the quote
+// currency, zero when the exchange does not report it.
+type Order struct {
+	ID       string
+	ClientID string
+	Pair     string
+	Side     Side
+	Type     OrderType
+	Amount   float64
+	Price    float64
+	Filled   float64
+	Fee      float64
+	Status   OrderStatus
+	Created  time.Time
+}
+
+// Executor places orders on an exchange.
+type Executor interface {
+	Place(request OrderRequest) (Order, error)
+	Order(ID string) (Order, error)
+	Cancel(ID string) error
+}
+
+// Balancer is implemented by the executors that can report balances.
+type Balancer interface {
+	Balances() map[string]float64
+}
+
+// Reconciler is implemented by the executors that can list the open orders
+// and the order history of a pair.
+type Reconciler interface {
+	OpenOrders(pair string) ([]Order, error)
+	History(pair string, since time.Time) ([]Order, error)
+}
+
+// Repricer is implemented by the executors that need the request price of
+// an order to report it, the submitter gives it back after a restart.
+type Repricer interface {
+	SetRequestPrice(ID string, price float64, placed time.Time)
+}
+
+// -------------------------
+// Configuration
+// -------------------------
+
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultTimeout      = 5 * time.Minute
+)
+
+// Config is the execution configuration of a pair.
+type Config struct {
+	Backend      string
+	OrderType    OrderType
+	Amount       float64
+	LimitOffset  float64
+	PollInterval time.Duration
+	Timeout      time.Duration
+}
+
+// LoadConfig reads the execution configuration of a pair. Settings under
+// execution.pairs.<PAIR> override the execution defaults. It returns false
+// when execution is not configured.
+//
+//	[execution]
+//	backend = "cexio"     # or "paper", see LoadPaperConfig
+//	order_type = "limit"
+//	limit_offset = 0.1    # percent away from the last price
+//	poll_interval = 5     # seconds
+//	timeout = 300         # seconds, unfilled orders are cancelled
+//
+//	[execution.pairs.BTCUSD]
+//	amount = 0.01
+func LoadConfig(pair string) (Config, bool) {
+	if !viper.IsSet("execution") {
+		return Config{}, false
+	}
+
+	config := Config{}
+	config.Backend = configString(pair, "backend")
+	config.OrderType = OrderType(configString(pair, "order_type"))
+	config.Amount = configFloat(pair, "amount")
+	config.LimitOffset = configFloat(pair, "limit_offset")
+	config.PollInterval = time.Duration(configFloat(pair, "poll_interval") * float64(time.Second))
+	config.Timeout = time.Duration(configFloat(pair, "timeout") * float64(time.Second))
+
+	if config.Backend == "" {
+		return Config{}, false
+	}
+
+	if config.OrderType == "" {
+		config.OrderType = Market
+	}
+
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	return config, true
+}
+
+func configKey(pair, name string) string {
+	pairKey := fmt.Sprintf("execution.pairs.%s.%s", strings.ToLower(pair), name)
+	if viper.IsSet(pairKey) {
+		return pairKey
+	}
+	return fmt.Sprintf("execution.%s", name)
+}
+
+func configString(pair, name string) string {
+	return viper.GetString(configKey(pair, name))
+}
+
+func configFloat(pair, name string) float64 {
+	return viper.GetFloat64(configKey(pair, name))
+}
+
+var (
+	papersMu = &sync.Mutex{}
+	papers   = make(map[string]*Paper)
+)
+
+// NewExecutor creates the executor selected by config.Backend for the
+// exchange. All the pairs of an exchange share one paper executor, so they
+// trade from the same virtual balances.
+func NewExecutor(exchange string, config Config, kr *kredis.Kredis) (Executor, error) {
+	return NewAccountExecutor(exchange, "", config, kr)
+}
+
+// NewAccountExecutor is NewExecutor with the paper balances of account,
+// for the processes other than the trader.
+func NewAccountExecutor(exchange, account string, config Config, kr *kredis.Kredis) (Executor, error) {
+	switch config.Backend {
+	case "paper":
+		papersMu.Lock()
+		defer papersMu.Unlock()
+
+		paperConfig := LoadPaperConfig(exchange)
+		paperConfig.Account = account
+
+		name := exchange + "/" + account
+		paper, ok := papers[name]
+		if !ok {
+			paper = NewPaper(paperConfig, kr)
+			papers[name] = paper
+		}
+		return paper, nil
+
+	case "cexio":
+		security := fmt.Sprintf("security.%s", strings.ToLower(exchange))
+		cexioConfig := CexioConfig{}
+		cexioConfig.Key = viper.GetString(security + ".key")
+		cexioConfig.Secret = viper.GetString(security + ".secret")
+		cexioConfig.UserID = viper.GetString(security + ".user_id")
+
+		if cexioConfig.Key == "" || cexioConfig.Secret == "" || cexioConfig.UserID == "" {
+			return nil, fmt.Errorf("cexio execution needs %s.key, secret and user_id", security)
+		}
+		return NewCexio(cexioConfig), nil
+	}
+
+	return nil, fmt.Errorf("unknown execution backend: %s", config.Backend)
+}
+
+// -------------------------
+// Orders
+// -------------------------
+
+// NewRequest builds the order request for a signal on pair at the last
+// known price.
+func NewRequest(pair string, side Side, config Config, lastPrice float64) OrderRequest {
+	request := OrderRequest{Pair: pair, Side: side, Type: config.OrderType, Amount: config.Amount}
+
+	if config.OrderType == Limit {
+		offset := lastPrice * config.LimitOffset / 100
+		if side == Buy {
+			request.Price = lastPrice + offset
+		} else {
+			request.Price = lastPrice - offset
+		}
+	} else {
+		request.Price = lastPrice
+	}
+
+	return request
+}
+
+// Track polls the order until it is final. Orders that are still open when
+// the timeout expires are cancelled, a cancelled order may be partially
+// filled. Track gives up with an error when the exchange does not confirm
+// the cancel within another timeout.
+func Track(executor Executor, order Order, config Config, clk clock.Clock) (Order, error) {
+
+	deadline := clk.Now().Add(config.Timeout)
+	cancelled := false
+
+	for !order.Status.Final() {
+
+		if !clk.Now().Before(deadline) {
+			if cancelled {
+				return order, fmt.Errorf("order %s for %s not confirmed cancelled", order.ID, order.Pair)
+			}
+			log.Warnf("Order %s for %s timed out, cancelling", order.ID, order.Pair)
+			if err := executor.Cancel(order.ID); err != nil {
+				log.Error("Cancelling order: ", err.Error())
+			}
+			cancelled = true
+			deadline = clk.Now().Add(config.Timeout)
+		}
+
+		clk.Sleep(config.PollInterval)
+
+		update, err := executor.Order(order.ID)
+		if err != nil {
+			log.Error("Tracking order: ", err.Error())
+			continue
+		}
+
+		if update.Filled != order.Filled || update.Status != order.Status {
+			log.Infof("Order %s for %s: %s, filled %f of %f", update.ID, update.Pair, update.Status, update.Filled, update.Amount)
+		}
+		order = update
+	}
+
+	return order, nil
+}
+
+// SplitPair splits a pair such as ETHBTC in its base and quote currencies.
+func SplitPair(pair string) (base, quote string, err error) {
+	pair = strings.ToUpper(pair)
+	for _, quote := range []string{"USDT", "USD", "EUR", "GBP", "RUB", "BTC", "ETH"} {
+		if strings.HasSuffix(pair, quote) && len(pair) > len(quote) {
+			return strings.TrimSuffix(pair, quote), quote, nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown quote currency in pair: %s", pair)
+}
@@ -0,0 +1,619 @@
+package execution_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/kredis"
+)
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	os.Exit(m.Run())
+}
+
+func TestSplitPair(t *testing.T) {
+
+	pairs := map[string][2]string{
+		"BTCUSD":  {"BTC", "USD"},
+		"ETHBTC":  {"ETH", "BTC"},
+		"DASHBTC": {"DASH", "BTC"},
+		"BCHEUR":  {"BCH", "EUR"},
+	}
+
+	for pair, want := range pairs {
+		base, quote, err := execution.SplitPair(pair)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		if base != want[0] || quote != want[1] {
+			t.Errorf("Bad split for %s: %s %s", pair, base, quote)
+		}
+	}
+
+	if _, _, err := execution.SplitPair("BTC"); err == nil {
+		t.Error("Expected error for pair without base currency")
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+
+	config := execution.Config{OrderType: execution.Limit, Amount: 2, LimitOffset: 1}
+
+	buy := execution.NewRequest("BTCUSD", execution.Buy, config, 1000)
+	if buy.Price != 1010 || buy.Amount != 2 {
+		t.Error("Bad limit buy request: ", buy)
+	}
+
+	sell := execution.NewRequest("BTCUSD", execution.Sell, config, 1000)
+	if sell.Price != 990 {
+		t.Error("Bad limit sell request: ", sell)
+	}
+}
+
+// cexioServer is a minimal CEX.IO private API. Orders fill after the given
+// count of get_order calls. With dropPlace orders are placed but the answer
+// is lost, archived orders are returned by the history after ours. With
+// market, ours is archived as a market buy of the quote amount placed,
+// filled at 4100, and get_order reports it open without price.
+type cexioServer struct {
+	t         *testing.T
+	mu        sync.Mutex
+	key       string
+	secret    string
+	userID    string
+	polls     int
+	fillAfter int
+	cancelled bool
+	placed    map[string]string
+	places    int
+	dropPlace bool
+	market    bool
+	archived  []string
+}
+
+func (cs *cexioServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		cs.t.Error(err.Error())
+	}
+
+	mac := hmac.New(sha256.New, []byte(cs.secret))
+	mac.Write([]byte(r.Form.Get("nonce") + cs.userID + cs.key))
+	if r.Form.Get("signature") != strings.ToUpper(hex.EncodeToString(mac.Sum(nil))) {
+		fmt.Fprint(w, `{"error":"Invalid signature"}`)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/place_order/"):
+		cs.placed = map[string]string{"path": r.URL.Path}
+		for key := range r.Form {
+			cs.placed[key] = r.Form.Get(key)
+		}
+		cs.places++
+		if cs.dropPlace {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, `{"id":"42","time":1506816000000,"type":"%s","price":"%s","amount":"%s","pending":"%s"}`,
+			r.Form.Get("type"), r.Form.Get("price"), r.Form.Get("amount"), r.Form.Get("amount"))
+
+	case r.URL.Path == "/get_order/" && cs.market:
+		fmt.Fprintf(w, `{"id":"42","time":1506816000000,"type":"buy","symbol1":"BTC","symbol2":"USD","amount":"%s","price":"0","remains":"%s","status":"a"}`,
+			cs.placed["amount"], cs.placed["amount"])
+
+	case r.URL.Path == "/get_order/":
+		cs.polls++
+		status, remains := "a", "0.5"
+		if cs.polls >= cs.fillAfter {
+			status, remains = "d", "0"
+		}
+		if cs.cancelled {
+			status = "cd"
+		}
+		fmt.Fprintf(w, `{"id":"42","time":1506816000000,"type":"buy","symbol1":"BTC","symbol2":"USD","amount":"1","price":"4000","remains":"%s","status":"%s"}`,
+			remains, status)
+
+	case r.URL.Path == "/cancel_order/":
+		cs.cancelled = true
+		fmt.Fprint(w, `true`)
+
+	case r.URL.Path == "/balance/":
+		fmt.Fprint(w, `{"timestamp":"1513177918","username":"up123","BTC":{"available":"0.5","orders":"0.1"},"USD":{"available":"1000.25","orders":"0"}}`)
+
+	case strings.HasPrefix(r.URL.Path, "/open_orders/"):
+		fmt.Fprint(w, `[]`)
+
+	case strings.HasPrefix(r.URL.Path, "/archived_orders/"):
+		archived := []string{}
+		if cs.placed != nil && cs.market {
+			spent, _ := strconv.ParseFloat(cs.placed["amount"], 64)
+			archived = append(archived, fmt.Sprintf(`{"id":"42","type":"buy","time":"%s","amount":"%s","price":"0","remains":"0","status":"d","ta:USD":"%s","a:BTC:cds":"%.8f"}`,
+				time.Now().UTC().Format(time.RFC3339), cs.placed["amount"], cs.placed["amount"], spent/4100))
+		} else if cs.placed != nil {
+			archived = append(archived, fmt.Sprintf(`{"id":"42","type":"buy","time":"%s","amount":"1","price":"4000","remains":"0","status":"d"}`,
+				time.Now().UTC().Format(time.RFC3339)))
+		}
+		archived = append(archived, cs.archived...)
+		fmt.Fprintf(w, "[%s]", strings.Join(archived, ","))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newCexioServer(t *testing.T, fillAfter int) (*cexioServer, *httptest.Server, *execution.Cexio) {
+	cs := &cexioServer{t: t, key: "KEY", secret: "SECRET", userID: "up123", fillAfter: fillAfter}
+	server := httptest.NewServer(cs)
+	cx := execution.NewCexio(execution.CexioConfig{Key: cs.key, Secret: cs.secret, UserID: cs.userID, BaseURL: server.URL})
+	return cs, server, cx
+}
+
+func TestCexioPlaceAndTrack(t *testing.T) {
+
+	cs, server, cx := newCexioServer(t, 3)
+	defer server.Close()
+
+	config := execution.Config{OrderType: execution.Limit, Amount: 1, PollInterval: time.Second, Timeout: time.Minute}
+	request := execution.NewRequest("BTCUSD", execution.Buy, config, 4000)
+
+	order, err := cx.Place(request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if order.ID != "42" || order.Status != execution.StatusNew {
+		t.Error("Bad placed order: ", order)
+	}
+
+	if cs.placed["path"] != "/place_order/BTC/USD/" || cs.placed["type"] != "buy" || cs.placed["amount"] != "1" {
+		t.Error("Bad place_order request: ", cs.placed)
+	}
+
+	clk := clock.NewSimulated(time.Now())
+	defer clk.Drive()()
+
+	order, err = execution.Track(cx, order, config, clk)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if order.Status != execution.StatusFilled || order.Filled != 1 {
+		t.Error("Order not filled: ", order)
+	}
+
+	if cs.polls != 3 {
+		t.Error("Bad count of polls: ", cs.polls)
+	}
+}
+
+func TestCexioMarketBuyAmount(t *testing.T) {
+
+	cs, server, cx := newCexioServer(t, 1)
+	defer server.Close()
+
+	config := execution.Config{OrderType: execution.Market, Amount: 0.5}
+
+	if _, err := cx.Place(execution.NewRequest("BTCUSD", execution.Buy, config, 4000)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if cs.placed["order_type"] != "market" || cs.placed["amount"] != "2000" {
+		t.Error("Market buy amount should be in quote currency: ", cs.placed)
+	}
+}
+
+func TestTrackTimeoutCancels(t *testing.T) {
+
+	cs, server, cx := newCexioServer(t, 1000)
+	defer server.Close()
+
+	config := execution.Config{OrderType: execution.Limit, Amount: 1, PollInterval: 10 * time.Second, Timeout: time.Minute}
+
+	order, err := cx.Place(execution.NewRequest("BTCUSD", execution.Buy, config, 4000))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	clk := clock.NewSimulated(time.Now())
+	defer clk.Drive()()
+
+	order, err = execution.Track(cx, order, config, clk)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !cs.cancelled {
+		t.Error("Timed out order was not cancelled")
+	}
+
+	if order.Status != execution.StatusCancelled || order.Filled != 0.5 {
+		t.Error("Expected partially filled cancelled order: ", order)
+	}
+}
+
+func TestCexioError(t *testing.T) {
+
+	_, server, _ := newCexioServer(t, 1)
+	defer server.Close()
+
+	cx := execution.NewCexio(execution.CexioConfig{Key: "KEY", Secret: "BAD", UserID: "up123", BaseURL: server.URL})
+
+	if _, err := cx.Place(execution.OrderRequest{Pair: "BTCUSD", Side: execution.Sell, Type: execution.Limit, Amount: 1, Price: 1}); err == nil {
+		t.Error("Expected signature error")
+	}
+}
+
+func TestCexioBalances(t *testing.T) {
+
+	_, server, cx := newCexioServer(t, 1)
+	defer server.Close()
+
+	balances := cx.Balances()
+	if len(balances) != 2 || balances["BTC"] != 0.5 || balances["USD"] != 1000.25 {
+		t.Error("Bad cexio balances: ", balances)
+	}
+
+	bad := execution.NewCexio(execution.CexioConfig{Key: "KEY", Secret: "BAD", UserID: "up123", BaseURL: server.URL})
+	if balances := bad.Balances(); len(balances) != 0 {
+		t.Error("Balances despite the error: ", balances)
+	}
+}
+
+func newPaper(t *testing.T, balances map[string]float64) (*execution.Paper, *kredis.Kredis, string) {
+	kr := kredis.NewKredis(1000)
+	kr.Start()
+
+	exchange := fmt.Sprintf("PAPERTEST%d", time.Now().UnixNano())
+	config := execution.PaperConfig{Exchange: exchange, Balances: balances, Slippage: 1, Fee: 0.5}
+
+	return execution.NewPaper(config, kr), kr, exchange
+}
+
+func TestPaperMarketOrders(t *testing.T) {
+
+	paper, kr, exchange := newPaper(t, map[string]float64{"USD": 1000})
+
+	if err := kr.Update(exchange, "BTCUSD", "100"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	order, err := paper.Place(execution.OrderRequest{Pair: "BTCUSD", Side: execution.Buy, Type: execution.Market, Amount: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// 2 * 101 plus 0.5% fee
+	if order.Status != execution.StatusFilled || order.Price != 101 {
+		t.Error("Bad paper buy: ", order)
+	}
+
+	balances := paper.Balances()
+	if math.Abs(balances["USD"]-(1000-202-1.01)) > 1e-9 || balances["BTC"] != 2 {
+		t.Error("Bad balances after buy: ", balances)
+	}
+
+	if _, err := paper.Place(execution.OrderRequest{Pair: "BTCUSD", Side: execution.Sell, Type: execution.Market, Amount: 3}); err == nil {
+		t.Error("Expected insufficient balance error")
+	}
+
+	// ---------------------------
+	// Balances survive a restart
+	// ---------------------------
+	restored := execution.NewPaper(execution.PaperConfig{Exchange: exchange, Balances: map[string]float64{"USD": 1}}, kr)
+
+	if restored.Balances()["BTC"] != 2 {
+		t.Error("Balances not restored: ", restored.Balances())
+	}
+
+	trades, err := kr.GetRange(fmt.Sprintf("%s_PAPER_TRADES", exchange), 10)
+	if err != nil || len(trades) != 1 {
+		t.Error("Bad paper trade history: ", trades, err)
+	}
+
+	// Another account has its own balances
+	other := execution.NewPaper(execution.PaperConfig{Exchange: exchange, Account: "rebalancer", Balances: map[string]float64{"USD": 1}}, kr)
+	if balances := other.Balances(); balances["BTC"] != 0 || balances["USD"] != 1 {
+		t.Error("Account shares the balances: ", balances)
+	}
+	if restored := execution.NewPaper(execution.PaperConfig{Exchange: exchange}, kr); restored.Balances()["BTC"] != 2 {
+		t.Error("Account overwrote the balances: ", restored.Balances())
+	}
+}
+
+func TestPaperLimitOrder(t *testing.T) {
+
+	paper, kr, exchange := newPaper(t, map[string]float64{"BTC": 1})
+	paper.SetClock(clock.NewSimulated(time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)))
+
+	if err := kr.Update(exchange, "BTCUSD", "100"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	order, err := paper.Place(execution.OrderRequest{Pair: "BTCUSD", Side: execution.Sell, Type: execution.Limit, Amount: 1, Price: 110})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if order.Status != execution.StatusNew {
+		t.Error("Limit sell above the price should not fill: ", order)
+	}
+
+	if err := kr.Update(exchange, "BTCUSD", "120"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The open order survives a restart
+	restarted := execution.NewPaper(execution.PaperConfig{Exchange: exchange, Slippage: 1, Fee: 0.5}, kr)
+	if open, err := restarted.OpenOrders("BTCUSD"); err != nil || len(open) != 1 || open[0].ID != order.ID {
+		t.Fatal("Open order not restored: ", open, err)
+	}
+
+	order, err = restarted.Order(order.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if order.Status != execution.StatusFilled || order.Price != 118.8 {
+		t.Error("Limit sell should fill once the price crosses: ", order)
+	}
+
+	if err := restarted.Cancel(order.ID); err == nil {
+		t.Error("Filled order should not be cancelled")
+	}
+}
+
+func TestSubmitterDedupe(t *testing.T) {
+
+	paper, kr, exchange := newPaper(t, map[string]float64{"USD": 1000})
+
+	if err := kr.Update(exchange, "BTCUSD", "100"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	sb := execution.NewSubmitter(exchange, "BTCUSD", paper, kr)
+
+	request := execution.OrderRequest{Pair: "BTCUSD", Side: execution.Buy, Type: execution.Market, Amount: 1,
+		ClientID: execution.ClientOrderID("BTCUSD", "DoBuy", 1)}
+
+	first, err := sb.Place(request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if first.ClientID != "BTCUSD-DoBuy-1" {
+		t.Error("Bad client ID: ", first.ClientID)
+	}
+
+	second, err := sb.Place(request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if second.ID != first.ID {
+		t.Error("Retried request placed a new order: ", first.ID, second.ID)
+	}
+
+	if btc := paper.Balances()["BTC"]; btc != 1 {
+		t.Error("Order placed more than once: ", btc)
+	}
+
+	// ---------------------------
+	// Client IDs survive a restart
+	// ---------------------------
+	restarted := execution.NewSubmitter(exchange, "BTCUSD", paper, kr)
+
+	third, err := restarted.Place(request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if third.ID != first.ID || paper.Balances()["BTC"] != 1 {
+		t.Error("Retried request placed a new order after a restart: ", third)
+	}
+
+	request.ClientID = execution.ClientOrderID("BTCUSD", "DoBuy", 2)
+	if _, err := restarted.Place(request); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if btc := paper.Balances()["BTC"]; btc != 2 {
+		t.Error("New client ID should place a new order: ", btc)
+	}
+}
+
+func TestSubmitterRecover(t *testing.T) {
+
+	cs, server, cx := newCexioServer(t, 1)
+	defer server.Close()
+
+	kr := kredis.NewKredis(1000)
+	kr.Start()
+
+	sb := execution.NewSubmitter(fmt.Sprintf("CEXTEST%d", rand.Int63()), "BTCUSD", cx, kr)
+
+	// The order reaches the exchange but the answer is lost
+	cs.dropPlace = true
+
+	request := execution.OrderRequest{Pair: "BTCUSD", Side: execution.Buy, Type: execution.Limit, Amount: 1, Price: 4000,
+		ClientID: execution.ClientOrderID("BTCUSD", "DoBuy", 1)}
+
+	order, err := sb.Place(request)
+	if err != nil {
+		t.Fatal("Placed order should be recovered: ", err.Error())
+	}
+
+	if order.ID != "42" || order.Status != execution.StatusFilled {
+		t.Error("Bad recovered order: ", order)
+	}
+
+	if _, err := sb.Place(request); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if cs.places != 1 {
+		t.Error("Recovered order placed again: ", cs.places)
+	}
+}
+
+func TestSubmitterMarketBuy(t *testing.T) {
+
+	cs, server, cx := newCexioServer(t, 1)
+	defer server.Close()
+
+	kr := kredis.NewKredis(1000)
+	kr.Start()
+
+	since := time.Now().Add(-time.Hour)
+	sb := execution.NewSubmitter(fmt.Sprintf("CEXTEST%d", rand.Int63()), "BTCUSD", cx, kr)
+
+	// A market buy reported in the quote currency, whose answer is lost
+	cs.dropPlace = true
+	cs.market = true
+
+	request := execution.OrderRequest{Pair: "BTCUSD", Side: execution.Buy, Type: execution.Market, Amount: 0.5, Price: 4000,
+		ClientID: execution.ClientOrderID("BTCUSD", "DoBuy", 1)}
+
+	order, err := sb.Place(request)
+	if err != nil {
+		t.Fatal("Placed market buy should be recovered: ", err.Error())
+	}
+
+	if order.ID != "42" || math.Abs(order.Filled-2000.0/4100) > 1e-8 || math.Abs(order.Price-4100) > 1e-3 {
+		t.Error("Market buy should be recovered in base units: ", order)
+	}
+
+	mismatches, err := sb.Reconcile(since, map[string]float64{"42": order.Filled})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(mismatches) != 0 {
+		t.Error("Journaled market buy should match the exchange: ", mismatches)
+	}
+}
+
+func TestSubmitterRepriceAfterRestart(t *testing.T) {
+
+	cs, server, cx := newCexioServer(t, 1)
+	defer server.Close()
+
+	kr := kredis.NewKredis(1000)
+	kr.Start()
+
+	exchange := fmt.Sprintf("CEXTEST%d", rand.Int63())
+	sb := execution.NewSubmitter(exchange, "BTCUSD", cx, kr)
+
+	cs.market = true
+
+	request := execution.OrderRequest{Pair: "BTCUSD", Side: execution.Buy, Type: execution.Market, Amount: 0.5, Price: 4000,
+		ClientID: execution.ClientOrderID("BTCUSD", "DoBuy", 1)}
+
+	if _, err := sb.Place(request); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The restarted executor gets the request price from the client orders
+	restarted := execution.NewCexio(execution.CexioConfig{Key: cs.key, Secret: cs.secret, UserID: cs.userID, BaseURL: server.URL})
+	sb = execution.NewSubmitter(exchange, "BTCUSD", restarted, kr)
+
+	order, err := sb.Order("42")
+	if err != nil {
+		t.Fatal("Market buy not reported after a restart: ", err.Error())
+	}
+
+	if order.Price != 4000 || math.Abs(order.Amount-0.5) > 1e-9 || order.Status != execution.StatusNew {
+		t.Error("Market buy should be reported at the request price: ", order)
+	}
+}
+
+func TestSubmitterReconcile(t *testing.T) {
+
+	cs, server, cx := newCexioServer(t, 1)
+	defer server.Close()
+
+	kr := kredis.NewKredis(1000)
+	kr.Start()
+
+	since := time.Now().Add(-time.Hour)
+	sb := execution.NewSubmitter(fmt.Sprintf("CEXTEST%d", rand.Int63()), "BTCUSD", cx, kr)
+
+	request := execution.OrderRequest{Pair: "BTCUSD", Side: execution.Buy, Type: execution.Limit, Amount: 1, Price: 4000,
+		ClientID: "BTCUSD-DoBuy-1"}
+
+	if _, err := sb.Place(request); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A request the exchange never got
+	cs.dropPlace = true
+	request.Amount = 2
+	request.ClientID = "BTCUSD-DoBuy-2"
+
+	if _, err := sb.Place(request); err == nil {
+		t.Error("Lost order should fail")
+	}
+
+	// A trade placed by hand
+	cs.archived = []string{fmt.Sprintf(`{"id":"43","type":"sell","time":"%s","amount":"3","price":"4000","remains":"0","status":"d"}`,
+		time.Now().UTC().Format(time.RFC3339))}
+
+	mismatches, err := sb.Reconcile(since, map[string]float64{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	kinds := make(map[string]execution.Mismatch)
+	for _, mismatch := range mismatches {
+		kinds[mismatch.Kind] = mismatch
+	}
+
+	if len(mismatches) != 3 {
+		t.Error("Bad mismatches: ", mismatches)
+	}
+
+	if lost := kinds[execution.MismatchLostOrder]; lost.ClientID != "BTCUSD-DoBuy-2" {
+		t.Error("Lost order not reported: ", mismatches)
+	}
+
+	if missing := kinds[execution.MismatchMissingFill]; missing.OrderID != "42" || missing.ClientID != "BTCUSD-DoBuy-1" {
+		t.Error("Missing fill not reported: ", mismatches)
+	}
+
+	if unknown := kinds[execution.MismatchUnknownOrder]; unknown.OrderID != "43" {
+		t.Error("Unknown order not reported: ", mismatches)
+	}
+
+	// ---------------------------
+	// Journaled fills
+	// ---------------------------
+	mismatches, err = sb.Reconcile(since, map[string]float64{"42": 0.5, "43": 3})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(mismatches) != 2 || mismatches[1].Kind != execution.MismatchFill || mismatches[1].Actual != 1 {
+		t.Error("Fill mismatch not reported: ", mismatches)
+	}
+}
@@ -0,0 +1,387 @@
+package execution
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/kredis"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// PaperConfig configures the paper trading simulator of an exchange.
+// Slippage and Fee are percentages, the fee is charged in the quote
+// currency. Account names virtual balances of their own, so processes
+// trading the same exchange do not overwrite each other's.
+type PaperConfig struct {
+	Exchange string
+	Account  string
+	Balances map[string]float64
+	Slippage float64
+	Fee      float64
+}
+
+// PaperTrade is a simulated fill, kept in <EX>_PAPER_TRADES, or
+// <EX>_<ACCOUNT>_PAPER_TRADES.
+type PaperTrade struct {
+	OrderID string    `json:"order_id"`
+	Pair    string    `json:"pair"`
+	Side    Side      `json:"side"`
+	Amount  float64   `json:"amount"`
+	Price   float64   `json:"price"`
+	Fee     float64   `json:"fee"`
+	Date    time.Time `json:"date"`
+}
+
+// Paper fills orders against the live price of the pair and keeps virtual
+// balances. Balances, orders and trades are persisted in redis so a paper
+// run can last for weeks across restarts.
+type Paper struct {
+	config   PaperConfig
+	kr       *kredis.Kredis
+	clock    clock.Clock
+	mu       *sync.Mutex
+	balances map[string]float64
+	orders   map[string]Order
+	count    int
+}
+
+// LoadPaperConfig reads the paper trading configuration of an exchange.
+//
+//	[execution.paper]
+//	slippage = 0.05
+//
+//	[execution.paper.balances]
+//	USD = 1000.0
+//
+//	[execution.paper.fees]
+//	cexio = 0.25
+func LoadPaperConfig(exchange string) PaperConfig {
+	config := PaperConfig{}
+	config.Exchange = strings.ToUpper(exchange)
+	config.Slippage = viper.GetFloat64("execution.paper.slippage")
+	config.Fee = viper.GetFloat64(fmt.Sprintf("execution.paper.fees.%s", strings.ToLower(exchange)))
+
+	config.Balances = make(map[string]float64)
+	for currency, balance := range viper.GetStringMap("execution.paper.balances") {
+		value, err := toFloat(balance)
+		if err != nil {
+			log.Errorf("Bad paper balance for %s: %v", currency, balance)
+			continue
+		}
+		config.Balances[strings.ToUpper(currency)] = value
+	}
+
+	return config
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("not a number: %v", value)
+}
+
+// NewPaper creates a paper executor. Balances and orders saved by a
+// previous run are restored, the configured balances only seed a new run.
+func NewPaper(config PaperConfig, kr *kredis.Kredis) *Paper {
+	pp := &Paper{}
+	pp.config = config
+	pp.kr = kr
+	pp.clock = clock.New()
+	pp.mu = &sync.Mutex{}
+	pp.orders = make(map[string]Order)
+	pp.balances = make(map[string]float64)
+
+	if saved, err := kr.GetString(pp.ordersKey()); err == nil && saved != "" {
+		if err := json.Unmarshal([]byte(saved), &pp.orders); err != nil {
+			log.Error("Restoring paper orders: ", err.Error())
+		}
+	}
+
+	if saved, err := kr.GetString(pp.balancesKey()); err == nil && saved != "" {
+		if err := json.Unmarshal([]byte(saved), &pp.balances); err != nil {
+			log.Error("Restoring paper balances: ", err.Error())
+		} else {
+			log.Infof("Restored paper balances for %s: %v", config.Exchange, pp.balances)
+			return pp
+		}
+	}
+
+	for currency, balance := range config.Balances {
+		pp.balances[currency] = balance
+	}
+	pp.saveBalances()
+
+	log.Infof("Seeded paper balances for %s: %v", config.Exchange, pp.balances)
+
+	return pp
+}
+
+// SetClock sets the clock used to date orders and trades.
+func (pp *Paper) SetClock(clk clock.Clock) {
+	pp.clock = clk
+}
+
+// prefix of the redis keys of the account
+func (pp *Paper) prefix() string {
+	if pp.config.Account == "" {
+		return pp.config.Exchange
+	}
+	return fmt.Sprintf("%s_%s", pp.config.Exchange, strings.ToUpper(pp.config.Account))
+}
+
+func (pp *Paper) balancesKey() string {
+	return fmt.Sprintf("%s_PAPER_BALANCES", pp.prefix())
+}
+
+func (pp *Paper) ordersKey() string {
+	return fmt.Sprintf("%s_PAPER_ORDERS", pp.prefix())
+}
+
+// Balances returns a copy of the virtual balances.
+func (pp *Paper) Balances() map[string]float64 {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	balances := make(map[string]float64)
+	for currency, balance := range pp.balances {
+		balances[currency] = balance
+	}
+	return balances
+}
+
+func (pp *Paper) saveBalances() {
+	balancesJSON, err := json.Marshal(pp.balances)
+	if err != nil {
+		log.Error("Marshaling paper balances: ", err.Error())
+		return
+	}
+	if err := pp.kr.Set(pp.balancesKey(), string(balancesJSON)); err != nil {
+		log.Error("Saving paper balances: ", err.Error())
+	}
+}
+
+// saveOrders persists the orders, forgetting the old final ones
+func (pp *Paper) saveOrders() {
+	for ID, order := range pp.orders {
+		if order.Status.Final() && pp.clock.Now().Sub(order.Created) > clientOrdersRetention {
+			delete(pp.orders, ID)
+		}
+	}
+
+	ordersJSON, err := json.Marshal(pp.orders)
+	if err != nil {
+		log.Error("Marshaling paper orders: ", err.Error())
+		return
+	}
+	if err := pp.kr.Set(pp.ordersKey(), string(ordersJSON)); err != nil {
+		log.Error("Saving paper orders: ", err.Error())
+	}
+}
+
+func (pp *Paper) price(pair string) (float64, error) {
+	key := fmt.Sprintf("PRICE_%s_%s", pp.config.Exchange, pair)
+	priceStr, err := pp.kr.GetString(key)
+	if err != nil {
+		return 0, fmt.Errorf("paper price %s: %s", key, err.Error())
+	}
+	return strconv.ParseFloat(priceStr, 64)
+}
+
+// Place fills market orders at once at the current price plus slippage.
+// Limit orders fill when the price crosses the limit, on placement or on a
+// later Order call.
+func (pp *Paper) Place(request OrderRequest) (Order, error) {
+	if _, _, err := SplitPair(request.Pair); err != nil {
+		return Order{}, err
+	}
+
+	if request.Amount <= 0 {
+		return Order{}, fmt.Errorf("paper order for %s: bad amount %f", request.Pair, request.Amount)
+	}
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.count++
+	order := Order{
+		ID:      fmt.Sprintf("PAPER-%d-%d", pp.clock.Now().UnixNano(), pp.count),
+		Pair:    request.Pair,
+		Side:    request.Side,
+		Type:    request.Type,
+		Amount:  request.Amount,
+		Price:   request.Price,
+		Status:  StatusNew,
+		Created: pp.clock.Now(),
+	}
+
+	order, err := pp.fill(order)
+	if err != nil {
+		return Order{}, err
+	}
+
+	pp.orders[order.ID] = order
+	pp.saveOrders()
+
+	return order, nil
+}
+
+// fill tries to fill an open order at the current price
+func (pp *Paper) fill(order Order) (Order, error) {
+
+	price, err := pp.price(order.Pair)
+	if err != nil {
+		return order, err
+	}
+
+	slippage := price * pp.config.Slippage / 100
+
+	if order.Side == Buy {
+		price += slippage
+		if order.Type == Limit {
+			if price > order.Price {
+				return order, nil
+			}
+		}
+	} else {
+		price -= slippage
+		if order.Type == Limit {
+			if price < order.Price {
+				return order, nil
+			}
+		}
+	}
+
+	base, quote, _ := SplitPair(order.Pair)
+	total := order.Amount * price
+	fee := total * pp.config.Fee / 100
+
+	if order.Side == Buy {
+		if pp.balances[quote] < total+fee {
+			order.Status = StatusRejected
+			return order, fmt.Errorf("paper buy %f %s: insufficient %s balance %f", order.Amount, base, quote, pp.balances[quote])
+		}
+		pp.balances[quote] -= total + fee
+		pp.balances[base] += order.Amount
+	} else {
+		if pp.balances[base] < order.Amount {
+			order.Status = StatusRejected
+			return order, fmt.Errorf("paper sell %f %s: insufficient balance %f", order.Amount, base, pp.balances[base])
+		}
+		pp.balances[base] -= order.Amount
+		pp.balances[quote] += total - fee
+	}
+
+	// Avoid dust from float rounding
+	for _, currency := range []string{base, quote} {
+		if math.Abs(pp.balances[currency]) < 1e-12 {
+			pp.balances[currency] = 0
+		}
+	}
+
+	order.Filled = order.Amount
+	order.Price = price
+	order.Fee = fee
+	order.Status = StatusFilled
+
+	pp.saveBalances()
+
+	trade := PaperTrade{OrderID: order.ID, Pair: order.Pair, Side: order.Side,
+		Amount: order.Amount, Price: price, Fee: fee, Date: pp.clock.Now()}
+
+	tradeJSON, err := json.Marshal(trade)
+	if err != nil {
+		log.Error("Marshaling paper trade: ", err.Error())
+	} else if err := pp.kr.AddString(pp.prefix(), "PAPER_TRADES", tradeJSON); err != nil {
+		log.Error("Saving paper trade: ", err.Error())
+	}
+
+	log.Infof("Paper %s %f %s at %f, fee %f %s", order.Side, order.Amount, base, price, fee, quote)
+
+	return order, nil
+}
+
+// Order returns the order, filling open limit orders the price crossed.
+func (pp *Paper) Order(ID string) (Order, error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	order, ok := pp.orders[ID]
+	if !ok {
+		return Order{}, fmt.Errorf("paper order %s not found", ID)
+	}
+
+	if !order.Status.Final() {
+		var err error
+		if order, err = pp.fill(order); err != nil {
+			log.Error(err.Error())
+		}
+		pp.orders[ID] = order
+		pp.saveOrders()
+	}
+
+	return order, nil
+}
+
+// Cancel cancels an open order.
+func (pp *Paper) Cancel(ID string) error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	order, ok := pp.orders[ID]
+	if !ok {
+		return fmt.Errorf("paper order %s not found", ID)
+	}
+
+	if order.Status.Final() {
+		return fmt.Errorf("paper order %s is %s", ID, order.Status)
+	}
+
+	order.Status = StatusCancelled
+	pp.orders[ID] = order
+	pp.saveOrders()
+	return nil
+}
+
+// OpenOrders returns the open orders of pair.
+func (pp *Paper) OpenOrders(pair string) ([]Order, error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	var orders []Order
+	for _, order := range pp.orders {
+		if order.Pair == pair && !order.Status.Final() {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// History returns the final orders of pair created since a date, the
+// paper orders are kept for a week.
+func (pp *Paper) History(pair string, since time.Time) ([]Order, error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	var orders []Order
+	for _, order := range pp.orders {
+		if order.Pair == pair && order.Status.Final() && !order.Created.Before(since) {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
@@ -0,0 +1,369 @@
+package execution
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/kredis"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mismatch kinds
+const (
+	// MismatchUnknownOrder is an exchange order no request of ours matches,
+	// a manual trade or a duplicate
+	MismatchUnknownOrder = "unknown_order"
+	// MismatchLostOrder is a request whose outcome is unknown and that no
+	// exchange order matches
+	MismatchLostOrder = "lost_order"
+	// MismatchFill is an order filled differently than journaled
+	MismatchFill = "fill_mismatch"
+	// MismatchMissingFill is an order filled by the exchange and not
+	// journaled
+	MismatchMissingFill = "missing_fill"
+)
+
+const (
+	clientOrdersRetention = 7 * 24 * time.Hour
+	// clockSkew tolerated between us and the exchange when matching orders
+	clockSkew = time.Minute
+)
+
+// ClientOrder is a request submitted with a client ID. OrderID is empty
+// while the exchange did not confirm the order.
+type ClientOrder struct {
+	ClientID  string       `json:"client_id"`
+	Request   OrderRequest `json:"request"`
+	OrderID   string       `json:"order_id,omitempty"`
+	Submitted time.Time    `json:"submitted"`
+}
+
+// Mismatch is a difference between our records and the exchange.
+type Mismatch struct {
+	Kind     string  `json:"kind"`
+	Pair     string  `json:"pair"`
+	ClientID string  `json:"client_id,omitempty"`
+	OrderID  string  `json:"order_id,omitempty"`
+	Expected float64 `json:"expected"`
+	Actual   float64 `json:"actual"`
+}
+
+func (mm Mismatch) String() string {
+	return fmt.Sprintf("%s on %s: client %s, order %s, expected %f, exchange %f",
+		mm.Kind, mm.Pair, mm.ClientID, mm.OrderID, mm.Expected, mm.Actual)
+}
+
+// Submitter places the orders of a pair at most once per client ID. The
+// client orders are kept in <EX>_<pair>_CLIENT_ORDERS, so a request retried
+// after a dropped connection or a restart returns the order already placed
+// instead of placing another one. When the exchange did not answer a
+// placement, the order is looked up in its open orders and history.
+type Submitter struct {
+	executor Executor
+	kr       *kredis.Kredis
+	key      string
+	pair     string
+	clock    clock.Clock
+	mu       *sync.Mutex
+	records  map[string]ClientOrder
+}
+
+// NewSubmitter creates the submitter of pair on top of executor, restoring
+// the client orders of a previous run.
+func NewSubmitter(exchange, pair string, executor Executor, kr *kredis.Kredis) *Submitter {
+	sb := &Submitter{}
+	sb.executor = executor
+	sb.kr = kr
+	sb.key = fmt.Sprintf("%s_%s_CLIENT_ORDERS", exchange, pair)
+	sb.pair = pair
+	sb.clock = clock.New()
+	sb.mu = &sync.Mutex{}
+	sb.records = make(map[string]ClientOrder)
+
+	if saved, err := kr.GetString(sb.key); err == nil && saved != "" {
+		if err := json.Unmarshal([]byte(saved), &sb.records); err != nil {
+			log.Errorf("Restoring client orders of %s: %s", pair, err.Error())
+		}
+	}
+
+	for _, record := range sb.records {
+		if record.OrderID != "" {
+			sb.reprice(record)
+		}
+	}
+
+	return sb
+}
+
+// reprice gives the request price of a bound record back to the executor
+func (sb *Submitter) reprice(record ClientOrder) {
+	if repricer, ok := sb.executor.(Repricer); ok {
+		repricer.SetRequestPrice(record.OrderID, record.Request.Price, record.Submitted)
+	}
+}
+
+// SetClock sets the clock used to date the client orders.
+func (sb *Submitter) SetClock(clk clock.Clock) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.clock = clk
+}
+
+// save persists the client orders, forgetting the old ones
+func (sb *Submitter) save() {
+	for clientID, record := range sb.records {
+		if sb.clock.Now().Sub(record.Submitted) > clientOrdersRetention {
+			delete(sb.records, clientID)
+		}
+	}
+
+	recordsJSON, err := json.Marshal(sb.records)
+	if err != nil {
+		log.Error("Marshaling client orders: ", err.Error())
+		return
+	}
+
+	if err := sb.kr.Set(sb.key, string(recordsJSON)); err != nil {
+		log.Errorf("Saving client orders of %s: %s", sb.pair, err.Error())
+	}
+}
+
+// ClientOrder returns the record of a client ID.
+func (sb *Submitter) ClientOrder(clientID string) (ClientOrder, bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	record, ok := sb.records[clientID]
+	return record, ok
+}
+
+// Place places the request once per client ID. A request without client ID
+// is placed as is.
+func (sb *Submitter) Place(request OrderRequest) (Order, error) {
+
+	if request.ClientID == "" {
+		return sb.executor.Place(request)
+	}
+
+	// ---------------------------------
+	// Already submitted, never again
+	// ---------------------------------
+	if order, found, err := sb.Recover(request.ClientID); found || err != nil {
+		if err == nil {
+			log.Warnf("Order %s already placed for client ID %s", order.ID, request.ClientID)
+		}
+		return order, err
+	}
+
+	sb.mu.Lock()
+	sb.records[request.ClientID] = ClientOrder{ClientID: request.ClientID, Request: request, Submitted: sb.clock.Now()}
+	sb.save()
+	sb.mu.Unlock()
+
+	order, err := sb.executor.Place(request)
+	if err != nil {
+		// The order may have reached the exchange anyway
+		if recovered, found, _ := sb.Recover(request.ClientID); found {
+			log.Warnf("Placing %s failed but order %s was placed: %s", request.ClientID, recovered.ID, err.Error())
+			return recovered, nil
+		}
+		return order, err
+	}
+
+	order.ClientID = request.ClientID
+	sb.bind(request.ClientID, order.ID)
+
+	return order, nil
+}
+
+func (sb *Submitter) bind(clientID, orderID string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	record := sb.records[clientID]
+	record.OrderID = orderID
+	sb.records[clientID] = record
+	sb.save()
+
+	sb.reprice(record)
+}
+
+// Recover returns the exchange order of a client ID. Orders placed without
+// confirmation are matched with the open orders and the history of the
+// exchange. It returns false when the client ID was not submitted or its
+// order can not be found.
+func (sb *Submitter) Recover(clientID string) (Order, bool, error) {
+
+	record, ok := sb.ClientOrder(clientID)
+	if !ok {
+		return Order{}, false, nil
+	}
+
+	if record.OrderID != "" {
+		order, err := sb.executor.Order(record.OrderID)
+		order.ClientID = clientID
+		return order, true, err
+	}
+
+	orders, err := sb.exchangeOrders(record.Submitted.Add(-clockSkew))
+	if err != nil {
+		return Order{}, false, err
+	}
+
+	if order, ok := sb.match(record, orders); ok {
+		log.Warnf("Recovered order %s of client ID %s", order.ID, clientID)
+		order.ClientID = clientID
+		sb.bind(clientID, order.ID)
+		return order, true, nil
+	}
+
+	return Order{}, false, nil
+}
+
+// exchangeOrders lists the open orders and the history of the pair
+func (sb *Submitter) exchangeOrders(since time.Time) ([]Order, error) {
+	reconciler, ok := sb.executor.(Reconciler)
+	if !ok {
+		return nil, nil
+	}
+
+	open, err := reconciler.OpenOrders(sb.pair)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := reconciler.History(sb.pair, since)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := append(open, history...)
+	sort.Slice(orders, func(i, j int) bool { return orders[i].Created.Before(orders[j].Created) })
+
+	return orders, nil
+}
+
+// match finds the first exchange order of the request submitted by record
+// not bound to another client ID. Market buys are bought with the quote
+// currency and fill at another price than requested, so their amount can
+// not match: the first market buy created around the submission does.
+func (sb *Submitter) match(record ClientOrder, orders []Order) (Order, bool) {
+	sb.mu.Lock()
+	bound := make(map[string]bool)
+	for _, other := range sb.records {
+		if other.OrderID != "" {
+			bound[other.OrderID] = true
+		}
+	}
+	sb.mu.Unlock()
+
+	for _, order := range orders {
+		if bound[order.ID] || order.Side != record.Request.Side {
+			continue
+		}
+		if order.Created.Before(record.Submitted.Add(-clockSkew)) {
+			continue
+		}
+		if record.Request.Type == Market && record.Request.Side == Buy {
+			if order.Type != Market || order.Created.After(record.Submitted.Add(clockSkew)) {
+				continue
+			}
+		} else if !sameAmount(order.Amount, record.Request.Amount) {
+			continue
+		}
+		return order, true
+	}
+
+	return Order{}, false
+}
+
+func sameAmount(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-8*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// Order returns the current state of an order.
+func (sb *Submitter) Order(ID string) (Order, error) {
+	return sb.executor.Order(ID)
+}
+
+// Cancel cancels an open order.
+func (sb *Submitter) Cancel(ID string) error {
+	return sb.executor.Cancel(ID)
+}
+
+// Reconcile compares the client orders submitted since a date with the
+// exchange, and the exchange fills with fills, the filled amounts we
+// journaled by order ID. Requests left without confirmation are recovered
+// when the exchange has them.
+func (sb *Submitter) Reconcile(since time.Time, fills map[string]float64) ([]Mismatch, error) {
+
+	if _, ok := sb.executor.(Reconciler); !ok {
+		return nil, fmt.Errorf("executor of %s can not list its orders", sb.pair)
+	}
+
+	orders, err := sb.exchangeOrders(since)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []Mismatch
+
+	// ------------------------------
+	// Requests without confirmation
+	// ------------------------------
+	sb.mu.Lock()
+	var pending []ClientOrder
+	for _, record := range sb.records {
+		if record.OrderID == "" && !record.Submitted.Before(since) {
+			pending = append(pending, record)
+		}
+	}
+	sb.mu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Submitted.Before(pending[j].Submitted) })
+
+	for _, record := range pending {
+		if order, ok := sb.match(record, orders); ok {
+			log.Warnf("Recovered order %s of client ID %s", order.ID, record.ClientID)
+			sb.bind(record.ClientID, order.ID)
+			continue
+		}
+		mismatches = append(mismatches, Mismatch{Kind: MismatchLostOrder, Pair: sb.pair,
+			ClientID: record.ClientID, Expected: record.Request.Amount})
+	}
+
+	// ------------------------------
+	// Exchange orders against ours
+	// ------------------------------
+	sb.mu.Lock()
+	clientIDs := make(map[string]string)
+	for _, record := range sb.records {
+		if record.OrderID != "" {
+			clientIDs[record.OrderID] = record.ClientID
+		}
+	}
+	sb.mu.Unlock()
+
+	for _, order := range orders {
+		clientID, ours := clientIDs[order.ID]
+		journaled, inJournal := fills[order.ID]
+
+		switch {
+		case !ours && !inJournal:
+			mismatches = append(mismatches, Mismatch{Kind: MismatchUnknownOrder, Pair: sb.pair,
+				OrderID: order.ID, Actual: order.Amount})
+		case order.Status.Final() && order.Filled > 0 && !inJournal:
+			mismatches = append(mismatches, Mismatch{Kind: MismatchMissingFill, Pair: sb.pair,
+				ClientID: clientID, OrderID: order.ID, Actual: order.Filled})
+		case order.Status.Final() && inJournal && !sameAmount(journaled, order.Filled):
+			mismatches = append(mismatches, Mismatch{Kind: MismatchFill, Pair: sb.pair,
+				ClientID: clientID, OrderID: order.ID, Expected: journaled, Actual: order.Filled})
+		}
+	}
+
+	return mismatches, nil
+}
@@ -0,0 +1,154 @@
+// Package journal keeps an append-only record of what the traders did:
+// every FSM transition and every executed or simulated trade, one JSON
+// entry per line. Profit and loss is computed from the recorded trades.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/execution"
+	log "github.com/sirupsen/logrus"
+)
+
+// Entry kinds
+const (
+	KindTransition = "transition"
+	KindTrade      = "trade"
+)
+
+// Entry is a line of the journal. Transitions fill Event, From, To and
+// Signals, trades fill Side, Price, Amount, Fee and OrderID.
+type Entry struct {
+	Kind      string          `json:"kind"`
+	Date      time.Time       `json:"date"`
+	Pair      string          `json:"pair"`
+	Event     string          `json:"event,omitempty"`
+	From      string          `json:"from,omitempty"`
+	To        string          `json:"to,omitempty"`
+	Signals   map[string]bool `json:"signals,omitempty"`
+	Side      execution.Side  `json:"side,omitempty"`
+	Price     float64         `json:"price,omitempty"`
+	Amount    float64         `json:"amount,omitempty"`
+	Fee       float64         `json:"fee,omitempty"`
+	OrderID   string          `json:"order_id,omitempty"`
+	Simulated bool            `json:"simulated,omitempty"`
+}
+
+// Journal appends entries to a file. It is safe for concurrent use, all the
+// pairs of a trader share one journal.
+type Journal struct {
+	mu   *sync.Mutex
+	path string
+	file *os.File
+}
+
+// Open opens the journal at path, creating it when needed. Entries are
+// always appended.
+func Open(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal %s: %s", path, err.Error())
+	}
+
+	jr := &Journal{}
+	jr.mu = &sync.Mutex{}
+	jr.path = path
+	jr.file = file
+
+	log.Info("Journal: ", path)
+
+	return jr, nil
+}
+
+// Path returns the path of the journal file.
+func (jr *Journal) Path() string {
+	return jr.path
+}
+
+// Append writes an entry and syncs it to disk.
+func (jr *Journal) Append(entry Entry) error {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+
+	if _, err := jr.file.Write(append(entryJSON, '\n')); err != nil {
+		return fmt.Errorf("writing journal %s: %s", jr.path, err.Error())
+	}
+
+	return jr.file.Sync()
+}
+
+// Close closes the journal file.
+func (jr *Journal) Close() error {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	return jr.file.Close()
+}
+
+// Query selects journal entries. Empty fields match everything.
+type Query struct {
+	Pair  string
+	Kind  string
+	Since time.Time
+	Until time.Time
+}
+
+// Match is true when entry is selected by the query.
+func (query Query) Match(entry Entry) bool {
+	switch {
+	case query.Pair != "" && entry.Pair != query.Pair:
+		return false
+	case query.Kind != "" && entry.Kind != query.Kind:
+		return false
+	case !query.Since.IsZero() && entry.Date.Before(query.Since):
+		return false
+	case !query.Until.IsZero() && !entry.Date.Before(query.Until):
+		return false
+	}
+	return true
+}
+
+// Read returns the entries of the journal at path selected by query, in
+// the order they were written.
+func Read(path string, query Query) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading journal %s: %s", path, err.Error())
+	}
+	defer file.Close()
+
+	var entries []Entry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		entry := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A crash can leave a truncated last line
+			log.Warnf("Skipping bad journal line %d: %s", line, err.Error())
+			continue
+		}
+
+		if query.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
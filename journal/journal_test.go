@@ -0,0 +1,161 @@
+package journal_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/journal"
+)
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	os.Exit(m.Run())
+}
+
+func almost(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestJournalAppendAndQuery(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal.jsonl")
+	start := time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	jr, err := journal.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	entries := []journal.Entry{
+		{Kind: journal.KindTransition, Date: start, Pair: "BTCUSD", Event: "TradeEvent", From: "IdleState", To: "TradingState"},
+		{Kind: journal.KindTrade, Date: start.Add(time.Hour), Pair: "BTCUSD", Side: execution.Buy, Price: 100, Amount: 1},
+		{Kind: journal.KindTrade, Date: start.Add(2 * time.Hour), Pair: "ETHBTC", Side: execution.Buy, Price: 0.05, Amount: 2},
+	}
+
+	for _, entry := range entries {
+		if err := jr.Append(entry); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	jr.Close()
+
+	// ------------------------------
+	// Reopening appends, a truncated
+	// line is skipped
+	// ------------------------------
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file.WriteString("{\"kind\":\"tra\n")
+	file.Close()
+
+	jr, err = journal.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	jr.Append(journal.Entry{Kind: journal.KindTrade, Date: start.Add(3 * time.Hour), Pair: "BTCUSD", Side: execution.Sell, Price: 110, Amount: 1})
+	jr.Close()
+
+	all, err := journal.Read(path, journal.Query{})
+	if err != nil || len(all) != 4 {
+		t.Fatal("Bad journal: ", len(all), err)
+	}
+
+	trades, _ := journal.Read(path, journal.Query{Pair: "BTCUSD", Kind: journal.KindTrade})
+	if len(trades) != 2 || trades[1].Side != execution.Sell {
+		t.Error("Bad trades query: ", trades)
+	}
+
+	window, _ := journal.Read(path, journal.Query{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)})
+	if len(window) != 2 {
+		t.Error("Bad date query: ", window)
+	}
+}
+
+func TestPnL(t *testing.T) {
+
+	entries := []journal.Entry{
+		{Kind: journal.KindTrade, Pair: "BTCUSD", Side: execution.Buy, Price: 100, Amount: 1, Fee: 1},
+		{Kind: journal.KindTrade, Pair: "BTCUSD", Side: execution.Buy, Price: 200, Amount: 1, Fee: 1},
+		{Kind: journal.KindTrade, Pair: "BTCUSD", Side: execution.Sell, Price: 250, Amount: 1, Fee: 2},
+		{Kind: journal.KindTrade, Pair: "ETHUSD", Side: execution.Buy, Price: 10, Amount: 10},
+		{Kind: journal.KindTrade, Pair: "ETHBTC", Side: execution.Buy, Price: 0.1, Amount: 1},
+		{Kind: journal.KindTransition, Pair: "BTCUSD", From: "HoldState", To: "Minute120SellState"},
+	}
+
+	report := journal.Compute(entries, map[string]float64{"BTCUSD": 300})
+
+	if len(report.Pairs) != 3 || len(report.Totals) != 2 {
+		t.Fatal("Bad report: ", report)
+	}
+
+	btc := report.Pairs[0]
+
+	// Average cost is (100 + 200 + 2 fees) / 2
+	if btc.Pair != "BTCUSD" || !almost(btc.AvgCost, 151) || !almost(btc.Position, 1) {
+		t.Error("Bad BTCUSD position: ", btc)
+	}
+
+	if !almost(btc.Realized, 250-151-2) || !almost(btc.Unrealized, 300-151) || btc.Trades != 3 {
+		t.Error("Bad BTCUSD PnL: ", btc)
+	}
+
+	// ETHUSD has no price, valued at its last trade
+	usd := report.Totals[1]
+	if usd.Quote != "USD" || !almost(usd.Total(), 97+149) || !almost(usd.Fees, 4) {
+		t.Error("Bad USD totals: ", usd)
+	}
+}
+
+func TestTrips(t *testing.T) {
+
+	start := time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return start.Add(time.Duration(hours) * time.Hour)
+	}
+
+	entries := []journal.Entry{
+		{Kind: journal.KindTrade, Date: at(0), Pair: "BTCUSD", Side: execution.Buy, Price: 100, Amount: 1, Fee: 1},
+		{Kind: journal.KindTrade, Date: at(1), Pair: "ETHUSD", Side: execution.Sell, Price: 10, Amount: 1},
+		{Kind: journal.KindTrade, Date: at(2), Pair: "BTCUSD", Side: execution.Sell, Price: 120, Amount: 0.5, Fee: 1},
+		{Kind: journal.KindTransition, Date: at(3), Pair: "BTCUSD", From: "HoldState", To: "TradingState"},
+		{Kind: journal.KindTrade, Date: at(4), Pair: "BTCUSD", Side: execution.Sell, Price: 90, Amount: 0.5, Fee: 1},
+		{Kind: journal.KindTrade, Date: at(5), Pair: "BTCUSD", Side: execution.Buy, Price: 100, Amount: 1},
+	}
+
+	trips := journal.Trips(entries)
+	if len(trips) != 2 {
+		t.Fatal("Bad trips: ", trips)
+	}
+
+	// Bought at 101 with the fee, sold half at 120 and half at 90
+	closed := trips[0]
+	if !closed.Opened.Equal(at(0)) || !closed.Closed.Equal(at(4)) || closed.Trades != 3 {
+		t.Error("Bad closed trip: ", closed)
+	}
+	if !almost(closed.Realized, (120-101)*0.5-1+(90-101)*0.5-1) || !almost(closed.Fees, 3) {
+		t.Error("Bad closed trip PnL: ", closed)
+	}
+
+	if open := trips[1]; !open.Closed.IsZero() || !open.Opened.Equal(at(5)) {
+		t.Error("Bad open trip: ", open)
+	}
+}
@@ -0,0 +1,190 @@
+package journal
+
+import (
+	"sort"
+	"time"
+
+	"github.com/lagarciag/tayni/execution"
+	log "github.com/sirupsen/logrus"
+)
+
+// PnL is the profit and loss of a pair, or of all the pairs sharing a
+// quote currency. Values are in the quote currency, positions are valued
+// at their average cost, buy fees included.
+type PnL struct {
+	Pair       string  `json:"pair,omitempty"`
+	Quote      string  `json:"quote"`
+	Trades     int     `json:"trades"`
+	Position   float64 `json:"position"`
+	AvgCost    float64 `json:"avg_cost"`
+	Last       float64 `json:"last"`
+	Fees       float64 `json:"fees"`
+	Realized   float64 `json:"realized"`
+	Unrealized float64 `json:"unrealized"`
+}
+
+// Total is the realized plus the unrealized profit.
+func (pnl PnL) Total() float64 {
+	return pnl.Realized + pnl.Unrealized
+}
+
+// Report is the profit and loss per pair and its totals per quote
+// currency, summing values in different currencies being meaningless.
+type Report struct {
+	Pairs  []PnL `json:"pairs"`
+	Totals []PnL `json:"totals"`
+}
+
+// holding is a position valued at its average cost
+type holding struct {
+	position float64
+	avgCost  float64
+}
+
+// fill applies a trade to the holding and returns the profit it realized,
+// buy fees are part of the cost.
+func (hd *holding) fill(entry Entry) float64 {
+	switch entry.Side {
+	case execution.Buy:
+		cost := hd.avgCost*hd.position + entry.Price*entry.Amount + entry.Fee
+		hd.position += entry.Amount
+		hd.avgCost = cost / hd.position
+	case execution.Sell:
+		amount := entry.Amount
+		if amount > hd.position {
+			log.Warnf("PnL: %s sells %f with a position of %f", entry.Pair, amount, hd.position)
+			amount = hd.position
+		}
+		realized := (entry.Price-hd.avgCost)*amount - entry.Fee
+		hd.position -= amount
+		if hd.position <= 1e-12 {
+			hd.position = 0
+			hd.avgCost = 0
+		}
+		return realized
+	}
+	return 0
+}
+
+// Compute replays the trades of entries. Open positions are valued at
+// prices, or at the last trade price of their pair when it has no price.
+func Compute(entries []Entry, prices map[string]float64) Report {
+
+	pairs := make(map[string]*PnL)
+	holdings := make(map[string]*holding)
+
+	for _, entry := range entries {
+		if entry.Kind != KindTrade || entry.Amount <= 0 {
+			continue
+		}
+
+		pnl, ok := pairs[entry.Pair]
+		if !ok {
+			_, quote, err := execution.SplitPair(entry.Pair)
+			if err != nil {
+				log.Warn("PnL: ", err.Error())
+			}
+			pnl = &PnL{Pair: entry.Pair, Quote: quote}
+			pairs[entry.Pair] = pnl
+			holdings[entry.Pair] = &holding{}
+		}
+
+		pnl.Trades++
+		pnl.Fees += entry.Fee
+		pnl.Last = entry.Price
+
+		hd := holdings[entry.Pair]
+		pnl.Realized += hd.fill(entry)
+		pnl.Position = hd.position
+		pnl.AvgCost = hd.avgCost
+	}
+
+	report := Report{}
+	totals := make(map[string]*PnL)
+
+	for _, pnl := range pairs {
+		if price, ok := prices[pnl.Pair]; ok && price > 0 {
+			pnl.Last = price
+		}
+		if pnl.Position > 0 {
+			pnl.Unrealized = (pnl.Last - pnl.AvgCost) * pnl.Position
+		}
+
+		report.Pairs = append(report.Pairs, *pnl)
+
+		total, ok := totals[pnl.Quote]
+		if !ok {
+			total = &PnL{Quote: pnl.Quote}
+			totals[pnl.Quote] = total
+		}
+		total.Trades += pnl.Trades
+		total.Fees += pnl.Fees
+		total.Realized += pnl.Realized
+		total.Unrealized += pnl.Unrealized
+	}
+
+	for _, total := range totals {
+		report.Totals = append(report.Totals, *total)
+	}
+
+	sort.Slice(report.Pairs, func(i, j int) bool { return report.Pairs[i].Pair < report.Pairs[j].Pair })
+	sort.Slice(report.Totals, func(i, j int) bool { return report.Totals[i].Quote < report.Totals[j].Quote })
+
+	return report
+}
+
+// Trip is a round trip of a pair, from a flat position back to flat. Open
+// trips have a zero Closed date. Realized includes all the fees.
+type Trip struct {
+	Pair     string    `json:"pair"`
+	Opened   time.Time `json:"opened"`
+	Closed   time.Time `json:"closed,omitempty"`
+	Trades   int       `json:"trades"`
+	Realized float64   `json:"realized"`
+	Fees     float64   `json:"fees"`
+}
+
+// Trips replays the trades of entries into round trips, in the order they
+// were opened.
+func Trips(entries []Entry) []Trip {
+
+	var trips []Trip
+	open := make(map[string]int)
+	holdings := make(map[string]*holding)
+
+	for _, entry := range entries {
+		if entry.Kind != KindTrade || entry.Amount <= 0 {
+			continue
+		}
+
+		hd, ok := holdings[entry.Pair]
+		if !ok {
+			hd = &holding{}
+			holdings[entry.Pair] = hd
+		}
+
+		if hd.position == 0 && entry.Side != execution.Buy {
+			log.Warnf("PnL: %s sells %f without a position", entry.Pair, entry.Amount)
+			continue
+		}
+
+		index, ok := open[entry.Pair]
+		if !ok {
+			index = len(trips)
+			open[entry.Pair] = index
+			trips = append(trips, Trip{Pair: entry.Pair, Opened: entry.Date})
+		}
+
+		trip := &trips[index]
+		trip.Trades++
+		trip.Fees += entry.Fee
+		trip.Realized += hd.fill(entry)
+
+		if hd.position == 0 {
+			trip.Closed = entry.Date
+			delete(open, entry.Pair)
+		}
+	}
+
+	return trips
+}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	log "github.com/sirupsen/logrus"
@@ -288,6 +289,51 @@ func (kr *Kredis) Set(key string, value string) error {
 	return err
 }
 
+// ------------------------------------
+// Leases, a key held by a value until
+// it expires or is released
+// ------------------------------------
+
+var renewLeaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+var releaseLeaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// SetLease sets key to value for ttl unless the key exists. It returns true
+// when the lease was taken.
+func (kr *Kredis) SetLease(key, value string, ttl time.Duration) (bool, error) {
+	kr.mu.Lock()
+	reply, err := kr.connUpdateList.Do("SET", key, value, "NX", "PX", int64(ttl/time.Millisecond))
+	kr.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// RenewLease extends the lease of key for ttl if it is still held by value.
+func (kr *Kredis) RenewLease(key, value string, ttl time.Duration) (bool, error) {
+	kr.mu.Lock()
+	renewed, err := redis.Int(renewLeaseScript.Do(kr.connUpdateList, key, value, int64(ttl/time.Millisecond)))
+	kr.mu.Unlock()
+	return renewed == 1, err
+}
+
+// ReleaseLease deletes key if it is held by value.
+func (kr *Kredis) ReleaseLease(key, value string) (bool, error) {
+	kr.mu.Lock()
+	released, err := redis.Int(releaseLeaseScript.Do(kr.connUpdateList, key, value))
+	kr.mu.Unlock()
+	return released == 1, err
+}
+
 func (kr *Kredis) GetString(key string) (value string, err error) {
 
 	kr.mu.Lock()
@@ -329,7 +375,9 @@ func (kr *Kredis) Update(exchange, pair string, value string) error {
 		return err
 	}
 
-	//_, err = kr.conn.Do("PUBLISH", key, key)
+	kr.mu.Lock()
+	_, err = kr.connUpdateList.Do("PUBLISH", key, value)
+	kr.mu.Unlock()
 
 	return err
 }
@@ -312,3 +312,43 @@ func pubSub(psc redis.PubSubConn) {
 		}
 	}
 }
+
+func TestKredisLease(t *testing.T) {
+
+	kr := NewKredis(10)
+
+	kr.dial()
+
+	key := fmt.Sprintf("TEST_LEASE_%d", rand.Int63())
+
+	taken, err := kr.SetLease(key, "a", time.Minute)
+	if err != nil || !taken {
+		t.Fatal("Lease should be taken: ", err)
+	}
+
+	if taken, _ := kr.SetLease(key, "b", time.Minute); taken {
+		t.Error("Held lease should not be taken by another holder")
+	}
+
+	if renewed, _ := kr.RenewLease(key, "b", time.Minute); renewed {
+		t.Error("Lease should only be renewed by its holder")
+	}
+
+	if renewed, err := kr.RenewLease(key, "a", time.Minute); err != nil || !renewed {
+		t.Error("Holder should renew the lease: ", err)
+	}
+
+	if released, _ := kr.ReleaseLease(key, "b"); released {
+		t.Error("Lease should only be released by its holder")
+	}
+
+	if released, err := kr.ReleaseLease(key, "a"); err != nil || !released {
+		t.Error("Holder should release the lease: ", err)
+	}
+
+	if taken, _ := kr.SetLease(key, "b", time.Minute); !taken {
+		t.Error("Released lease should be taken")
+	}
+
+	kr.ReleaseLease(key, "b")
+}
@@ -0,0 +1,228 @@
+// Package leader elects the instance that acts when several traders run
+// for redundancy. The leader holds a lease in redis and renews it, the
+// standbys try to take it on every renewal period and take over once it
+// expires.
+package leader
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/kredis"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Lease scopes
+const (
+	ScopePair    = "pair"
+	ScopeProcess = "process"
+)
+
+const defaultTTL = 15 * time.Second
+
+// Config of the election. Renew should be well under TTL so the leader
+// renews several times before its lease can expire.
+type Config struct {
+	Scope string
+	TTL   time.Duration
+	Renew time.Duration
+	ID    string
+}
+
+// LoadConfig reads the election configuration. It returns false when the
+// election is not configured, the instance then always acts.
+//
+//	[leader]
+//	scope = "pair"
+//	ttl = "15s"
+//	renew = "5s"
+//	id = "trader-a"
+func LoadConfig() (Config, bool) {
+	if !viper.IsSet("leader") {
+		return Config{}, false
+	}
+
+	config := Config{}
+	config.Scope = viper.GetString("leader.scope")
+	config.TTL = viper.GetDuration("leader.ttl")
+	config.Renew = viper.GetDuration("leader.renew")
+	config.ID = viper.GetString("leader.id")
+
+	return config, true
+}
+
+// Validate fills the defaults and checks the configuration.
+func (config *Config) Validate() error {
+	if config.Scope == "" {
+		config.Scope = ScopePair
+	}
+	if config.Scope != ScopePair && config.Scope != ScopeProcess {
+		return fmt.Errorf("unknown leader scope: %s", config.Scope)
+	}
+
+	if config.TTL <= 0 {
+		config.TTL = defaultTTL
+	}
+	if config.Renew <= 0 {
+		config.Renew = config.TTL / 3
+	}
+	if config.Renew >= config.TTL {
+		return fmt.Errorf("leader renew %s should be under the ttl %s", config.Renew, config.TTL)
+	}
+
+	if config.ID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "tayni"
+		}
+		config.ID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	return nil
+}
+
+// Lease is a leadership held in redis under a key.
+type Lease struct {
+	kr      *kredis.Kredis
+	key     string
+	id      string
+	ttl     time.Duration
+	renew   time.Duration
+	clock   clock.Clock
+	mu      *sync.Mutex
+	held    bool
+	renewed time.Time
+}
+
+// NewLease creates the lease of key for the instance of a validated
+// config. It is not held until acquired.
+func NewLease(kr *kredis.Kredis, key string, config Config) *Lease {
+	ls := &Lease{}
+	ls.kr = kr
+	ls.key = key
+	ls.id = config.ID
+	ls.ttl = config.TTL
+	ls.renew = config.Renew
+	ls.clock = clock.New()
+	ls.mu = &sync.Mutex{}
+	return ls
+}
+
+// SetClock sets the clock used to renew and expire the lease.
+func (ls *Lease) SetClock(clk clock.Clock) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.clock = clk
+}
+
+// Key returns the redis key of the lease.
+func (ls *Lease) Key() string {
+	return ls.key
+}
+
+// ID returns the instance holding or waiting for the lease.
+func (ls *Lease) ID() string {
+	return ls.id
+}
+
+// Holder returns the instance holding the lease, empty when free.
+func (ls *Lease) Holder() string {
+	holder, err := ls.kr.GetString(ls.key)
+	if err != nil {
+		return ""
+	}
+	return holder
+}
+
+// Held tells if the lease is held. A lease not renewed within its ttl is
+// considered lost even before redis expires it, so a stalled leader stops
+// acting before a standby can take over.
+func (ls *Lease) Held() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.held && ls.clock.Now().Sub(ls.renewed) < ls.ttl
+}
+
+// Acquire renews the lease when held, or takes it when free. It returns
+// true when the lease is held afterwards.
+func (ls *Lease) Acquire() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	now := ls.clock.Now()
+
+	var held bool
+	var err error
+	if ls.held {
+		held, err = ls.kr.RenewLease(ls.key, ls.id, ls.ttl)
+	}
+	if !held && err == nil {
+		held, err = ls.kr.SetLease(ls.key, ls.id, ls.ttl)
+	}
+
+	if err != nil {
+		log.Errorf("Lease %s: %s", ls.key, err.Error())
+		held = false
+	}
+
+	if held != ls.held {
+		if held {
+			log.Warnf("Lease %s taken by %s", ls.key, ls.id)
+		} else {
+			log.Warnf("Lease %s lost by %s", ls.key, ls.id)
+		}
+	}
+
+	ls.held = held
+	if held {
+		ls.renewed = now
+	}
+
+	return held
+}
+
+// Release gives the lease up so a standby takes over at once.
+func (ls *Lease) Release() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if !ls.held {
+		return nil
+	}
+	ls.held = false
+
+	_, err := ls.kr.ReleaseLease(ls.key, ls.id)
+	return err
+}
+
+// Run acquires or renews the lease every renewal period until stop is
+// closed, calling handler, when not nil, with the result of every attempt.
+// The lease is released on stop.
+func (ls *Lease) Run(stop chan struct{}, handler func(held bool)) {
+
+	if handler == nil {
+		handler = func(held bool) {}
+	}
+
+	handler(ls.Acquire())
+
+	ticker := ls.clock.NewTicker(ls.renew)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			if err := ls.Release(); err != nil {
+				log.Errorf("Releasing lease %s: %s", ls.key, err.Error())
+			}
+			handler(false)
+			return
+		case <-ticker.C():
+			handler(ls.Acquire())
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package leader_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+)
+
+var kr *kredis.Kredis
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	kr = kredis.NewKredis(1)
+	kr.Start()
+
+	os.Exit(m.Run())
+}
+
+func newLeases(t *testing.T, config leader.Config) (*leader.Lease, *leader.Lease) {
+	key := fmt.Sprintf("TEST_LEADER_%d", rand.Int63())
+
+	configA, configB := config, config
+	configA.ID, configB.ID = "a", "b"
+
+	for _, config := range []*leader.Config{&configA, &configB} {
+		if err := config.Validate(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	return leader.NewLease(kr, key, configA), leader.NewLease(kr, key, configB)
+}
+
+func TestConfigValidate(t *testing.T) {
+
+	config := leader.Config{}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if config.Scope != leader.ScopePair || config.Renew != config.TTL/3 || config.ID == "" {
+		t.Errorf("Bad defaults: %+v", config)
+	}
+
+	bad := []leader.Config{
+		{Scope: "host"},
+		{TTL: time.Second, Renew: time.Second},
+	}
+
+	for _, config := range bad {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Config should be invalid: %+v", config)
+		}
+	}
+}
+
+func TestLeaseSingleLeader(t *testing.T) {
+
+	a, b := newLeases(t, leader.Config{TTL: time.Minute})
+
+	if !a.Acquire() {
+		t.Fatal("First instance should lead")
+	}
+
+	if b.Acquire() || b.Held() {
+		t.Error("Second instance should stand by")
+	}
+
+	if holder := b.Holder(); holder != "a" {
+		t.Error("Bad holder: ", holder)
+	}
+
+	// Renewals keep the lease
+	if !a.Acquire() || !a.Held() {
+		t.Error("Leader should renew its lease")
+	}
+
+	// Released leases are taken at once
+	if err := a.Release(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if a.Held() {
+		t.Error("Released lease should not be held")
+	}
+
+	if !b.Acquire() {
+		t.Error("Standby should take the released lease")
+	}
+
+	if a.Acquire() {
+		t.Error("Former leader should stand by")
+	}
+
+	b.Release()
+}
+
+func TestLeaseLocalExpiry(t *testing.T) {
+
+	a, _ := newLeases(t, leader.Config{TTL: time.Minute})
+
+	clk := clock.NewSimulated(time.Now())
+	a.SetClock(clk)
+
+	if !a.Acquire() {
+		t.Fatal("Lease should be taken")
+	}
+
+	clk.Advance(30 * time.Second)
+
+	if !a.Held() {
+		t.Error("Lease should be held within its ttl")
+	}
+
+	// Not renewed in time, the leader stops acting
+	clk.Advance(31 * time.Second)
+
+	if a.Held() {
+		t.Error("Lease not renewed within its ttl should be lost")
+	}
+
+	a.Release()
+}
+
+func TestLeaseRun(t *testing.T) {
+
+	a, b := newLeases(t, leader.Config{TTL: time.Second, Renew: 50 * time.Millisecond})
+
+	stop := make(chan struct{})
+	heldChan := make(chan bool, 100)
+
+	go a.Run(stop, func(held bool) {
+		heldChan <- held
+	})
+
+	if held := <-heldChan; !held {
+		t.Fatal("Running lease should be taken")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if !a.Held() || b.Acquire() {
+		t.Error("Running lease should be renewed")
+	}
+
+	close(stop)
+
+	for held := range heldChan {
+		if !held {
+			break
+		}
+	}
+
+	if !b.Acquire() {
+		t.Error("Stopped lease should be released")
+	}
+
+	b.Release()
+}
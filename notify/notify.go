@@ -0,0 +1,412 @@
+// Package notify delivers what the traders do to the people watching them.
+// A Notifier sends events to a sink: a JSON webhook, email, a file or the
+// log, and Twitter. The Router sends every event to the sinks whose routes
+// match its type, pair and severity, as configured.
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/twitter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Event types
+const (
+	EventBuy       = "buy"
+	EventSell      = "sell"
+	EventOrder     = "order"
+	EventReconcile = "reconcile"
+	EventBreaker   = "breaker"
+	EventRotation  = "rotation"
+	EventRebalance = "rebalance"
+	EventAlert     = "alert"
+	EventReport    = "report"
+)
+
+// Severity of an event, routes take the events of a minimum severity.
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Critical
+)
+
+var severityNames = []string{"info", "warning", "critical"}
+
+func (severity Severity) String() string {
+	if severity < Info || severity > Critical {
+		return fmt.Sprintf("severity(%d)", int(severity))
+	}
+	return severityNames[severity]
+}
+
+// MarshalText writes the severity by name.
+func (severity Severity) MarshalText() ([]byte, error) {
+	return []byte(severity.String()), nil
+}
+
+// UnmarshalText reads a severity name.
+func (severity *Severity) UnmarshalText(text []byte) error {
+	parsed, err := ParseSeverity(string(text))
+	if err != nil {
+		return err
+	}
+	*severity = parsed
+	return nil
+}
+
+// ParseSeverity parses a severity name, empty is Info.
+func ParseSeverity(name string) (Severity, error) {
+	if name == "" {
+		return Info, nil
+	}
+	for i, severityName := range severityNames {
+		if strings.EqualFold(name, severityName) {
+			return Severity(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown severity: %s", name)
+}
+
+// Event is something worth telling. Pair is empty for the events of the
+// whole process, such as a breaker trip. Price and State, when known, are
+// the last price of the pair and the state of its FSM. The Price and Amount
+// of a filled trade are those of the fill.
+type Event struct {
+	Type     string    `json:"type"`
+	Severity Severity  `json:"severity"`
+	Pair     string    `json:"pair,omitempty"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Date     time.Time `json:"date"`
+	Price    float64   `json:"price,omitempty"`
+	Amount   float64   `json:"amount,omitempty"`
+	State    string    `json:"state,omitempty"`
+}
+
+func (event Event) String() string {
+	if event.Pair == "" {
+		return fmt.Sprintf("[%s] %s: %s", event.Severity, event.Type, event.Title)
+	}
+	return fmt.Sprintf("[%s] %s %s: %s", event.Severity, event.Type, event.Pair, event.Title)
+}
+
+// Notifier sends events.
+type Notifier interface {
+	Notify(event Event) error
+}
+
+// Route sends the events of the listed types and pairs, all when empty, of
+// at least Severity to Sinks.
+type Route struct {
+	Name     string
+	Sinks    []string
+	Events   []string
+	Pairs    []string
+	Severity Severity
+}
+
+func (route Route) match(event Event) bool {
+	if event.Severity < route.Severity {
+		return false
+	}
+	return listed(route.Events, event.Type) && listed(route.Pairs, event.Pair)
+}
+
+func listed(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Router is the Notifier of a process, it sends every event to the sinks of
+// the routes matching it, once per sink, as the throttle allows.
+type Router struct {
+	mu       *sync.Mutex
+	sinks    map[string]Notifier
+	routes   []Route
+	clock    clock.Clock
+	throttle *throttle
+}
+
+// NewRouter creates a router without sinks, events go nowhere.
+func NewRouter() *Router {
+	rt := &Router{}
+	rt.mu = &sync.Mutex{}
+	rt.sinks = make(map[string]Notifier)
+	rt.clock = clock.New()
+	return rt
+}
+
+// SetClock sets the clock used to date, throttle and digest the events.
+func (rt *Router) SetClock(clk clock.Clock) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.clock = clk
+	if rt.throttle != nil {
+		rt.throttle = newThrottle(rt.throttle.config, clk.Now())
+	}
+}
+
+// SetThrottle throttles the events sent to the sinks, see ThrottleConfig.
+func (rt *Router) SetThrottle(config ThrottleConfig) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.throttle = newThrottle(config, rt.clock.Now())
+}
+
+// AddSink registers a sink under name.
+func (rt *Router) AddSink(name string, sink Notifier) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.sinks[name] = sink
+}
+
+// AddRoute adds a route to registered sinks.
+func (rt *Router) AddRoute(route Route) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, sink := range route.Sinks {
+		if _, ok := rt.sinks[sink]; !ok {
+			return fmt.Errorf("route %s to unknown sink %s", route.Name, sink)
+		}
+	}
+
+	rt.routes = append(rt.routes, route)
+	return nil
+}
+
+// Notify sends the event to its sinks. A failing sink does not stop the
+// others, the errors are returned together.
+func (rt *Router) Notify(event Event) error {
+	rt.mu.Lock()
+	now := rt.clock.Now()
+	th := rt.throttle
+	rt.mu.Unlock()
+
+	if event.Date.IsZero() {
+		event.Date = now.UTC()
+	}
+
+	throttled := th != nil && event.Severity < Critical
+	if throttled && th.duplicate(event, now) {
+		log.Debug("Duplicated notification: ", event)
+		return nil
+	}
+
+	rt.mu.Lock()
+	var names []string
+	sent := make(map[string]bool)
+	for _, route := range rt.routes {
+		if !route.match(event) {
+			continue
+		}
+		for _, name := range route.Sinks {
+			if sent[name] {
+				continue
+			}
+			sent[name] = true
+			if throttled && th.batch(name, event, now) {
+				log.Debugf("Notification to %s throttled: %s", name, event)
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	sinks := make([]Notifier, len(names))
+	for i, name := range names {
+		sinks[i] = rt.sinks[name]
+	}
+	rt.mu.Unlock()
+
+	var failed []string
+	for i, sink := range sinks {
+		if err := sink.Notify(event); err != nil {
+			log.Errorf("Notifying %s to %s: %s", event, names[i], err.Error())
+			failed = append(failed, fmt.Sprintf("%s: %s", names[i], err.Error()))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("notifying %s: %s", event, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Flush sends the digest of the batched events to every sink.
+func (rt *Router) Flush() error {
+	rt.mu.Lock()
+	th := rt.throttle
+	now := rt.clock.Now()
+	rt.mu.Unlock()
+
+	if th == nil {
+		return nil
+	}
+
+	var failed []string
+	for name, digest := range th.digests(now) {
+		rt.mu.Lock()
+		sink := rt.sinks[name]
+		rt.mu.Unlock()
+
+		if err := sink.Notify(digest); err != nil {
+			log.Errorf("Sending digest to %s: %s", name, err.Error())
+			failed = append(failed, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("sending digests: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Run sends the digests every digest interval until stop is closed, it
+// returns at once without digest.
+func (rt *Router) Run(stop chan struct{}) {
+	rt.mu.Lock()
+	if rt.throttle == nil || rt.throttle.config.Digest <= 0 {
+		rt.mu.Unlock()
+		return
+	}
+	ticker := rt.clock.NewTicker(rt.throttle.config.Digest)
+	rt.mu.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			rt.Flush()
+			return
+		case <-ticker.C():
+			rt.Flush()
+		}
+	}
+}
+
+// Default tweets the buys and the sells, as the traders always did. The
+// operational events are not public, they need a configured route.
+func Default(tc *twitter.TwitterClient) *Router {
+	rt := NewRouter()
+	rt.AddSink("twitter", NewTwitter(tc))
+	rt.AddRoute(Route{Name: "default", Sinks: []string{"twitter"}, Events: []string{EventBuy, EventSell}})
+	return rt
+}
+
+// Load creates the router of the notify configuration, the twitter sinks
+// tweet with tc. Without configuration it returns Default. The throttle
+// is read with LoadThrottleConfig.
+//
+//	[notify.sinks.chat]
+//	type = "webhook"
+//	url = "http://localhost:8065/hooks/tayni"
+//	timeout = "10s"
+//
+//	[notify.sinks.mail]
+//	type = "email"
+//	host = "smtp.example.com"
+//	port = 587
+//	username = "tayni"
+//	password = "secret"
+//	from = "tayni@example.com"
+//	to = ["oncall@example.com"]
+//
+//	[notify.sinks.file]
+//	type = "file"            # "log" writes to the log instead
+//	path = "/var/log/tayni/notify.log"
+//
+//	[notify.sinks.twitter]
+//	type = "twitter"         # with the [twitter] settings
+//
+//	[notify.routes.trades]
+//	sinks = ["chat", "twitter"]
+//	events = ["buy", "sell"] # all events when empty
+//	pairs = ["BTCUSD"]       # all pairs when empty
+//
+//	[notify.routes.oncall]
+//	sinks = ["chat", "mail"]
+//	severity = "warning"
+func Load(tc *twitter.TwitterClient) (*Router, error) {
+	if !viper.IsSet("notify") {
+		return Default(tc), nil
+	}
+
+	rt := NewRouter()
+
+	if config, ok, err := LoadThrottleConfig(); err != nil {
+		return nil, fmt.Errorf("notify throttle: %s", err.Error())
+	} else if ok {
+		rt.SetThrottle(config)
+	}
+
+	for name := range viper.GetStringMap("notify.sinks") {
+		key := fmt.Sprintf("notify.sinks.%s", name)
+
+		var sink Notifier
+		switch kind := viper.GetString(key + ".type"); kind {
+		case "webhook":
+			url := viper.GetString(key + ".url")
+			if url == "" {
+				return nil, fmt.Errorf("webhook sink %s needs an url", name)
+			}
+			sink = NewWebhook(url, viper.GetDuration(key+".timeout"))
+		case "email":
+			config := EmailConfig{}
+			config.Host = viper.GetString(key + ".host")
+			config.Port = viper.GetInt(key + ".port")
+			config.Username = viper.GetString(key + ".username")
+			config.Password = viper.GetString(key + ".password")
+			config.From = viper.GetString(key + ".from")
+			config.To = viper.GetStringSlice(key + ".to")
+			if config.Host == "" || config.From == "" || len(config.To) == 0 {
+				return nil, fmt.Errorf("email sink %s needs a host, from and to", name)
+			}
+			sink = NewEmail(config)
+		case "file":
+			sink = NewFile(viper.GetString(key + ".path"))
+		case "log":
+			sink = NewFile("")
+		case "twitter":
+			sink = NewTwitter(tc)
+		default:
+			return nil, fmt.Errorf("unknown type %q of sink %s", kind, name)
+		}
+
+		rt.AddSink(name, sink)
+	}
+
+	for name := range viper.GetStringMap("notify.routes") {
+		key := fmt.Sprintf("notify.routes.%s", name)
+
+		severity, err := ParseSeverity(viper.GetString(key + ".severity"))
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %s", name, err.Error())
+		}
+
+		route := Route{Name: name, Severity: severity}
+		route.Sinks = viper.GetStringSlice(key + ".sinks")
+		route.Events = viper.GetStringSlice(key + ".events")
+		route.Pairs = viper.GetStringSlice(key + ".pairs")
+
+		if err := rt.AddRoute(route); err != nil {
+			return nil, err
+		}
+	}
+
+	return rt, nil
+}
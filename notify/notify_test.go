@@ -0,0 +1,437 @@
+package notify_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/lagarciag/tayni/twitter"
+	"github.com/spf13/viper"
+)
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	os.Exit(m.Run())
+}
+
+// recorder keeps the events it is notified
+type recorder struct {
+	mu     sync.Mutex
+	events []notify.Event
+	err    error
+}
+
+func (rc *recorder) Notify(event notify.Event) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.events = append(rc.events, event)
+	return rc.err
+}
+
+func (rc *recorder) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.events)
+}
+
+func TestRouter(t *testing.T) {
+
+	chat, mail, broken := &recorder{}, &recorder{}, &recorder{err: fmt.Errorf("down")}
+
+	rt := notify.NewRouter()
+	rt.AddSink("chat", chat)
+	rt.AddSink("mail", mail)
+	rt.AddSink("broken", broken)
+
+	if err := rt.AddRoute(notify.Route{Name: "bad", Sinks: []string{"pager"}}); err == nil {
+		t.Error("Route to an unknown sink accepted")
+	}
+
+	routes := []notify.Route{
+		{Name: "trades", Sinks: []string{"chat"}, Events: []string{notify.EventBuy, notify.EventSell}},
+		{Name: "oncall", Sinks: []string{"chat", "mail"}, Severity: notify.Warning},
+		{Name: "btc", Sinks: []string{"broken"}, Pairs: []string{"BTCUSD"}, Events: []string{notify.EventBuy}},
+	}
+	for _, route := range routes {
+		if err := rt.AddRoute(route); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err := rt.Notify(notify.Event{Type: notify.EventBuy, Pair: "ETHBTC", Title: "BUY ETHBTC"}); err != nil {
+		t.Error(err.Error())
+	}
+	if chat.count() != 1 || mail.count() != 0 {
+		t.Error("Buy not routed to chat only: ", chat.count(), mail.count())
+	}
+
+	// Critical goes to chat once and to mail
+	if err := rt.Notify(notify.Event{Type: notify.EventOrder, Severity: notify.Critical, Pair: "ETHBTC"}); err != nil {
+		t.Error(err.Error())
+	}
+	if chat.count() != 2 || mail.count() != 1 {
+		t.Error("Critical not routed to chat and mail: ", chat.count(), mail.count())
+	}
+
+	// Info of other events goes nowhere
+	rt.Notify(notify.Event{Type: notify.EventRotation})
+	if chat.count() != 2 || mail.count() != 1 {
+		t.Error("Rotation routed: ", chat.count(), mail.count())
+	}
+
+	// A failing sink does not stop the others
+	if err := rt.Notify(notify.Event{Type: notify.EventBuy, Pair: "BTCUSD"}); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Error("Failing sink not reported: ", err)
+	}
+	if chat.count() != 3 || broken.count() != 1 {
+		t.Error("Bad BTCUSD routing: ", chat.count(), broken.count())
+	}
+
+	if chat.events[0].Date.IsZero() {
+		t.Error("Event not dated")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+
+	var received []notify.Event
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := notify.Event{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error("Bad webhook body: ", err.Error())
+		}
+		received = append(received, event)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	wh := notify.NewWebhook(server.URL, time.Second)
+
+	event := notify.Event{Type: notify.EventSell, Severity: notify.Warning, Pair: "ETHBTC", Title: "SELL", Message: "sold"}
+	if err := wh.Notify(event); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(received) != 1 || received[0].Severity != notify.Warning || received[0].Message != "sold" {
+		t.Error("Bad webhook event: ", received)
+	}
+
+	status = http.StatusBadGateway
+	if err := wh.Notify(event); err == nil {
+		t.Error("Webhook error not reported")
+	}
+}
+
+func TestFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.log")
+	fl := notify.NewFile(path)
+
+	for i := 0; i < 2; i++ {
+		event := notify.Event{Type: notify.EventBuy, Pair: "ETHBTC", Title: "BUY", Message: "\n\tbuy ETH\n\tnow\n", Date: time.Now()}
+		if err := fl.Notify(event); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "[info] buy ETHBTC: BUY buy ETH now") {
+		t.Error("Bad file content: ", string(content))
+	}
+
+	if err := notify.NewFile("").Notify(notify.Event{Type: notify.EventBuy}); err != nil {
+		t.Error("Log sink failed: ", err.Error())
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	tc := twitter.NewTwitterClient(twitter.Config{ConsumerKey: "x"})
+
+	rt, err := notify.Load(tc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Tweets off are not an error
+	if err := rt.Notify(notify.Event{Type: notify.EventBuy}); err != nil {
+		t.Error("Default router failed: ", err.Error())
+	}
+
+	// Only the trades are public
+	rc := &recorder{}
+	rt.AddSink("twitter", rc)
+	for _, eventType := range []string{notify.EventBuy, notify.EventSell, notify.EventOrder, notify.EventReconcile, notify.EventAlert} {
+		if err := rt.Notify(notify.Event{Type: eventType, Severity: notify.Critical}); err != nil {
+			t.Error("Default router failed: ", err.Error())
+		}
+	}
+	if rc.count() != 2 {
+		t.Error("Default router tweets more than the trades: ", rc.count())
+	}
+
+	var count int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+	}))
+	defer server.Close()
+
+	viper.Set("notify.sinks.chat.type", "webhook")
+	viper.Set("notify.sinks.chat.url", server.URL)
+	viper.Set("notify.sinks.log.type", "log")
+	viper.Set("notify.routes.oncall.sinks", []string{"chat", "log"})
+	viper.Set("notify.routes.oncall.severity", "critical")
+	defer viper.Reset()
+
+	rt, err = notify.Load(tc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rt.Notify(notify.Event{Type: notify.EventBuy})
+	rt.Notify(notify.Event{Type: notify.EventBreaker, Severity: notify.Critical})
+	if count != 1 {
+		t.Error("Bad configured routing: ", count)
+	}
+
+	viper.Set("notify.routes.oncall.sinks", []string{"pager"})
+	if _, err := notify.Load(tc); err == nil {
+		t.Error("Route to an unknown sink loaded")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+
+	indicators := movingstats.Indicators{LastValue: 0.05, Ema: 0.049}
+
+	tp := notify.DefaultTemplates()
+
+	message, err := tp.Render(notify.NewData("CEXIO", "ETHBTC", notify.EventBuy, indicators))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(message, "ETH is outperforming BTC") || !strings.Contains(message, "last: 0.050000") {
+		t.Error("Bad crypto buy message: ", message)
+	}
+
+	// New pairs get a message without code changes
+	message, _ = tp.Render(notify.NewData("CEXIO", "LTCUSD", notify.EventSell, indicators))
+	if !strings.Contains(message, "SELL LTCUSD") {
+		t.Error("Bad sell message: ", message)
+	}
+
+	if strings.Contains(message, "fill:") {
+		t.Error("Signal without order should have no fill: ", message)
+	}
+
+	data := notify.NewData("CEXIO", "LTCUSD", notify.EventSell, indicators)
+	data.Amount, data.Price = 2, 51.5
+	message, _ = tp.Render(data)
+	if !strings.Contains(message, "fill: 2.000000 LTC at 51.500000") {
+		t.Error("Bad filled sell message: ", message)
+	}
+
+	data = notify.NewData("CEXIO", "BTCUSD", "stop", indicators)
+	data.Transition = notify.Transition{Event: "stop", From: "HoldState", To: "IdleState"}
+	message, _ = tp.Render(data)
+	if !strings.Contains(message, "(HoldState -> IdleState)") {
+		t.Error("Bad default message: ", message)
+	}
+
+	tp, err = notify.NewTemplates(
+		map[string]string{notify.EventBuy: "buy {{.Base}} with {{.Quote}}"},
+		map[string]map[string]string{
+			"ethbtc": {notify.EventSell: "ETH sold, PnL {{printf \"%.2f\" .PnL}}"},
+			"XRPBTC": {notify.DefaultTemplate: "XRP {{.Event}}"},
+		})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data = notify.NewData("CEXIO", "ETHBTC", notify.EventSell, indicators)
+	data.PnL = 1.5
+	cases := map[string]notify.Data{
+		"ETH sold, PnL 1.50":  data,
+		"buy ETH with BTC":    notify.NewData("CEXIO", "ETHBTC", notify.EventBuy, indicators),
+		"XRP buy":             notify.NewData("CEXIO", "XRPBTC", notify.EventBuy, indicators),
+		"downperforming BTC.": notify.NewData("CEXIO", "LTCBTC", notify.EventSell, indicators),
+	}
+	for expected, data := range cases {
+		if message, _ := tp.Render(data); !strings.Contains(message, expected) {
+			t.Errorf("Expected %q in %q", expected, message)
+		}
+	}
+
+	if _, err := notify.NewTemplates(map[string]string{notify.EventBuy: "{{.Pair"}, nil); err == nil {
+		t.Error("Bad template parsed")
+	}
+
+	viper.Set("notify.templates.sell", "sold {{.Pair}}")
+	viper.Set("notify.templates.pairs.ethbtc.buy", "bought ETH")
+	defer viper.Reset()
+
+	tp, err = notify.LoadTemplates()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if message, _ := tp.Render(notify.NewData("CEXIO", "BTCUSD", notify.EventSell, indicators)); message != "sold BTCUSD" {
+		t.Error("Bad configured sell: ", message)
+	}
+	if message, _ := tp.Render(notify.NewData("CEXIO", "ETHBTC", notify.EventBuy, indicators)); message != "bought ETH" {
+		t.Error("Bad configured pair buy: ", message)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+
+	clk := clock.NewSimulated(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	chat, mail := &recorder{}, &recorder{}
+
+	rt := notify.NewRouter()
+	rt.SetClock(clk)
+	rt.AddSink("chat", chat)
+	rt.AddSink("mail", mail)
+	rt.AddRoute(notify.Route{Name: "all", Sinks: []string{"chat", "mail"}, Severity: notify.Warning})
+	rt.SetThrottle(notify.ThrottleConfig{DedupeWindow: 10 * time.Minute, RateWindow: time.Hour, SinkRate: 3, PairRate: 2})
+
+	warning := func(pair, title string) notify.Event {
+		return notify.Event{Type: notify.EventOrder, Severity: notify.Warning, Pair: pair, Title: title}
+	}
+
+	// The same event within the window is sent once
+	rt.Notify(warning("ETHBTC", "retry"))
+	rt.Notify(warning("ETHBTC", "retry"))
+	if chat.count() != 1 || mail.count() != 1 {
+		t.Error("Duplicate sent: ", chat.count(), mail.count())
+	}
+	clk.Advance(10 * time.Minute)
+	rt.Notify(warning("ETHBTC", "retry"))
+	if chat.count() != 2 {
+		t.Error("Event not sent after the dedupe window: ", chat.count())
+	}
+
+	// Fills of the same side are not duplicates
+	fills := &recorder{}
+	trades := notify.NewRouter()
+	trades.SetClock(clk)
+	trades.AddSink("fills", fills)
+	trades.AddRoute(notify.Route{Name: "trades", Sinks: []string{"fills"}})
+	trades.SetThrottle(notify.ThrottleConfig{DedupeWindow: 10 * time.Minute})
+	for _, price := range []float64{0.05, 0.06, 0.06} {
+		trades.Notify(notify.Event{Type: notify.EventBuy, Severity: notify.Warning, Pair: "ETHBTC",
+			Title: "BUY ETHBTC", Price: price, Amount: 1})
+	}
+	if fills.count() != 2 {
+		t.Error("Fills deduplicated by title: ", fills.count())
+	}
+
+	// Two per pair, three per sink
+	rt.Notify(warning("ETHBTC", "other"))
+	rt.Notify(warning("BTCUSD", "retry"))
+	rt.Notify(warning("XRPBTC", "retry"))
+	if chat.count() != 3 {
+		t.Error("Rates not applied: ", chat.count())
+	}
+
+	// Critical is never throttled
+	for i := 0; i < 2; i++ {
+		rt.Notify(notify.Event{Type: notify.EventBreaker, Severity: notify.Critical, Title: "tripped"})
+	}
+	if chat.count() != 5 || mail.count() != 5 {
+		t.Error("Critical throttled: ", chat.count(), mail.count())
+	}
+
+	// The rate window slides
+	clk.Advance(time.Hour)
+	rt.Notify(warning("XRPBTC", "again"))
+	if chat.count() != 6 {
+		t.Error("Event not sent after the rate window: ", chat.count())
+	}
+
+	// Digest the low severity and the rate limited events
+	digested := &recorder{}
+	rt = notify.NewRouter()
+	rt.SetClock(clk)
+	rt.AddSink("chat", digested)
+	rt.AddRoute(notify.Route{Name: "all", Sinks: []string{"chat"}})
+	rt.SetThrottle(notify.ThrottleConfig{PairRate: 1, Digest: time.Hour, DigestSeverity: notify.Info})
+
+	rt.Notify(notify.Event{Type: notify.EventBuy, Pair: "ETHBTC", Price: 0.05, State: "DoBuyState"})
+	rt.Notify(notify.Event{Type: notify.EventSell, Pair: "ETHBTC", Price: 0.06, State: "DoSellState"})
+	rt.Notify(notify.Event{Type: notify.EventBuy, Pair: "BTCUSD", Price: 10000})
+	rt.Notify(warning("ETHBTC", "first"))
+	rt.Notify(warning("ETHBTC", "second"))
+	if digested.count() != 1 {
+		t.Fatal("Digested events sent: ", digested.count())
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		rt.Run(stop)
+		close(done)
+	}()
+	close(stop)
+	<-done
+
+	if digested.count() != 2 {
+		t.Fatal("Digest not sent: ", digested.count())
+	}
+	digest := digested.events[1]
+	expected := []string{
+		"4 events",
+		"BTCUSD: buy 1, last 10000.000000",
+		"ETHBTC: buy 1, order 1, sell 1, last 0.060000, state DoSellState",
+	}
+	for _, text := range expected {
+		if !strings.Contains(digest.Message, text) {
+			t.Errorf("Expected %q in digest %q", text, digest.Message)
+		}
+	}
+	if digest.Type != notify.EventDigest || digest.Severity != notify.Warning {
+		t.Error("Bad digest: ", digest)
+	}
+
+	// Nothing batched, nothing sent
+	rt.Flush()
+	if digested.count() != 2 {
+		t.Error("Empty digest sent: ", digested.count())
+	}
+
+	viper.Set("notify.throttle.digest", "1h")
+	viper.Set("notify.throttle.digest_severity", "critical")
+	defer viper.Reset()
+	if _, _, err := notify.LoadThrottleConfig(); err == nil {
+		t.Error("Critical digest loaded")
+	}
+}
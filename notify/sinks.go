@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/twitter"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// Webhook posts every event as JSON to an url, the format most chat
+// platforms accept through an adapter.
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook creates the webhook sink of url, a zero timeout is 10s.
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	wh := &Webhook{}
+	wh.url = url
+	wh.client = &http.Client{Timeout: timeout}
+	return wh
+}
+
+// Notify posts the event.
+func (wh *Webhook) Notify(event Event) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(eventJSON))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s answered %s", wh.url, resp.Status)
+	}
+	return nil
+}
+
+// EmailConfig is the SMTP server and the recipients of an email sink. The
+// server is not authenticated without Username.
+type EmailConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Email mails every event.
+type Email struct {
+	config EmailConfig
+}
+
+// NewEmail creates the email sink of config, port 25 by default.
+func NewEmail(config EmailConfig) *Email {
+	if config.Port <= 0 {
+		config.Port = 25
+	}
+
+	em := &Email{}
+	em.config = config
+	return em
+}
+
+// Notify mails the event.
+func (em *Email) Notify(event Event) error {
+	var auth smtp.Auth
+	if em.config.Username != "" {
+		auth = smtp.PlainAuth("", em.config.Username, em.config.Password, em.config.Host)
+	}
+
+	subject := fmt.Sprintf("[tayni] %s", event)
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", em.config.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(em.config.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", event.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n", event.Message)
+
+	addr := fmt.Sprintf("%s:%d", em.config.Host, em.config.Port)
+	return smtp.SendMail(addr, auth, em.config.From, em.config.To, body.Bytes())
+}
+
+// File appends every event to a file, one line each, or writes it to the
+// log when there is no path.
+type File struct {
+	path string
+	mu   *sync.Mutex
+}
+
+// NewFile creates the file sink of path, the log sink when empty.
+func NewFile(path string) *File {
+	fl := &File{}
+	fl.path = path
+	fl.mu = &sync.Mutex{}
+	return fl
+}
+
+// Notify writes the event.
+func (fl *File) Notify(event Event) error {
+	message := strings.Join(strings.Fields(event.Message), " ")
+
+	if fl.path == "" {
+		entry := log.WithField("notify", event.Type)
+		switch event.Severity {
+		case Critical:
+			entry.Errorf("%s %s", event, message)
+		case Warning:
+			entry.Warnf("%s %s", event, message)
+		default:
+			entry.Infof("%s %s", event, message)
+		}
+		return nil
+	}
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	file, err := os.OpenFile(fl.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s %s %s\n", event.Date.Format(time.RFC3339), event, message)
+	return err
+}
+
+// Twitter tweets the message of every event. It does nothing while the
+// tweets are off.
+type Twitter struct {
+	tc *twitter.TwitterClient
+}
+
+// NewTwitter creates the Twitter sink of tc.
+func NewTwitter(tc *twitter.TwitterClient) *Twitter {
+	return &Twitter{tc: tc}
+}
+
+// Notify tweets the event.
+func (tw *Twitter) Notify(event Event) error {
+	if tw.tc == nil || !tw.tc.Enabled() {
+		log.Debug("Tweets are off: ", event)
+		return nil
+	}
+	return tw.tc.Twit(event.Message)
+}
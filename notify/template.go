@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/spf13/viper"
+)
+
+// DefaultTemplate is the name of the fallback template
+const DefaultTemplate = "default"
+
+// Transition of the FSM that caused an event
+type Transition struct {
+	Event string
+	From  string
+	To    string
+}
+
+// Data is what the templates can use. PnL is the profit and loss of the
+// position, in the quote currency, realized by a filled sell. Amount and
+// Price are the fill of a trade in base units, zero when no order was
+// placed.
+type Data struct {
+	Exchange   string
+	Pair       string
+	Base       string
+	Quote      string
+	Event      string
+	Indicators movingstats.Indicators
+	Transition Transition
+	PnL        float64
+	Amount     float64
+	Price      float64
+	Time       time.Time
+}
+
+// NewData fills the data of an event of pair, splitting it in its base and
+// quote currencies.
+func NewData(exchange, pair, event string, indicators movingstats.Indicators) Data {
+	data := Data{Exchange: exchange, Pair: pair, Event: event, Indicators: indicators}
+	data.Base, data.Quote, _ = execution.SplitPair(pair)
+	data.Time = time.Now().UTC()
+	return data
+}
+
+const defaultBuyTemplate = `TayniBot (beta tests) says: {{if eq .Quote "BTC"}}{{.Base}} is outperforming BTC.
+Watch for {{.Base}} buy signal{{else}}BUY {{.Pair}}{{end}}
+ema : {{printf "%f" .Indicators.Ema}}
+sma : {{printf "%f" .Indicators.Sma}}
+last: {{printf "%f" .Indicators.LastValue}}
+ATRP: {{printf "%f" .Indicators.ATRP}}
+PDMI: {{printf "%f" .Indicators.PDI}}
+MDMI: {{printf "%f" .Indicators.MDI}}
+{{if .Amount}}fill: {{printf "%f" .Amount}} {{.Base}} at {{printf "%f" .Price}}
+{{end}}time: {{.Time}}
+`
+
+const defaultSellTemplate = `TayniBot (beta tests) says: {{if eq .Quote "BTC"}}{{.Base}} is downperforming BTC.
+Watch for BTC buy signal{{else}}SELL {{.Pair}}{{end}}
+ema : {{printf "%f" .Indicators.Ema}}
+sma : {{printf "%f" .Indicators.Sma}}
+last: {{printf "%f" .Indicators.LastValue}}
+ATRP: {{printf "%f" .Indicators.ATRP}}
+PDMI: {{printf "%f" .Indicators.PDI}}
+MDMI: {{printf "%f" .Indicators.MDI}}
+PnL : {{printf "%f" .PnL}} {{.Quote}}
+{{if .Amount}}fill: {{printf "%f" .Amount}} {{.Base}} at {{printf "%f" .Price}}
+{{end}}time: {{.Time}}
+`
+
+const defaultEventTemplate = `TayniBot (beta tests) says: {{.Event}} {{.Pair}} ({{.Transition.From}} -> {{.Transition.To}})
+last: {{printf "%f" .Indicators.LastValue}}
+time: {{.Time}}
+`
+
+// Templates render the message of the events. A message comes from the
+// template of the pair and event, the default of the pair, the template of
+// the event or the default, the first found.
+type Templates struct {
+	events map[string]*template.Template
+	pairs  map[string]map[string]*template.Template
+}
+
+// NewTemplates parses the templates of the events and of the pairs, both
+// keyed by event name or DefaultTemplate. The built in buy, sell and
+// default templates are used when not given.
+func NewTemplates(events map[string]string, pairs map[string]map[string]string) (*Templates, error) {
+	tp := &Templates{}
+	tp.events = make(map[string]*template.Template)
+	tp.pairs = make(map[string]map[string]*template.Template)
+
+	builtIn := map[string]string{
+		EventBuy:        defaultBuyTemplate,
+		EventSell:       defaultSellTemplate,
+		DefaultTemplate: defaultEventTemplate,
+	}
+	for event, text := range builtIn {
+		if _, ok := events[event]; !ok {
+			tp.events[event] = template.Must(template.New(event).Parse(text))
+		}
+	}
+
+	for event, text := range events {
+		tmpl, err := template.New(event).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template of %s: %s", event, err.Error())
+		}
+		tp.events[strings.ToLower(event)] = tmpl
+	}
+
+	for pair, pairEvents := range pairs {
+		pair = strings.ToUpper(pair)
+		tp.pairs[pair] = make(map[string]*template.Template)
+		for event, text := range pairEvents {
+			tmpl, err := template.New(pair + "_" + event).Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("template of %s %s: %s", pair, event, err.Error())
+			}
+			tp.pairs[pair][strings.ToLower(event)] = tmpl
+		}
+	}
+
+	return tp, nil
+}
+
+// DefaultTemplates returns the built in templates.
+func DefaultTemplates() *Templates {
+	tp, _ := NewTemplates(nil, nil)
+	return tp
+}
+
+// LoadTemplates reads the templates of the configuration, text/template
+// with Data. Wording changes only need a restart.
+//
+//	[notify.templates]
+//	default = "{{.Event}} {{.Pair}} at {{.Indicators.LastValue}}"
+//	buy = "BUY {{.Base}} with {{.Quote}} at {{.Indicators.LastValue}}"
+//
+//	[notify.templates.pairs.ETHBTC]
+//	sell = "ETH is weaker than BTC, PnL {{printf \"%.8f\" .PnL}}"
+func LoadTemplates() (*Templates, error) {
+	events := make(map[string]string)
+	pairs := make(map[string]map[string]string)
+
+	for event, text := range viper.GetStringMap("notify.templates") {
+		if event == "pairs" {
+			continue
+		}
+		if text, ok := text.(string); ok {
+			events[event] = text
+		}
+	}
+
+	for pair := range viper.GetStringMap("notify.templates.pairs") {
+		pairs[pair] = viper.GetStringMapString(fmt.Sprintf("notify.templates.pairs.%s", pair))
+	}
+
+	return NewTemplates(events, pairs)
+}
+
+// lookup returns the template of an event of pair
+func (tp *Templates) lookup(pair, event string) *template.Template {
+	event = strings.ToLower(event)
+	if pairEvents, ok := tp.pairs[strings.ToUpper(pair)]; ok {
+		if tmpl, ok := pairEvents[event]; ok {
+			return tmpl
+		}
+		if tmpl, ok := pairEvents[DefaultTemplate]; ok {
+			return tmpl
+		}
+	}
+	if tmpl, ok := tp.events[event]; ok {
+		return tmpl
+	}
+	return tp.events[DefaultTemplate]
+}
+
+// Render renders the message of data.Event.
+func (tp *Templates) Render(data Data) (string, error) {
+	var message bytes.Buffer
+	if err := tp.lookup(data.Pair, data.Event).Execute(&message, data); err != nil {
+		return "", fmt.Errorf("rendering %s of %s: %s", data.Event, data.Pair, err.Error())
+	}
+	return message.String(), nil
+}
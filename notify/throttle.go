@@ -0,0 +1,260 @@
+package notify
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// EventDigest is the summary of the events batched for a sink
+const EventDigest = "digest"
+
+// ThrottleConfig limits what reaches the sinks. Identical events within
+// DedupeWindow, same title, message, price and amount, are sent once. A sink takes at most SinkRate events, and
+// PairRate events of a pair, per RateWindow, zero is unlimited. With a
+// Digest interval the events up to DigestSeverity, and the rate limited
+// ones, are batched into a periodic summary instead. Critical events are
+// never throttled.
+type ThrottleConfig struct {
+	DedupeWindow   time.Duration
+	RateWindow     time.Duration
+	SinkRate       int
+	PairRate       int
+	Digest         time.Duration
+	DigestSeverity Severity
+}
+
+const defaultRateWindow = time.Hour
+
+// LoadThrottleConfig reads the throttling of the notifications. It returns
+// false when they are not throttled.
+//
+//	[notify.throttle]
+//	dedupe_window = "10m"
+//	rate_window = "1h"
+//	sink_rate = 20
+//	pair_rate = 4
+//	digest = "1h"
+//	digest_severity = "info"
+func LoadThrottleConfig() (ThrottleConfig, bool, error) {
+	if !viper.IsSet("notify.throttle") {
+		return ThrottleConfig{}, false, nil
+	}
+
+	config := ThrottleConfig{}
+	config.DedupeWindow = viper.GetDuration("notify.throttle.dedupe_window")
+	config.RateWindow = viper.GetDuration("notify.throttle.rate_window")
+	config.SinkRate = viper.GetInt("notify.throttle.sink_rate")
+	config.PairRate = viper.GetInt("notify.throttle.pair_rate")
+	config.Digest = viper.GetDuration("notify.throttle.digest")
+
+	severity, err := ParseSeverity(viper.GetString("notify.throttle.digest_severity"))
+	if err != nil {
+		return config, false, err
+	}
+	config.DigestSeverity = severity
+
+	if config.DigestSeverity >= Critical {
+		return config, false, fmt.Errorf("critical events can not be digested")
+	}
+
+	return config, true, nil
+}
+
+type delivery struct {
+	date time.Time
+	pair string
+}
+
+// throttle keeps what was sent to decide what can be sent next
+type throttle struct {
+	config    ThrottleConfig
+	mu        *sync.Mutex
+	seen      map[string]time.Time
+	delivered map[string][]delivery
+	batched   map[string][]Event
+	since     time.Time
+}
+
+func newThrottle(config ThrottleConfig, now time.Time) *throttle {
+	if config.RateWindow <= 0 {
+		config.RateWindow = defaultRateWindow
+	}
+
+	th := &throttle{}
+	th.config = config
+	th.mu = &sync.Mutex{}
+	th.seen = make(map[string]time.Time)
+	th.delivered = make(map[string][]delivery)
+	th.batched = make(map[string][]Event)
+	th.since = now
+	return th
+}
+
+// duplicate tells if an identical event was notified within the window.
+// Trades and alerts repeat their titles, the message, price and amount
+// tell them apart.
+func (th *throttle) duplicate(event Event, now time.Time) bool {
+	if th.config.DedupeWindow <= 0 {
+		return false
+	}
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	for key, date := range th.seen {
+		if now.Sub(date) >= th.config.DedupeWindow {
+			delete(th.seen, key)
+		}
+	}
+
+	key := strings.Join([]string{event.Type, event.Severity.String(), event.Pair, event.Title, event.Message,
+		strconv.FormatFloat(event.Price, 'g', -1, 64), strconv.FormatFloat(event.Amount, 'g', -1, 64)}, "|")
+	if _, ok := th.seen[key]; ok {
+		return true
+	}
+	th.seen[key] = now
+	return false
+}
+
+// batch keeps the event for the digest of sink, it returns false when the
+// event should be sent at once
+func (th *throttle) batch(sink string, event Event, now time.Time) bool {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	digest := th.config.Digest > 0
+	if digest && event.Severity <= th.config.DigestSeverity {
+		th.batched[sink] = append(th.batched[sink], event)
+		return true
+	}
+
+	if th.allow(sink, event.Pair, now) {
+		return false
+	}
+
+	if digest {
+		th.batched[sink] = append(th.batched[sink], event)
+	}
+	return true
+}
+
+// allow counts a delivery to sink when within its rates
+func (th *throttle) allow(sink, pair string, now time.Time) bool {
+	recent := th.delivered[sink][:0]
+	pairCount := 0
+	for _, sent := range th.delivered[sink] {
+		if now.Sub(sent.date) < th.config.RateWindow {
+			recent = append(recent, sent)
+			if sent.pair == pair {
+				pairCount++
+			}
+		}
+	}
+	th.delivered[sink] = recent
+
+	if th.config.SinkRate > 0 && len(recent) >= th.config.SinkRate {
+		return false
+	}
+	if th.config.PairRate > 0 && pair != "" && pairCount >= th.config.PairRate {
+		return false
+	}
+
+	th.delivered[sink] = append(th.delivered[sink], delivery{date: now, pair: pair})
+	return true
+}
+
+// digests takes the batched events and returns the digest of every sink
+func (th *throttle) digests(now time.Time) map[string]Event {
+	th.mu.Lock()
+	batched := th.batched
+	since := th.since
+	th.batched = make(map[string][]Event)
+	th.since = now
+	th.mu.Unlock()
+
+	digests := make(map[string]Event)
+	for sink, events := range batched {
+		if len(events) > 0 {
+			digests[sink] = Digest(events, since, now)
+		}
+	}
+	return digests
+}
+
+type pairSummary struct {
+	counts map[string]int
+	price  float64
+	state  string
+}
+
+// Digest summarizes events: the count of every type, the last price and
+// the last state of each pair.
+func Digest(events []Event, since, now time.Time) Event {
+	summaries := make(map[string]*pairSummary)
+	severity := Info
+
+	for _, event := range events {
+		pair := event.Pair
+		if pair == "" {
+			pair = "-"
+		}
+		summary, ok := summaries[pair]
+		if !ok {
+			summary = &pairSummary{counts: make(map[string]int)}
+			summaries[pair] = summary
+		}
+		summary.counts[event.Type]++
+		if event.Price != 0 {
+			summary.price = event.Price
+		}
+		if event.State != "" {
+			summary.state = event.State
+		}
+		if event.Severity > severity {
+			severity = event.Severity
+		}
+	}
+
+	pairs := make([]string, 0, len(summaries))
+	for pair := range summaries {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "%d events from %s to %s\n", len(events),
+		since.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+
+	for _, pair := range pairs {
+		summary := summaries[pair]
+
+		types := make([]string, 0, len(summary.counts))
+		for eventType := range summary.counts {
+			types = append(types, eventType)
+		}
+		sort.Strings(types)
+
+		counts := make([]string, len(types))
+		for i, eventType := range types {
+			counts[i] = fmt.Sprintf("%s %d", eventType, summary.counts[eventType])
+		}
+
+		fmt.Fprintf(&message, "%s: %s", pair, strings.Join(counts, ", "))
+		if summary.price != 0 {
+			fmt.Fprintf(&message, ", last %f", summary.price)
+		}
+		if summary.state != "" {
+			fmt.Fprintf(&message, ", state %s", summary.state)
+		}
+		message.WriteString("\n")
+	}
+
+	return Event{Type: EventDigest, Severity: severity, Title: fmt.Sprintf("Digest of %d events", len(events)),
+		Message: message.String(), Date: now}
+}
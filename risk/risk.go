@@ -0,0 +1,323 @@
+// Package risk sizes positions, caps exposure and decides when an open
+// position must be closed by a stop-loss, a take-profit or a trailing stop,
+// independently of the indicator signals.
+package risk
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/execution"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// SizeFixed buys a fixed value of quote currency
+	SizeFixed = "fixed"
+	// SizeEquity buys a fraction of the equity
+	SizeEquity = "equity"
+)
+
+// Exit reasons
+const (
+	StopLoss     = "stop_loss"
+	TakeProfit   = "take_profit"
+	TrailingStop = "trailing_stop"
+)
+
+// Config is the risk configuration of a pair. Amounts and exposures are in
+// the quote currency of the pair, stops are percentages of the entry price
+// (of the highest price since entry for the trailing stop). A zero stop is
+// disabled.
+type Config struct {
+	Sizing       string
+	Amount       float64
+	Fraction     float64
+	Equity       float64
+	MaxExposure  float64
+	StopLoss     float64
+	TakeProfit   float64
+	TrailingStop float64
+}
+
+// Position is an open position of a pair.
+type Position struct {
+	Pair   string    `json:"pair"`
+	Amount float64   `json:"amount"`
+	Entry  float64   `json:"entry"`
+	High   float64   `json:"high"`
+	Opened time.Time `json:"opened"`
+}
+
+// Exposure is the quote currency value of the position at entry.
+func (pos Position) Exposure() float64 {
+	return pos.Amount * pos.Entry
+}
+
+// Manager keeps the open positions of all pairs. Total exposure is capped
+// per quote currency.
+type Manager struct {
+	mu               *sync.Mutex
+	configs          map[string]Config
+	defaultConfig    Config
+	maxTotalExposure float64
+	positions        map[string]*Position
+}
+
+// NewManager creates a risk manager. maxTotalExposure caps the sum of the
+// exposures sharing a quote currency, zero disables the cap.
+func NewManager(defaultConfig Config, maxTotalExposure float64) *Manager {
+	rm := &Manager{}
+	rm.mu = &sync.Mutex{}
+	rm.configs = make(map[string]Config)
+	rm.defaultConfig = defaultConfig
+	rm.maxTotalExposure = maxTotalExposure
+	rm.positions = make(map[string]*Position)
+	return rm
+}
+
+// LoadManager creates the risk manager from the configuration. Settings
+// under risk.pairs.<PAIR> override the risk defaults. It returns false when
+// risk management is not configured.
+//
+//	[risk]
+//	sizing = "equity"          # or "fixed"
+//	fraction = 0.1             # of equity, for equity sizing
+//	amount = 100.0             # quote currency, for fixed sizing
+//	equity = 1000.0            # used when the executor can not report balances
+//	max_exposure = 500.0       # per pair, quote currency
+//	max_total_exposure = 800.0 # per quote currency
+//	stop_loss = 5.0            # percent
+//	take_profit = 10.0         # percent
+//	trailing_stop = 3.0        # percent
+//
+//	[risk.pairs.ETHBTC]
+//	amount = 0.05
+func LoadManager(pairs []string) (*Manager, bool) {
+	if !viper.IsSet("risk") {
+		return nil, false
+	}
+
+	rm := NewManager(loadConfig(""), viper.GetFloat64("risk.max_total_exposure"))
+
+	for _, pair := range pairs {
+		rm.SetConfig(pair, loadConfig(pair))
+	}
+
+	return rm, true
+}
+
+func loadConfig(pair string) Config {
+	key := func(name string) string {
+		pairKey := fmt.Sprintf("risk.pairs.%s.%s", strings.ToLower(pair), name)
+		if pair != "" && viper.IsSet(pairKey) {
+			return pairKey
+		}
+		return fmt.Sprintf("risk.%s", name)
+	}
+
+	config := Config{}
+	config.Sizing = viper.GetString(key("sizing"))
+	config.Amount = viper.GetFloat64(key("amount"))
+	config.Fraction = viper.GetFloat64(key("fraction"))
+	config.Equity = viper.GetFloat64(key("equity"))
+	config.MaxExposure = viper.GetFloat64(key("max_exposure"))
+	config.StopLoss = viper.GetFloat64(key("stop_loss"))
+	config.TakeProfit = viper.GetFloat64(key("take_profit"))
+	config.TrailingStop = viper.GetFloat64(key("trailing_stop"))
+
+	if config.Sizing == "" {
+		config.Sizing = SizeFixed
+	}
+
+	return config
+}
+
+// SetConfig sets the risk configuration of a pair.
+func (rm *Manager) SetConfig(pair string, config Config) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.configs[pair] = config
+}
+
+// Config returns the risk configuration of a pair.
+func (rm *Manager) Config(pair string) Config {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.config(pair)
+}
+
+func (rm *Manager) config(pair string) Config {
+	if config, ok := rm.configs[pair]; ok {
+		return config
+	}
+	return rm.defaultConfig
+}
+
+// exposure returns the exposure of the positions quoted in quote
+func (rm *Manager) exposure(quote string) float64 {
+	total := float64(0)
+	for pair, pos := range rm.positions {
+		if _, posQuote, err := execution.SplitPair(pair); err == nil && posQuote == quote {
+			total += pos.Exposure()
+		}
+	}
+	return total
+}
+
+// Size returns the base currency amount to buy for pair at price. balance
+// is the free quote currency balance, or a negative value when unknown, in
+// which case the configured equity is used. The amount is reduced to fit
+// the pair and total exposure caps.
+func (rm *Manager) Size(pair string, price, balance float64) (float64, error) {
+	if price <= 0 {
+		return 0, fmt.Errorf("risk sizing %s: bad price %f", pair, price)
+	}
+
+	_, quote, err := execution.SplitPair(pair)
+	if err != nil {
+		return 0, err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	config := rm.config(pair)
+	exposure := rm.exposure(quote)
+
+	var value float64
+
+	switch config.Sizing {
+	case SizeEquity:
+		equity := config.Equity
+		if balance >= 0 {
+			equity = balance + exposure
+		}
+		value = equity * config.Fraction
+	case SizeFixed:
+		value = config.Amount
+	default:
+		return 0, fmt.Errorf("risk sizing %s: unknown sizing %s", pair, config.Sizing)
+	}
+
+	if pos, ok := rm.positions[pair]; ok && config.MaxExposure > 0 {
+		if room := config.MaxExposure - pos.Exposure(); value > room {
+			value = room
+		}
+	} else if config.MaxExposure > 0 && value > config.MaxExposure {
+		value = config.MaxExposure
+	}
+
+	if rm.maxTotalExposure > 0 {
+		if room := rm.maxTotalExposure - exposure; value > room {
+			value = room
+		}
+	}
+
+	if balance >= 0 && value > balance {
+		value = balance
+	}
+
+	if value <= 0 {
+		return 0, fmt.Errorf("risk sizing %s: no room left, exposure %f %s", pair, exposure, quote)
+	}
+
+	return value / price, nil
+}
+
+// Open records a fill of a buy. Adding to an open position averages the
+// entry price.
+func (rm *Manager) Open(pair string, amount, price float64, now time.Time) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	pos, ok := rm.positions[pair]
+	if !ok {
+		rm.positions[pair] = &Position{Pair: pair, Amount: amount, Entry: price, High: price, Opened: now}
+		log.Infof("Risk position opened for %s: %f at %f", pair, amount, price)
+		return
+	}
+
+	pos.Entry = (pos.Entry*pos.Amount + price*amount) / (pos.Amount + amount)
+	pos.Amount += amount
+	if price > pos.High {
+		pos.High = price
+	}
+}
+
+// Reduce records a fill of a sell, the position is closed once it is
+// fully sold.
+func (rm *Manager) Reduce(pair string, amount float64) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	pos, ok := rm.positions[pair]
+	if !ok {
+		return
+	}
+
+	pos.Amount -= amount
+	if pos.Amount <= 1e-12 {
+		delete(rm.positions, pair)
+		log.Infof("Risk position closed for %s", pair)
+	}
+}
+
+// Restore puts back a position saved by a previous run, replacing the
+// open position of its pair.
+func (rm *Manager) Restore(pos Position) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if pos.Amount <= 0 {
+		delete(rm.positions, pos.Pair)
+		return
+	}
+
+	rm.positions[pos.Pair] = &pos
+	log.Infof("Risk position restored for %s: %f at %f", pos.Pair, pos.Amount, pos.Entry)
+}
+
+// Position returns the open position of pair.
+func (rm *Manager) Position(pair string) (Position, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	pos, ok := rm.positions[pair]
+	if !ok {
+		return Position{}, false
+	}
+	return *pos, true
+}
+
+// Check updates the position of pair with a new price and returns the
+// reason to exit it, if any.
+func (rm *Manager) Check(pair string, price float64) (reason string, exit bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	pos, ok := rm.positions[pair]
+	if !ok || price <= 0 {
+		return "", false
+	}
+
+	if price > pos.High {
+		pos.High = price
+	}
+
+	config := rm.config(pair)
+
+	switch {
+	case config.StopLoss > 0 && price <= pos.Entry*(1-config.StopLoss/100):
+		return StopLoss, true
+	case config.TakeProfit > 0 && price >= pos.Entry*(1+config.TakeProfit/100):
+		return TakeProfit, true
+	case config.TrailingStop > 0 && price <= pos.High*(1-config.TrailingStop/100):
+		return TrailingStop, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,113 @@
+package risk_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/risk"
+)
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	os.Exit(m.Run())
+}
+
+func almost(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestSizeFixed(t *testing.T) {
+
+	rm := risk.NewManager(risk.Config{Sizing: risk.SizeFixed, Amount: 100}, 0)
+
+	amount, err := rm.Size("BTCUSD", 4000, -1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !almost(amount, 0.025) {
+		t.Error("Bad fixed size: ", amount)
+	}
+
+	// Not enough balance
+	amount, err = rm.Size("BTCUSD", 4000, 40)
+	if err != nil || !almost(amount, 0.01) {
+		t.Error("Size should be limited by balance: ", amount, err)
+	}
+}
+
+func TestSizeEquityAndCaps(t *testing.T) {
+
+	rm := risk.NewManager(risk.Config{Sizing: risk.SizeEquity, Fraction: 0.5, MaxExposure: 300}, 400)
+	now := time.Now()
+
+	// Half of 1000, capped at 300 for the pair
+	amount, err := rm.Size("BTCUSD", 100, 1000)
+	if err != nil || !almost(amount, 3) {
+		t.Error("Size should be capped by pair exposure: ", amount, err)
+	}
+
+	rm.Open("BTCUSD", 3, 100, now)
+
+	// Equity is 700 free plus 300 exposed, only 100 left of the total cap
+	amount, err = rm.Size("ETHUSD", 10, 700)
+	if err != nil || !almost(amount, 10) {
+		t.Error("Size should be capped by total exposure: ", amount, err)
+	}
+
+	// Other quote currencies have their own total
+	amount, err = rm.Size("ETHBTC", 0.1, 1)
+	if err != nil || !almost(amount, 5) {
+		t.Error("Bad size for BTC quoted pair: ", amount, err)
+	}
+
+	rm.Open("ETHUSD", 10, 10, now)
+
+	if _, err := rm.Size("BCHUSD", 10, 600); err == nil {
+		t.Error("Expected error with no exposure left")
+	}
+
+	rm.Reduce("ETHUSD", 10)
+
+	if _, ok := rm.Position("ETHUSD"); ok {
+		t.Error("Sold position should be closed")
+	}
+}
+
+func TestStops(t *testing.T) {
+
+	rm := risk.NewManager(risk.Config{Sizing: risk.SizeFixed, Amount: 100, StopLoss: 5, TakeProfit: 10, TrailingStop: 3}, 0)
+	rm.Open("BTCUSD", 1, 100, time.Now())
+
+	if _, exit := rm.Check("BTCUSD", 102); exit {
+		t.Error("No stop should be hit at 102")
+	}
+
+	if reason, exit := rm.Check("BTCUSD", 98.9); !exit || reason != risk.TrailingStop {
+		t.Error("Trailing stop should be hit 3% below 102: ", reason)
+	}
+
+	if reason, exit := rm.Check("BTCUSD", 110.5); !exit || reason != risk.TakeProfit {
+		t.Error("Take profit should be hit above 110: ", reason)
+	}
+
+	rm.Reduce("BTCUSD", 1)
+	rm.SetConfig("BTCUSD", risk.Config{Sizing: risk.SizeFixed, StopLoss: 5})
+	rm.Open("BTCUSD", 1, 100, time.Now())
+
+	if reason, exit := rm.Check("BTCUSD", 95); !exit || reason != risk.StopLoss {
+		t.Error("Stop loss should be hit at 95: ", reason)
+	}
+
+	if _, exit := rm.Check("ETHUSD", 1); exit {
+		t.Error("No stop without position")
+	}
+}
@@ -0,0 +1,280 @@
+package statistician
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ConfluenceCount requires at least MinAgree timeframes to agree
+	ConfluenceCount = "count"
+	// ConfluenceWeighted requires the weighted vote to reach Threshold
+	ConfluenceWeighted = "weighted"
+)
+
+// ConfluenceConfig describes how the signals of several timeframes are
+// combined into a single one.
+type ConfluenceConfig struct {
+	Timeframes []int
+	Weights    []float64
+	Mode       string
+	MinAgree   int
+	Threshold  float64
+}
+
+// ConfluenceSignal is the combined signal published as JSON in the
+// <EX>_<pair>_CONFLUENCE key.
+type ConfluenceSignal struct {
+	Name       string  `json:"name"`
+	Date       string  `json:"date"`
+	Mode       string  `json:"mode"`
+	Timeframes []int   `json:"timeframes"`
+	Buy        bool    `json:"buy"`
+	Sell       bool    `json:"sell"`
+	BuyScore   float64 `json:"buy_score"`
+	SellScore  float64 `json:"sell_score"`
+	BuyAgree   []int   `json:"buy_agree"`
+	SellAgree  []int   `json:"sell_agree"`
+}
+
+// LoadConfluenceConfig reads the confluence section of the configuration:
+//
+//	[confluence]
+//	timeframes = [120, 60, 30]
+//	weights = [3, 2, 1]  # optional, defaults to 1 per timeframe
+//	mode = "count"       # or "weighted"
+//	min_agree = 2        # count mode
+//	threshold = 0.6      # weighted mode, fraction of the total weight
+//
+// It returns false when confluence is not configured, and an error when a
+// timeframe or weight is not a number or the mode is unknown.
+func LoadConfluenceConfig() (config ConfluenceConfig, ok bool, err error) {
+
+	if !viper.IsSet("confluence.timeframes") {
+		return config, false, nil
+	}
+
+	timeframesInterface, isList := viper.Get("confluence.timeframes").([]interface{})
+	if !isList {
+		return config, false, fmt.Errorf("confluence.timeframes is not a list")
+	}
+
+	config.Timeframes = make([]int, len(timeframesInterface))
+	for i, minutes := range timeframesInterface {
+		switch m := minutes.(type) {
+		case int64:
+			config.Timeframes[i] = int(m)
+		case int:
+			config.Timeframes[i] = m
+		default:
+			return config, false, fmt.Errorf("confluence.timeframes: bad timeframe %v", minutes)
+		}
+	}
+
+	config.Weights = make([]float64, len(config.Timeframes))
+	for i := range config.Weights {
+		config.Weights[i] = 1
+	}
+
+	if viper.IsSet("confluence.weights") {
+		weightsInterface, isList := viper.Get("confluence.weights").([]interface{})
+		if !isList {
+			return config, false, fmt.Errorf("confluence.weights is not a list")
+		}
+		if len(weightsInterface) != len(config.Timeframes) {
+			return config, false, fmt.Errorf("confluence.weights: %d weights for %d timeframes",
+				len(weightsInterface), len(config.Timeframes))
+		}
+		for i, weight := range weightsInterface {
+			switch w := weight.(type) {
+			case int64:
+				config.Weights[i] = float64(w)
+			case int:
+				config.Weights[i] = float64(w)
+			case float64:
+				config.Weights[i] = w
+			default:
+				return config, false, fmt.Errorf("confluence.weights: bad weight %v", weight)
+			}
+			if config.Weights[i] < 0 {
+				return config, false, fmt.Errorf("confluence.weights: negative weight %v", weight)
+			}
+		}
+	}
+
+	config.Mode = ConfluenceCount
+	if viper.IsSet("confluence.mode") {
+		config.Mode = viper.GetString("confluence.mode")
+	}
+
+	switch config.Mode {
+	case ConfluenceCount, ConfluenceWeighted:
+	default:
+		return config, false, fmt.Errorf("unknown confluence mode: %s", config.Mode)
+	}
+
+	config.MinAgree = len(config.Timeframes)
+	if viper.IsSet("confluence.min_agree") {
+		config.MinAgree = viper.GetInt("confluence.min_agree")
+	}
+
+	config.Threshold = 1
+	if viper.IsSet("confluence.threshold") {
+		config.Threshold = viper.GetFloat64("confluence.threshold")
+	}
+
+	// ----------------------------------
+	// A vote that can not fail leaves the
+	// BUY and SELL signals always on
+	// ----------------------------------
+	if config.MinAgree <= 0 || config.MinAgree > len(config.Timeframes) {
+		return config, false, fmt.Errorf("confluence.min_agree %d out of 1 to %d", config.MinAgree, len(config.Timeframes))
+	}
+
+	if config.Threshold <= 0 || config.Threshold > 1 {
+		return config, false, fmt.Errorf("confluence.threshold %f out of (0, 1]", config.Threshold)
+	}
+
+	totalWeight := float64(0)
+	for _, weight := range config.Weights {
+		totalWeight += weight
+	}
+	if totalWeight <= 0 {
+		return config, false, fmt.Errorf("confluence.weights are all zero")
+	}
+
+	return config, true, nil
+}
+
+// Confluence combines the BUY & SELL signals of the minute strategies of
+// a statistician.
+type Confluence struct {
+	ID     string
+	config ConfluenceConfig
+
+	buyFilter  *signalFilter
+	sellFilter *signalFilter
+
+	mu     *sync.Mutex
+	latest ConfluenceSignal
+}
+
+func NewConfluence(ID string, config ConfluenceConfig, signalConfig SignalConfig) *Confluence {
+	cf := &Confluence{}
+	cf.ID = ID
+	cf.config = config
+	cf.buyFilter = newSignalFilter(signalConfig)
+	cf.sellFilter = newSignalFilter(signalConfig)
+	cf.mu = &sync.Mutex{}
+	return cf
+}
+
+// vote returns the score of the agreeing timeframes and whether the combined
+// signal is on. The score is the count of agreeing timeframes in count mode
+// and the fraction of the total weight in weighted mode.
+func (cf *Confluence) vote(signals map[int]bool) (score float64, agree []int, on bool) {
+
+	agree = []int{}
+	totalWeight := float64(0)
+
+	for i, minutes := range cf.config.Timeframes {
+		totalWeight += cf.config.Weights[i]
+		if signals[minutes] {
+			agree = append(agree, minutes)
+			score += cf.config.Weights[i]
+		}
+	}
+
+	switch cf.config.Mode {
+	case ConfluenceWeighted:
+		if totalWeight > 0 {
+			score = score / totalWeight
+		}
+		on = score >= cf.config.Threshold
+	default:
+		score = float64(len(agree))
+		on = len(agree) >= cf.config.MinAgree
+	}
+
+	return score, agree, on
+}
+
+// Update computes the combined signal from the per timeframe signals and
+// returns it together with whether it has to be published.
+func (cf *Confluence) Update(buySignals, sellSignals map[int]bool, now time.Time) (signal ConfluenceSignal, publish bool) {
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	buyScore, buyAgree, rawBuy := cf.vote(buySignals)
+	sellScore, sellAgree, rawSell := cf.vote(sellSignals)
+
+	buy, publishBuy := cf.buyFilter.update(rawBuy, now)
+	sell, publishSell := cf.sellFilter.update(rawSell, now)
+
+	if buy != cf.latest.Buy {
+		log.Infof("CONFLUENCE BUY CHANGE for %s :%v %v", cf.ID, buy, buyAgree)
+	}
+	if sell != cf.latest.Sell {
+		log.Infof("CONFLUENCE SELL CHANGE for %s :%v %v", cf.ID, sell, sellAgree)
+	}
+
+	cf.latest = ConfluenceSignal{
+		Name:       cf.ID,
+		Date:       now.UTC().Format(time.RFC3339),
+		Mode:       cf.config.Mode,
+		Timeframes: cf.config.Timeframes,
+		Buy:        buy,
+		Sell:       sell,
+		BuyScore:   buyScore,
+		SellScore:  sellScore,
+		BuyAgree:   buyAgree,
+		SellAgree:  sellAgree,
+	}
+
+	return cf.latest, publishBuy || publishSell
+}
+
+// Latest returns the last computed combined signal.
+func (cf *Confluence) Latest() ConfluenceSignal {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return cf.latest
+}
+
+// publishConfluence stores the combined signal in the retained
+// <EX>_<pair>_CONFLUENCE key and publishes it, together with the boolean
+// <EX>_<pair>_CONFLUENCE_BUY & _SELL signals.
+func (st *Statistician) publishConfluence(signal ConfluenceSignal) {
+
+	key := fmt.Sprintf("%s_CONFLUENCE", st.key)
+
+	signalJSON, err := json.Marshal(signal)
+	if err != nil {
+		log.Error("confluence marshal: ", err.Error())
+		return
+	}
+
+	if err := st.kr.Set(key, string(signalJSON)); err != nil {
+		log.Errorf("Setting retained confluence: %s", key)
+	}
+	if err := st.kr.Publish(key, string(signalJSON)); err != nil {
+		log.Errorf("Publishing to: %s", key)
+	}
+
+	for suffix, value := range map[string]bool{"BUY": signal.Buy, "SELL": signal.Sell} {
+		signalKey := fmt.Sprintf("%s_%s", key, suffix)
+		valueStr := fmt.Sprintf("%v", value)
+		if err := st.kr.Set(signalKey, valueStr); err != nil {
+			log.Errorf("Setting retained signal: %s -> %s ", signalKey, valueStr)
+		}
+		if err := st.kr.Publish(signalKey, valueStr); err != nil {
+			log.Errorf("Publishing to: %s -> %s ", signalKey, valueStr)
+		}
+	}
+}
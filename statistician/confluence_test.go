@@ -0,0 +1,138 @@
+package statistician
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfluenceCount(t *testing.T) {
+
+	config := ConfluenceConfig{
+		Timeframes: []int{120, 60, 30},
+		Weights:    []float64{1, 1, 1},
+		Mode:       ConfluenceCount,
+		MinAgree:   2,
+	}
+
+	cf := NewConfluence("TEST_PAIR", config, DefaultSignalConfig())
+	now := time.Now()
+
+	signal, publish := cf.Update(map[int]bool{120: true}, map[int]bool{}, now)
+	if signal.Buy || !publish {
+		t.Error("one of three timeframes should not buy: ", signal)
+	}
+
+	signal, publish = cf.Update(map[int]bool{120: true, 30: true}, map[int]bool{}, now.Add(time.Second))
+	if !signal.Buy || !publish {
+		t.Error("two of three timeframes should buy: ", signal)
+	}
+
+	if !reflect.DeepEqual(signal.BuyAgree, []int{120, 30}) {
+		t.Error("bad agreeing timeframes: ", signal.BuyAgree)
+	}
+
+	if signal.BuyScore != 2 {
+		t.Error("bad buy score: ", signal.BuyScore)
+	}
+
+	if _, publish = cf.Update(map[int]bool{120: true, 30: true}, map[int]bool{}, now.Add(2*time.Second)); publish {
+		t.Error("unchanged confluence should not be published")
+	}
+}
+
+func TestConfluenceWeighted(t *testing.T) {
+
+	config := ConfluenceConfig{
+		Timeframes: []int{120, 60, 30},
+		Weights:    []float64{3, 2, 1},
+		Mode:       ConfluenceWeighted,
+		Threshold:  0.5,
+	}
+
+	cf := NewConfluence("TEST_PAIR", config, DefaultSignalConfig())
+	now := time.Now()
+
+	signal, _ := cf.Update(map[int]bool{60: true, 30: true}, map[int]bool{120: true}, now)
+	if !signal.Buy {
+		t.Error("half of the weight should buy: ", signal)
+	}
+	if !signal.Sell {
+		t.Error("half of the weight should sell: ", signal)
+	}
+
+	signal, _ = cf.Update(map[int]bool{30: true}, map[int]bool{}, now.Add(time.Second))
+	if signal.Buy || signal.Sell {
+		t.Error("one sixth of the weight should not buy or sell: ", signal)
+	}
+}
+
+func TestLoadConfluenceConfig(t *testing.T) {
+
+	defer func() {
+		viper.Set("confluence.timeframes", nil)
+		viper.Set("confluence.weights", nil)
+		viper.Set("confluence.mode", nil)
+		viper.Set("confluence.min_agree", nil)
+		viper.Set("confluence.threshold", nil)
+	}()
+
+	viper.Set("confluence.timeframes", []interface{}{int64(120), 60})
+	viper.Set("confluence.weights", []interface{}{2.5, int64(1)})
+	viper.Set("confluence.mode", ConfluenceWeighted)
+
+	config, ok, err := LoadConfluenceConfig()
+	if err != nil || !ok {
+		t.Fatal("confluence not loaded: ", err)
+	}
+	if !reflect.DeepEqual(config.Timeframes, []int{120, 60}) || !reflect.DeepEqual(config.Weights, []float64{2.5, 1}) {
+		t.Error("bad confluence config: ", config)
+	}
+
+	viper.Set("confluence.mode", "majority")
+	if _, _, err := LoadConfluenceConfig(); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+
+	// ----------------------------------
+	// Votes that are always on or off
+	// ----------------------------------
+	viper.Set("confluence.mode", ConfluenceWeighted)
+	bad := []struct {
+		key   string
+		value interface{}
+	}{
+		{"confluence.min_agree", 0},
+		{"confluence.min_agree", 3},
+		{"confluence.threshold", 0.0},
+		{"confluence.threshold", 1.5},
+		{"confluence.weights", []interface{}{1.0}},
+		{"confluence.weights", []interface{}{1.0, 2.0, 3.0}},
+		{"confluence.weights", []interface{}{2.0, -1.0}},
+		{"confluence.weights", []interface{}{0.0, 0.0}},
+	}
+	for _, tc := range bad {
+		viper.Set("confluence.weights", []interface{}{2.5, int64(1)})
+		viper.Set("confluence.min_agree", nil)
+		viper.Set("confluence.threshold", nil)
+		viper.Set(tc.key, tc.value)
+		if _, _, err := LoadConfluenceConfig(); err == nil {
+			t.Errorf("expected error for %s = %v", tc.key, tc.value)
+		}
+	}
+	viper.Set("confluence.min_agree", nil)
+	viper.Set("confluence.threshold", nil)
+
+	viper.Set("confluence.mode", ConfluenceCount)
+	viper.Set("confluence.weights", []interface{}{"heavy"})
+	if _, _, err := LoadConfluenceConfig(); err == nil {
+		t.Error("expected error for string weight")
+	}
+
+	viper.Set("confluence.timeframes", []interface{}{30.5})
+	if _, _, err := LoadConfluenceConfig(); err == nil {
+		t.Error("expected error for float timeframe")
+	}
+}
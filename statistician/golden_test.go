@@ -0,0 +1,208 @@
+package statistician_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/statistician"
+	"github.com/spf13/viper"
+)
+
+// go test ./statistician -run TestGoldenIndicators -update
+var update = flag.Bool("update", false, "regenerate the golden indicator files")
+
+const (
+	goldenPrices     = "testdata/prices.txt"
+	goldenSampleRate = 60
+	goldenEvery      = 40
+
+	// Tolerances used to compare float indicators
+	goldenAbsTolerance = 1e-9
+	goldenRelTolerance = 1e-9
+)
+
+// goldenWindows are the configured minute_strategies, each with its golden
+// file, a new window needs -update
+func goldenWindows(t *testing.T) []int {
+	strategies, ok := viper.Get("minute_strategies").([]interface{})
+	if !ok || len(strategies) == 0 {
+		t.Fatal("minute_strategies is not configured")
+	}
+
+	windows := make([]int, len(strategies))
+	for i, minutes := range strategies {
+		switch m := minutes.(type) {
+		case int64:
+			windows[i] = int(m)
+		case int:
+			windows[i] = m
+		default:
+			t.Fatalf("minute_strategies: bad window %v", minutes)
+		}
+	}
+	return windows
+}
+
+type goldenRecord struct {
+	Sample     int                    `json:"sample"`
+	Stable     bool                   `json:"stable"`
+	Indicators movingstats.Indicators `json:"indicators"`
+}
+
+func goldenFile(window int) string {
+	return filepath.Join("testdata", "golden", fmt.Sprintf("indicators_ms_%d.json", window))
+}
+
+func loadGoldenPrices(t *testing.T) []float64 {
+	f, err := os.Open(goldenPrices)
+	if err != nil {
+		t.Fatal("opening prices: ", err.Error())
+	}
+	defer f.Close()
+
+	var prices []float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		price, err := strconv.ParseFloat(scanner.Text(), 64)
+		if err != nil {
+			t.Fatal("parsing prices: ", err.Error())
+		}
+		prices = append(prices, price)
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal("reading prices: ", err.Error())
+	}
+
+	return prices
+}
+
+// runGoldenWindow feeds prices through a fresh minute strategy and records
+// its indicators every goldenEvery samples and after the last sample.
+func runGoldenWindow(t *testing.T, window int, prices []float64) []goldenRecord {
+
+	name := fmt.Sprintf("GOLDEN_%d", time.Now().UnixNano())
+
+	// --------------------------------------
+	// The name is new on every run, so the
+	// strategy warms up without history.
+	// Its indicators and signals are removed
+	// once the strategy is stopped
+	// --------------------------------------
+	ID := fmt.Sprintf("%s_MS_%d", name, window)
+	t.Cleanup(func() {
+		for _, suffix := range []string{"INDICATORS", "BUY", "SELL"} {
+			if err := kr.DeleteList(ID, suffix); err != nil {
+				t.Error(err.Error())
+			}
+		}
+	})
+
+	ms := statistician.NewMinuteStrategy(name, window, 0, false, kr, goldenSampleRate)
+	ms.SetClock(clock.NewSimulated(time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)))
+	ms.Start()
+	defer ms.Stop()
+
+	var records []goldenRecord
+
+	for i, price := range prices {
+		ms.Add(price)
+
+		if (i+1)%goldenEvery == 0 || i == len(prices)-1 {
+			ms.Flush()
+			indicators := ms.Indicators()
+			indicators.Name = ""
+			records = append(records, goldenRecord{Sample: i + 1, Stable: ms.Stable(), Indicators: indicators})
+		}
+	}
+
+	return records
+}
+
+func goldenFloatEqual(want, got float64) bool {
+	if math.IsNaN(want) || math.IsNaN(got) {
+		return math.IsNaN(want) && math.IsNaN(got)
+	}
+	diff := math.Abs(want - got)
+	return diff <= goldenAbsTolerance || diff <= goldenRelTolerance*math.Max(math.Abs(want), math.Abs(got))
+}
+
+func compareGolden(t *testing.T, window int, want, got goldenRecord) {
+
+	if want.Sample != got.Sample || want.Stable != got.Stable {
+		t.Errorf("MS_%d sample %d: stable %v, golden sample %d stable %v",
+			window, got.Sample, got.Stable, want.Sample, want.Stable)
+	}
+
+	wantValue := reflect.ValueOf(want.Indicators)
+	gotValue := reflect.ValueOf(got.Indicators)
+
+	for i := 0; i < wantValue.NumField(); i++ {
+		field := wantValue.Type().Field(i).Name
+		wantField := wantValue.Field(i).Interface()
+		gotField := gotValue.Field(i).Interface()
+
+		if wantFloat, ok := wantField.(float64); ok {
+			if !goldenFloatEqual(wantFloat, gotField.(float64)) {
+				t.Errorf("MS_%d sample %d: %s is %v, golden %v", window, got.Sample, field, gotField, wantFloat)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(wantField, gotField) {
+			t.Errorf("MS_%d sample %d: %s is %v, golden %v", window, got.Sample, field, gotField, wantField)
+		}
+	}
+}
+
+func TestGoldenIndicators(t *testing.T) {
+
+	prices := loadGoldenPrices(t)
+
+	for _, window := range goldenWindows(t) {
+
+		records := runGoldenWindow(t, window, prices)
+
+		if *update {
+			goldenJSON, err := json.MarshalIndent(records, "", "  ")
+			if err != nil {
+				t.Fatal("marshaling golden: ", err.Error())
+			}
+			if err := ioutil.WriteFile(goldenFile(window), goldenJSON, 0644); err != nil {
+				t.Fatal("writing golden: ", err.Error())
+			}
+			t.Log("Updated golden file: ", goldenFile(window))
+			continue
+		}
+
+		goldenJSON, err := ioutil.ReadFile(goldenFile(window))
+		if err != nil {
+			t.Fatal("reading golden, run with -update to create it: ", err.Error())
+		}
+
+		var golden []goldenRecord
+		if err := json.Unmarshal(goldenJSON, &golden); err != nil {
+			t.Fatal("unmarshaling golden: ", err.Error())
+		}
+
+		if len(golden) != len(records) {
+			t.Fatalf("MS_%d: %d records, golden has %d", window, len(records), len(golden))
+		}
+
+		for i := range golden {
+			compareGolden(t, window, golden[i], records[i])
+		}
+	}
+}
@@ -12,29 +12,73 @@ import (
 
 	"math"
 
+	"strconv"
+
 	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/clock"
 	"github.com/lagarciag/tayni/kredis"
 	"github.com/metakeule/fmtdate"
 	log "github.com/sirupsen/logrus"
 )
 
-type MinuteStrategy struct {
-	ID string
+// StrategyState is the lifecycle state of a MinuteStrategy
+type StrategyState int
+
+const (
+	// StrategyInit is a strategy that has not been started
+	StrategyInit StrategyState = iota
+	// StrategyWarmingUp is a running strategy that has not seen stableCount samples
+	StrategyWarmingUp
+	// StrategyStable is a running strategy with enough samples for its indicators
+	StrategyStable
+	// StrategyStopped is a strategy that no longer processes samples
+	StrategyStopped
+)
 
-	init bool
+func (state StrategyState) String() string {
+	switch state {
+	case StrategyInit:
+		return "Init"
+	case StrategyWarmingUp:
+		return "WarmingUp"
+	case StrategyStable:
+		return "Stable"
+	case StrategyStopped:
+		return "Stopped"
+	}
+	return fmt.Sprintf("StrategyState(%d)", int(state))
+}
 
-	count uint64
+// strategySample is a value queued for the add worker. A sample with a
+// flushed channel carries no value, the worker closes the channel once all
+// the samples queued before it are processed.
+type strategySample struct {
+	value   float64
+	flushed chan struct{}
+}
 
-	addChannel chan float64
+type MinuteStrategy struct {
+	ID string
 
-	warmAppLock *sync.Cond
+	count uint64
 
-	warmUpComplete bool
+	// ----------------
+	// Lifecycle
+	// ----------------
+	state      StrategyState
+	startOnce  *sync.Once
+	stopOnce   *sync.Once
+	addChannel chan strategySample
+	quit       chan struct{}
+	workerDone chan struct{}
+	ready      chan struct{}
 
 	indicators movingstats.Indicators
 
 	kr *kredis.Kredis
 
+	clock clock.Clock
+
 	mu *sync.Mutex
 
 	LatestValue float64
@@ -81,10 +125,23 @@ type MinuteStrategy struct {
 	fh *os.File
 
 	indicatorsChan chan movingstats.Indicators
+	storerDone     chan struct{}
 
 	buy  bool
 	sell bool
 
+	// ---------------------------------
+	// Signal filtering (hysteresis and
+	// debounce) before publishing
+	// ---------------------------------
+	signalConfig SignalConfig
+	buyFilter    *signalFilter
+	sellFilter   *signalFilter
+	adxBull      bool
+	pDIBull      bool
+	mDIBear      bool
+	atrLimitOk   bool
+
 	doDbUpdate bool
 
 	// --------------------
@@ -111,14 +168,20 @@ func NewMinuteStrategy(name string, minuteWindowSize int, stdLimit float64, doLo
 	ps.dirtyHistory = false
 	ps.ID = ID
 
-	ps.init = true
+	ps.state = StrategyInit
+	ps.startOnce = &sync.Once{}
+	ps.stopOnce = &sync.Once{}
+	ps.quit = make(chan struct{})
+	ps.workerDone = make(chan struct{})
+	ps.ready = make(chan struct{})
 	ps.indicatorsChan = make(chan movingstats.Indicators, 1300000)
+	ps.storerDone = make(chan struct{})
 	ps.indicators = movingstats.Indicators{}
 	ps.doDbUpdate = true
 	ps.kr = kr
+	ps.clock = clock.New()
 	//ps.fh = f
 	ps.mu = &sync.Mutex{}
-	ps.warmAppLock = sync.NewCond(&sync.Mutex{})
 	//ps.log = log
 	ps.sampleRate = sampleRate
 	ps.multiplier = 60 / sampleRate
@@ -141,11 +204,12 @@ func NewMinuteStrategy(name string, minuteWindowSize int, stdLimit float64, doLo
 		ps.dirtyHistory,
 		ID)
 
-	ps.addChannel = make(chan float64, ps.movingSampleWindowSize)
+	ps.addChannel = make(chan strategySample, ps.movingSampleWindowSize)
 
 	ps.stable = false
 
 	ps.stDevBuyLimit = stdLimit
+	ps.SetSignalConfig(DefaultSignalConfig())
 	ps.stableCount = ps.movingSampleWindowSize * 26
 
 	go ps.indicatorsStorer()
@@ -165,7 +229,7 @@ func (ps *MinuteStrategy) initIndicators() {
 		log.Warn("Indicators History is to shallow, setting dirty bit")
 	}
 
-	log.Infof("Indicators count: %d, sample window size: %d, max period count (26): %d", ps.indicatorsSaved, ps.movingSampleWindowSize)
+	log.Infof("Indicators count: %d, sample window size: %d, max period count (26): %d", ps.indicatorsSaved, ps.movingSampleWindowSize, ps.movingSampleWindowSize*26)
 
 	// ------------------
 	// Get latest values
@@ -217,32 +281,119 @@ func (ms *MinuteStrategy) SetDbUpdate(do bool) {
 	ms.doDbUpdate = do
 }
 
-func (ms *MinuteStrategy) WarmUp(value float64) {
+// SetClock sets the clock used to time stamp indicators and signals.
+func (ms *MinuteStrategy) SetClock(clk clock.Clock) {
+	ms.mu.Lock()
+	ms.clock = clk
+	ms.mu.Unlock()
+}
 
-	//TODO: HACK
-	/*
-		for n := 0; n < int(ms.stableCount*2); n++ {
-			ms.add(value)
-		}
-	*/
-	ms.init = false
-	ms.warmUpComplete = true
-	ms.warmAppLock.Broadcast()
-	log.Info("Warm up Complete -> ", ms.ID)
+// SetSignalConfig sets the hysteresis and debounce parameters used before
+// publishing the BUY & SELL signals. It resets the signal filters.
+func (ms *MinuteStrategy) SetSignalConfig(config SignalConfig) {
+	ms.mu.Lock()
+	ms.signalConfig = config
+	ms.buyFilter = newSignalFilter(config)
+	ms.sellFilter = newSignalFilter(config)
+	ms.mu.Unlock()
 }
 
-func (ms *MinuteStrategy) Add(value float64) {
-	if ms.init {
-		ms.init = false
+// Start launches the worker that processes the samples in the order they
+// are added. Calling Start more than once has no effect.
+func (ms *MinuteStrategy) Start() {
+	ms.startOnce.Do(func() {
+		ms.mu.Lock()
+		ms.state = StrategyWarmingUp
+		ms.mu.Unlock()
+
+		log.Info("Starting minute strategy -> ", ms.ID)
 		go ms.addWorker()
-		time.Sleep(time.Millisecond * 500)
-		go ms.WarmUp(value)
+	})
+}
 
-	} else {
+// Stop processes the samples already queued, waits for their indicators to
+// be stored and stops the worker. Samples added after Stop are dropped.
+func (ms *MinuteStrategy) Stop() {
+	ms.Start()
+	ms.stopOnce.Do(func() {
+		close(ms.quit)
+		<-ms.workerDone
 
-		ms.addChannel <- value
+		// Only the worker stores indicators
+		close(ms.indicatorsChan)
+		<-ms.storerDone
+
+		ms.mu.Lock()
+		ms.state = StrategyStopped
+		ms.mu.Unlock()
+
+		log.Info("Minute strategy stopped -> ", ms.ID)
+	})
+}
+
+// Add queues a sample. It starts the strategy if it was not started and
+// blocks while the queue is full, samples are never dropped or reordered.
+func (ms *MinuteStrategy) Add(value float64) {
+	ms.Start()
+
+	// Select picks any ready case, a stopped strategy may still have room
+	select {
+	case <-ms.quit:
+		log.Warn("Sample added to stopped strategy -> ", ms.ID)
+		return
+	default:
+	}
+
+	select {
+	case ms.addChannel <- strategySample{value: value}:
+	case <-ms.quit:
+		log.Warn("Sample added to stopped strategy -> ", ms.ID)
+	}
+}
+
+// Flush blocks until every sample added before the call is processed.
+func (ms *MinuteStrategy) Flush() {
+	ms.Start()
+
+	flushed := make(chan struct{})
+
+	select {
+	case <-ms.quit:
+		<-ms.workerDone
+		return
+	default:
+	}
+
+	select {
+	case ms.addChannel <- strategySample{flushed: flushed}:
+		// The worker may stop before reaching the sample
+		select {
+		case <-flushed:
+		case <-ms.workerDone:
+		}
+	case <-ms.quit:
+		<-ms.workerDone
 	}
+}
 
+// Ready returns a channel that is closed once the strategy is stable.
+func (ms *MinuteStrategy) Ready() <-chan struct{} {
+	return ms.ready
+}
+
+// State returns the lifecycle state of the strategy.
+func (ms *MinuteStrategy) State() StrategyState {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.state
+}
+
+// Progress returns the count of processed samples and the count of samples
+// needed to be stable.
+func (ms *MinuteStrategy) Progress() (seen int, stableCount int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.currentSampleCount, ms.stableCount
 }
 
 func (ms *MinuteStrategy) add(value float64) {
@@ -251,36 +402,57 @@ func (ms *MinuteStrategy) add(value float64) {
 	ms.LatestValue = value
 	ms.movingStats.Add(value)
 
-	if ms.currentSampleCount == ms.stableCount {
+	ms.currentSampleCount++
+
+	if !ms.stable && ms.currentSampleCount > ms.stableCount {
 		ms.stable = true
+		ms.state = StrategyStable
+		close(ms.ready)
+		log.Infof("Warm up Complete -> %s, samples: %d", ms.ID, ms.currentSampleCount)
 	}
-	ms.currentSampleCount++
 
 	ms.buySellUpdate()
 
-	if ms.warmUpComplete {
-		ms.updateIndicators()
-	}
+	ms.updateIndicators()
 
 	ms.mu.Unlock()
 
-	if ms.warmUpComplete {
-		ms.storeIndicators()
-	}
+	ms.storeIndicators()
 
 }
 
 func (ms *MinuteStrategy) addWorker() {
 
-	ms.warmAppLock.L.Lock()
-	ms.warmAppLock.Wait()
-	ms.warmAppLock.L.Unlock()
-
-	log.Info("addWorker waken up -> ", ms.ID)
+	defer close(ms.workerDone)
+
+	for {
+		select {
+		case sample := <-ms.addChannel:
+			ms.process(sample)
+
+		case <-ms.quit:
+			// --------------------------------
+			// Drain what was queued before the
+			// strategy was stopped
+			// --------------------------------
+			for {
+				select {
+				case sample := <-ms.addChannel:
+					ms.process(sample)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
 
-	for value := range ms.addChannel {
-		ms.add(value)
+func (ms *MinuteStrategy) process(sample strategySample) {
+	if sample.flushed != nil {
+		close(sample.flushed)
+		return
 	}
+	ms.add(sample.value)
 }
 
 func (ms *MinuteStrategy) StdDevPercentage() float64 {
@@ -345,87 +517,55 @@ func (ms *MinuteStrategy) EmaDirectionUp() bool {
 
 func (ms *MinuteStrategy) buySellUpdate() {
 
-	//ms.buy = false
-	//ms.sell = false
-
 	adx := ms.movingStats.Adx()
 	mDI := ms.movingStats.MinusDI()
 	pDI := ms.movingStats.PlusDI()
 
-	pDirectionalBull := false
-	mDirectionalBear := false
-	adxBull := false
-	pDIBull := false
-	mDIBear := false
-	//diBull := false
+	// ----------------------------------------
+	// Each threshold has a hysteresis band so
+	// values hovering around it do not flip
+	// the signal back and forth
+	// ----------------------------------------
+	cfg := ms.signalConfig
 
-	if adx > float64(20) {
-		adxBull = true
-	}
+	ms.adxBull = hysteresis(ms.adxBull, adx, 20, cfg.AdxBand)
+	ms.pDIBull = hysteresis(ms.pDIBull, pDI, 15, cfg.PdiBand) &&
+		hysteresis(ms.pDIBull, pDI-mDI, 0, cfg.PdiBand)
+	ms.mDIBear = hysteresis(ms.mDIBear, mDI, 20, cfg.MdiBand)
 
-	if pDI > float64(15) && pDI > mDI {
-		pDIBull = true
-	}
+	atrLimit := ms.movingStats.AtrLimit()
+	ms.atrLimitOk = hysteresis(ms.atrLimitOk, ms.movingStats.Atrp(), atrLimit, atrLimit*cfg.AtrpBand)
 
-	if mDI > float64(20) {
-		mDIBear = true
-	}
+	pDirectionalBull := ms.pDIBull && ms.adxBull
+	mDirectionalBear := ms.mDIBear || ms.adxBull
 
-	if pDIBull && adxBull {
-		pDirectionalBull = true
-	}
+	rawBuy := pDirectionalBull && ms.MacdBullish() && ms.EmaDirectionUp() && ms.atrLimitOk
+	rawSell := mDirectionalBear && !ms.MacdBullish() && !ms.EmaDirectionUp()
 
-	if mDIBear || adxBull {
-		mDirectionalBear = true
-	}
+	now := ms.clock.Now()
+	buy, publishBuy := ms.buyFilter.update(rawBuy, now)
+	sell, publishSell := ms.sellFilter.update(rawSell, now)
 
 	buyKey := fmt.Sprintf("%s_BUY", ms.ID)
 	sellKey := fmt.Sprintf("%s_SELL", ms.ID)
 
-	atrLimitOk := false
-
-	if ms.movingStats.Atrp() > ms.movingStats.AtrLimit() {
-		atrLimitOk = true
-		//log.Debug("AtrLimit OK ", ms.movingStats.Atrp())
-	} else {
-		//log.Debug("AtrLimit NOT ok, ", ms.movingStats.Atrp())
+	if buy != ms.buy {
+		log.Infof("BUY CHANGE for %s :%v", buyKey, buy)
+	}
+	if sell != ms.sell {
+		log.Infof("SELL CHANGE for %s :%v", sellKey, sell)
 	}
 
+	ms.buy = buy
+	ms.sell = sell
+
 	if ms.doDbUpdate {
-		if pDirectionalBull && ms.MacdBullish() && ms.EmaDirectionUp() && atrLimitOk {
-			if ms.buy == false {
-				log.Infof("BUY CHANGE for %s :%v", buyKey, true)
-			}
-			if err := ms.kr.Publish(buyKey, "true"); err != nil {
-				log.Errorf("Publishing to: %s -> %s ", buyKey, "true")
-			}
-			ms.buy = true
-		} else {
-			if ms.buy == true {
-				log.Infof("BUY CHANGE for %s :%v", buyKey, false)
-			}
-			if err := ms.kr.Publish(buyKey, "false"); err != nil {
-				log.Errorf("Publishing to: %s -> %s ", buyKey, "false")
-			}
-			ms.buy = false
+		if publishBuy {
+			ms.publishSignal(buyKey, buy)
 		}
 
-		if mDirectionalBear && !ms.MacdBullish() && !ms.EmaDirectionUp() {
-			if ms.sell == false {
-				log.Infof("SELL CHANGE for %s : %v", sellKey, true)
-			}
-			if err := ms.kr.Publish(sellKey, "true"); err != nil {
-				log.Errorf("Publishing to: %s -> %s ", sellKey, "true")
-			}
-			ms.sell = true
-		} else {
-			if ms.sell == true {
-				log.Infof("SELL CHANGE for %s :%v", sellKey, false)
-			}
-			if err := ms.kr.Publish(sellKey, "false"); err != nil {
-				log.Errorf("Publishing to: %s -> %s ", buyKey, "false")
-			}
-			ms.sell = false
+		if publishSell {
+			ms.publishSignal(sellKey, sell)
 		}
 
 		if ms.count%6 == 0 {
@@ -435,6 +575,27 @@ func (ms *MinuteStrategy) buySellUpdate() {
 	}
 }
 
+// publishSignal keeps the signal value in a retained key, so late
+// subscribers can read the current state, and publishes it.
+func (ms *MinuteStrategy) publishSignal(key string, signal bool) {
+	value := strconv.FormatBool(signal)
+
+	if err := ms.kr.Set(key, value); err != nil {
+		log.Errorf("Setting retained signal: %s -> %s ", key, value)
+	}
+
+	if err := ms.kr.Publish(key, value); err != nil {
+		log.Errorf("Publishing to: %s -> %s ", key, value)
+	}
+}
+
+// signals returns the filtered BUY & SELL signals of the last sample.
+func (ms *MinuteStrategy) signals() (buy, sell bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.buy, ms.sell
+}
+
 func (ms *MinuteStrategy) Buy() bool {
 	return ms.buy
 }
@@ -448,9 +609,18 @@ func (ms *MinuteStrategy) Sell() bool {
 // --------------
 
 func (ms *MinuteStrategy) Stable() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	return ms.stable
 }
 
+// Indicators returns a copy of the latest indicators.
+func (ms *MinuteStrategy) Indicators() movingstats.Indicators {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.indicators
+}
+
 func (ms *MinuteStrategy) updateIndicators() {
 
 	if ms.doDbUpdate {
@@ -545,7 +715,7 @@ func (ms *MinuteStrategy) updateIndicators() {
 		if err != nil {
 			panic(err)
 		}
-		ms.indicators.Date = fmtdate.Format("MM/DD/YYYY hh:mm:ss", time.Now().Add(offSet))
+		ms.indicators.Date = fmtdate.Format("MM/DD/YYYY hh:mm:ss", ms.clock.Now().Add(offSet))
 	}
 }
 
@@ -613,6 +783,8 @@ func (ms *MinuteStrategy) indicatorsHistoryGetter(size int) (indicators []moving
 }
 
 func (ms *MinuteStrategy) indicatorsStorer() {
+	defer close(ms.storerDone)
+
 	for indicator := range ms.indicatorsChan {
 		//log.Info("Store indicator: ", indicator, ms.ID, ms.)
 		indicatorsJSON, err := json.Marshal(indicator)
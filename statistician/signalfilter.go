@@ -0,0 +1,149 @@
+package statistician
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Default refresh interval for published signals. The trader cascade only
+// moves forward on a received signal, so an unchanged value is republished
+// from time to time to let it catch up.
+const defaultSignalRefresh = time.Minute
+
+// SignalConfig holds the parameters used to filter the BUY & SELL signals
+// before they are published to redis.
+type SignalConfig struct {
+	// Publish only when the filtered signal changes (or on refresh)
+	PublishOnChange bool
+
+	// Time a new signal value must hold before it is published
+	MinDwell time.Duration
+
+	// Republish an unchanged signal at this interval, 0 disables it
+	Refresh time.Duration
+
+	// Hysteresis bands around each indicator threshold
+	AdxBand  float64
+	PdiBand  float64
+	MdiBand  float64
+	AtrpBand float64
+}
+
+// DefaultSignalConfig returns a config with publish on change enabled and
+// no hysteresis or dwell time, which matches the unfiltered thresholds.
+func DefaultSignalConfig() SignalConfig {
+	return SignalConfig{
+		PublishOnChange: true,
+		Refresh:         defaultSignalRefresh,
+	}
+}
+
+// LoadSignalConfig reads the signals section of the configuration:
+//
+//	[signals]
+//	publish_on_change = true
+//	min_dwell = 60 # seconds
+//	refresh = 60   # seconds, 0 disables
+//	  [signals.hysteresis]
+//	  adx = 2.0
+//	  pdi = 1.5
+//	  mdi = 2.0
+//	  atrp = 0.05
+//
+// Missing keys keep their default value.
+func LoadSignalConfig() SignalConfig {
+	config := DefaultSignalConfig()
+
+	if viper.IsSet("signals.publish_on_change") {
+		config.PublishOnChange = viper.GetBool("signals.publish_on_change")
+	}
+	if viper.IsSet("signals.min_dwell") {
+		config.MinDwell = time.Duration(viper.GetInt64("signals.min_dwell")) * time.Second
+	}
+	if viper.IsSet("signals.refresh") {
+		config.Refresh = time.Duration(viper.GetInt64("signals.refresh")) * time.Second
+	}
+
+	config.AdxBand = viper.GetFloat64("signals.hysteresis.adx")
+	config.PdiBand = viper.GetFloat64("signals.hysteresis.pdi")
+	config.MdiBand = viper.GetFloat64("signals.hysteresis.mdi")
+	config.AtrpBand = viper.GetFloat64("signals.hysteresis.atrp")
+
+	return config
+}
+
+// hysteresis compares value against threshold using a band around it:
+// a false state needs to go above threshold+band to become true and a true
+// state needs to go below threshold-band to become false.
+func hysteresis(state bool, value, threshold, band float64) bool {
+	if state {
+		return value > threshold-band
+	}
+	return value > threshold+band
+}
+
+// signalFilter debounces a boolean signal and decides when it has to be
+// published.
+type signalFilter struct {
+	config SignalConfig
+
+	// Last published value
+	value     bool
+	published bool
+
+	// Value waiting for the dwell time to expire
+	candidate      bool
+	candidateSince time.Time
+
+	lastPublish time.Time
+}
+
+func newSignalFilter(config SignalConfig) *signalFilter {
+	return &signalFilter{config: config}
+}
+
+// update feeds the raw signal computed for the current sample and returns
+// the filtered value and whether it must be published.
+func (sf *signalFilter) update(raw bool, now time.Time) (value bool, publish bool) {
+
+	// --------------------------------------
+	// The first value is published as is so
+	// subscribers learn the current state
+	// --------------------------------------
+	if !sf.published {
+		sf.value = raw
+		sf.candidate = raw
+		sf.published = true
+		sf.lastPublish = now
+		return sf.value, true
+	}
+
+	changed := false
+
+	if raw == sf.value {
+		sf.candidate = raw
+	} else {
+		if raw != sf.candidate {
+			sf.candidate = raw
+			sf.candidateSince = now
+		}
+		if now.Sub(sf.candidateSince) >= sf.config.MinDwell {
+			sf.value = raw
+			changed = true
+		}
+	}
+
+	switch {
+	case changed, !sf.config.PublishOnChange:
+		publish = true
+	case sf.config.Refresh > 0 && now.Sub(sf.lastPublish) >= sf.config.Refresh:
+		publish = true
+	}
+
+	if publish {
+		sf.lastPublish = now
+	}
+
+	return sf.value, publish
+}
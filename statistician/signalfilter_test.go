@@ -0,0 +1,118 @@
+package statistician
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHysteresisBand(t *testing.T) {
+
+	state := false
+
+	for _, step := range []struct {
+		value    float64
+		expected bool
+	}{
+		{19, false},
+		{21, false}, // inside the band, still off
+		{22.5, true},
+		{19, true}, // inside the band, still on
+		{17.5, false},
+		{21.9, false},
+	} {
+		state = hysteresis(state, step.value, 20, 2)
+		if state != step.expected {
+			t.Errorf("value %f: expected %v, got %v", step.value, step.expected, state)
+		}
+	}
+
+	// With no band it behaves as a plain threshold
+	if hysteresis(false, 20.1, 20, 0) != true || hysteresis(true, 20, 20, 0) != false {
+		t.Error("zero band should be a plain threshold")
+	}
+}
+
+func TestSignalFilterPublishOnChange(t *testing.T) {
+
+	config := DefaultSignalConfig()
+	config.Refresh = 0
+	sf := newSignalFilter(config)
+
+	now := time.Now()
+
+	if value, publish := sf.update(false, now); value || !publish {
+		t.Error("first value must be published")
+	}
+
+	for i := 1; i < 10; i++ {
+		if _, publish := sf.update(false, now.Add(time.Duration(i)*time.Second)); publish {
+			t.Error("unchanged value must not be published")
+		}
+	}
+
+	if value, publish := sf.update(true, now.Add(time.Minute)); !value || !publish {
+		t.Error("changed value must be published")
+	}
+}
+
+func TestSignalFilterDwell(t *testing.T) {
+
+	config := DefaultSignalConfig()
+	config.Refresh = 0
+	config.MinDwell = time.Minute
+	sf := newSignalFilter(config)
+
+	now := time.Now()
+	sf.update(false, now)
+
+	// A flip shorter than the dwell time is never published
+	if value, publish := sf.update(true, now.Add(time.Second)); value || publish {
+		t.Error("flip published before dwell time")
+	}
+	if value, publish := sf.update(false, now.Add(2*time.Second)); value || publish {
+		t.Error("bounce back must not be published")
+	}
+
+	// The dwell time restarts with the new flip
+	sf.update(true, now.Add(10*time.Second))
+
+	if value, publish := sf.update(true, now.Add(30*time.Second)); value || publish {
+		t.Error("flip published before dwell time")
+	}
+
+	if value, publish := sf.update(true, now.Add(70*time.Second)); !value || !publish {
+		t.Error("flip not published after dwell time")
+	}
+}
+
+func TestSignalFilterRefresh(t *testing.T) {
+
+	config := DefaultSignalConfig()
+	config.Refresh = time.Minute
+	sf := newSignalFilter(config)
+
+	now := time.Now()
+	sf.update(true, now)
+
+	if _, publish := sf.update(true, now.Add(30*time.Second)); publish {
+		t.Error("published before refresh")
+	}
+
+	if value, publish := sf.update(true, now.Add(61*time.Second)); !value || !publish {
+		t.Error("unchanged value not refreshed")
+	}
+}
+
+func TestSignalFilterEverySample(t *testing.T) {
+
+	config := DefaultSignalConfig()
+	config.PublishOnChange = false
+	sf := newSignalFilter(config)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, publish := sf.update(true, now.Add(time.Duration(i)*time.Second)); !publish {
+			t.Error("every sample must be published when publish on change is off")
+		}
+	}
+}
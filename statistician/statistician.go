@@ -3,8 +3,7 @@ package statistician
 import (
 	"fmt"
 
-	//"time"
-
+	"github.com/lagarciag/tayni/clock"
 	"github.com/lagarciag/tayni/kredis"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -60,6 +59,12 @@ type Statistician struct {
 	key        string
 	sampleRate int
 
+	// Combined signal of several minute strategies, nil if not configured
+	confluence *Confluence
+	doDbUpdate bool
+
+	clock clock.Clock
+
 	kr *kredis.Kredis
 }
 
@@ -83,35 +88,133 @@ func NewStatistician(exchange, pair string, kr *kredis.Kredis, warmUp bool, samp
 	}
 
 	statistician.kr = kr
+	statistician.clock = clock.New()
 
 	statistician.statsHash = make(map[int]*MinuteStrategy)
 
+	signalConfig := LoadSignalConfig()
+	log.Debugf("Signal config for %s: %+v", statistician.key, signalConfig)
+
 	for ID, pstat := range statistician.minuteStrategies {
 		//log.Info("MinuteStrategy : ", statistician.key, pstat)
 		ms := NewMinuteStrategy(statistician.key, pstat, stdLimitList[ID], false, kr, sampleRate)
+		ms.SetSignalConfig(signalConfig)
 		statistician.statsHash[pstat] = ms
 
 	}
 
+	// ----------------------------------
+	// Multi timeframe confluence signal
+	// ----------------------------------
+	statistician.doDbUpdate = true
+
+	confluenceConfig, ok, err := LoadConfluenceConfig()
+	if err != nil {
+		log.Fatal("Loading confluence configuration: ", err.Error())
+	}
+
+	if ok {
+		for _, minutes := range confluenceConfig.Timeframes {
+			if _, ok := statistician.statsHash[minutes]; !ok {
+				log.Fatalf("Confluence timeframe %d is not in minute_strategies", minutes)
+			}
+		}
+		statistician.confluence = NewConfluence(statistician.key, confluenceConfig, signalConfig)
+		log.Infof("Confluence for %s: %+v", statistician.key, confluenceConfig)
+	}
+
 	return statistician
 }
+
+// SetClock sets the clock of the statistician and all its minute strategies.
+func (st *Statistician) SetClock(clk clock.Clock) {
+	st.clock = clk
+	for key := range st.statsHash {
+		st.statsHash[key].SetClock(clk)
+	}
+}
+
 func (st *Statistician) SetDbUpdates(do bool) {
+	st.doDbUpdate = do
 	for key := range st.statsHash {
 		tStat := st.statsHash[key]
 		tStat.SetDbUpdate(do)
 	}
 }
 
-func (st *Statistician) Add(val float64) {
+// Start starts all the minute strategies.
+func (st *Statistician) Start() {
 	for key := range st.statsHash {
-		tStat := st.statsHash[key]
-		tStat.Add(val)
-		/*if st.warmUp && st.tickCounter == 0 {
-			go tStat.WarmUp(val)
-		}*/
+		st.statsHash[key].Start()
+	}
+}
+
+// Stop processes the queued samples and stops all the minute strategies.
+func (st *Statistician) Stop() {
+	for key := range st.statsHash {
+		st.statsHash[key].Stop()
+	}
+}
 
+// Flush blocks until all the minute strategies processed the samples
+// added so far.
+func (st *Statistician) Flush() {
+	for key := range st.statsHash {
+		st.statsHash[key].Flush()
+	}
+}
+
+// Add feeds a sample to all the minute strategies and returns once every
+// strategy processed it, so the indicators and signals read after Add
+// always include the sample.
+func (st *Statistician) Add(val float64) {
+	for key := range st.statsHash {
+		st.statsHash[key].Add(val)
 	}
 	st.tickCounter++
+
+	st.Flush()
+
+	st.confluenceUpdate()
+}
+
+// Progress returns the count of processed samples and the count needed to
+// be stable for the minute strategy of the given size.
+func (st *Statistician) Progress(size int) (seen int, stableCount int, err error) {
+	aStat, ok := st.statsHash[size]
+	if ok {
+		seen, stableCount = aStat.Progress()
+		return seen, stableCount, nil
+	}
+	return 0, 0, fmt.Errorf("Invalid size request")
+}
+
+func (st *Statistician) confluenceUpdate() {
+	if st.confluence == nil {
+		return
+	}
+
+	buySignals := make(map[int]bool)
+	sellSignals := make(map[int]bool)
+
+	for _, minutes := range st.confluence.config.Timeframes {
+		buySignals[minutes], sellSignals[minutes] = st.statsHash[minutes].signals()
+	}
+
+	signal, publish := st.confluence.Update(buySignals, sellSignals, st.clock.Now())
+
+	if publish && st.doDbUpdate {
+		st.publishConfluence(signal)
+	}
+}
+
+// Confluence returns the latest combined signal and false if confluence
+// is not configured.
+func (st *Statistician) Confluence() (ConfluenceSignal, bool) {
+	if st.confluence == nil {
+		return ConfluenceSignal{}, false
+	}
+	return st.confluence.Latest(), true
 }
 
 func (st *Statistician) EMA(size int) (val float64, err error) {
@@ -163,7 +266,7 @@ func (st *Statistician) MacdDivBullish(size int) (bool, error) {
 func (st *Statistician) Stable(size int) (bool, error) {
 	aStat, ok := st.statsHash[size]
 	if ok {
-		return aStat.stable, nil
+		return aStat.Stable(), nil
 	}
 	return false, fmt.Errorf("Invalid size request")
 }
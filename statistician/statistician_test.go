@@ -10,8 +10,10 @@ import (
 
 	"fmt"
 
+	"github.com/lagarciag/tayni/clock"
 	"github.com/lagarciag/tayni/kredis"
 	"github.com/lagarciag/tayni/statistician"
+	"github.com/spf13/viper"
 )
 
 var kr *kredis.Kredis
@@ -21,6 +23,18 @@ func TestMain(m *testing.M) {
 	seed := time.Now().UTC().UnixNano()
 	rand.Seed(seed)
 	fmt.Println("SEED:", seed)
+
+	// ----------------------------
+	// Set up Viper configuration
+	// ----------------------------
+	viper.SetConfigName("tayniserver")  // name of config file (without extension)
+	viper.AddConfigPath("/etc/tayni/")  // path to look for the config file in
+	viper.AddConfigPath("$HOME/.tayni") // call multiple times to add many search paths
+	viper.AddConfigPath(".")            // optionally look for config in the working directory
+	if err := viper.ReadInConfig(); err != nil {
+		fmt.Println("No configuration file: ", err.Error())
+	}
+
 	kr = kredis.NewKredis(1300000)
 	kr.Start()
 
@@ -30,6 +44,7 @@ func TestMain(m *testing.M) {
 func BenchmarkAddValues(b *testing.B) {
 
 	stat := statistician.NewStatistician("TEST", "TEST_PAIR", kr, false, 10)
+	stat.SetClock(clock.NewSimulated(time.Now()))
 	// run the Fib function b.N times
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
@@ -47,6 +62,7 @@ func TestStatistitianAdd(t *testing.T) {
 	for _, window := range minuteStrategies {
 
 		stat := statistician.NewStatistician("TEST", "TEST_PAIR", kr, false, 10)
+		stat.SetClock(clock.NewSimulated(time.Now()))
 
 		for count := 0; count < (int(window)*stablePeriodsCount)+1; count++ {
 			value := float64(rand.Intn(10000))
@@ -81,13 +97,14 @@ func TestStatistitianAddWarmUp(t *testing.T) {
 	for _, window := range minuteStrategies {
 
 		stat := statistician.NewStatistician("TEST", "TEST_PAIR", kr, false, 10)
+		stat.SetClock(clock.NewSimulated(time.Now()))
 
 		for count := 0; count < 1; count++ {
 			value := float64(rand.Intn(10000))
 			stat.Add(value)
 		}
 
-		time.Sleep(time.Second)
+		stat.Flush()
 
 		stable, err := stat.Stable(int(window))
 
@@ -102,3 +119,77 @@ func TestStatistitianAddWarmUp(t *testing.T) {
 	}
 
 }
+
+func TestMinuteStrategyLifecycle(t *testing.T) {
+
+	ms := statistician.NewMinuteStrategy("TEST_LIFECYCLE", statistician.Minute30, 0, false, kr, 60)
+	ms.SetDbUpdate(false)
+
+	if ms.State() != statistician.StrategyInit {
+		t.Error("Bad initial state: ", ms.State())
+	}
+
+	ms.Start()
+
+	if ms.State() != statistician.StrategyWarmingUp {
+		t.Error("Bad state after start: ", ms.State())
+	}
+
+	_, stableCount := ms.Progress()
+
+	for count := 0; count < stableCount; count++ {
+		ms.Add(float64(count + 1))
+	}
+	ms.Flush()
+
+	seen, _ := ms.Progress()
+	if seen != stableCount {
+		t.Errorf("First samples dropped, seen %d of %d", seen, stableCount)
+	}
+
+	if ms.LatestValue != float64(stableCount) {
+		t.Error("Samples processed out of order, latest value: ", ms.LatestValue)
+	}
+
+	select {
+	case <-ms.Ready():
+		t.Error("Ready before stable count")
+	default:
+	}
+
+	ms.Add(float64(stableCount + 1))
+
+	select {
+	case <-ms.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Strategy never became ready")
+	}
+
+	if ms.State() != statistician.StrategyStable || !ms.Stable() {
+		t.Error("Bad state after warm up: ", ms.State())
+	}
+
+	ms.Stop()
+
+	// Neither blocks once the worker is gone
+	done := make(chan struct{})
+	go func() {
+		ms.Add(0)
+		ms.Flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add or Flush blocked after stop")
+	}
+
+	seen, _ = ms.Progress()
+	if seen != stableCount+1 {
+		t.Error("Sample processed after stop, seen: ", seen)
+	}
+
+	if ms.State() != statistician.StrategyStopped {
+		t.Error("Bad state after stop: ", ms.State())
+	}
+}
@@ -0,0 +1,466 @@
+// Package strength computes the relative strength of every collected asset
+// against every other one, from the price lists kept by the collector in
+// <EX>_<pair>. Assets without a collected pair between them are compared
+// through a synthetic cross over USD or BTC.
+//
+// The matrix is published periodically as JSON on <EX>_STRENGTH_MATRIX and
+// kept under the same key, its ranking tells which asset is strongest.
+package strength
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/kredis"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// MatrixKey is where the matrix of an exchange is kept and published
+const MatrixKey = "%s_STRENGTH_MATRIX"
+
+const defaultInterval = 5 * time.Minute
+
+// pivots used for synthetic crosses, in order of preference
+var pivots = []string{"USD", "BTC"}
+
+// Config of the matrix of an exchange. Windows are in minutes, SampleRate
+// is the seconds between two samples of the price lists.
+type Config struct {
+	Exchange   string
+	Pairs      []string
+	Windows    []int
+	SampleRate int
+	Interval   time.Duration
+}
+
+// LoadConfig reads the strength configuration of an exchange and its
+// collected pairs. It returns false when it is not configured, and an
+// error when a window is not a positive number of minutes.
+//
+//	[strength]
+//	windows = [60, 240, 1440]
+//	interval = "5m"
+func LoadConfig(exchange string) (Config, bool, error) {
+	if !viper.IsSet("strength") {
+		return Config{}, false, nil
+	}
+
+	config := Config{}
+	config.Exchange = strings.ToUpper(exchange)
+	config.SampleRate = viper.GetInt("sample_rate")
+	config.Interval = viper.GetDuration("strength.interval")
+
+	if viper.IsSet("strength.windows") {
+		windows, isList := viper.Get("strength.windows").([]interface{})
+		if !isList {
+			return config, false, fmt.Errorf("strength.windows is not a list")
+		}
+		for _, window := range windows {
+			minutes := 0
+			switch w := window.(type) {
+			case int64:
+				minutes = int(w)
+			case int:
+				minutes = w
+			default:
+				return config, false, fmt.Errorf("strength.windows: bad window %v", window)
+			}
+			if minutes <= 0 {
+				return config, false, fmt.Errorf("strength.windows: window %d is not positive", minutes)
+			}
+			config.Windows = append(config.Windows, minutes)
+		}
+	}
+
+	config.Pairs = viper.GetStringSlice(fmt.Sprintf("exchange.%s.pairs", strings.ToLower(exchange)))
+
+	return config, len(config.Windows) > 0 && len(config.Pairs) > 0, nil
+}
+
+// Cell is the strength of an asset against another one. Returns are the
+// price changes of the asset in the other one over each window, Trend the
+// slope of the log ratio over the longest window in percent per hour. Via
+// is the pivot of a synthetic cross.
+type Cell struct {
+	Returns map[int]float64 `json:"returns"`
+	Trend   float64         `json:"trend"`
+	Via     string          `json:"via,omitempty"`
+}
+
+// Strength is the score of an asset, its mean return against all others.
+type Strength struct {
+	Asset string  `json:"asset"`
+	Score float64 `json:"score"`
+}
+
+// Matrix is the relative strength of the assets of an exchange. Cells are
+// indexed by asset and then by the asset it is measured in.
+type Matrix struct {
+	Exchange string                     `json:"exchange"`
+	Date     time.Time                  `json:"date"`
+	Windows  []int                      `json:"windows"`
+	Assets   []string                   `json:"assets"`
+	Cells    map[string]map[string]Cell `json:"cells"`
+	Ranking  []Strength                 `json:"ranking"`
+}
+
+// Strongest returns the asset ranked first, empty without ranking.
+func (mx Matrix) Strongest() string {
+	if len(mx.Ranking) == 0 {
+		return ""
+	}
+	return mx.Ranking[0].Asset
+}
+
+// Score returns the score of an asset.
+func (mx Matrix) Score(asset string) (float64, bool) {
+	for _, strength := range mx.Ranking {
+		if strength.Asset == asset {
+			return strength.Score, true
+		}
+	}
+	return 0, false
+}
+
+// Compute builds the matrix from the price lists of the pairs, newest
+// price first as the collector keeps them.
+func Compute(config Config, prices map[string][]float64, now time.Time) Matrix {
+
+	if config.SampleRate <= 0 {
+		config.SampleRate = 1
+	}
+
+	mx := Matrix{Exchange: config.Exchange, Date: now, Windows: config.Windows}
+	mx.Cells = make(map[string]map[string]Cell)
+
+	assets := make(map[string]bool)
+	for pair := range prices {
+		base, quote, err := execution.SplitPair(pair)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		assets[base] = true
+		assets[quote] = true
+	}
+	for asset := range assets {
+		mx.Assets = append(mx.Assets, asset)
+	}
+	sort.Strings(mx.Assets)
+
+	for _, asset := range mx.Assets {
+		var sum float64
+		var count int
+
+		for _, other := range mx.Assets {
+			if other == asset {
+				continue
+			}
+
+			ratio, via, ok := cross(asset, other, prices)
+			if !ok {
+				continue
+			}
+
+			cell := Cell{Returns: make(map[int]float64), Via: via}
+			longest := 0
+			for _, window := range config.Windows {
+				samples := window * 60 / config.SampleRate
+				if samples <= 0 || samples >= len(ratio) || ratio[samples] <= 0 {
+					continue
+				}
+				cell.Returns[window] = ratio[0]/ratio[samples] - 1
+				sum += cell.Returns[window]
+				count++
+				if samples > longest {
+					longest = samples
+				}
+			}
+			cell.Trend = trend(ratio, longest, config.SampleRate)
+
+			if mx.Cells[asset] == nil {
+				mx.Cells[asset] = make(map[string]Cell)
+			}
+			mx.Cells[asset][other] = cell
+		}
+
+		if count > 0 {
+			mx.Ranking = append(mx.Ranking, Strength{Asset: asset, Score: sum / float64(count)})
+		}
+	}
+
+	sort.SliceStable(mx.Ranking, func(i, j int) bool { return mx.Ranking[i].Score > mx.Ranking[j].Score })
+
+	return mx
+}
+
+// direct returns the prices of asset in other from a collected pair
+func direct(asset, other string, prices map[string][]float64) ([]float64, bool) {
+	if series, ok := prices[asset+other]; ok {
+		return series, true
+	}
+
+	series, ok := prices[other+asset]
+	if !ok {
+		return nil, false
+	}
+
+	inverse := make([]float64, len(series))
+	for i, price := range series {
+		if price != 0 {
+			inverse[i] = 1 / price
+		}
+	}
+	return inverse, true
+}
+
+// priced returns the prices of asset in a pivot, directly or through the
+// other pivot
+func priced(asset, pivot string, prices map[string][]float64) ([]float64, bool) {
+	if series, ok := direct(asset, pivot, prices); ok {
+		return series, true
+	}
+
+	for _, other := range pivots {
+		if other == pivot || other == asset {
+			continue
+		}
+		assetPrices, okAsset := direct(asset, other, prices)
+		otherPrices, okOther := direct(other, pivot, prices)
+		if okAsset && okOther {
+			return combine(assetPrices, otherPrices, func(a, b float64) float64 { return a * b }), true
+		}
+	}
+
+	return nil, false
+}
+
+// cross returns the prices of asset in other, directly or through a pivot
+func cross(asset, other string, prices map[string][]float64) ([]float64, string, bool) {
+	if series, ok := direct(asset, other, prices); ok {
+		return series, "", true
+	}
+
+	for _, pivot := range pivots {
+		if pivot == asset || pivot == other {
+			continue
+		}
+		assetPrices, okAsset := priced(asset, pivot, prices)
+		otherPrices, okOther := priced(other, pivot, prices)
+		if !okAsset || !okOther {
+			continue
+		}
+
+		series := combine(assetPrices, otherPrices, func(a, b float64) float64 {
+			if b == 0 {
+				return 0
+			}
+			return a / b
+		})
+		return series, pivot, true
+	}
+
+	return nil, "", false
+}
+
+// combine applies op to the samples of two series taken at the same time
+func combine(a, b []float64, op func(a, b float64) float64) []float64 {
+	size := len(a)
+	if len(b) < size {
+		size = len(b)
+	}
+
+	series := make([]float64, size)
+	for i := range series {
+		series[i] = op(a[i], b[i])
+	}
+	return series
+}
+
+// trend is the least squares slope of the log ratio over the newest
+// samples, in percent per hour
+func trend(ratio []float64, samples, sampleRate int) float64 {
+	if samples < 2 {
+		return 0
+	}
+
+	var sumX, sumY, sumXY, sumXX, n float64
+	for i := 0; i <= samples; i++ {
+		if ratio[i] <= 0 {
+			continue
+		}
+		// hours from now, the newest sample first
+		x := -float64(i*sampleRate) / 3600
+		y := math.Log(ratio[i])
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+		n++
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if n < 2 || denominator == 0 {
+		return 0
+	}
+
+	return (n*sumXY - sumX*sumY) / denominator * 100
+}
+
+// Publisher computes and publishes the matrix of an exchange periodically.
+type Publisher struct {
+	config Config
+	kr     *kredis.Kredis
+	clock  clock.Clock
+	mu     *sync.Mutex
+	latest Matrix
+	ok     bool
+}
+
+// NewPublisher creates the publisher of config. kr must not be subscribed
+// to any channel, the matrix is also kept in redis.
+func NewPublisher(config Config, kr *kredis.Kredis) *Publisher {
+	if config.Interval <= 0 {
+		config.Interval = defaultInterval
+	}
+	if config.SampleRate <= 0 {
+		config.SampleRate = 1
+	}
+
+	pb := &Publisher{}
+	pb.config = config
+	pb.kr = kr
+	pb.clock = clock.New()
+	pb.mu = &sync.Mutex{}
+	return pb
+}
+
+// SetClock sets the clock used to date and schedule the matrix.
+func (pb *Publisher) SetClock(clk clock.Clock) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.clock = clk
+}
+
+// Key returns the redis key and channel of the matrix.
+func (pb *Publisher) Key() string {
+	return fmt.Sprintf(MatrixKey, pb.config.Exchange)
+}
+
+// Latest returns the last matrix computed, false before the first one.
+func (pb *Publisher) Latest() (Matrix, bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return pb.latest, pb.ok
+}
+
+// Update reads the price lists, computes the matrix and publishes it.
+func (pb *Publisher) Update() (Matrix, error) {
+
+	longest := 0
+	for _, window := range pb.config.Windows {
+		if window > longest {
+			longest = window
+		}
+	}
+	size := longest*60/pb.config.SampleRate + 1
+
+	prices := make(map[string][]float64)
+	for _, pair := range pb.config.Pairs {
+		raw, err := pb.kr.GetRange(fmt.Sprintf("%s_%s", pb.config.Exchange, pair), size)
+		if err != nil {
+			log.Errorf("Reading prices of %s: %s", pair, err.Error())
+			continue
+		}
+		if len(raw) == 0 {
+			continue
+		}
+
+		series := make([]float64, 0, len(raw))
+		for _, value := range raw {
+			price, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Matrix{}, fmt.Errorf("bad price of %s: %s", pair, err.Error())
+			}
+			series = append(series, price)
+		}
+		prices[pair] = series
+	}
+
+	pb.mu.Lock()
+	now := pb.clock.Now()
+	pb.mu.Unlock()
+
+	mx := Compute(pb.config, prices, now)
+
+	mxJSON, err := json.Marshal(mx)
+	if err != nil {
+		return mx, err
+	}
+
+	if err := pb.kr.Set(pb.Key(), string(mxJSON)); err != nil {
+		return mx, err
+	}
+
+	if err := pb.kr.Publish(pb.Key(), string(mxJSON)); err != nil {
+		return mx, err
+	}
+
+	pb.mu.Lock()
+	pb.latest = mx
+	pb.ok = true
+	pb.mu.Unlock()
+
+	log.Infof("Strength matrix of %s published, strongest %s", pb.config.Exchange, mx.Strongest())
+
+	return mx, nil
+}
+
+// Run updates the matrix every interval until stop is closed.
+func (pb *Publisher) Run(stop chan struct{}) {
+
+	if _, err := pb.Update(); err != nil {
+		log.Error("Strength matrix: ", err.Error())
+	}
+
+	pb.mu.Lock()
+	ticker := pb.clock.NewTicker(pb.config.Interval)
+	pb.mu.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			if _, err := pb.Update(); err != nil {
+				log.Error("Strength matrix: ", err.Error())
+			}
+		}
+	}
+}
+
+// Load reads the last matrix published for an exchange.
+func Load(kr *kredis.Kredis, exchange string) (Matrix, error) {
+	mx := Matrix{}
+
+	mxJSON, err := kr.GetString(fmt.Sprintf(MatrixKey, strings.ToUpper(exchange)))
+	if err != nil || mxJSON == "" {
+		return mx, fmt.Errorf("no strength matrix for %s", exchange)
+	}
+
+	if err := json.Unmarshal([]byte(mxJSON), &mx); err != nil {
+		return mx, fmt.Errorf("bad strength matrix for %s: %s", exchange, err.Error())
+	}
+
+	return mx, nil
+}
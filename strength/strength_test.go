@@ -0,0 +1,189 @@
+package strength_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/strength"
+	"github.com/spf13/viper"
+)
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	os.Exit(m.Run())
+}
+
+// series returns samples going linearly from past to now, newest first
+func series(past, now float64, size int) []float64 {
+	values := make([]float64, size+1)
+	for i := range values {
+		values[i] = now - (now-past)*float64(i)/float64(size)
+	}
+	return values
+}
+
+func TestCompute(t *testing.T) {
+
+	// One sample per minute, one hour window
+	config := strength.Config{Exchange: "TEST", Windows: []int{30, 60}, SampleRate: 60}
+
+	prices := map[string][]float64{
+		"BTCUSD": series(100, 110, 60),
+		"ETHBTC": series(0.05, 0.055, 60),
+		"LTCUSD": series(50, 50, 60),
+	}
+
+	mx := strength.Compute(config, prices, time.Now())
+
+	if len(mx.Assets) != 4 {
+		t.Error("Bad assets: ", mx.Assets)
+	}
+
+	if strongest := mx.Strongest(); strongest != "ETH" {
+		t.Error("ETH should be strongest: ", mx.Ranking)
+	}
+
+	if last := mx.Ranking[len(mx.Ranking)-1].Asset; last != "USD" {
+		t.Error("USD should be weakest: ", mx.Ranking)
+	}
+
+	// ---------------------------
+	// Direct and inverted pairs
+	// ---------------------------
+	if ret := mx.Cells["BTC"]["USD"].Returns[60]; math.Abs(ret-0.1) > 1e-9 {
+		t.Error("Bad BTCUSD return: ", ret)
+	}
+
+	if ret := mx.Cells["USD"]["BTC"].Returns[60]; math.Abs(ret-(100.0/110-1)) > 1e-9 {
+		t.Error("Bad USDBTC return: ", ret)
+	}
+
+	// ---------------------------
+	// Synthetic crosses
+	// ---------------------------
+	ethUSD := mx.Cells["ETH"]["USD"]
+	if ethUSD.Via != "BTC" || math.Abs(ethUSD.Returns[60]-0.21) > 1e-9 {
+		t.Errorf("Bad ETHUSD cross: %+v", ethUSD)
+	}
+
+	ethLTC := mx.Cells["ETH"]["LTC"]
+	if ethLTC.Via != "USD" || math.Abs(ethLTC.Returns[60]-0.21) > 1e-9 {
+		t.Errorf("Bad ETHLTC cross: %+v", ethLTC)
+	}
+
+	if trend := mx.Cells["ETH"]["LTC"].Trend; trend <= 0 {
+		t.Error("ETH should be trending up against LTC: ", trend)
+	}
+
+	if trend := mx.Cells["LTC"]["USD"].Trend; math.Abs(trend) > 1e-9 {
+		t.Error("LTC is flat against USD: ", trend)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	viper.Set("exchange.test.pairs", []string{"ETHBTC", "BTCUSD"})
+	defer viper.Reset()
+
+	// A list decoded as int or int64 is the same configuration
+	for _, windows := range []interface{}{[]interface{}{60, 240}, []interface{}{int64(60), int64(240)}} {
+		viper.Set("strength.windows", windows)
+
+		config, ok, err := strength.LoadConfig("test")
+		if err != nil || !ok {
+			t.Fatal("Configuration not loaded: ", err)
+		}
+		if fmt.Sprint(config.Windows) != "[60 240]" || config.Exchange != "TEST" {
+			t.Error("Bad configuration: ", config)
+		}
+	}
+
+	for _, windows := range []interface{}{[]interface{}{"60"}, []interface{}{0}, []interface{}{1.5}, 60} {
+		viper.Set("strength.windows", windows)
+
+		if _, _, err := strength.LoadConfig("test"); err == nil {
+			t.Error("Bad windows accepted: ", windows)
+		}
+	}
+}
+
+func TestComputeShortHistory(t *testing.T) {
+
+	config := strength.Config{Exchange: "TEST", Windows: []int{30, 600}, SampleRate: 60}
+
+	mx := strength.Compute(config, map[string][]float64{"BTCUSD": series(100, 110, 60)}, time.Now())
+
+	cell := mx.Cells["BTC"]["USD"]
+	if _, ok := cell.Returns[600]; ok {
+		t.Error("No return without enough history: ", cell.Returns)
+	}
+
+	if _, ok := cell.Returns[30]; !ok {
+		t.Error("Missing return of a window with history: ", cell.Returns)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+
+	kr := kredis.NewKredis(1000)
+	kr.Start()
+
+	exchange := fmt.Sprintf("STRENGTHTEST%d", rand.Int63())
+
+	// The collector pushes the newest price first
+	for _, pair := range []string{"BTCUSD", "ETHBTC"} {
+		values := series(100, 90, 60)
+		if pair == "ETHBTC" {
+			values = series(0.05, 0.06, 60)
+		}
+		for i := len(values) - 1; i >= 0; i-- {
+			if err := kr.AddString(exchange, pair, fmt.Sprintf("%f", values[i])); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	config := strength.Config{Exchange: exchange, Pairs: []string{"BTCUSD", "ETHBTC"}, Windows: []int{60}, SampleRate: 60}
+
+	pb := strength.NewPublisher(config, kr)
+	pb.SetClock(clock.NewSimulated(time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)))
+
+	if _, ok := pb.Latest(); ok {
+		t.Error("No matrix before the first update")
+	}
+
+	mx, err := pb.Update()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if mx.Strongest() != "ETH" {
+		t.Error("ETH should be strongest: ", mx.Ranking)
+	}
+
+	saved, err := strength.Load(kr, exchange)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	savedJSON, _ := json.Marshal(saved.Ranking)
+	mxJSON, _ := json.Marshal(mx.Ranking)
+	if string(savedJSON) != string(mxJSON) {
+		t.Error("Saved matrix differs: ", string(savedJSON))
+	}
+
+	if ret := saved.Cells["BTC"]["USD"].Returns[60]; math.Abs(ret-(90.0/100-1)) > 1e-6 {
+		t.Error("Bad saved return: ", ret)
+	}
+}
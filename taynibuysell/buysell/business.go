@@ -6,7 +6,12 @@ import (
 
 	"fmt"
 
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/execution"
 	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/lagarciag/tayni/strength"
 	"github.com/lagarciag/tayni/twitter"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -22,6 +27,8 @@ type CryptoTrader struct {
 	pairsMapExchanges        map[string][]string
 	tFsmExchangeMap          map[string]*CryptoSelectorFsm
 	tc                       *twitter.TwitterClient
+	breaker                  *breaker.Breaker
+	lease                    *leader.Lease
 	pairs                    []string
 	cryptoPairs              []string
 }
@@ -82,10 +89,37 @@ func NewCryptoTrader() *CryptoTrader {
 		// and create FSMs per pair
 		// ---------------------------
 		log.Infof("Exchange: %s ,  %v", exKey, pairsList)
-		trader.tFsmExchangeMap[exKey] = NewCryptoTradeFsm(pairsList)
+		trader.tFsmExchangeMap[exKey] = NewCryptoTradeFsm(exKey, pairsList)
 
 	}
 
+	// ----------------------------------
+	// One notifier for the selectors, the
+	// breaker is shared with the trader
+	// through redis
+	// ----------------------------------
+	trader.tc = twitter.NewTwitterClient(twitter.LoadConfig())
+	notifier, err := notify.Load(trader.tc)
+	if err != nil {
+		log.Fatal("Notifications: ", err.Error())
+	}
+	go notifier.Run(make(chan struct{}))
+	for exKey := range trader.tFsmExchangeMap {
+		trader.tFsmExchangeMap[exKey].SetNotifier(notifier)
+	}
+
+	brk, ok, err := breaker.Load()
+	if err != nil {
+		log.Fatal("Breaker: ", err.Error())
+	}
+	if ok {
+		brk.SetNotifier(notifier)
+		trader.breaker = brk
+		for exKey := range trader.tFsmExchangeMap {
+			trader.tFsmExchangeMap[exKey].SetBreaker(brk)
+		}
+	}
+
 	return trader
 }
 
@@ -102,6 +136,26 @@ func Start(ID string) {
 
 	trader := NewCryptoTrader()
 
+	// ----------------------------------
+	// One lease per selector ID, the
+	// standbys keep their subscriptions
+	// ----------------------------------
+	if config, ok := leader.LoadConfig(); ok {
+		if err := config.Validate(); err != nil {
+			log.Fatal(err.Error())
+		}
+
+		lkr := kredis.NewKredis(1)
+		lkr.Start()
+
+		lease := leader.NewLease(lkr, fmt.Sprintf("LEADER_BUYSELL_%s", ID), config)
+		trader.lease = lease
+		for exKey := range trader.tFsmExchangeMap {
+			trader.tFsmExchangeMap[exKey].SetLease(lease)
+		}
+		go lease.Run(make(chan struct{}), nil)
+	}
+
 	trader.startControllers()
 
 	go trader.MonitorSubscriptions()
@@ -111,7 +165,39 @@ func Start(ID string) {
 	// --------------------------------------
 	trader.cryptoPairs, trader.pairs = GetPairsLists()
 
-	_ = NewCryptoSelector(ID, kr, trader.cryptoPairs, trader.pairs, nil)
+	cs := NewCryptoSelector(ID, kr, trader.cryptoPairs, trader.pairs, nil)
+	if trader.lease != nil {
+		cs.SetLease(trader.lease)
+	}
+
+	// ------------------------------------
+	// Rank the candidates by relative
+	// strength when the matrix is computed
+	// ------------------------------------
+	var publisher *strength.Publisher
+	strengthConfig, ok, err := strength.LoadConfig(ID)
+	if err != nil {
+		log.Fatal("Strength: ", err.Error())
+	}
+	if ok {
+		skr := kredis.NewKredis(1)
+		skr.Start()
+
+		publisher = strength.NewPublisher(strengthConfig, skr)
+		go publisher.Run(make(chan struct{}))
+
+		cs.SetRanker(RankByStrength(publisher.Latest))
+	}
+
+	// ------------------------------------
+	// Keep target weights across several
+	// assets instead of rotating one
+	// ------------------------------------
+	if config, ok := LoadRebalancerConfig(ID); ok {
+		if err := trader.startRebalancer(ID, config, cs, publisher); err != nil {
+			log.Fatal("Rebalancer: ", err.Error())
+		}
+	}
 
 	time.Sleep(time.Second * 5)
 
@@ -138,6 +224,60 @@ func Start(ID string) {
 	*/
 }
 
+// startRebalancer switches the selector to rebalancing and runs the
+// rebalancer with the executor of the exchange, under the lease and the
+// breaker of the selectors.
+func (trader *CryptoTrader) startRebalancer(ID string, config RebalancerConfig, cs *CryptoSelector, publisher *strength.Publisher) error {
+
+	pairs := cs.pairs()
+	if len(pairs) == 0 {
+		return fmt.Errorf("no pairs to rebalance")
+	}
+
+	execConfig, ok := execution.LoadConfig(pairs[0])
+	if !ok {
+		return fmt.Errorf("rebalancing needs the execution configuration")
+	}
+
+	rkr := kredis.NewKredis(1)
+	rkr.Start()
+
+	// Paper balances of its own, the trader keeps the exchange ones
+	executor, err := execution.NewAccountExecutor(ID, "REBALANCER", execConfig, rkr)
+	if err != nil {
+		return err
+	}
+	if _, ok := executor.(execution.Balancer); !ok {
+		return fmt.Errorf("the %s execution backend can not report balances to rebalance", execConfig.Backend)
+	}
+
+	rebalancer := NewRebalancer(ID, config, pairs, cs.Candidates, executor, rkr)
+	if trader.breaker != nil {
+		rebalancer.SetBreaker(trader.breaker)
+	}
+	if trader.lease != nil {
+		rebalancer.SetLease(trader.lease)
+	}
+
+	switch config.Weights {
+	case WeightsBySignal:
+	case WeightsByStrength:
+		if publisher == nil {
+			return fmt.Errorf("weights by strength need the strength configuration")
+		}
+		rebalancer.SetRanker(RankByStrength(publisher.Latest))
+	default:
+		return fmt.Errorf("unknown rebalancer weights: %s", config.Weights)
+	}
+
+	cs.SetRebalancing(true)
+	go rebalancer.Run(make(chan struct{}))
+
+	log.Infof("Crypto selector %s rebalancing every %s by %s", ID, config.Interval, config.Weights)
+
+	return nil
+}
+
 func (trader *CryptoTrader) MonitorSubscriptions() {
 	sbus := trader.kr.SubscriberChann()
 
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/notify"
 	"github.com/looplab/fsm"
 	log "github.com/sirupsen/logrus"
 )
@@ -27,6 +28,25 @@ func (tf *CryptoSelectorFsm) CallBackInHoldState(e *fsm.Event) {
 
 }
 
+// CallBackBeforeEvent cancels every event of a standby.
+func (tf *CryptoSelectorFsm) CallBackBeforeEvent(e *fsm.Event) {
+	if !tf.Leading() {
+		e.Cancel(fmt.Errorf("crypto selector on standby"))
+	}
+}
+
+// CallBackBeforeBuy cancels a buy while the breaker refuses new positions.
+func (tf *CryptoSelectorFsm) CallBackBeforeBuy(e *fsm.Event) {
+	if tf.breaker == nil {
+		return
+	}
+
+	if err := tf.breaker.Allow(""); err != nil {
+		log.Warnf("%s refused: %s", e.Event, err.Error())
+		e.Cancel(err)
+	}
+}
+
 func (tf *CryptoSelectorFsm) CallBackInDoSellState(e *fsm.Event) {
 	log.Infof("In state %s --> %s:", tf.FSM.Current(), "void")
 	//log.Info("In state :", tf.FSM.Current())
@@ -59,10 +79,7 @@ func (tf *CryptoSelectorFsm) CallBackInDoSellState(e *fsm.Event) {
 
 		twit := fmt.Sprintf(twitMessage, "void", ema, sma, last, atrp, theTime)
 
-		if err := tf.tc.Twit(twit); err != nil {
-			log.Error(err.Error())
-			log.Info(twit)
-		}
+		tf.notify(notify.Event{Type: notify.EventSell, Title: "SELL", Message: twit, State: e.Dst})
 
 		sellKey := fmt.Sprintf("%s_SELL", "void")
 		if err := tf.kr.Publish(sellKey, "true"); err != nil {
@@ -115,10 +132,7 @@ func (tf *CryptoSelectorFsm) CallBackInDoBuyState(e *fsm.Event) {
 		`
 	twit := fmt.Sprintf(twitMessage, "void", ema, sma, last, atrp, theTime)
 
-	if err := tf.tc.Twit(twit); err != nil {
-		log.Error(err.Error())
-		log.Info(twit)
-	}
+	tf.notify(notify.Event{Type: notify.EventBuy, Title: "BUY", Message: twit, State: e.Dst})
 
 	buyKey := fmt.Sprintf("%s_BUY", "void")
 	if err := tf.kr.Publish(buyKey, "true"); err != nil {
@@ -1,26 +1,56 @@
 package buysell
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
 	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	TradePairString  = "%s_CRYPTO_SELECTOR_TRPAIR_STATE_%s"
 	CryptoPairString = "%s_CRYPTO_SELECTOR_CRPAIR_STATE_%s"
+	// RotationString keeps the last rotation decision of a selector
+	RotationString = "%s_CRYPTO_SELECTOR_ROTATION_STATE_LAST"
+	// RotationChannel publishes the rotation decisions of a selector
+	RotationChannel = "%s_CRYPTO_SELECTOR_ROTATION"
 )
 
+// CryptoSelector decides the single asset to hold from the buy signals of
+// the crypto and trade pairs. The buy maps tell which pairs are held, they
+// are persisted with the last rotation so a restart keeps the holding.
 type CryptoSelector struct {
 	ID                string
 	kr                *kredis.Kredis
+	store             *kredis.Kredis
 	cryptoPairs       []string
 	tradePairs        []string
 	cryptoPairsBuyMap map[string]bool
 	tradePairsBuyMap  map[string]bool
 	tradeMessage      chan Message
 	subsChan          chan []string
+
+	ranker      Ranker
+	clock       clock.Clock
+	mu          *sync.Mutex
+	signals     map[string]Signal
+	holding     string
+	rebalancing bool
+	lease       *leader.Lease
+}
+
+// Signal is the buy signal of a pair, active since Since.
+type Signal struct {
+	Pair  string
+	Since time.Time
 }
 
 func NewCryptoSelector(ID string,
@@ -33,12 +63,25 @@ func NewCryptoSelector(ID string,
 	cs := &CryptoSelector{}
 	cs.kr = kr
 
+	// kr is subscribed to the signals, the state is saved with a
+	// connection of its own
+	cs.store = kredis.NewKredis(1)
+	cs.store.Start()
+
 	go kr.SubscriberMonitor()
 
 	cs.ID = ID
 	cs.cryptoPairs = cryptoPairs
 	cs.tradePairs = tradePairs
 	cs.tradeMessage = tradesMessage
+	if cs.tradeMessage == nil {
+		cs.tradeMessage = make(chan Message, 100)
+	}
+
+	cs.ranker = RankBySignal
+	cs.clock = clock.New()
+	cs.mu = &sync.Mutex{}
+	cs.signals = make(map[string]Signal)
 
 	// --------------------
 	// Initialize buy maps
@@ -83,19 +126,7 @@ func NewCryptoSelector(ID string,
 
 	}
 
-	// ----------------------------------------------
-	// Set default BTCUSD to buy, unless any other
-	// crypto pair is set to buy
-	// ----------------------------------------------
-
-	cs.tradePairsBuyMap["BTCUSD"] = true
-	for _, pairState := range cs.cryptoPairsBuyMap {
-
-		if pairState {
-			cs.tradePairsBuyMap["BTCUSD"] = false
-		}
-
-	}
+	cs.restoreHolding()
 
 	log.Debug("CryptoPairsBuyMap: ", cs.cryptoPairsBuyMap)
 	log.Debug("TradePairsBuyMap: ", cs.tradePairsBuyMap)
@@ -110,24 +141,303 @@ func NewCryptoSelector(ID string,
 		cs.kr.SubscribeLookup(buyKey)
 	}
 
+	go cs.Select()
 	go cs.MonitorSubscriptions()
 
 	return cs
 }
 
+// SetRanker sets how the candidates are ranked, RankBySignal by default.
+func (cs *CryptoSelector) SetRanker(ranker Ranker) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.ranker = ranker
+}
+
+// SetClock sets the clock used to date the signals and rotations.
+func (cs *CryptoSelector) SetClock(clk clock.Clock) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.clock = clk
+}
+
+// SetRebalancing makes the selector only follow the signals, a Rebalancer
+// trades from its candidates instead of rotating the holding.
+func (cs *CryptoSelector) SetRebalancing(rebalancing bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.rebalancing = rebalancing
+}
+
+// SetLease makes the selector decide the rotations only while the lease is
+// held, standbys follow the signals and the rotations of the leader.
+func (cs *CryptoSelector) SetLease(ls *leader.Lease) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.lease = ls
+}
+
+// Leading tells if this instance decides the rotations.
+func (cs *CryptoSelector) Leading() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.leading()
+}
+
+func (cs *CryptoSelector) leading() bool {
+	return cs.lease == nil || cs.lease.Held()
+}
+
+// Candidates returns the pairs with an active buy signal, not ranked.
+func (cs *CryptoSelector) Candidates() []Candidate {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.candidates()
+}
+
+// Holding returns the asset currently held.
+func (cs *CryptoSelector) Holding() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.holding
+}
+
+// restoreHolding continues with the asset of the last rotation, or of the
+// held pair, BTC by default. The held pair is taken as bullish until its
+// signal says otherwise.
+func (cs *CryptoSelector) restoreHolding() {
+
+	cs.holding = DefaultAsset
+
+	heldPair := ""
+	for _, pair := range cs.tradePairs {
+		if cs.tradePairsBuyMap[pair] {
+			heldPair = pair
+		}
+	}
+	for _, pair := range cs.cryptoPairs {
+		if cs.cryptoPairsBuyMap[pair] {
+			heldPair = pair
+		}
+	}
+
+	if heldPair != "" {
+		if base, _, err := execution.SplitPair(heldPair); err == nil {
+			cs.holding = base
+		}
+	}
+
+	if saved, err := cs.kr.GetString(fmt.Sprintf(RotationString, cs.ID)); err == nil && saved != "" {
+		rotation := Rotation{}
+		if err := json.Unmarshal([]byte(saved), &rotation); err != nil {
+			log.Error("Bad saved rotation: ", err.Error())
+		} else {
+			cs.holding = rotation.Buy
+		}
+	}
+
+	for _, pair := range cs.pairs() {
+		if base, _, err := execution.SplitPair(pair); err == nil && base == cs.holding && cs.held(pair) {
+			cs.signals[pair] = Signal{Pair: pair, Since: cs.clock.Now()}
+		}
+	}
+
+	log.Infof("Crypto selector %s holding %s", cs.ID, cs.holding)
+}
+
+// followLeader takes the holding of the last rotation saved by the leader,
+// so a standby taking over the lease rotates from the right asset.
+func (cs *CryptoSelector) followLeader() {
+	saved, err := cs.store.GetString(fmt.Sprintf(RotationString, cs.ID))
+	if err != nil || saved == "" {
+		return
+	}
+
+	rotation := Rotation{}
+	if err := json.Unmarshal([]byte(saved), &rotation); err != nil {
+		log.Error("Bad saved rotation: ", err.Error())
+		return
+	}
+
+	if rotation.Buy != cs.holding {
+		log.Infof("Crypto selector %s standby follows %s", cs.ID, rotation.Buy)
+		cs.holding = rotation.Buy
+	}
+}
+
+func (cs *CryptoSelector) pairs() []string {
+	pairs := make([]string, 0, len(cs.cryptoPairs)+len(cs.tradePairs))
+	pairs = append(pairs, cs.cryptoPairs...)
+	return append(pairs, cs.tradePairs...)
+}
+
+func (cs *CryptoSelector) held(pair string) bool {
+	if held, ok := cs.cryptoPairsBuyMap[pair]; ok {
+		return held
+	}
+	return cs.tradePairsBuyMap[pair]
+}
+
+// Select decides a rotation on every signal received on the trade message
+// channel.
 func (cs *CryptoSelector) Select() {
 
-	/*
-		for message := range cs.tradeMessage {
+	for message := range cs.tradeMessage {
+
+		// <ID>_<pair>_BUY
+		pair := strings.TrimSuffix(strings.TrimPrefix(message.Event, cs.ID+"_"), "_BUY")
+		if pair == message.Event {
+			continue
+		}
+
+		cs.Signal(pair, message.Signal)
+	}
+}
+
+// Signal updates the buy signal of pair and rotates the holding when the
+// ranking asks for it. It returns the rotation decided, if any.
+func (cs *CryptoSelector) Signal(pair string, buy bool) (Rotation, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	_, crypto := cs.cryptoPairsBuyMap[pair]
+	_, trade := cs.tradePairsBuyMap[pair]
+	if !crypto && !trade {
+		log.Debug("Signal of unknown pair: ", pair)
+		return Rotation{}, false
+	}
+
+	if _, active := cs.signals[pair]; buy && !active {
+		cs.signals[pair] = Signal{Pair: pair, Since: cs.clock.Now()}
+	}
+	if !buy {
+		delete(cs.signals, pair)
+	}
+
+	if cs.rebalancing {
+		return Rotation{}, false
+	}
+
+	// -------------------------------
+	// Standbys keep the holding of
+	// the leader, they do not rotate
+	// -------------------------------
+	if !cs.leading() {
+		cs.followLeader()
+		return Rotation{}, false
+	}
+
+	rotation, ok := cs.decide()
+	if !ok {
+		return Rotation{}, false
+	}
+
+	cs.rotate(rotation)
+
+	return rotation, true
+}
+
+func (cs *CryptoSelector) candidates() []Candidate {
+	var candidates []Candidate
+	for pair, signal := range cs.signals {
+		base, _, err := execution.SplitPair(pair)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		_, crypto := cs.cryptoPairsBuyMap[pair]
+		candidates = append(candidates, Candidate{Pair: pair, Asset: base, Crypto: crypto, Since: signal.Since})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Pair < candidates[j].Pair })
+	return candidates
+}
+
+// decide ranks the bullish pairs and returns the rotation to the best one
+// when it beats the held asset.
+func (cs *CryptoSelector) decide() (Rotation, bool) {
 
-			pair := strings.Split(message.Event, "_")
-			buy := message.Signal
+	ranked := cs.ranker(cs.candidates())
 
+	target := DefaultAsset
+	reason := "no buy signals"
+
+	if len(ranked) > 0 {
+		held := false
+		heldScore := 0.0
+		for _, candidate := range ranked {
+			if candidate.Asset == cs.holding && (!held || candidate.Score > heldScore) {
+				held = true
+				heldScore = candidate.Score
+			}
 		}
-	*/
 
+		target = cs.holding
+		if top := ranked[0]; !held || top.Score > heldScore {
+			target = top.Asset
+			reason = fmt.Sprintf("%s is the strongest buy signal", top.Pair)
+		}
+	}
+
+	if target == cs.holding {
+		return Rotation{}, false
+	}
+
+	legs, err := route(cs.holding, target, cs.pairs())
+	if err != nil {
+		log.Error(err.Error())
+		return Rotation{}, false
+	}
+
+	return Rotation{ID: cs.ID, Date: cs.clock.Now(), Sell: cs.holding, Buy: target, Legs: legs,
+		Reason: reason, Candidates: ranked}, true
+}
+
+// rotate makes the rotation the new holding, saves it and publishes it
+func (cs *CryptoSelector) rotate(rotation Rotation) {
+
+	cs.holding = rotation.Buy
+
+	for pair := range cs.cryptoPairsBuyMap {
+		base, _, _ := execution.SplitPair(pair)
+		cs.cryptoPairsBuyMap[pair] = base == cs.holding
+		cs.saveState(fmt.Sprintf(CryptoPairString, cs.ID, pair), cs.cryptoPairsBuyMap[pair])
+	}
+
+	for pair := range cs.tradePairsBuyMap {
+		base, _, _ := execution.SplitPair(pair)
+		cs.tradePairsBuyMap[pair] = base == cs.holding
+		cs.saveState(fmt.Sprintf(TradePairString, cs.ID, pair), cs.tradePairsBuyMap[pair])
+	}
+
+	rotationJSON, err := json.Marshal(rotation)
+	if err != nil {
+		log.Error("Marshaling rotation: ", err.Error())
+		return
+	}
+
+	if err := cs.store.Set(fmt.Sprintf(RotationString, cs.ID), string(rotationJSON)); err != nil {
+		log.Error("Saving rotation: ", err.Error())
+	}
+
+	if err := cs.kr.Publish(fmt.Sprintf(RotationChannel, cs.ID), string(rotationJSON)); err != nil {
+		log.Error("Publishing rotation: ", err.Error())
+	}
+
+	message := `
+	----------------------------------------------------
+	ROTATION %s: %s
+	----------------------------------------------------
+	`
+	log.Infof(message, cs.ID, rotation)
+}
+
+func (cs *CryptoSelector) saveState(key string, held bool) {
+	if err := cs.store.Set(key, fmt.Sprintf("%t", held)); err != nil {
+		log.Errorf("Saving %s: %s", key, err.Error())
+	}
 }
 
+// MonitorSubscriptions forwards the buy signals to the selector.
 func (cs *CryptoSelector) MonitorSubscriptions() {
 
 	sbus := cs.kr.SubscriberChann()
@@ -143,5 +453,6 @@ func (cs *CryptoSelector) MonitorSubscriptions() {
 
 		log.Debugf("Message: %s -> %v ", key, val)
 
+		cs.tradeMessage <- Message{Event: key, Signal: val == "true"}
 	}
 }
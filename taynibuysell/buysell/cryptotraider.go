@@ -2,13 +2,17 @@ package buysell
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/execution"
 	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	"github.com/lagarciag/tayni/notify"
 	"github.com/lagarciag/tayni/twitter"
 	"github.com/looplab/fsm"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 const (
@@ -19,26 +23,6 @@ const (
 	ShutdownState = "ShutdownState"
 	DoBuyState    = "DoBuyState"
 	DoSellState   = "DoSellState"
-
-	// --------------
-	// Buy States
-	// --------------
-	BuyBTCState = "BuyBTCState"
-	BuyBCHState = "BuyBCHState"
-	BuyZECState = "BuyZECState"
-	BuyBGDState = "BuyBGDState"
-	BuyETHState = "BuyETHState"
-	BuyXRPState = "BuyXRPState"
-	// -------------
-	//   Sell Sates
-	// -------------
-
-	SellBTCState = "SellBTCState"
-	SellBCHState = "SellBCHState"
-	SellZECState = "SellZECState"
-	SellBGDState = "SellBGDState"
-	SellETHState = "SellETHState"
-	SellXRPState = "SellXRPState"
 )
 
 const (
@@ -51,34 +35,68 @@ const (
 	DoSellEvent       = "DoSellEvent"
 	BuyCompleteEvent  = "BuyCompleteEvent"
 	SellCompleteEvent = "SellCompleteEvent"
-
-	// --------------
-	// Buy Events
-	// --------------
-
-	BuyBTCEvent = "BuyBTCEvent"
-	BuyBCHEvent = "BuyBCHEvent"
-	BuyZECEvent = "BuyZECEvent"
-	BuyBGDEvent = "BuyBGDEvent"
-	BuyETHEvent = "BuyETHEvent"
-
-	SellBTCEvent = "SellBtcEvent"
-	SellBCHEvent = "SellBCHEvent"
-	SellZECEvent = "SellZECEvent"
-	SellBGDEvent = "SellBGDEvent"
-	SellETHEvent = "SellETHEvent"
 )
 
+// --------------------------------------
+// Every configured coin has its buy and
+// sell states and events
+// --------------------------------------
+
+// BuyState is the state holding coin
+func BuyState(coin string) string {
+	return fmt.Sprintf("Buy%sState", coin)
+}
+
+// SellState is the state selling coin
+func SellState(coin string) string {
+	return fmt.Sprintf("Sell%sState", coin)
+}
+
+// BuyEvent moves the selector to hold coin
+func BuyEvent(coin string) string {
+	return fmt.Sprintf("Buy%sEvent", coin)
+}
+
+// SellEvent moves the selector out of coin
+func SellEvent(coin string) string {
+	return fmt.Sprintf("Sell%sEvent", coin)
+}
+
+// Coins returns the coins of the pairs, BTC first as it is the default
+// holding, then the base of every pair in order.
+func Coins(pairList []string) []string {
+	coins := []string{DefaultAsset}
+	seen := map[string]bool{DefaultAsset: true}
+
+	for _, pair := range pairList {
+		base, _, err := execution.SplitPair(pair)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		if !seen[base] {
+			seen[base] = true
+			coins = append(coins, base)
+		}
+	}
+
+	return coins
+}
+
 type Message struct {
 	Event  string
 	Signal bool
 }
 
 type CryptoSelectorFsm struct {
-	tc *twitter.TwitterClient
-	kr *kredis.Kredis
-	To string
-
+	tc       *twitter.TwitterClient
+	notifier notify.Notifier
+	kr       *kredis.Kredis
+	breaker  *breaker.Breaker
+	lease    *leader.Lease
+	To       string
+
+	coins                []string
 	eventsStringList     []string
 	statesStringList     []string
 	redisMessagesBuyMap  map[string]string
@@ -94,18 +112,6 @@ type CryptoSelectorFsm struct {
 	shutdownEvent fsm.EventDesc
 	tradeEvent    fsm.EventDesc
 
-	buyBTCEvent fsm.EventDesc
-	buyBCHEvent fsm.EventDesc
-	buyZECEvent fsm.EventDesc
-	buyBGDEvent fsm.EventDesc
-	buyETHEvent fsm.EventDesc
-
-	sellBTCEvent fsm.EventDesc
-	sellBCHEvent fsm.EventDesc
-	sellZECEvent fsm.EventDesc
-	sellBGDEvent fsm.EventDesc
-	sellETHEvent fsm.EventDesc
-
 	// ------------------
 	// Events List
 	// ------------------
@@ -115,45 +121,30 @@ type CryptoSelectorFsm struct {
 	// Fsm Callbacks
 	callbacks fsm.Callbacks
 
-	ChanStartEvent     chan Message
-	ChanStopEvent      chan Message
-	ChanShutdownEvent  chan Message
-	ChanTradeEvent     chan Message
-	testChanTradeEvent chan Message
-
-	// --------------
-	// Buy Events
-	// --------------
-
-	ChanDoBuyEvent        chan Message
-	ChanDoSellEvent       chan Message
-	ChanBuyCompleteEvent  chan Message
-	ChanSellCompleteEvent chan Message
-
-	ChanBuyBTCEvent chan Message
-	ChanBuyBCHEvent chan Message
-	ChanBuyZECEvent chan Message
-	ChanBuyBGDEvent chan Message
-	ChanBuyETHEvent chan Message
-
-	ChanSellBTCEvent      chan Message
-	ChanSellBCHEvent      chan Message
-	ChanSellZECEvent      chan Message
-	ChanSellBGDEvent      chan Message
-	ChanSellETHEvent      chan Message
+	ChanStartEvent    chan Message
+	ChanStopEvent     chan Message
+	ChanShutdownEvent chan Message
+	ChanTradeEvent    chan Message
+
 	ChanMessageMap        map[string]chan Message
 	ChanMapForRedisEvents map[string]chan Message
 }
 
-func NewCryptoTradeFsm(pairList []string) *CryptoSelectorFsm {
+// NewCryptoTradeFsm creates the selector FSM of the coins of pairList,
+// see Coins, moved by the <exchange>_<coin>_BUY and _SELL signals.
+// Adding a coin only needs its pair in the configuration.
+func NewCryptoTradeFsm(exchange string, pairList []string) *CryptoSelectorFsm {
 	log.Info("Creating new crytop trading fsm for pairs: ", pairList)
 
 	tFsm := &CryptoSelectorFsm{}
 
+	tFsm.coins = Coins(pairList)
+
 	tFsm.eventsStringList = []string{StartEvent,
 		StopEvent,
 		ShutdownEvent,
-		TradeEvent}
+		TradeEvent,
+		SellCompleteEvent}
 	tFsm.statesStringList = []string{StartState,
 		IdleState,
 		TradingState,
@@ -164,28 +155,15 @@ func NewCryptoTradeFsm(pairList []string) *CryptoSelectorFsm {
 	tFsm.redisMessagesBuyMap = make(map[string]string)
 	tFsm.redisMessagesSellMap = make(map[string]string)
 
-	//CEXIO_BTC_BUY"
-
-	for _, aPair := range pairList {
-
-		pairX := strings.Split(aPair, "BTC")
-		pair := pairX[0]
-
-		buyEventName := fmt.Sprintf("Buy%sEvent", pair)
-		sellEventName := fmt.Sprintf("Sell%sEvent", pair)
-
-		tFsm.eventsStringList = append(tFsm.eventsStringList, buyEventName)
-		tFsm.eventsStringList = append(tFsm.eventsStringList, sellEventName)
+	for _, coin := range tFsm.coins {
+		tFsm.eventsStringList = append(tFsm.eventsStringList, BuyEvent(coin))
+		tFsm.eventsStringList = append(tFsm.eventsStringList, SellEvent(coin))
 
-		buyStateName := fmt.Sprintf("Buy%sState", pair)
-		sellStateName := fmt.Sprintf("Sell%sState", pair)
-
-		tFsm.statesStringList = append(tFsm.statesStringList, buyStateName)
-		tFsm.statesStringList = append(tFsm.statesStringList, sellStateName)
-
-		tFsm.redisMessagesBuyMap[pair] = fmt.Sprintf("CEXIO_%s_BUY", pair)
-		tFsm.redisMessagesSellMap[pair] = fmt.Sprintf("CEXIO_%s_SELL", pair)
+		tFsm.statesStringList = append(tFsm.statesStringList, BuyState(coin))
+		tFsm.statesStringList = append(tFsm.statesStringList, SellState(coin))
 
+		tFsm.redisMessagesBuyMap[coin] = fmt.Sprintf("%s_%s_BUY", exchange, coin)
+		tFsm.redisMessagesSellMap[coin] = fmt.Sprintf("%s_%s_SELL", exchange, coin)
 	}
 
 	log.Info("EVENTS: ", tFsm.eventsStringList)
@@ -193,101 +171,26 @@ func NewCryptoTradeFsm(pairList []string) *CryptoSelectorFsm {
 
 	tFsm.kr = kredis.NewKredis(1000000)
 	tFsm.kr.Start()
-	config := twitter.Config{}
-
-	vTwitterConfig := viper.Get("twitter").(map[string]interface{})
-	config.Twit = vTwitterConfig["twit"].(bool)
-	config.ConsumerKey = vTwitterConfig["consumer_key"].(string)
-	config.ConsumerSecret = vTwitterConfig["consumer_secret"].(string)
-	config.AccessToken = vTwitterConfig["access_token"].(string)
-	config.AccessTokenSecret = vTwitterConfig["access_token_secret"].(string)
-
-	if config.ConsumerKey == "" {
-		log.Fatal("bad consumerkey")
-	}
 
-	tFsm.tc = twitter.NewTwitterClient(config)
+	tFsm.tc = twitter.NewTwitterClient(twitter.LoadConfig())
+	tFsm.notifier = notify.Default(tFsm.tc)
 
 	// ------------
 	// Events
 	// ------------
-	startEvent := fsm.EventDesc{Name: StartEvent, Src: []string{StartState}, Dst: IdleState}
-
-	stopEvent := fsm.EventDesc{Name: StopEvent,
-		Src: []string{
-			TradingState,
-			BuyBTCState,
-			BuyBCHState,
-			BuyZECState,
-			BuyBGDState,
-			BuyETHState,
-			HoldState,
-		}, Dst: IdleState}
-
-	tradeEvent := fsm.EventDesc{Name: TradeEvent, Src: []string{IdleState}, Dst: TradingState}
-
-	// ----------------------
-	// Buying related events
-	// ----------------------
-
-	buyBTCEvent := fsm.EventDesc{Name: BuyBTCEvent,
-		Src: []string{TradingState},
-		Dst: BuyBTCState}
-
-	buyBCHEvent := fsm.EventDesc{Name: BuyBCHEvent,
-		Src: []string{TradingState},
-		Dst: BuyBCHState}
-
-	buyZECEvent := fsm.EventDesc{Name: BuyZECEvent,
-		Src: []string{TradingState},
-		Dst: BuyZECState}
-
-	buyBGDEvent := fsm.EventDesc{Name: BuyBGDEvent,
-		Src: []string{TradingState},
-		Dst: BuyBGDState}
+	var buyStates, sellStates []string
+	for _, coin := range tFsm.coins {
+		buyStates = append(buyStates, BuyState(coin))
+		sellStates = append(sellStates, SellState(coin))
+	}
 
-	buyETHEvent := fsm.EventDesc{Name: BuyETHEvent,
-		Src: []string{TradingState},
-		Dst: BuyETHState}
+	tFsm.startEvent = fsm.EventDesc{Name: StartEvent, Src: []string{StartState}, Dst: IdleState}
 
-	// ----------------------
-	// Selling related events
-	// ----------------------
+	tFsm.stopEvent = fsm.EventDesc{Name: StopEvent,
+		Src: append([]string{TradingState, HoldState}, buyStates...),
+		Dst: IdleState}
 
-	sellBTCEvent := fsm.EventDesc{Name: SellBTCEvent,
-		Src: []string{TradingState},
-		Dst: SellBTCState}
-
-	sellBCHEvent := fsm.EventDesc{Name: SellBCHEvent,
-		Src: []string{TradingState},
-		Dst: SellBCHState}
-
-	sellZECEvent := fsm.EventDesc{Name: SellZECEvent,
-		Src: []string{TradingState},
-		Dst: SellZECState}
-
-	sellBGDEvent := fsm.EventDesc{Name: SellBGDEvent,
-		Src: []string{TradingState},
-		Dst: SellBGDState}
-
-	sellETHEvent := fsm.EventDesc{Name: SellETHEvent,
-		Src: []string{TradingState},
-		Dst: SellETHState}
-
-	tFsm.startEvent = startEvent
-	tFsm.stopEvent = stopEvent
-	tFsm.tradeEvent = tradeEvent
-	tFsm.buyBTCEvent = buyBTCEvent
-	tFsm.buyBCHEvent = buyBCHEvent
-	tFsm.buyZECEvent = buyZECEvent
-	tFsm.buyBGDEvent = buyBGDEvent
-	tFsm.buyETHEvent = buyETHEvent
-
-	tFsm.sellBTCEvent = sellBTCEvent
-	tFsm.sellBCHEvent = sellBCHEvent
-	tFsm.sellZECEvent = sellZECEvent
-	tFsm.sellBGDEvent = sellBGDEvent
-	tFsm.sellETHEvent = sellETHEvent
+	tFsm.tradeEvent = fsm.EventDesc{Name: TradeEvent, Src: []string{IdleState}, Dst: TradingState}
 
 	tFsm.shutdownEvent = fsm.EventDesc{Name: ShutdownEvent,
 		Src: []string{StartState,
@@ -302,18 +205,17 @@ func NewCryptoTradeFsm(pairList []string) *CryptoSelectorFsm {
 		tFsm.stopEvent,
 		tFsm.shutdownEvent,
 		tFsm.tradeEvent,
-		tFsm.buyBTCEvent,
-		tFsm.buyBTCEvent,
-		tFsm.buyBCHEvent,
-		tFsm.buyZECEvent,
-		tFsm.buyBGDEvent,
-		tFsm.buyETHEvent,
-
-		tFsm.sellBTCEvent,
-		tFsm.sellBCHEvent,
-		tFsm.sellZECEvent,
-		tFsm.sellBGDEvent,
-		tFsm.sellETHEvent,
+		fsm.EventDesc{Name: SellCompleteEvent, Src: sellStates, Dst: TradingState},
+	}
+
+	// ------------------------------------
+	// Buying and selling related events,
+	// a coin is sold to go back to trading
+	// ------------------------------------
+	for _, coin := range tFsm.coins {
+		tFsm.eventsList = append(tFsm.eventsList,
+			fsm.EventDesc{Name: BuyEvent(coin), Src: []string{TradingState}, Dst: BuyState(coin)},
+			fsm.EventDesc{Name: SellEvent(coin), Src: []string{BuyState(coin)}, Dst: SellState(coin)})
 	}
 
 	// -------------------
@@ -325,62 +227,40 @@ func NewCryptoTradeFsm(pairList []string) *CryptoSelectorFsm {
 		ShutdownState: tFsm.CallBackInShutdownState,
 		TradingState:  tFsm.CallBackInTradingState,
 
-		DoBuyEvent:        tFsm.CallBackInDoBuyState,
-		DoSellEvent:       tFsm.CallBackInDoSellState,
-		BuyCompleteEvent:  tFsm.CallBackInBuyCompleteState,
 		SellCompleteEvent: tFsm.CallBackInSellCompleteState,
+	}
+
+	for _, coin := range tFsm.coins {
+		tFsm.callbacks[BuyEvent(coin)] = tFsm.CallBackInState
+		tFsm.callbacks[SellEvent(coin)] = tFsm.CallBackInState
+	}
 
-		BuyBTCEvent: tFsm.CallBackInState,
-		BuyBCHEvent: tFsm.CallBackInState,
-		BuyZECEvent: tFsm.CallBackInState,
-		BuyBGDEvent: tFsm.CallBackInState,
-		BuyETHEvent: tFsm.CallBackInState,
-
-		SellBTCEvent: tFsm.CallBackInState,
-		SellBCHEvent: tFsm.CallBackInState,
-		SellZECEvent: tFsm.CallBackInState,
-		SellBGDEvent: tFsm.CallBackInState,
-		SellETHEvent: tFsm.CallBackInState,
+	// ----------------------------------
+	// Only the leader moves, entries are
+	// refused while the breaker is
+	// tripped, exits are not
+	// ----------------------------------
+	tFsm.callbacks["before_event"] = tFsm.CallBackBeforeEvent
+	for _, event := range tFsm.eventsList {
+		if strings.HasPrefix(event.Name, "Buy") {
+			tFsm.callbacks["before_"+event.Name] = tFsm.CallBackBeforeBuy
+		}
 	}
 
 	// ------------------
 	// Event Channels
 	// ------------------
-
-	/*
-		tFsm.ChanStartEvent = make(chan bool)
-		tFsm.ChanStopEvent = make(chan bool)
-		tFsm.ChanShutdownEvent = make(chan bool)
-		tFsm.ChanTradeEvent = make(chan bool)
-		tFsm.testChanTradeEvent = make(chan bool)
-
-		// --------------
-		// Buy Events
-		// --------------
-
-		tFsm.ChanDoBuyEvent = make(chan bool, 1)
-		tFsm.ChanDoSellEvent = make(chan bool, 1)
-		tFsm.ChanBuyCompleteEvent = make(chan bool, 1)
-		tFsm.ChanSellCompleteEvent = make(chan bool, 1)
-
-		tFsm.ChanBuyBTCEvent = make(chan bool, 1)
-		tFsm.ChanBuyBCHEvent = make(chan bool, 1)
-		tFsm.ChanBuyZECEvent = make(chan bool, 1)
-		tFsm.ChanBuyBGDEvent = make(chan bool, 1)
-		tFsm.ChanBuyETHEvent = make(chan bool, 1)
-
-		tFsm.ChanSellBTCEvent = make(chan bool, 1)
-		tFsm.ChanSellBCHEvent = make(chan bool, 1)
-		tFsm.ChanSellZECEvent = make(chan bool, 1)
-		tFsm.ChanSellBGDEvent = make(chan bool, 1)
-		tFsm.ChanSellETHEvent = make(chan bool, 1)
-	*/
 	tFsm.ChanMessageMap = make(map[string]chan Message)
 
 	for _, event := range tFsm.eventsStringList {
 		tFsm.ChanMessageMap[event] = make(chan Message)
 	}
 
+	tFsm.ChanStartEvent = tFsm.ChanMessageMap[StartEvent]
+	tFsm.ChanStopEvent = tFsm.ChanMessageMap[StopEvent]
+	tFsm.ChanShutdownEvent = tFsm.ChanMessageMap[ShutdownEvent]
+	tFsm.ChanTradeEvent = tFsm.ChanMessageMap[TradeEvent]
+
 	// -------------
 	// FSM creation
 	// -------------
@@ -390,29 +270,65 @@ func NewCryptoTradeFsm(pairList []string) *CryptoSelectorFsm {
 
 	tFsm.ChanMapForRedisEvents = make(map[string]chan Message)
 
-	/*
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_BTC_BUY")] = tFsm.ChanBuyBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_BCH_BUY")] = tFsm.ChanBuyBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_ZEC_BUY")] = tFsm.ChanBuyBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_BGD_BUY")] = tFsm.ChanBuyBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_ETH_BUY")] = tFsm.ChanBuyBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_DASH_BUY")] = tFsm.ChanBuyBTCEvent
-
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_BTC_SELL")] = tFsm.ChanSellBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_BCH_SELL")] = tFsm.ChanSellBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_ZEC_SELL")] = tFsm.ChanSellBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_BGD_SELL")] = tFsm.ChanSellBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_ETH_SELL")] = tFsm.ChanSellBTCEvent
-		tFsm.ChanMapForRedisEvents[fmt.Sprintf("CEXIO_DASH_SELL")] = tFsm.ChanSellBTCEvent
-	*/
+	for _, coin := range tFsm.coins {
+		tFsm.ChanMapForRedisEvents[tFsm.redisMessagesBuyMap[coin]] = tFsm.ChanMessageMap[BuyEvent(coin)]
+		tFsm.ChanMapForRedisEvents[tFsm.redisMessagesSellMap[coin]] = tFsm.ChanMessageMap[SellEvent(coin)]
+	}
+
 	tFsm.ChanMapForRedisEvents["TRADE"] = tFsm.ChanTradeEvent
 	tFsm.ChanMapForRedisEvents["START"] = tFsm.ChanStartEvent
-	tFsm.ChanMapForRedisEvents["STOP"] = tFsm.ChanStartEvent
+	tFsm.ChanMapForRedisEvents["STOP"] = tFsm.ChanStopEvent
 
 	return tFsm
 
 }
 
+// Coins returns the coins of the FSM, each with its buy and sell states.
+func (tFsm *CryptoSelectorFsm) Coins() []string {
+	coins := make([]string, len(tFsm.coins))
+	copy(coins, tFsm.coins)
+	return coins
+}
+
+// States returns every state of the FSM, sorted.
+func (tFsm *CryptoSelectorFsm) States() []string {
+	states := make([]string, len(tFsm.statesStringList))
+	copy(states, tFsm.statesStringList)
+	sort.Strings(states)
+	return states
+}
+
+// SetNotifier sets where the buys and sells are notified, all to Twitter
+// by default.
+func (tFsm *CryptoSelectorFsm) SetNotifier(notifier notify.Notifier) {
+	tFsm.notifier = notifier
+}
+
+// notify sends an event, failures are only logged
+func (tFsm *CryptoSelectorFsm) notify(event notify.Event) {
+	if tFsm.notifier == nil {
+		return
+	}
+	if err := tFsm.notifier.Notify(event); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// SetBreaker makes the FSM refuse new buys while the breaker is tripped.
+func (tFsm *CryptoSelectorFsm) SetBreaker(brk *breaker.Breaker) {
+	tFsm.breaker = brk
+}
+
+// SetLease makes the FSM act only while the lease is held.
+func (tFsm *CryptoSelectorFsm) SetLease(ls *leader.Lease) {
+	tFsm.lease = ls
+}
+
+// Leading tells if this instance acts.
+func (tFsm *CryptoSelectorFsm) Leading() bool {
+	return tFsm.lease == nil || tFsm.lease.Held()
+}
+
 func (tFsm *CryptoSelectorFsm) SignalChannelsMap() map[string]chan Message {
 	return tFsm.ChanMapForRedisEvents
 }
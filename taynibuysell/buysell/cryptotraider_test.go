@@ -2,12 +2,17 @@ package buysell_test
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/execution"
 	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	"github.com/lagarciag/tayni/strength"
 	"github.com/lagarciag/tayni/taynibuysell/buysell"
 	"github.com/lagarciag/tayni/taynitrader/trader"
 	log "github.com/sirupsen/logrus"
@@ -89,6 +94,379 @@ func TestCryptoSelectorBasic(t *testing.T) {
 
 }
 
+func TestCryptoSelectorRotation(t *testing.T) {
+
+	kr := kredis.NewKredis(20000)
+	kr.Start()
+
+	ID := fmt.Sprintf("TESTROT%d", rand.Int63())
+	cryptoPairs := []string{"ETHBTC", "XRPBTC"}
+	tradePairs := []string{"BTCUSD"}
+
+	cs := buysell.NewCryptoSelector(ID, kr, cryptoPairs, tradePairs, nil)
+
+	if holding := cs.Holding(); holding != buysell.DefaultAsset {
+		t.Fatal("Selector should hold BTC by default: ", holding)
+	}
+
+	// ------------------------
+	// An alt beats BTC
+	// ------------------------
+	rotation, ok := cs.Signal("ETHBTC", true)
+	if !ok || rotation.Sell != "BTC" || rotation.Buy != "ETH" || len(rotation.Legs) != 1 ||
+		rotation.Legs[0].Pair != "ETHBTC" || rotation.Legs[0].Side != execution.Buy {
+		t.Error("Bad rotation to ETH: ", rotation)
+	}
+
+	// No churn between alts of the same rank
+	if rotation, ok := cs.Signal("XRPBTC", true); ok {
+		t.Error("Held ETH is still bullish: ", rotation)
+	}
+
+	// ------------------------
+	// Alt to alt through BTC
+	// ------------------------
+	rotation, ok = cs.Signal("ETHBTC", false)
+	if !ok || rotation.Buy != "XRP" || len(rotation.Legs) != 2 ||
+		rotation.Legs[0] != (buysell.Leg{Pair: "ETHBTC", Side: execution.Sell}) ||
+		rotation.Legs[1] != (buysell.Leg{Pair: "XRPBTC", Side: execution.Buy}) {
+		t.Error("Bad rotation to XRP: ", rotation)
+	}
+
+	held, err := kr.GetString(fmt.Sprintf(buysell.CryptoPairString, ID, "XRPBTC"))
+	if err != nil || held != "true" {
+		t.Error("Held pair not persisted: ", held, err)
+	}
+
+	// ------------------------
+	// A restart keeps XRP
+	// ------------------------
+	rkr := kredis.NewKredis(20000)
+	rkr.Start()
+
+	restarted := buysell.NewCryptoSelector(ID, rkr, cryptoPairs, tradePairs, nil)
+
+	if holding := restarted.Holding(); holding != "XRP" {
+		t.Error("Holding not restored: ", holding)
+	}
+
+	// Without buy signals back to BTC
+	rotation, ok = restarted.Signal("XRPBTC", false)
+	if !ok || rotation.Buy != "BTC" || rotation.Legs[0] != (buysell.Leg{Pair: "XRPBTC", Side: execution.Sell}) {
+		t.Error("Bad rotation back to BTC: ", rotation)
+	}
+
+	if rotation, ok := restarted.Signal("BTCUSD", true); ok {
+		t.Error("BTC is already held: ", rotation)
+	}
+}
+
+func TestCryptoSelectorStandby(t *testing.T) {
+
+	kr := kredis.NewKredis(20000)
+	kr.Start()
+
+	ID := fmt.Sprintf("TESTSTANDBY%d", rand.Int63())
+	cryptoPairs := []string{"ETHBTC", "XRPBTC"}
+	tradePairs := []string{"BTCUSD"}
+
+	cs := buysell.NewCryptoSelector(ID, kr, cryptoPairs, tradePairs, nil)
+
+	leaseConfig := leader.Config{TTL: time.Minute, ID: "standby"}
+	if err := leaseConfig.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	lease := leader.NewLease(kr, fmt.Sprintf("TEST_LEADER_%d", rand.Int63()), leaseConfig)
+	cs.SetLease(lease)
+
+	// ---------------------------
+	// A standby does not rotate
+	// ---------------------------
+	if rotation, ok := cs.Signal("ETHBTC", true); ok || cs.Leading() {
+		t.Error("Standby should not rotate: ", rotation)
+	}
+
+	if held, _ := kr.GetString(fmt.Sprintf(buysell.CryptoPairString, ID, "ETHBTC")); held == "true" {
+		t.Error("Standby saved the selector state")
+	}
+
+	if saved, _ := kr.GetString(fmt.Sprintf(buysell.RotationString, ID)); saved != "" {
+		t.Error("Standby saved a rotation: ", saved)
+	}
+
+	// ---------------------------
+	// It rotates once leading
+	// ---------------------------
+	if !lease.Acquire() {
+		t.Fatal("Free lease not acquired")
+	}
+	defer lease.Release()
+
+	rotation, ok := cs.Signal("ETHBTC", true)
+	if !ok || rotation.Buy != "ETH" {
+		t.Error("Leader should rotate to ETH: ", rotation)
+	}
+}
+
+func TestRankByStrength(t *testing.T) {
+
+	mx := strength.Matrix{Ranking: []strength.Strength{{Asset: "XRP", Score: 0.2}, {Asset: "ETH", Score: 0.1}}}
+	ranker := buysell.RankByStrength(func() (strength.Matrix, bool) { return mx, true })
+
+	now := time.Now()
+	candidates := []buysell.Candidate{
+		{Pair: "BTCUSD", Asset: "BTC", Since: now.Add(-time.Hour)},
+		{Pair: "ETHBTC", Asset: "ETH", Crypto: true, Since: now.Add(-time.Hour)},
+		{Pair: "XRPBTC", Asset: "XRP", Crypto: true, Since: now},
+	}
+
+	ranked := ranker(candidates)
+	if ranked[0].Asset != "XRP" || ranked[1].Asset != "ETH" || ranked[2].Score != -1 {
+		t.Error("Bad ranking by strength: ", ranked)
+	}
+
+	// Without matrix the signals rank
+	ranked = buysell.RankByStrength(func() (strength.Matrix, bool) { return strength.Matrix{}, false })(candidates)
+	if ranked[0].Asset != "ETH" || ranked[2].Asset != "BTC" {
+		t.Error("Bad ranking by signal: ", ranked)
+	}
+}
+
+func TestRebalancerPlan(t *testing.T) {
+
+	prices := map[string]float64{"BTCUSD": 10000, "ETHBTC": 0.05}
+	price := func(pair string) (float64, error) {
+		last, ok := prices[pair]
+		if !ok {
+			return 0, fmt.Errorf("no price for %s", pair)
+		}
+		return last, nil
+	}
+
+	config := buysell.RebalancerConfig{Tolerance: 5, Fee: 1}
+	balances := map[string]float64{"BTC": 1, "USD": 5000}
+	pairs := []string{"ETHBTC", "BTCUSD"}
+
+	plan, err := buysell.PlanRebalance(config, balances, map[string]float64{"ETH": 1}, pairs, price)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if math.Abs(plan.Value-1.5) > 1e-9 {
+		t.Error("Bad portfolio value: ", plan.Value)
+	}
+
+	// The USD are sold first and fund the ETH net of fees
+	if len(plan.Trades) != 2 {
+		t.Fatal("Bad trades: ", plan)
+	}
+	if sell := plan.Trades[0]; sell.Pair != "BTCUSD" || sell.Side != execution.Buy || math.Abs(sell.Amount-0.5) > 1e-9 {
+		t.Error("Bad USD trade: ", sell)
+	}
+	spend := 1 + 0.5*0.99
+	if buy := plan.Trades[1]; buy.Pair != "ETHBTC" || buy.Side != execution.Buy || math.Abs(buy.Amount-spend/1.01/0.05) > 1e-9 {
+		t.Error("Bad ETH trade: ", buy)
+	}
+
+	// Within the band nothing trades
+	balances = map[string]float64{"BTC": 0.48, "ETH": 10.4}
+	plan, _ = buysell.PlanRebalance(config, balances, map[string]float64{"ETH": 0.5, "BTC": 0.5}, pairs, price)
+	if len(plan.Trades) != 0 {
+		t.Error("Traded within the tolerance: ", plan)
+	}
+
+	// Orders under the exchange minimum are skipped
+	config.MinOrder = map[string]float64{"ETH": 100}
+	plan, _ = buysell.PlanRebalance(config, map[string]float64{"BTC": 1}, map[string]float64{"ETH": 1}, pairs, price)
+	if len(plan.Trades) != 0 || len(plan.Skipped) != 1 {
+		t.Error("Bad minimum order: ", plan, plan.Skipped)
+	}
+
+	weights := buysell.TargetWeights([]buysell.Candidate{{Asset: "ETH", Score: 3}, {Asset: "XRP", Score: 1}, {Asset: "LTC", Score: -1}})
+	if weights["ETH"] != 0.75 || weights["XRP"] != 0.25 || len(weights) != 2 {
+		t.Error("Bad target weights: ", weights)
+	}
+	if weights := buysell.TargetWeights(nil); weights["BTC"] != 1 {
+		t.Error("Bad default weights: ", weights)
+	}
+}
+
+func TestRebalancerPaper(t *testing.T) {
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	exchange := fmt.Sprintf("REBALANCE%d", rand.Int())
+	kr.Set(fmt.Sprintf("PRICE_%s_ETHBTC", exchange), "0.05")
+	kr.Set(fmt.Sprintf("PRICE_%s_XRPBTC", exchange), "0.0001")
+
+	paper := execution.NewPaper(execution.PaperConfig{Exchange: exchange, Balances: map[string]float64{"BTC": 1}, Fee: 0.25}, kr)
+
+	candidates := []buysell.Candidate{
+		{Pair: "ETHBTC", Asset: "ETH", Crypto: true},
+		{Pair: "XRPBTC", Asset: "XRP", Crypto: true},
+	}
+
+	config := buysell.RebalancerConfig{Exchange: exchange, Tolerance: 2, Fee: 0.25, Interval: time.Minute}
+	rebalancer := buysell.NewRebalancer("TEST", config, []string{"ETHBTC", "XRPBTC"},
+		func() []buysell.Candidate { return candidates }, paper, kr)
+
+	plan, err := rebalancer.Rebalance()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(plan.Trades) != 2 {
+		t.Fatal("Bad trades: ", plan)
+	}
+
+	balances := paper.Balances()
+	if math.Abs(balances["ETH"]*0.05-0.5/1.0025) > 1e-6 || balances["BTC"] > 1e-6 {
+		t.Error("Bad balances: ", balances)
+	}
+
+	// Balanced, nothing to do
+	if plan, _ := rebalancer.Rebalance(); len(plan.Trades) != 0 {
+		t.Error("Traded a balanced portfolio: ", plan)
+	}
+
+	// XRP is sold into ETH
+	candidates = candidates[:1]
+	plan, err = rebalancer.Rebalance()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(plan.Trades) != 2 || plan.Trades[0].Pair != "XRPBTC" || plan.Trades[0].Side != execution.Sell {
+		t.Fatal("Bad trades: ", plan)
+	}
+
+	balances = paper.Balances()
+	if balances["XRP"] != 0 || balances["BTC"] > 1e-6 || balances["ETH"] < 19 {
+		t.Error("Bad balances: ", balances)
+	}
+
+	saved, err := kr.GetString(fmt.Sprintf(buysell.RebalanceString, "TEST"))
+	if err != nil || saved == "" {
+		t.Error("Plan not saved: ", err)
+	}
+}
+
+func TestRebalancerStandbyAndBreaker(t *testing.T) {
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	exchange := fmt.Sprintf("REBALANCE%d", rand.Int())
+	kr.Set(fmt.Sprintf("PRICE_%s_ETHBTC", exchange), "0.05")
+
+	paper := execution.NewPaper(execution.PaperConfig{Exchange: exchange, Balances: map[string]float64{"BTC": 1}}, kr)
+
+	candidates := []buysell.Candidate{{Pair: "ETHBTC", Asset: "ETH", Crypto: true}}
+
+	config := buysell.RebalancerConfig{Exchange: exchange, Tolerance: 2, Interval: time.Minute}
+	rebalancer := buysell.NewRebalancer("TEST", config, []string{"ETHBTC"},
+		func() []buysell.Candidate { return candidates }, paper, kr)
+
+	// ---------------------------
+	// A standby does not trade
+	// ---------------------------
+	leaseConfig := leader.Config{TTL: time.Minute, ID: "standby"}
+	if err := leaseConfig.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	lease := leader.NewLease(kr, fmt.Sprintf("TEST_LEADER_%d", rand.Int63()), leaseConfig)
+	rebalancer.SetLease(lease)
+
+	if _, err := rebalancer.Rebalance(); err == nil || rebalancer.Leading() {
+		t.Error("Standby should not rebalance")
+	}
+
+	if !lease.Acquire() {
+		t.Fatal("Free lease not acquired")
+	}
+	defer lease.Release()
+
+	// ---------------------------
+	// Nor does a tripped breaker
+	// ---------------------------
+	brk := breaker.New(breaker.Config{Key: fmt.Sprintf("TEST_BREAKER_%d", rand.Int63())}, kr)
+	rebalancer.SetBreaker(brk)
+
+	if err := brk.Kill("test"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := rebalancer.Rebalance(); err == nil {
+		t.Error("Tripped breaker should stop the rebalancing")
+	}
+
+	if balances := paper.Balances(); balances["BTC"] != 1 || balances["ETH"] != 0 {
+		t.Error("Traded while refused: ", balances)
+	}
+
+	if err := brk.Reset(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	plan, err := rebalancer.Rebalance()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(plan.Trades) != 1 || paper.Balances()["ETH"] <= 0 {
+		t.Error("Leader should rebalance once the breaker is reset: ", plan)
+	}
+}
+
+func TestCryptoSelectorFsmCoins(t *testing.T) {
+
+	coins := buysell.Coins([]string{"BTCUSD", "ETHBTC", "XRPBTC", "LTCBTC", "ETHUSD"})
+	if fmt.Sprint(coins) != "[BTC ETH XRP LTC]" {
+		t.Error("Bad coins: ", coins)
+	}
+
+	tFsm := buysell.NewCryptoTradeFsm("BITFINEX", []string{"ETHBTC", "XRPBTC", "LTCBTC"})
+
+	for _, coin := range tFsm.Coins() {
+		if _, ok := tFsm.ChanMapForRedisEvents[fmt.Sprintf("BITFINEX_%s_BUY", coin)]; !ok {
+			t.Error("No buy channel for ", coin)
+		}
+		if _, ok := tFsm.ChanMessageMap[buysell.SellEvent(coin)]; !ok {
+			t.Error("No sell channel for ", coin)
+		}
+	}
+
+	if tFsm.ChanMapForRedisEvents["STOP"] != tFsm.ChanStopEvent {
+		t.Error("STOP not mapped to the stop event")
+	}
+
+	events := []string{buysell.StartEvent,
+		buysell.TradeEvent,
+		buysell.BuyEvent("LTC"),
+		buysell.SellEvent("LTC"),
+		buysell.SellCompleteEvent,
+	}
+	states := []string{buysell.IdleState,
+		buysell.TradingState,
+		buysell.BuyState("LTC"),
+		buysell.SellState("LTC"),
+		buysell.TradingState,
+	}
+
+	for i, event := range events {
+		if err := tFsm.FSM.Event(event); err != nil {
+			t.Fatal("Event ", event, ": ", err.Error())
+		}
+		if tFsm.FSM.Current() != states[i] {
+			t.Error("Bad current state: ", tFsm.FSM.Current())
+		}
+	}
+
+	// A coin can not be bought while another is held
+	tFsm.FSM.Event(buysell.BuyEvent("ETH"))
+	if err := tFsm.FSM.Event(buysell.BuyEvent("XRP")); err == nil {
+		t.Error("XRP bought while holding ETH")
+	}
+}
+
 /*
 func TestTraderController(t *testing.T) {
 
@@ -0,0 +1,569 @@
+package buysell
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// RebalanceString keeps the last rebalancing plan of a selector
+	RebalanceString = "%s_REBALANCER_PLAN_LAST"
+	// RebalanceChannel publishes the rebalancing plans of a selector
+	RebalanceChannel = "%s_REBALANCER"
+)
+
+// Weights sources
+const (
+	WeightsBySignal   = "signal"
+	WeightsByStrength = "strength"
+)
+
+const (
+	defaultRebalanceInterval = 10 * time.Minute
+	defaultTolerance         = 5.0
+)
+
+// RebalancerConfig configures the rebalancer of an exchange. Tolerance is
+// the drift from a target weight, in percent points, tolerated before
+// trading. Fee is a percentage of every trade, MinOrder the smallest order
+// accepted by the exchange per base currency.
+type RebalancerConfig struct {
+	Exchange  string
+	Weights   string
+	Tolerance float64
+	Fee       float64
+	MinOrder  map[string]float64
+	Interval  time.Duration
+}
+
+// LoadRebalancerConfig reads the rebalancer configuration of an exchange.
+// It returns false when the selector should rotate a single asset instead.
+// The fee defaults to the paper fee of the exchange.
+//
+//	[rebalancer]
+//	weights = "strength"  # or "signal"
+//	tolerance = 5         # percent points
+//	fee = 0.25            # percent
+//	interval = "10m"
+//
+//	[rebalancer.min_order]
+//	BTC = 0.001
+//	ETH = 0.01
+func LoadRebalancerConfig(exchange string) (RebalancerConfig, bool) {
+	if !viper.IsSet("rebalancer") {
+		return RebalancerConfig{}, false
+	}
+
+	config := RebalancerConfig{}
+	config.Exchange = strings.ToUpper(exchange)
+	config.Weights = viper.GetString("rebalancer.weights")
+	config.Tolerance = viper.GetFloat64("rebalancer.tolerance")
+	config.Interval = viper.GetDuration("rebalancer.interval")
+
+	config.Fee = execution.LoadPaperConfig(exchange).Fee
+	if viper.IsSet("rebalancer.fee") {
+		config.Fee = viper.GetFloat64("rebalancer.fee")
+	}
+
+	config.MinOrder = make(map[string]float64)
+	for currency := range viper.GetStringMap("rebalancer.min_order") {
+		config.MinOrder[strings.ToUpper(currency)] = viper.GetFloat64("rebalancer.min_order." + currency)
+	}
+
+	if config.Weights == "" {
+		config.Weights = WeightsBySignal
+	}
+
+	if config.Tolerance <= 0 {
+		config.Tolerance = defaultTolerance
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = defaultRebalanceInterval
+	}
+
+	return config, true
+}
+
+// TargetWeights turns ranked candidates into target weights proportional
+// to their positive scores, an asset counting once with its best score.
+// Without a positive score everything goes to BTC.
+func TargetWeights(ranked []Candidate) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, candidate := range ranked {
+		if candidate.Score > scores[candidate.Asset] {
+			scores[candidate.Asset] = candidate.Score
+		}
+	}
+
+	total := 0.0
+	for _, score := range scores {
+		total += score
+	}
+
+	if total <= 0 {
+		return map[string]float64{DefaultAsset: 1}
+	}
+
+	weights := make(map[string]float64)
+	for asset, score := range scores {
+		if score > 0 {
+			weights[asset] = score / total
+		}
+	}
+	return weights
+}
+
+// Position is an asset of the portfolio. Value is in BTC, Weight and Target
+// are fractions of the portfolio value.
+type Position struct {
+	Asset  string  `json:"asset"`
+	Amount float64 `json:"amount"`
+	Value  float64 `json:"value"`
+	Weight float64 `json:"weight"`
+	Target float64 `json:"target"`
+}
+
+// Trade is an order of a rebalancing. Amount is in the base currency of the
+// pair, Value and Fee are in BTC.
+type Trade struct {
+	Leg
+	Asset  string  `json:"asset"`
+	Amount float64 `json:"amount"`
+	Price  float64 `json:"price"`
+	Value  float64 `json:"value"`
+	Fee    float64 `json:"fee"`
+}
+
+// Plan is the rebalancing of a portfolio valued Value BTC. Skipped lists
+// the trades dropped and why.
+type Plan struct {
+	ID        string     `json:"id"`
+	Date      time.Time  `json:"date"`
+	Value     float64    `json:"value"`
+	Positions []Position `json:"positions"`
+	Trades    []Trade    `json:"trades"`
+	Skipped   []string   `json:"skipped,omitempty"`
+}
+
+func (pl Plan) String() string {
+	trades := make([]string, len(pl.Trades))
+	for i, trade := range pl.Trades {
+		trades[i] = fmt.Sprintf("%s %f %s", trade.Side, trade.Amount, trade.Pair)
+	}
+	return fmt.Sprintf("value %f BTC, trades: [%s]", pl.Value, strings.Join(trades, ", "))
+}
+
+// PlanRebalance computes the trades moving the balances to the target
+// weights. Every asset trades against BTC, whose weight is what the others
+// leave. Assets drifting less than the tolerance are left alone, the sells
+// go first and fund the buys net of fees, and the orders under the
+// exchange minimum are skipped.
+func PlanRebalance(config RebalancerConfig,
+	balances map[string]float64,
+	targets map[string]float64,
+	pairs []string,
+	price func(pair string) (float64, error)) (Plan, error) {
+
+	plan := Plan{}
+
+	assets := make(map[string]bool)
+	for asset, amount := range balances {
+		if amount > 0 {
+			assets[asset] = true
+		}
+	}
+	for asset := range targets {
+		assets[asset] = true
+	}
+	assets[DefaultAsset] = true
+
+	// ---------------------------
+	// Value the portfolio in BTC
+	// ---------------------------
+	prices := make(map[string]float64)
+	for asset := range assets {
+		unit, err := unitPrice(asset, pairs, price)
+		if err != nil {
+			log.Errorf("Rebalancer can not value %s: %s", asset, err.Error())
+			plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s: %s", asset, err.Error()))
+			continue
+		}
+		prices[asset] = unit
+		plan.Value += balances[asset] * unit
+	}
+
+	if plan.Value <= 0 {
+		return plan, fmt.Errorf("nothing to rebalance in %v", balances)
+	}
+
+	for asset, unit := range prices {
+		value := balances[asset] * unit
+		plan.Positions = append(plan.Positions, Position{Asset: asset, Amount: balances[asset],
+			Value: value, Weight: value / plan.Value, Target: targets[asset]})
+	}
+	sort.Slice(plan.Positions, func(i, j int) bool { return plan.Positions[i].Asset < plan.Positions[j].Asset })
+
+	// ---------------------------
+	// Drifts out of the band
+	// ---------------------------
+	fee := config.Fee / 100
+	var sells, buys []Trade
+
+	for _, position := range plan.Positions {
+		if position.Asset == DefaultAsset {
+			continue
+		}
+
+		drift := position.Target - position.Weight
+		if math.Abs(drift)*100 <= config.Tolerance {
+			continue
+		}
+
+		value := math.Abs(drift) * plan.Value
+		if drift < 0 {
+			leg, _ := directLeg(position.Asset, DefaultAsset, pairs)
+			sells = append(sells, Trade{Leg: leg, Asset: position.Asset, Value: value, Fee: value * fee})
+		} else {
+			leg, _ := directLeg(DefaultAsset, position.Asset, pairs)
+			buys = append(buys, Trade{Leg: leg, Asset: position.Asset, Value: value})
+		}
+	}
+
+	// -------------------------------
+	// Sells fund the buys net of the
+	// fees, short funds scale all buys
+	// -------------------------------
+	available := balances[DefaultAsset]
+	for _, trade := range sells {
+		available += trade.Value - trade.Fee
+	}
+
+	needed := 0.0
+	for _, trade := range buys {
+		needed += trade.Value * (1 + fee)
+	}
+
+	scale := 1.0
+	if needed > available {
+		scale = available / needed
+	}
+
+	for i := range buys {
+		spend := buys[i].Value * (1 + fee) * scale
+		buys[i].Value = spend / (1 + fee)
+		buys[i].Fee = spend - buys[i].Value
+	}
+
+	for _, trade := range append(sells, buys...) {
+		trade, err := sized(trade, prices, pairs, price)
+		if err != nil {
+			plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s: %s", trade.Asset, err.Error()))
+			continue
+		}
+
+		base, _, _ := execution.SplitPair(trade.Pair)
+		if minimum := config.MinOrder[base]; trade.Amount <= 0 || trade.Amount < minimum {
+			plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s: %f %s under the minimum order %f",
+				trade.Asset, trade.Amount, base, minimum))
+			continue
+		}
+
+		plan.Trades = append(plan.Trades, trade)
+	}
+
+	return plan, nil
+}
+
+// unitPrice is the value of one unit of asset in BTC
+func unitPrice(asset string, pairs []string, price func(pair string) (float64, error)) (float64, error) {
+	if asset == DefaultAsset {
+		return 1, nil
+	}
+
+	leg, ok := directLeg(DefaultAsset, asset, pairs)
+	if !ok {
+		return 0, fmt.Errorf("no pair with %s", DefaultAsset)
+	}
+
+	last, err := price(leg.Pair)
+	if err != nil {
+		return 0, err
+	}
+	if last <= 0 {
+		return 0, fmt.Errorf("bad price of %s: %f", leg.Pair, last)
+	}
+
+	// Buying the asset with BTC means the asset is the base
+	if leg.Side == execution.Buy {
+		return last, nil
+	}
+	return 1 / last, nil
+}
+
+// sized sets the amount of a trade in the base currency of its pair
+func sized(trade Trade, prices map[string]float64, pairs []string, price func(pair string) (float64, error)) (Trade, error) {
+	if trade.Pair == "" {
+		return trade, fmt.Errorf("no pair with %s", DefaultAsset)
+	}
+
+	last, err := price(trade.Pair)
+	if err != nil {
+		return trade, err
+	}
+	trade.Price = last
+
+	base, _, err := execution.SplitPair(trade.Pair)
+	if err != nil {
+		return trade, err
+	}
+
+	if base == DefaultAsset {
+		trade.Amount = trade.Value
+	} else {
+		trade.Amount = trade.Value / prices[trade.Asset]
+	}
+
+	return trade, nil
+}
+
+// Rebalancer keeps the portfolio of an exchange at the target weights of
+// the bullish assets, an alternative to rotating a single asset. It plans
+// every interval and places the trades with the executor, which must report
+// its balances, see execution.Balancer. Like the selector FSM, it only
+// trades while its lease is held and the breaker allows it.
+type Rebalancer struct {
+	ID         string
+	config     RebalancerConfig
+	pairs      []string
+	candidates func() []Candidate
+	executor   execution.Executor
+	kr         *kredis.Kredis
+	ranker     Ranker
+	price      func(pair string) (float64, error)
+	clock      clock.Clock
+	breaker    *breaker.Breaker
+	lease      *leader.Lease
+	mu         *sync.Mutex
+}
+
+// NewRebalancer creates the rebalancer of the selector ID trading pairs.
+// candidates returns the bullish pairs, kr must not be subscribed to any
+// channel.
+func NewRebalancer(ID string,
+	config RebalancerConfig,
+	pairs []string,
+	candidates func() []Candidate,
+	executor execution.Executor,
+	kr *kredis.Kredis) *Rebalancer {
+
+	rb := &Rebalancer{}
+	rb.ID = ID
+	rb.config = config
+	rb.pairs = pairs
+	rb.candidates = candidates
+	rb.executor = executor
+	rb.kr = kr
+	rb.ranker = RankBySignal
+	rb.price = rb.lastPrice
+	rb.clock = clock.New()
+	rb.mu = &sync.Mutex{}
+	return rb
+}
+
+// SetRanker sets how the candidates are scored into weights, RankBySignal
+// by default.
+func (rb *Rebalancer) SetRanker(ranker Ranker) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.ranker = ranker
+}
+
+// SetClock sets the clock used to date and schedule the plans.
+func (rb *Rebalancer) SetClock(clk clock.Clock) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.clock = clk
+}
+
+// SetBreaker stops the rebalancing while the breaker is tripped and counts
+// the order requests in it.
+func (rb *Rebalancer) SetBreaker(brk *breaker.Breaker) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.breaker = brk
+}
+
+// SetLease makes the rebalancer trade only while the lease is held.
+func (rb *Rebalancer) SetLease(ls *leader.Lease) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.lease = ls
+}
+
+// Leading tells if this instance rebalances.
+func (rb *Rebalancer) Leading() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.lease == nil || rb.lease.Held()
+}
+
+// orders returns the executor placing the trades, counting its requests in
+// the breaker.
+func (rb *Rebalancer) orders() execution.Executor {
+	if rb.breaker == nil {
+		return rb.executor
+	}
+	return rb.breaker.Watch(rb.executor)
+}
+
+// lastPrice reads the last price of pair published by the collector
+func (rb *Rebalancer) lastPrice(pair string) (float64, error) {
+	key := fmt.Sprintf("PRICE_%s_%s", rb.config.Exchange, pair)
+	priceStr, err := rb.kr.GetString(key)
+	if err != nil {
+		return 0, fmt.Errorf("price %s: %s", key, err.Error())
+	}
+	return strconv.ParseFloat(priceStr, 64)
+}
+
+// Rebalance plans the trades to the current targets and places them. It
+// returns the plan, with the trades that went through. Standbys and a
+// tripped breaker do not rebalance.
+func (rb *Rebalancer) Rebalance() (Plan, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.lease != nil && !rb.lease.Held() {
+		return Plan{}, fmt.Errorf("rebalancer %s is on standby", rb.ID)
+	}
+
+	if rb.breaker != nil {
+		if err := rb.breaker.Allow(""); err != nil {
+			return Plan{}, fmt.Errorf("rebalancing %s refused: %s", rb.ID, err.Error())
+		}
+	}
+
+	balancer, ok := rb.executor.(execution.Balancer)
+	if !ok {
+		return Plan{}, fmt.Errorf("executor of %s can not report its balances", rb.ID)
+	}
+
+	targets := TargetWeights(rb.ranker(rb.candidates()))
+
+	plan, err := PlanRebalance(rb.config, balancer.Balances(), targets, rb.pairs, rb.price)
+	if err != nil {
+		return plan, err
+	}
+	plan.ID = rb.ID
+	plan.Date = rb.clock.Now()
+
+	var placed []Trade
+	for i, trade := range plan.Trades {
+		if err := rb.place(plan, i, trade); err != nil {
+			log.Errorf("Rebalancing %s: %s", trade.Pair, err.Error())
+			plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s: %s", trade.Asset, err.Error()))
+			continue
+		}
+		placed = append(placed, trade)
+	}
+	plan.Trades = placed
+
+	rb.publish(plan)
+
+	return plan, nil
+}
+
+// place places a trade and follows it until final
+func (rb *Rebalancer) place(plan Plan, index int, trade Trade) error {
+
+	config, ok := execution.LoadConfig(trade.Pair)
+	if !ok {
+		config = execution.Config{OrderType: execution.Market}
+	}
+	config.Amount = trade.Amount
+
+	request := execution.NewRequest(trade.Pair, trade.Side, config, trade.Price)
+	request.ClientID = execution.ClientOrderID(trade.Pair, fmt.Sprintf("REBALANCE%d", plan.Date.Unix()), index)
+
+	executor := rb.orders()
+
+	order, err := executor.Place(request)
+	if err != nil {
+		return err
+	}
+
+	if !order.Status.Final() {
+		if order, err = execution.Track(executor, order, config, rb.clock); err != nil {
+			return err
+		}
+	}
+
+	if order.Status != execution.StatusFilled {
+		return fmt.Errorf("order %s %s, filled %f of %f", order.ID, order.Status, order.Filled, order.Amount)
+	}
+
+	return nil
+}
+
+// publish saves the plan and publishes it
+func (rb *Rebalancer) publish(plan Plan) {
+
+	planJSON, err := json.Marshal(plan)
+	if err != nil {
+		log.Error("Marshaling rebalancing plan: ", err.Error())
+		return
+	}
+
+	if err := rb.kr.Set(fmt.Sprintf(RebalanceString, rb.ID), string(planJSON)); err != nil {
+		log.Error("Saving rebalancing plan: ", err.Error())
+	}
+
+	if err := rb.kr.Publish(fmt.Sprintf(RebalanceChannel, rb.ID), string(planJSON)); err != nil {
+		log.Error("Publishing rebalancing plan: ", err.Error())
+	}
+
+	message := `
+	----------------------------------------------------
+	REBALANCE %s: %s
+	----------------------------------------------------
+	`
+	log.Infof(message, rb.ID, plan)
+}
+
+// Run rebalances every interval until stop is closed.
+func (rb *Rebalancer) Run(stop chan struct{}) {
+
+	rb.mu.Lock()
+	ticker := rb.clock.NewTicker(rb.config.Interval)
+	rb.mu.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			if !rb.Leading() {
+				continue
+			}
+			if _, err := rb.Rebalance(); err != nil {
+				log.Error("Rebalancer: ", err.Error())
+			}
+		}
+	}
+}
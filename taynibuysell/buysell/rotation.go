@@ -0,0 +1,143 @@
+package buysell
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/strength"
+)
+
+// DefaultAsset is held when no pair has a buy signal
+const DefaultAsset = "BTC"
+
+// Candidate is a pair with an active buy signal. Asset is what holding it
+// means, the base currency of the pair.
+type Candidate struct {
+	Pair   string    `json:"pair"`
+	Asset  string    `json:"asset"`
+	Crypto bool      `json:"crypto"`
+	Since  time.Time `json:"since"`
+	Score  float64   `json:"score"`
+}
+
+// Ranker orders the candidates, best first, setting their score. The
+// holding only rotates to a candidate scoring more than the held asset.
+type Ranker func(candidates []Candidate) []Candidate
+
+// RankBySignal is the default ranker. Alts bullish against BTC beat the
+// trade pairs, and within each group the longest bullish comes first.
+func RankBySignal(candidates []Candidate) []Candidate {
+	ranked := make([]Candidate, len(candidates))
+	copy(ranked, candidates)
+
+	for i := range ranked {
+		if ranked[i].Crypto {
+			ranked[i].Score = 2
+		} else {
+			ranked[i].Score = 1
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].Since.Before(ranked[j].Since)
+	})
+
+	return ranked
+}
+
+// RankByStrength ranks the candidates by the strength score of their asset
+// in the latest matrix, the longest bullish first on ties. Assets missing
+// from the matrix score -1, the lowest return possible. Without a matrix
+// it ranks by signal.
+func RankByStrength(latest func() (strength.Matrix, bool)) Ranker {
+	return func(candidates []Candidate) []Candidate {
+		mx, ok := latest()
+		if !ok {
+			return RankBySignal(candidates)
+		}
+
+		ranked := make([]Candidate, len(candidates))
+		copy(ranked, candidates)
+
+		for i := range ranked {
+			score, found := mx.Score(ranked[i].Asset)
+			if !found {
+				score = -1
+			}
+			ranked[i].Score = score
+		}
+
+		sort.SliceStable(ranked, func(i, j int) bool {
+			if ranked[i].Score != ranked[j].Score {
+				return ranked[i].Score > ranked[j].Score
+			}
+			return ranked[i].Since.Before(ranked[j].Since)
+		})
+
+		return ranked
+	}
+}
+
+// Leg is one order of a rotation
+type Leg struct {
+	Pair string         `json:"pair"`
+	Side execution.Side `json:"side"`
+}
+
+// Rotation is the decision to move the holding from one asset to another.
+type Rotation struct {
+	ID         string      `json:"id"`
+	Date       time.Time   `json:"date"`
+	Sell       string      `json:"sell"`
+	Buy        string      `json:"buy"`
+	Legs       []Leg       `json:"legs"`
+	Reason     string      `json:"reason"`
+	Candidates []Candidate `json:"candidates"`
+}
+
+func (rt Rotation) String() string {
+	return fmt.Sprintf("sell %s, buy %s: %s", rt.Sell, rt.Buy, rt.Reason)
+}
+
+// route returns the orders moving from one asset to another with the
+// given pairs, directly or through BTC.
+func route(from, to string, pairs []string) ([]Leg, error) {
+	if from == to {
+		return nil, nil
+	}
+
+	if leg, ok := directLeg(from, to, pairs); ok {
+		return []Leg{leg}, nil
+	}
+
+	if from != DefaultAsset && to != DefaultAsset {
+		toBTC, okFrom := directLeg(from, DefaultAsset, pairs)
+		fromBTC, okTo := directLeg(DefaultAsset, to, pairs)
+		if okFrom && okTo {
+			return []Leg{toBTC, fromBTC}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no pairs to rotate from %s to %s", from, to)
+}
+
+func directLeg(from, to string, pairs []string) (Leg, bool) {
+	for _, pair := range pairs {
+		base, quote, err := execution.SplitPair(pair)
+		if err != nil {
+			continue
+		}
+		switch {
+		case base == to && quote == from:
+			return Leg{Pair: pair, Side: execution.Buy}, true
+		case base == from && quote == to:
+			return Leg{Pair: pair, Side: execution.Sell}, true
+		}
+	}
+	return Leg{}, false
+}
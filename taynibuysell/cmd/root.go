@@ -29,6 +29,7 @@ import (
 )
 
 var cfgFile string
+var selectorID string
 var osSignals chan os.Signal
 var shutDownCond *sync.Cond
 
@@ -56,6 +57,7 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.taynitrader.yaml)")
+	RootCmd.PersistentFlags().StringVar(&selectorID, "id", "CEXIO", "selector ID, prefix of the <ID>_<pair>_BUY signals")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -77,7 +79,7 @@ func start() {
 
 	shutDownCond = sync.NewCond(&sync.Mutex{})
 	go shutdownControl()
-	buysell.Start()
+	buysell.Start(selectorID)
 
 	shutDownCond.L.Lock()
 	shutDownCond.Wait()
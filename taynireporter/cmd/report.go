@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/lagarciag/tayni/taynireporter/reporter"
+	"github.com/lagarciag/tayni/twitter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var reportAt string
+
+// reportCmd generates the performance reports
+var reportCmd = &cobra.Command{
+	Use:   "report [daily|weekly]",
+	Short: "generate the performance reports",
+	Long: `Generates the performance report of the last complete day or week, per pair
+and in total, as Markdown and HTML in report.directory of the configuration.
+Without a period it keeps running and generates every configured report as
+soon as its period is over.
+
+  taynireporter report daily
+  taynireporter report weekly --at 2018-01-08T00:00:00Z
+  taynireporter report`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := report(args); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reportCmd)
+
+	reportCmd.Flags().StringVar(&reportAt, "at", "", "RFC3339 date, report the period that ended before it instead of now")
+}
+
+func report(args []string) error {
+
+	config, ok := reporter.LoadReportConfig()
+	if !ok {
+		return fmt.Errorf("reports not configured, add a [report] section")
+	}
+
+	var err error
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	var notifier notify.Notifier
+	var router *notify.Router
+	if config.Notify {
+		if router, err = notify.Load(twitter.NewTwitterClient(twitter.LoadConfig())); err != nil {
+			return err
+		}
+		notifier = router
+	}
+
+	gen, err := reporter.NewGenerator(config, kr, notifier)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+
+		log.Infof("Generating the %s reports in: %s", strings.Join(config.Periods, " and "), config.Directory)
+		go func() {
+			<-signals
+			log.Info("Taynireporter shutdown...")
+			close(stop)
+		}()
+		if router != nil {
+			go router.Run(stop)
+		}
+		gen.Run(stop)
+		return nil
+	}
+
+	now := time.Now()
+	if reportAt != "" {
+		if now, err = time.Parse(time.RFC3339, reportAt); err != nil {
+			return err
+		}
+	}
+
+	if _, err = gen.Generate(strings.ToLower(args[0]), now); err != nil {
+		return err
+	}
+
+	// Reports held back for a digest go out now
+	if router != nil {
+		return router.Flush()
+	}
+	return nil
+}
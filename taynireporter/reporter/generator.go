@@ -0,0 +1,303 @@
+package reporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/journal"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/notify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// DefaultMaxGap is the longest silence of a feed still counted as up
+	DefaultMaxGap = 5 * time.Minute
+
+	// indicatorsDateLayout is the date of the statistician records, in UTC
+	indicatorsDateLayout = "01/02/2006 15:04:05"
+
+	// historyLimit is the size of the indicator lists in redis
+	historyLimit = 24000
+
+	// checkInterval is how often Run looks for a report to generate
+	checkInterval = time.Hour
+)
+
+// ReportConfig configures the performance reports. They are computed from
+// the trades Journal for the Pairs of Exchange and written to Directory.
+// MaxGap is the longest silence of a price feed still counted as up.
+type ReportConfig struct {
+	Directory  string
+	Journal    string
+	Exchange   string
+	Pairs      []string
+	Timeframes []int
+	Periods    []string
+	MaxGap     time.Duration
+	Notify     bool
+}
+
+// LoadReportConfig reads the report configuration. It returns false when
+// the reports are not configured. The journal is the one of the trader, the
+// exchange the first one configured and the timeframes minute_strategies
+// by default.
+//
+//	[report]
+//	directory = "/var/lib/tayni/reports"
+//	journal = "/var/lib/tayni/journal.jsonl"
+//	exchange = "cexio"
+//	periods = ["daily", "weekly"]
+//	max_gap = "5m"
+//	notify = true
+func LoadReportConfig() (ReportConfig, bool) {
+	if !viper.IsSet("report") {
+		return ReportConfig{}, false
+	}
+
+	config := ReportConfig{}
+	config.Directory = viper.GetString("report.directory")
+	config.Journal = viper.GetString("report.journal")
+	config.Exchange = strings.ToUpper(viper.GetString("report.exchange"))
+	config.Periods = viper.GetStringSlice("report.periods")
+	config.MaxGap = viper.GetDuration("report.max_gap")
+	config.Notify = viper.GetBool("report.notify")
+
+	if config.Journal == "" {
+		config.Journal = viper.GetString("journal.path")
+	}
+	if len(config.Periods) == 0 {
+		config.Periods = Periods
+	}
+	if config.MaxGap <= 0 {
+		config.MaxGap = DefaultMaxGap
+	}
+
+	if config.Exchange == "" {
+		var exchanges []string
+		for exchange := range viper.GetStringMap("exchange") {
+			exchanges = append(exchanges, strings.ToUpper(exchange))
+		}
+		sort.Strings(exchanges)
+		if len(exchanges) > 0 {
+			config.Exchange = exchanges[0]
+		}
+	}
+	config.Pairs = viper.GetStringSlice(fmt.Sprintf("exchange.%s.pairs", strings.ToLower(config.Exchange)))
+
+	if timeframes, ok := viper.Get("minute_strategies").([]interface{}); ok {
+		for _, timeframe := range timeframes {
+			switch minutes := timeframe.(type) {
+			case int64:
+				config.Timeframes = append(config.Timeframes, int(minutes))
+			case int:
+				config.Timeframes = append(config.Timeframes, minutes)
+			}
+		}
+	}
+	sort.Ints(config.Timeframes)
+
+	return config, true
+}
+
+// Generator generates the performance reports of the periods, reading the
+// prices and the feed history from redis.
+type Generator struct {
+	config   ReportConfig
+	kr       *kredis.Kredis
+	notifier notify.Notifier
+	clock    clock.Clock
+}
+
+// NewGenerator creates a report generator. The reports are sent to
+// notifier when configured to, it may be nil.
+func NewGenerator(config ReportConfig, kr *kredis.Kredis, notifier notify.Notifier) (*Generator, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("reports without a directory")
+	}
+	if config.Journal == "" {
+		return nil, fmt.Errorf("reports without a journal")
+	}
+	for _, period := range config.Periods {
+		if _, _, err := Bounds(period, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxGap <= 0 {
+		config.MaxGap = DefaultMaxGap
+	}
+
+	gen := &Generator{}
+	gen.config = config
+	gen.kr = kr
+	gen.notifier = notifier
+	gen.clock = clock.New()
+
+	return gen, nil
+}
+
+// SetClock replaces the wall clock, for simulations and tests.
+func (gen *Generator) SetClock(clk clock.Clock) {
+	gen.clock = clk
+}
+
+// Path returns the path of the Markdown report of the last complete period
+// before now.
+func (gen *Generator) Path(period string, now time.Time) (string, error) {
+	since, _, err := Bounds(period, now)
+	if err != nil {
+		return "", err
+	}
+	report := Report{Period: period, Since: since}
+	return filepath.Join(gen.config.Directory, report.Name()+".md"), nil
+}
+
+// Generate computes the report of the last complete period before now,
+// writes it and sends it when configured to.
+func (gen *Generator) Generate(period string, now time.Time) (Report, error) {
+	since, until, err := Bounds(period, now)
+	if err != nil {
+		return Report{}, err
+	}
+
+	entries, err := journal.Read(gen.config.Journal, journal.Query{Until: until})
+	if err != nil {
+		log.Error("Report: ", err.Error())
+		return Report{}, err
+	}
+
+	report := Compute(period, entries, since, until, gen.config.Pairs, gen.config.Timeframes, gen.prices(until))
+	report.Generated = gen.clock.Now().UTC()
+
+	for _, pf := range report.Pairs {
+		uptime, from := Uptime(gen.feed(pf.Pair), since, until, gen.config.MaxGap)
+		report.SetUptime(pf.Pair, uptime, from)
+	}
+
+	paths, err := report.Write(gen.config.Directory)
+	if err != nil {
+		log.Error("Report: ", err.Error())
+		return report, err
+	}
+	log.Infof("%s written: %s", report.Title(), strings.Join(paths, ", "))
+
+	if gen.config.Notify && gen.notifier != nil {
+		event := notify.Event{Type: notify.EventReport, Severity: notify.Info, Title: report.Title(),
+			Message: report.Markdown(), Date: report.Generated}
+		if err := gen.notifier.Notify(event); err != nil {
+			log.Error("Sending report: ", err.Error())
+		}
+	}
+
+	return report, nil
+}
+
+// prices are the prices of the pairs at until, the last value of their
+// newest indicator record at or before it. The ones without a record are
+// left out, journal.Compute values them at their last trade.
+func (gen *Generator) prices(until time.Time) map[string]float64 {
+	prices := make(map[string]float64)
+
+	for _, pair := range gen.config.Pairs {
+		var date time.Time
+		for _, rec := range gen.records(pair) {
+			if rec.date.After(until) || rec.last <= 0 || !rec.date.After(date) {
+				continue
+			}
+			date = rec.date
+			prices[pair] = rec.last
+		}
+	}
+	return prices
+}
+
+// feed returns the dates of the indicator records of pair, the statistician
+// writes one per sample
+func (gen *Generator) feed(pair string) []time.Time {
+	records := gen.records(pair)
+
+	dates := make([]time.Time, 0, len(records))
+	for _, rec := range records {
+		dates = append(dates, rec.date)
+	}
+	return dates
+}
+
+// record is the date and the price of an indicator record
+type record struct {
+	date time.Time
+	last float64
+}
+
+// records returns the indicator records of pair in the lowest timeframe,
+// newest first
+func (gen *Generator) records(pair string) []record {
+	if gen.kr == nil || len(gen.config.Timeframes) == 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s_%s_MS_%d_INDICATORS", gen.config.Exchange, pair, gen.config.Timeframes[0])
+	values, err := gen.kr.GetRange(key, historyLimit)
+	if err != nil {
+		log.Warnf("Reading the feed of %s: %s", pair, err.Error())
+		return nil
+	}
+
+	records := make([]record, 0, len(values))
+	for _, value := range values {
+		indicators := struct {
+			Date      string  `json:"date"`
+			LastValue float64 `json:"last_value"`
+		}{}
+		if err := json.Unmarshal([]byte(value), &indicators); err != nil {
+			continue
+		}
+		date, err := time.ParseInLocation(indicatorsDateLayout, indicators.Date, time.UTC)
+		if err != nil {
+			continue
+		}
+		records = append(records, record{date: date, last: indicators.LastValue})
+	}
+	return records
+}
+
+// Check generates the reports of the last complete periods that were not
+// written yet.
+func (gen *Generator) Check() {
+	now := gen.clock.Now()
+	for _, period := range gen.config.Periods {
+		path, err := gen.Path(period, now)
+		if err != nil {
+			log.Error("Report: ", err.Error())
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		gen.Generate(period, now)
+	}
+}
+
+// Run checks for reports to generate at once and every hour until stop is
+// closed.
+func (gen *Generator) Run(stop chan struct{}) {
+	ticker := gen.clock.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	gen.Check()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			gen.Check()
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package reporter
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/journal"
+)
+
+// Report periods
+const (
+	PeriodDaily  = "daily"
+	PeriodWeekly = "weekly"
+)
+
+// Periods lists the valid periods
+var Periods = []string{PeriodDaily, PeriodWeekly}
+
+// signalEvent matches the cascade events of the trader, Minute30BuyEvent
+var signalEvent = regexp.MustCompile(`^Minute(\d+)(Buy|Sell)Event$`)
+
+// Bounds returns the last complete period before now, in UTC. Days start
+// at midnight and weeks on Monday.
+func Bounds(period string, now time.Time) (since, until time.Time, err error) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case PeriodDaily:
+		return today.AddDate(0, 0, -1), today, nil
+	case PeriodWeekly:
+		monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+		return monday.AddDate(0, 0, -7), monday, nil
+	}
+
+	return since, until, fmt.Errorf("unknown report period %q, expected one of %s", period, strings.Join(Periods, ", "))
+}
+
+// Signals counts the buy and sell signals of a timeframe the trader acted
+// on.
+type Signals struct {
+	Buy  int `json:"buy"`
+	Sell int `json:"sell"`
+}
+
+// Performance of a pair, or of all the pairs of a quote currency when Pair
+// is empty. Values are in the quote currency: PnL is realized in the period
+// and Unrealized is the value of the open position at its end. HitRatio is
+// the percentage of the round trips closed in the period that won, Uptime
+// the percentage of the price feed seen since UptimeSince, negative when
+// unknown.
+type Performance struct {
+	Pair        string          `json:"pair,omitempty"`
+	Quote       string          `json:"quote"`
+	Trades      int             `json:"trades"`
+	RoundTrips  int             `json:"round_trips"`
+	Wins        int             `json:"wins"`
+	HitRatio    float64         `json:"hit_ratio"`
+	PnL         float64         `json:"pnl"`
+	Unrealized  float64         `json:"unrealized"`
+	Fees        float64         `json:"fees"`
+	MaxDrawdown float64         `json:"max_drawdown"`
+	InPosition  time.Duration   `json:"in_position"`
+	Signals     map[int]Signals `json:"signals"`
+	Uptime      float64         `json:"uptime"`
+	UptimeSince time.Time       `json:"uptime_since,omitempty"`
+}
+
+// Report is the performance of every pair in a period and its totals per
+// quote currency.
+type Report struct {
+	Period     string        `json:"period"`
+	Since      time.Time     `json:"since"`
+	Until      time.Time     `json:"until"`
+	Generated  time.Time     `json:"generated"`
+	Timeframes []int         `json:"timeframes"`
+	Pairs      []Performance `json:"pairs"`
+	Totals     []Performance `json:"totals"`
+}
+
+// Compute reports the performance of the journal entries of the period
+// from since to until. Entries must start before the period so positions
+// opened earlier are valued at their cost, later entries are ignored. Open
+// positions are valued at prices, the prices at until, see journal.Compute.
+func Compute(period string, entries []journal.Entry, since, until time.Time, pairs []string, timeframes []int, prices map[string]float64) Report {
+
+	report := Report{Period: period, Since: since, Until: until, Timeframes: timeframes}
+
+	var before, upTo []journal.Entry
+	for _, entry := range entries {
+		if !entry.Date.Before(until) {
+			continue
+		}
+		upTo = append(upTo, entry)
+		if entry.Date.Before(since) {
+			before = append(before, entry)
+		}
+	}
+
+	performances := make(map[string]*Performance)
+	performance := func(pair string) *Performance {
+		pf, ok := performances[pair]
+		if !ok {
+			_, quote, _ := execution.SplitPair(pair)
+			pf = &Performance{Pair: pair, Quote: quote, Signals: make(map[int]Signals), Uptime: -1}
+			for _, timeframe := range timeframes {
+				pf.Signals[timeframe] = Signals{}
+			}
+			performances[pair] = pf
+		}
+		return pf
+	}
+	for _, pair := range pairs {
+		performance(pair)
+	}
+
+	// ---------------------------------
+	// PnL of the period is the PnL up to
+	// its end less the one before it
+	// ---------------------------------
+	start := make(map[string]journal.PnL)
+	for _, pnl := range journal.Compute(before, nil).Pairs {
+		start[pnl.Pair] = pnl
+	}
+	for _, pnl := range journal.Compute(upTo, prices).Pairs {
+		pf := performance(pnl.Pair)
+		pf.Trades = pnl.Trades - start[pnl.Pair].Trades
+		pf.PnL = pnl.Realized - start[pnl.Pair].Realized
+		pf.Fees = pnl.Fees - start[pnl.Pair].Fees
+		pf.Unrealized = pnl.Unrealized
+	}
+
+	// ---------------------------------
+	// Round trips closed in the period,
+	// time in position within it
+	// ---------------------------------
+	trips := journal.Trips(upTo)
+	sort.SliceStable(trips, func(i, j int) bool { return closing(trips[i], until).Before(closing(trips[j], until)) })
+
+	equity := make(map[string]float64)
+	peaks := make(map[string]float64)
+	for _, trip := range trips {
+		pf := performance(trip.Pair)
+
+		opened, closed := trip.Opened, closing(trip, until)
+		if opened.Before(since) {
+			opened = since
+		}
+		if closed.After(opened) {
+			pf.InPosition += closed.Sub(opened)
+		}
+
+		if trip.Closed.IsZero() || trip.Closed.Before(since) {
+			continue
+		}
+
+		pf.RoundTrips++
+		if trip.Realized > 0 {
+			pf.Wins++
+		}
+
+		equity[trip.Pair] += trip.Realized
+		peaks[trip.Pair] = math.Max(peaks[trip.Pair], equity[trip.Pair])
+		pf.MaxDrawdown = math.Max(pf.MaxDrawdown, peaks[trip.Pair]-equity[trip.Pair])
+	}
+
+	// ---------------------------------
+	// Signals the trader acted on
+	// ---------------------------------
+	for _, entry := range upTo {
+		if entry.Kind != journal.KindTransition || entry.Date.Before(since) {
+			continue
+		}
+		match := signalEvent.FindStringSubmatch(entry.Event)
+		if match == nil {
+			continue
+		}
+		timeframe, _ := strconv.Atoi(match[1])
+
+		pf := performance(entry.Pair)
+		signals := pf.Signals[timeframe]
+		if match[2] == "Buy" {
+			signals.Buy++
+		} else {
+			signals.Sell++
+		}
+		pf.Signals[timeframe] = signals
+	}
+
+	for _, pf := range performances {
+		if pf.RoundTrips > 0 {
+			pf.HitRatio = float64(pf.Wins) / float64(pf.RoundTrips) * 100
+		}
+		report.Pairs = append(report.Pairs, *pf)
+	}
+	sort.Slice(report.Pairs, func(i, j int) bool { return report.Pairs[i].Pair < report.Pairs[j].Pair })
+
+	report.totals(trips, since, until)
+
+	return report
+}
+
+// closing is the date a trip closed, or until while it is open
+func closing(trip journal.Trip, until time.Time) time.Time {
+	if trip.Closed.IsZero() || trip.Closed.After(until) {
+		return until
+	}
+	return trip.Closed
+}
+
+// totals sums the pairs per quote currency, the drawdown is the one of the
+// trips of all the pairs in the order they closed
+func (report *Report) totals(trips []journal.Trip, since, until time.Time) {
+	totals := make(map[string]*Performance)
+
+	for _, pf := range report.Pairs {
+		total, ok := totals[pf.Quote]
+		if !ok {
+			total = &Performance{Quote: pf.Quote, Signals: make(map[int]Signals), Uptime: -1}
+			totals[pf.Quote] = total
+		}
+		total.Trades += pf.Trades
+		total.RoundTrips += pf.RoundTrips
+		total.Wins += pf.Wins
+		total.PnL += pf.PnL
+		total.Unrealized += pf.Unrealized
+		total.Fees += pf.Fees
+		total.InPosition += pf.InPosition
+		for timeframe, signals := range pf.Signals {
+			sum := total.Signals[timeframe]
+			sum.Buy += signals.Buy
+			sum.Sell += signals.Sell
+			total.Signals[timeframe] = sum
+		}
+	}
+
+	equity := make(map[string]float64)
+	peaks := make(map[string]float64)
+	for _, trip := range trips {
+		if trip.Closed.IsZero() || trip.Closed.Before(since) || !trip.Closed.Before(until) {
+			continue
+		}
+		_, quote, _ := execution.SplitPair(trip.Pair)
+		total, ok := totals[quote]
+		if !ok {
+			continue
+		}
+		equity[quote] += trip.Realized
+		peaks[quote] = math.Max(peaks[quote], equity[quote])
+		total.MaxDrawdown = math.Max(total.MaxDrawdown, peaks[quote]-equity[quote])
+	}
+
+	for _, total := range totals {
+		if total.RoundTrips > 0 {
+			total.HitRatio = float64(total.Wins) / float64(total.RoundTrips) * 100
+		}
+		report.Totals = append(report.Totals, *total)
+	}
+	sort.Slice(report.Totals, func(i, j int) bool { return report.Totals[i].Quote < report.Totals[j].Quote })
+}
+
+// SetUptime sets the feed uptime of pair, see Uptime.
+func (report *Report) SetUptime(pair string, uptime float64, since time.Time) {
+	for i := range report.Pairs {
+		if report.Pairs[i].Pair == pair {
+			report.Pairs[i].Uptime = uptime
+			report.Pairs[i].UptimeSince = since
+		}
+	}
+}
+
+// Uptime is the percentage of the period from since to until in which the
+// feed produced samples no more than maxGap apart. When the samples do not
+// reach back to since, the uptime is the one since the first sample, which
+// is returned. Without samples it is unknown, negative.
+func Uptime(dates []time.Time, since, until time.Time, maxGap time.Duration) (float64, time.Time) {
+	var inPeriod []time.Time
+	for _, date := range dates {
+		if !date.Before(since) && date.Before(until) {
+			inPeriod = append(inPeriod, date)
+		}
+	}
+	if len(inPeriod) == 0 {
+		return -1, time.Time{}
+	}
+
+	sort.Slice(inPeriod, func(i, j int) bool { return inPeriod[i].Before(inPeriod[j]) })
+
+	from := inPeriod[0]
+	if from.Sub(since) <= maxGap {
+		from = since
+	}
+
+	down := time.Duration(0)
+	last := from
+	for _, date := range append(inPeriod, until) {
+		if gap := date.Sub(last); gap > maxGap {
+			down += gap
+		}
+		last = date
+	}
+
+	span := until.Sub(from)
+	if span <= 0 {
+		return -1, time.Time{}
+	}
+	return float64(span-down) / float64(span) * 100, from
+}
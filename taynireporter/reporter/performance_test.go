@@ -0,0 +1,299 @@
+package reporter_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/journal"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/lagarciag/tayni/taynireporter/reporter"
+	"github.com/spf13/viper"
+)
+
+var kr *kredis.Kredis
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	seed := time.Now().UTC().UnixNano()
+	rand.Seed(seed)
+	fmt.Println("SEED:", seed)
+
+	kr = kredis.NewKredis(1)
+	kr.Start()
+
+	os.Exit(m.Run())
+}
+
+func almost(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// recorder keeps the events it is notified
+type recorder struct {
+	mu     sync.Mutex
+	events []notify.Event
+}
+
+func (rc *recorder) Notify(event notify.Event) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.events = append(rc.events, event)
+	return nil
+}
+
+// Monday 2018-01-08 is the reported day
+var day = time.Date(2018, 1, 8, 0, 0, 0, 0, time.UTC)
+
+func at(hours int) time.Time {
+	return day.Add(time.Duration(hours) * time.Hour)
+}
+
+// entries of the reported day, with a position opened the day before and
+// trades after it
+func entries() []journal.Entry {
+	return []journal.Entry{
+		{Kind: journal.KindTransition, Date: at(-5), Pair: "BTCUSD", Event: "Minute30BuyEvent"},
+		{Kind: journal.KindTrade, Date: at(-4), Pair: "BTCUSD", Side: execution.Buy, Price: 100, Amount: 1},
+		{Kind: journal.KindTrade, Date: at(1), Pair: "ETHBTC", Side: execution.Buy, Price: 0.05, Amount: 2},
+		{Kind: journal.KindTrade, Date: at(3), Pair: "ETHBTC", Side: execution.Sell, Price: 0.06, Amount: 2},
+		{Kind: journal.KindTransition, Date: at(5), Pair: "BTCUSD", Event: "Minute60SellEvent"},
+		{Kind: journal.KindTrade, Date: at(6), Pair: "BTCUSD", Side: execution.Sell, Price: 110, Amount: 1},
+		{Kind: journal.KindTransition, Date: at(7), Pair: "BTCUSD", Event: "Minute30BuyEvent"},
+		{Kind: journal.KindTransition, Date: at(7), Pair: "BTCUSD", Event: "TradeEvent"},
+		{Kind: journal.KindTrade, Date: at(8), Pair: "BTCUSD", Side: execution.Buy, Price: 100, Amount: 1, Fee: 1},
+		{Kind: journal.KindTrade, Date: at(10), Pair: "BTCUSD", Side: execution.Sell, Price: 95, Amount: 1},
+		{Kind: journal.KindTransition, Date: at(11), Pair: "BTCUSD", Event: "Minute30BuyEvent"},
+		{Kind: journal.KindTrade, Date: at(12), Pair: "BTCUSD", Side: execution.Buy, Price: 100, Amount: 1},
+		{Kind: journal.KindTrade, Date: at(29), Pair: "BTCUSD", Side: execution.Sell, Price: 120, Amount: 1},
+	}
+}
+
+func TestBounds(t *testing.T) {
+
+	now := time.Date(2018, 1, 10, 15, 4, 0, 0, time.UTC)
+
+	since, until, err := reporter.Bounds(reporter.PeriodDaily, now)
+	if err != nil || !since.Equal(time.Date(2018, 1, 9, 0, 0, 0, 0, time.UTC)) || !until.Equal(time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Bad daily bounds: ", since, until, err)
+	}
+
+	// Wednesday reports the week from the Monday before
+	since, until, err = reporter.Bounds(reporter.PeriodWeekly, now)
+	if err != nil || !since.Equal(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)) || !until.Equal(day) {
+		t.Error("Bad weekly bounds: ", since, until, err)
+	}
+	if since, _, _ = reporter.Bounds(reporter.PeriodWeekly, day); !since.Equal(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Bad weekly bounds on a Monday: ", since)
+	}
+
+	if _, _, err := reporter.Bounds("monthly", now); err == nil {
+		t.Error("Unknown period accepted")
+	}
+}
+
+func TestCompute(t *testing.T) {
+
+	report := reporter.Compute(reporter.PeriodDaily, entries(), day, at(24), []string{"BTCUSD", "ETHBTC", "XRPUSD"},
+		[]int{30, 60}, map[string]float64{"BTCUSD": 105})
+
+	if len(report.Pairs) != 3 || len(report.Totals) != 2 {
+		t.Fatal("Bad report: ", report)
+	}
+
+	// Sold the position of the day before at 110, lost 6 with the fee
+	btc := report.Pairs[0]
+	if btc.Pair != "BTCUSD" || btc.Trades != 4 || btc.RoundTrips != 2 || btc.Wins != 1 || btc.HitRatio != 50 {
+		t.Error("Bad BTCUSD trades: ", btc)
+	}
+	if !almost(btc.PnL, 4) || !almost(btc.Fees, 1) || !almost(btc.Unrealized, 5) || !almost(btc.MaxDrawdown, 6) {
+		t.Error("Bad BTCUSD PnL: ", btc)
+	}
+	if btc.InPosition != 20*time.Hour {
+		t.Error("Bad BTCUSD time in position: ", btc.InPosition)
+	}
+	if btc.Signals[30].Buy != 2 || btc.Signals[60].Sell != 1 || btc.Signals[60].Buy != 0 {
+		t.Error("Bad BTCUSD signals: ", btc.Signals)
+	}
+
+	eth := report.Pairs[1]
+	if !almost(eth.PnL, 0.02) || eth.HitRatio != 100 || eth.InPosition != 2*time.Hour || eth.MaxDrawdown != 0 {
+		t.Error("Bad ETHBTC: ", eth)
+	}
+
+	// Pairs without trades are reported too
+	if xrp := report.Pairs[2]; xrp.Pair != "XRPUSD" || xrp.Trades != 0 || xrp.Uptime >= 0 {
+		t.Error("Bad XRPUSD: ", xrp)
+	}
+
+	if btcTotal := report.Totals[0]; btcTotal.Quote != "BTC" || !almost(btcTotal.PnL, 0.02) {
+		t.Error("Bad BTC total: ", btcTotal)
+	}
+	if usd := report.Totals[1]; usd.Quote != "USD" || usd.Trades != 4 || !almost(usd.PnL, 4) ||
+		!almost(usd.MaxDrawdown, 6) || usd.Signals[30].Buy != 2 {
+		t.Error("Bad USD total: ", usd)
+	}
+}
+
+func TestUptime(t *testing.T) {
+
+	var dates []time.Time
+	for minute := 0; minute < 24*60; minute++ {
+		if minute >= 600 && minute < 660 {
+			continue
+		}
+		dates = append(dates, day.Add(time.Duration(minute)*time.Minute))
+	}
+
+	// Down from the sample of 09:59 to the one of 11:00
+	uptime, since := reporter.Uptime(dates, day, at(24), 5*time.Minute)
+	if !almost(uptime, float64(24*60-61)/(24*60)*100) || !since.Equal(day) {
+		t.Error("Bad uptime: ", uptime, since)
+	}
+
+	// Samples from noon only
+	uptime, since = reporter.Uptime(dates[len(dates)-12*60:], day, at(24), 5*time.Minute)
+	if uptime != 100 || !since.Equal(at(12)) {
+		t.Error("Bad partial uptime: ", uptime, since)
+	}
+
+	if uptime, _ = reporter.Uptime(nil, day, at(24), 5*time.Minute); uptime >= 0 {
+		t.Error("Uptime without samples: ", uptime)
+	}
+}
+
+func TestRender(t *testing.T) {
+
+	report := reporter.Compute(reporter.PeriodDaily, entries(), day, at(24), []string{"BTCUSD"}, []int{30, 60}, nil)
+	report.Generated = at(25)
+	report.SetUptime("BTCUSD", 99.5, at(12))
+
+	md := report.Markdown()
+	for _, expected := range []string{
+		"# Daily report 2018-01-08",
+		"| Pair | Trades | Hit ratio | PnL |",
+		"| BTCUSD | 4 | 50% (1/2) | 4.00000000 |",
+		"99.5% since 01-08 12:00",
+		"| 30m buy | 30m sell | 60m buy | 60m sell |",
+		"| BTCUSD | 2 | 0 | 0 | 1 |",
+	} {
+		if !strings.Contains(md, expected) {
+			t.Errorf("Markdown without %q:\n%s", expected, md)
+		}
+	}
+
+	html, err := report.HTML()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(html, "<h1>Daily report 2018-01-08</h1>") || !strings.Contains(html, "<td>50% (1/2)</td>") {
+		t.Error("Bad HTML: ", html)
+	}
+}
+
+func TestGenerator(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "reports")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal.jsonl")
+	jr, err := journal.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, entry := range entries() {
+		jr.Append(entry)
+	}
+	jr.Close()
+
+	// The feed of the day stopped at 18:00 at 105, later records and the
+	// live price are not the value at the end of the day
+	exchange := fmt.Sprintf("TEST%d", rand.Intn(1000000))
+	record := func(date time.Time, price float64) {
+		indicators := fmt.Sprintf("{\"date\":%q,\"last_value\":%v}", date.Format("01/02/2006 15:04:05"), price)
+		if err := kr.AddStringLong(exchange, "BTCUSD_MS_30_INDICATORS", indicators); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for minute := 0; minute < 18*60; minute += 5 {
+		price := 100.0
+		if minute >= 17*60 {
+			price = 105
+		}
+		record(day.Add(time.Duration(minute)*time.Minute), price)
+	}
+	record(at(24).Add(30*time.Minute), 130)
+	kr.Set(fmt.Sprintf("PRICE_%s_BTCUSD", exchange), "130")
+
+	config := reporter.ReportConfig{Directory: filepath.Join(dir, "out"), Journal: path, Exchange: exchange,
+		Pairs: []string{"BTCUSD"}, Timeframes: []int{30, 60}, Periods: []string{reporter.PeriodDaily}, Notify: true}
+
+	if _, err := reporter.NewGenerator(reporter.ReportConfig{Journal: path}, kr, nil); err == nil {
+		t.Error("Generator without a directory")
+	}
+
+	rc := &recorder{}
+	gen, err := reporter.NewGenerator(config, kr, rc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	clk := clock.NewSimulated(at(25))
+	gen.SetClock(clk)
+
+	gen.Check()
+	if len(rc.events) != 1 || rc.events[0].Type != notify.EventReport || rc.events[0].Title != "Daily report 2018-01-08" {
+		t.Fatal("Report not sent: ", rc.events)
+	}
+
+	for _, name := range []string{"daily-2018-01-08.md", "daily-2018-01-08.html"} {
+		if _, err := os.Stat(filepath.Join(config.Directory, name)); err != nil {
+			t.Error("Report not written: ", err.Error())
+		}
+	}
+	md, _ := ioutil.ReadFile(filepath.Join(config.Directory, "daily-2018-01-08.md"))
+	if !strings.Contains(string(md), "| 5.00000000 |") || !strings.Contains(string(md), "| 74.7% |") {
+		t.Error("Bad unrealized PnL or uptime:\n", string(md))
+	}
+
+	// Written reports are not generated again
+	clk.Advance(time.Hour)
+	gen.Check()
+	if len(rc.events) != 1 {
+		t.Error("Report generated twice: ", len(rc.events))
+	}
+}
+
+func TestLoadReportConfig(t *testing.T) {
+
+	if _, ok := reporter.LoadReportConfig(); ok {
+		t.Fatal("Reports configured without a report section")
+	}
+
+	viper.Set("minute_strategies", []interface{}{int64(60), int64(30)})
+	viper.Set("exchange.cexio.pairs", []string{"BTCUSD", "ETHBTC"})
+	viper.Set("journal.path", "/tmp/journal.jsonl")
+	viper.Set("report.directory", "/tmp/reports")
+	defer viper.Reset()
+
+	config, ok := reporter.LoadReportConfig()
+	if !ok {
+		t.Fatal("Reports not configured")
+	}
+	if config.Journal != "/tmp/journal.jsonl" || config.Exchange != "CEXIO" || len(config.Pairs) != 2 ||
+		len(config.Periods) != 2 || config.MaxGap != reporter.DefaultMaxGap || config.Timeframes[0] != 30 {
+		t.Error("Bad report config: ", config)
+	}
+}
@@ -0,0 +1,187 @@
+package reporter
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const reportDateLayout = "2006-01-02"
+
+// table is a section of the report, rendered as Markdown or HTML
+type table struct {
+	Title   string
+	Headers []string
+	Rows    [][]string
+}
+
+// Title of the report, "Daily report 2018-01-08"
+func (report Report) Title() string {
+	title := "Report"
+	switch report.Period {
+	case PeriodDaily:
+		title = "Daily report"
+	case PeriodWeekly:
+		title = "Weekly report"
+	}
+	return fmt.Sprintf("%s %s", title, report.Since.Format(reportDateLayout))
+}
+
+// Name is the file name of the report without extension, daily-2018-01-08
+func (report Report) Name() string {
+	return fmt.Sprintf("%s-%s", report.Period, report.Since.Format(reportDateLayout))
+}
+
+func (report Report) span() string {
+	return fmt.Sprintf("From %s to %s UTC, generated %s.", report.Since.Format("2006-01-02 15:04"),
+		report.Until.Format("2006-01-02 15:04"), report.Generated.UTC().Format("2006-01-02 15:04"))
+}
+
+func hours(duration time.Duration) string {
+	return fmt.Sprintf("%.1fh", duration.Hours())
+}
+
+func ratio(pf Performance) string {
+	if pf.RoundTrips == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%% (%d/%d)", pf.HitRatio, pf.Wins, pf.RoundTrips)
+}
+
+func uptime(pf Performance, since time.Time) string {
+	if pf.Uptime < 0 {
+		return "-"
+	}
+	if pf.UptimeSince.After(since) {
+		return fmt.Sprintf("%.1f%% since %s", pf.Uptime, pf.UptimeSince.Format("01-02 15:04"))
+	}
+	return fmt.Sprintf("%.1f%%", pf.Uptime)
+}
+
+func (report Report) tables() []table {
+	performanceHeaders := []string{"Trades", "Hit ratio", "PnL", "Unrealized", "Fees", "Max drawdown", "In position"}
+	performanceRow := func(pf Performance) []string {
+		return []string{
+			fmt.Sprintf("%d", pf.Trades),
+			ratio(pf),
+			fmt.Sprintf("%.8f", pf.PnL),
+			fmt.Sprintf("%.8f", pf.Unrealized),
+			fmt.Sprintf("%.8f", pf.Fees),
+			fmt.Sprintf("%.8f", pf.MaxDrawdown),
+			hours(pf.InPosition),
+		}
+	}
+
+	totals := table{Title: "Totals", Headers: append([]string{"Quote"}, performanceHeaders...)}
+	for _, pf := range report.Totals {
+		totals.Rows = append(totals.Rows, append([]string{pf.Quote}, performanceRow(pf)...))
+	}
+
+	pairs := table{Title: "Pairs", Headers: append(append([]string{"Pair"}, performanceHeaders...), "Feed uptime")}
+	for _, pf := range report.Pairs {
+		row := append([]string{pf.Pair}, performanceRow(pf)...)
+		pairs.Rows = append(pairs.Rows, append(row, uptime(pf, report.Since)))
+	}
+
+	signals := table{Title: "Signals", Headers: []string{"Pair"}}
+	for _, timeframe := range report.Timeframes {
+		signals.Headers = append(signals.Headers, fmt.Sprintf("%dm buy", timeframe), fmt.Sprintf("%dm sell", timeframe))
+	}
+	for _, pf := range report.Pairs {
+		row := []string{pf.Pair}
+		for _, timeframe := range report.Timeframes {
+			row = append(row, fmt.Sprintf("%d", pf.Signals[timeframe].Buy), fmt.Sprintf("%d", pf.Signals[timeframe].Sell))
+		}
+		signals.Rows = append(signals.Rows, row)
+	}
+
+	return []table{totals, pairs, signals}
+}
+
+// Markdown renders the report.
+func (report Report) Markdown() string {
+	var md strings.Builder
+
+	fmt.Fprintf(&md, "# %s\n\n%s\n", report.Title(), report.span())
+
+	for _, tb := range report.tables() {
+		fmt.Fprintf(&md, "\n## %s\n\n", tb.Title)
+		fmt.Fprintf(&md, "| %s |\n", strings.Join(tb.Headers, " | "))
+		fmt.Fprintf(&md, "|%s\n", strings.Repeat(" --- |", len(tb.Headers)))
+		for _, row := range tb.Rows {
+			fmt.Fprintf(&md, "| %s |\n", strings.Join(row, " | "))
+		}
+	}
+
+	return md.String()
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Span}}</p>
+{{range .Tables}}<h2>{{.Title}}</h2>
+<table>
+<tr>{{range .Headers}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// HTML renders the report.
+func (report Report) HTML() (string, error) {
+	data := struct {
+		Title  string
+		Span   string
+		Tables []table
+	}{report.Title(), report.span(), report.tables()}
+
+	var html bytes.Buffer
+	if err := htmlTemplate.Execute(&html, data); err != nil {
+		return "", fmt.Errorf("rendering %s: %s", report.Name(), err.Error())
+	}
+	return html.String(), nil
+}
+
+// Write writes the Markdown and HTML renderings of the report to directory
+// and returns their paths.
+func (report Report) Write(directory string) ([]string, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("creating report directory %s: %s", directory, err.Error())
+	}
+
+	html, err := report.HTML()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for extension, content := range map[string]string{".md": report.Markdown(), ".html": html} {
+		path := filepath.Join(directory, report.Name()+extension)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return paths, fmt.Errorf("writing report %s: %s", path, err.Error())
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
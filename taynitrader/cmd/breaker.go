@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/spf13/cobra"
+)
+
+// breakerCmd shows, trips and resets the trading breaker
+var breakerCmd = &cobra.Command{
+	Use:   "breaker <status|kill|reset> [reason]",
+	Short: "show, trip or reset the trading breaker",
+	Long: `Works on the trading breaker kept in redis, shared by every trading
+process. No new positions are opened while it is tripped, held positions
+can still be sold.
+
+  status            show the breaker state and the loss counters of the day
+  kill [reason]     trip the breaker by hand, it stays tripped across restarts
+  reset             close the breaker`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if err := runBreaker(args); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(breakerCmd)
+}
+
+func runBreaker(args []string) error {
+
+	config, _, err := breaker.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	brk := breaker.New(config, kr)
+
+	switch args[0] {
+	case "status":
+	case "kill":
+		if err := brk.Kill(strings.Join(args[1:], " ")); err != nil {
+			return err
+		}
+	case "reset":
+		if err := brk.Reset(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown breaker action: %s", args[0])
+	}
+
+	return printJSON(brk.State())
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lagarciag/tayni/alert"
+	"github.com/lagarciag/tayni/control"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/spf13/cobra"
+)
+
+var controlAddress string
+var controlToken string
+var alertRearm bool
+var alertSeverity string
+var alertTimeframe int
+
+// controlCmd talks to the control API of a running trader
+var controlCmd = &cobra.Command{
+	Use:   "control <status|pause|resume|hold|trade|sell|alerts|alert|unalert> [pair|all|rule|id]",
+	Short: "control a running taynitrader",
+	Long: `Sends an operator command to the control API of a running taynitrader.
+
+  status [pair]     show the state of one or all pairs
+  pause <pair>      stop following the signals
+  resume <pair>     go back to holding or trading after a pause
+  hold <pair>       force the hold state
+  trade <pair>      force the trading state
+  sell <pair>       sell the held position now, "sell all" flattens every pair
+  alerts            list the price and indicator alerts
+  alert <rule>      add an alert, such as "BTCUSD crosses 10000",
+                    "ETHBTC moves 5% within 1h" or "BTCUSD ATRP above 3"
+  unalert <id>      remove an alert
+
+The address and token default to control.listen and control.token of the
+configuration.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 || (len(args) > 2 && args[0] != "alert") {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if err := runControl(args); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(controlCmd)
+
+	controlCmd.Flags().StringVar(&controlAddress, "address", "", "control API address (default is control.listen of the configuration)")
+	controlCmd.Flags().StringVar(&controlToken, "token", "", "control API token (default is control.token of the configuration)")
+	controlCmd.Flags().BoolVar(&alertRearm, "rearm", false, "the alert fires again once its condition resets")
+	controlCmd.Flags().StringVar(&alertSeverity, "severity", "info", "severity of the alert notifications")
+	controlCmd.Flags().IntVar(&alertTimeframe, "timeframe", 0, "minutes of the indicator records of the alert (default is alerts.timeframe)")
+}
+
+func runControl(args []string) error {
+
+	config, _ := control.LoadConfig()
+	if controlAddress == "" {
+		controlAddress = config.Listen
+	}
+	if controlAddress == "" {
+		controlAddress = control.DefaultListen
+	}
+	if controlToken == "" {
+		controlToken = config.Token
+	}
+
+	client := control.NewClient(controlAddress, controlToken)
+
+	action := args[0]
+
+	switch action {
+	case "alerts":
+		alerts, err := client.Alerts()
+		if err != nil {
+			return err
+		}
+		return printJSON(alerts)
+	case "alert":
+		return addAlert(client, strings.Join(args[1:], " "))
+	case "unalert":
+		if len(args) != 2 {
+			return fmt.Errorf("unalert needs the id of an alert")
+		}
+		return client.RemoveAlert(args[1])
+	}
+
+	pair := ""
+	if len(args) == 2 {
+		pair = strings.ToUpper(args[1])
+		if strings.ToLower(args[1]) == control.AllPairs {
+			pair = control.AllPairs
+		}
+	}
+
+	if action == "status" {
+		statuses, err := client.Status(pair)
+		if err != nil {
+			return err
+		}
+		return printJSON(statuses)
+	}
+
+	if pair == "" {
+		return fmt.Errorf("%s needs a pair or all", action)
+	}
+
+	result, err := client.Command(action, pair)
+	if err != nil {
+		return err
+	}
+
+	if err := printJSON(result); err != nil {
+		return err
+	}
+
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%s failed for %d pairs", action, len(result.Errors))
+	}
+
+	return nil
+}
+
+func addAlert(client *control.Client, rule string) error {
+	definition, err := alert.Parse(rule)
+	if err != nil {
+		return err
+	}
+
+	definition.Severity, err = notify.ParseSeverity(alertSeverity)
+	if err != nil {
+		return err
+	}
+	definition.Rearm = alertRearm
+	definition.Timeframe = alertTimeframe
+
+	added, err := client.AddAlert(definition)
+	if err != nil {
+		return err
+	}
+	return printJSON(added)
+}
+
+func printJSON(value interface{}) error {
+	valueJSON, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(valueJSON))
+	return nil
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lagarciag/tayni/journal"
+	"github.com/lagarciag/tayni/kredis"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var journalFile string
+var journalPair string
+var journalKind string
+var journalSince string
+var journalUntil string
+var journalFormat string
+var journalExchange string
+var journalPnL bool
+
+// journalCmd queries and exports the trade journal
+var journalCmd = &cobra.Command{
+	Use:   "journal",
+	Short: "query and export the trade journal",
+	Long: `Prints the transitions and trades recorded in the trade journal, as JSON
+lines or CSV, or the profit and loss computed from its trades with --pnl.
+Open positions are valued at the current price in redis.
+
+  taynitrader journal --pair BTCUSD --kind trade --since 2017-10-01T00:00:00Z
+  taynitrader journal --pnl`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := queryJournal(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(journalCmd)
+
+	journalCmd.Flags().StringVar(&journalFile, "file", "", "journal file (default is journal.path of the configuration)")
+	journalCmd.Flags().StringVar(&journalPair, "pair", "", "only entries of this pair")
+	journalCmd.Flags().StringVar(&journalKind, "kind", "", "only entries of this kind: transition or trade")
+	journalCmd.Flags().StringVar(&journalSince, "since", "", "only entries from this RFC3339 date")
+	journalCmd.Flags().StringVar(&journalUntil, "until", "", "only entries before this RFC3339 date")
+	journalCmd.Flags().StringVar(&journalFormat, "format", "json", "output format: json or csv")
+	journalCmd.Flags().StringVar(&journalExchange, "exchange", "CEXIO", "exchange of the prices used to value open positions")
+	journalCmd.Flags().BoolVar(&journalPnL, "pnl", false, "print the profit and loss instead of the entries")
+}
+
+func queryJournal() error {
+
+	if journalFile == "" {
+		journalFile = viper.GetString("journal.path")
+	}
+
+	if journalFile == "" {
+		return fmt.Errorf("no journal file, set journal.path or --file")
+	}
+
+	query := journal.Query{Pair: journalPair, Kind: journalKind}
+
+	var err error
+	if journalSince != "" {
+		if query.Since, err = time.Parse(time.RFC3339, journalSince); err != nil {
+			return err
+		}
+	}
+	if journalUntil != "" {
+		if query.Until, err = time.Parse(time.RFC3339, journalUntil); err != nil {
+			return err
+		}
+	}
+
+	entries, err := journal.Read(journalFile, query)
+	if err != nil {
+		return err
+	}
+
+	if journalPnL {
+		report := journal.Compute(entries, journalPrices(entries))
+		reportJSON, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(reportJSON))
+		return nil
+	}
+
+	switch journalFormat {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		return writeJournalCSV(entries)
+	default:
+		return fmt.Errorf("unknown format: %s", journalFormat)
+	}
+
+	return nil
+}
+
+// journalPrices reads the current price of the traded pairs, pairs without
+// a price are valued at their last trade.
+func journalPrices(entries []journal.Entry) map[string]float64 {
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	prices := make(map[string]float64)
+
+	for _, entry := range entries {
+		if _, ok := prices[entry.Pair]; ok || entry.Kind != journal.KindTrade {
+			continue
+		}
+
+		key := fmt.Sprintf("PRICE_%s_%s", strings.ToUpper(journalExchange), entry.Pair)
+		priceStr, err := kr.GetString(key)
+		if err != nil || priceStr == "" {
+			log.Warnf("No price for %s, using its last trade", entry.Pair)
+			continue
+		}
+
+		if price, err := strconv.ParseFloat(priceStr, 64); err == nil {
+			prices[entry.Pair] = price
+		}
+	}
+
+	return prices
+}
+
+func writeJournalCSV(entries []journal.Entry) error {
+	writer := csv.NewWriter(os.Stdout)
+
+	header := []string{"date", "kind", "pair", "event", "from", "to", "signals",
+		"side", "price", "amount", "fee", "order_id", "simulated"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		var signals []string
+		for event, value := range entry.Signals {
+			signals = append(signals, fmt.Sprintf("%s=%v", event, value))
+		}
+		sort.Strings(signals)
+
+		record := []string{
+			entry.Date.Format(time.RFC3339),
+			entry.Kind,
+			entry.Pair,
+			entry.Event,
+			entry.From,
+			entry.To,
+			strings.Join(signals, " "),
+			string(entry.Side),
+			strconv.FormatFloat(entry.Price, 'f', -1, 64),
+			strconv.FormatFloat(entry.Amount, 'f', -1, 64),
+			strconv.FormatFloat(entry.Fee, 'f', -1, 64),
+			entry.OrderID,
+			strconv.FormatBool(entry.Simulated),
+		}
+
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/strength"
+	"github.com/spf13/cobra"
+)
+
+var strengthFull bool
+
+// strengthCmd shows the last relative strength matrix
+var strengthCmd = &cobra.Command{
+	Use:   "strength [exchange]",
+	Short: "show which asset is strongest",
+	Long: `Shows the ranking of the last relative strength matrix published for the
+exchange, CEXIO by default. The score of an asset is its mean return against
+all the others over the configured windows.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		exchange := "CEXIO"
+		if len(args) > 0 {
+			exchange = args[0]
+		}
+		if err := runStrength(exchange); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	strengthCmd.Flags().BoolVar(&strengthFull, "full", false, "print the whole matrix")
+	RootCmd.AddCommand(strengthCmd)
+}
+
+func runStrength(exchange string) error {
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	mx, err := strength.Load(kr, exchange)
+	if err != nil {
+		return err
+	}
+
+	if strengthFull {
+		return printJSON(mx)
+	}
+
+	return printJSON(mx.Ranking)
+}
@@ -1,17 +1,34 @@
 package trader
 
 import (
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"fmt"
 
+	"github.com/lagarciag/tayni/alert"
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/chat"
+	"github.com/lagarciag/tayni/control"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/journal"
 	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/lagarciag/tayni/risk"
 	"github.com/lagarciag/tayni/twitter"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+const (
+	// reconcileWindow of orders checked when a pair starts
+	reconcileWindow          = 24 * time.Hour
+	defaultReconcileInterval = 10 * time.Minute
+)
+
 type Trader struct {
 	kr                       *kredis.Kredis
 	subscriptionMapExchanges map[string]map[string][]string
@@ -19,6 +36,7 @@ type Trader struct {
 	tc                       *twitter.TwitterClient
 	pairs                    []string
 	cryptoPairs              []string
+	alerts                   *alert.Service
 }
 
 func NewTrader() *Trader {
@@ -31,10 +49,10 @@ func NewTrader() *Trader {
 	exchanges := viper.Get("exchange").(map[string]interface{})
 	minuteStrategiesInt := viper.Get("minute_strategies").([]interface{})
 
-	minuteStrageis := make([]int, len(minuteStrategiesInt))
+	minuteStrategies := make(map[int]bool)
 
-	for i, stat := range minuteStrategiesInt {
-		minuteStrageis[i] = int(stat.(int64))
+	for _, stat := range minuteStrategiesInt {
+		minuteStrategies[int(stat.(int64))] = true
 	}
 
 	// -------------------------------------------------------
@@ -58,20 +76,31 @@ func NewTrader() *Trader {
 
 		// Create slice of subscriptions
 
+		trader.tFsmExchangeMap[exchange] = make(map[string]*TradeFsm)
+
 		for i, pair := range pairsIntList {
 			pairs[i] = pair.(string)
-			subscriptionKeys := make([]string, len(minuteStrageis)*2)
+
+			cascade, err := LoadCascadeConfig(exchange, pairs[i])
+			if err != nil {
+				log.Fatalf("Bad cascade for %s: %s", pairs[i], err.Error())
+			}
+
+			subscriptionKeys := make([]string, len(cascade.Timeframes)*2)
 
 			j := 0
-			for _, stat := range minuteStrageis {
-				subscriptionKeys[j] = fmt.Sprintf("%s_%s_MS_%d_BUY", exchange, pairs[i], stat)
-				subscriptionKeys[j+1] = fmt.Sprintf("%s_%s_MS_%d_SELL", exchange, pairs[i], stat)
+			for _, stat := range cascade.Timeframes {
+				if !minuteStrategies[stat] {
+					log.Warnf("Cascade timeframe %d of %s is not in minute_strategies", stat, pairs[i])
+				}
+				subscriptionKeys[j] = BuySignalKey(exchange, pairs[i], stat)
+				subscriptionKeys[j+1] = SellSignalKey(exchange, pairs[i], stat)
 				j = j + 2
 			}
-			subscriptionMapPairs[pair.(string)] = subscriptionKeys
+			subscriptionMapPairs[pairs[i]] = subscriptionKeys
+			trader.tFsmExchangeMap[exchange][pairs[i]] = NewTradeFsmWithConfig(pairs[i], cascade)
 		}
 		trader.subscriptionMapExchanges[exchange] = subscriptionMapPairs
-		trader.tFsmExchangeMap[exchange] = make(map[string]*TradeFsm)
 	}
 
 	//tFsmSlice := make([]*TradeFsm, len())
@@ -88,10 +117,125 @@ func NewTrader() *Trader {
 				trader.kr.SubscribeLookup(pair)
 			}
 
-			trader.tFsmExchangeMap[exKey][exPair] = NewTradeFsm(exPair)
+			// Price updates for the risk stops
+			trader.kr.SubscribeLookup(fmt.Sprintf("%s_%s", exKey, exPair))
+
+			// ----------------------------------
+			// Place real orders when configured
+			// ----------------------------------
+			if config, ok := execution.LoadConfig(exPair); ok {
+				executor, err := execution.NewExecutor(exKey, config, trader.tFsmExchangeMap[exKey][exPair].Kredis())
+				if err != nil {
+					log.Fatal("Creating executor: ", err.Error())
+				}
+				log.Infof("Order execution for %s: %+v", exPair, config)
+				tFsm := trader.tFsmExchangeMap[exKey][exPair]
+				tFsm.SetExecutor(executor, config)
+				tFsm.SetSubmitter(execution.NewSubmitter(exKey, exPair, executor, tFsm.Kredis()))
+			}
 		}
 
 	}
+
+	// -------------------------------------
+	// One risk manager for all the pairs so
+	// total exposure can be capped
+	// -------------------------------------
+	var allPairs []string
+	for exKey := range trader.tFsmExchangeMap {
+		for exPair := range trader.tFsmExchangeMap[exKey] {
+			allPairs = append(allPairs, exPair)
+		}
+	}
+
+	if riskManager, ok := risk.LoadManager(allPairs); ok {
+		log.Info("Risk management enabled for: ", allPairs)
+		for exKey := range trader.tFsmExchangeMap {
+			for _, tFsm := range trader.tFsmExchangeMap[exKey] {
+				tFsm.SetRiskManager(riskManager)
+			}
+		}
+	}
+
+	// ---------------------------------
+	// One journal for all the pairs
+	// ---------------------------------
+	if viper.IsSet("journal.path") {
+		jr, err := journal.Open(viper.GetString("journal.path"))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for exKey := range trader.tFsmExchangeMap {
+			for _, tFsm := range trader.tFsmExchangeMap[exKey] {
+				tFsm.SetJournal(jr)
+			}
+		}
+	}
+
+	// ---------------------------------
+	// One notifier for all the pairs
+	// ---------------------------------
+	trader.tc = twitter.NewTwitterClient(twitter.LoadConfig())
+	notifier, err := notify.Load(trader.tc)
+	if err != nil {
+		log.Fatal("Notifications: ", err.Error())
+	}
+	go notifier.Run(make(chan struct{}))
+	templates, err := notify.LoadTemplates()
+	if err != nil {
+		log.Fatal("Notification templates: ", err.Error())
+	}
+	for exKey := range trader.tFsmExchangeMap {
+		for _, tFsm := range trader.tFsmExchangeMap[exKey] {
+			tFsm.SetNotifier(notifier)
+			tFsm.SetTemplates(templates)
+		}
+	}
+
+	// ---------------------------------
+	// Price and indicator alerts of the
+	// first exchange, with their own
+	// redis connection
+	// ---------------------------------
+	exchangeNames := make([]string, 0, len(trader.tFsmExchangeMap))
+	for exKey := range trader.tFsmExchangeMap {
+		exchangeNames = append(exchangeNames, exKey)
+	}
+	sort.Strings(exchangeNames)
+	if len(exchangeNames) > 0 {
+		alertConfig, ok, err := alert.LoadConfig(exchangeNames[0])
+		if err != nil {
+			log.Fatal("Alerts: ", err.Error())
+		}
+		if ok {
+			alertsKr := kredis.NewKredis(1)
+			alertsKr.Start()
+			trader.alerts, err = alert.NewService(alertConfig, alertsKr, notifier)
+			if err != nil {
+				log.Fatal("Alerts: ", err.Error())
+			}
+		}
+	}
+
+	// ---------------------------------
+	// One breaker for all the pairs
+	// ---------------------------------
+	brk, ok, err := breaker.Load()
+	if err != nil {
+		log.Fatal("Breaker: ", err.Error())
+	}
+	if ok {
+		brk.SetNotifier(notifier)
+		if state := brk.State(); state.Tripped {
+			log.Warn("Trading breaker is tripped, only exits are allowed: ", state.Reason)
+		}
+		for exKey := range trader.tFsmExchangeMap {
+			for _, tFsm := range trader.tFsmExchangeMap[exKey] {
+				tFsm.SetBreaker(brk)
+			}
+		}
+	}
+
 	return trader
 }
 
@@ -105,6 +249,38 @@ func Start() {
 	trader.startControllers()
 	go trader.monitorSubscriptions()
 
+	// ---------------------
+	// Operator control API
+	// ---------------------
+	if config, ok := control.LoadConfig(); ok {
+		server, err := control.NewServer(config, trader)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if trader.alerts != nil {
+			server.SetAlerts(trader.alerts)
+		}
+		if err := server.Start(); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	// ---------------------------------
+	// Chat commands, with their own
+	// redis connection
+	// ---------------------------------
+	if config, ok := chat.LoadConfig(); ok {
+		chatKr := kredis.NewKredis(1)
+		chatKr.Start()
+		bot, err := chat.NewBot(config, trader, chatKr)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if err := bot.Start(); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
 	// --------------------------------------
 	// Create pairs list from configuration
 	// --------------------------------------
@@ -128,44 +304,191 @@ func Start() {
 	log.Info("Pairs to trade in: ", trader.pairs)
 	log.Info("CryptoPairs to trade in: ", trader.pairs)
 
-	for _, pair := range trader.pairs {
+	go trader.reconcileOrders()
 
-		tFsmMap := trader.tFsmExchangeMap["CEXIO"]
+	// ------------------------------------
+	// Without election every pair starts,
+	// with it the leases decide
+	// ------------------------------------
+	config, ok := leader.LoadConfig()
+	if !ok {
+		for _, pair := range trader.pairs {
+			trader.startPair(trader.tFsmExchangeMap["CEXIO"][pair])
+		}
+		trader.startAlerts(nil)
+		return
+	}
 
-		tFsm := tFsmMap[pair]
-		chansMap := tFsm.SignalChannelsMap()
+	if err := config.Validate(); err != nil {
+		log.Fatal(err.Error())
+	}
 
-		startChan := chansMap["START"]
-		startChan <- true
+	trader.startLeases(config)
+}
 
-		key := fmt.Sprintf("%s_TRADE_FSM_STATE", pair)
-		state, err := trader.kr.GetString(key)
+// startPair continues the pair from its saved context, or starts it in
+// the hold or trading state.
+func (trader *Trader) startPair(tFsm *TradeFsm) {
 
-		if err != nil {
-			log.Error("While Geting string: ", key)
-		}
+	pair := tFsm.pairID
+	chansMap := tFsm.SignalChannelsMap()
 
-		var stateMessage string
+	// -------------------------------------
+	// Continue from the saved context, the
+	// state alone is the fallback
+	// -------------------------------------
+	restored, err := tFsm.Restore()
+	if err != nil {
+		log.Error(err.Error())
+	}
 
-		if state == HoldState {
-			stateMessage = "HOLD"
-		} else {
-			stateMessage = "TRADE"
-		}
+	// Orders may have changed while we were away
+	if tFsm.submitter != nil {
+		go trader.reconcile(tFsm, time.Now().Add(-reconcileWindow))
+	}
+
+	if restored {
+		log.Infof("Trading restored for pair %s in %s", pair, tFsm.FSM.Current())
+		return
+	}
+
+	startChan := chansMap["START"]
+	startChan <- true
+
+	key := fmt.Sprintf("%s_TRADE_FSM_STATE", pair)
+	state, err := trader.kr.GetString(key)
+
+	if err != nil {
+		log.Error("While Geting string: ", key)
+	}
+
+	var stateMessage string
+
+	if state == HoldState {
+		stateMessage = "HOLD"
+	} else {
+		stateMessage = "TRADE"
+	}
 
-		tradeChan := chansMap[stateMessage]
+	tradeChan := chansMap[stateMessage]
 
-		tradeChan <- true
+	tradeChan <- true
 
-		message := `
+	message := `
 		-----------------------------------
 		TRAIDING STARTED FOR PAIR : %s
 		-----------------------------------`
 
-		log.Infof(message, pair)
+	log.Infof(message, pair)
+}
+
+// startLeases runs the election of the traded pairs, one lease per pair or
+// one for the process.
+func (trader *Trader) startLeases(config leader.Config) {
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	var tFsms []*TradeFsm
+	for _, pair := range trader.pairs {
+		tFsms = append(tFsms, trader.tFsmExchangeMap["CEXIO"][pair])
+	}
+
+	log.Infof("Leader election of %s per %s as %s", trader.pairs, config.Scope, config.ID)
+
+	if config.Scope == leader.ScopeProcess {
+		lease := leader.NewLease(kr, "LEADER_TRADER", config)
+		for _, tFsm := range tFsms {
+			tFsm.SetLease(lease)
+		}
+		go lease.Run(make(chan struct{}), trader.leaseHandler(tFsms))
+		trader.startAlerts(lease)
+		return
+	}
+
+	for _, tFsm := range tFsms {
+		lease := leader.NewLease(kr, fmt.Sprintf("LEADER_TRADER_%s_%s", tFsm.exchange, tFsm.pairID), config)
+		tFsm.SetLease(lease)
+		go lease.Run(make(chan struct{}), trader.leaseHandler([]*TradeFsm{tFsm}))
+	}
+
+	// The alerts are not of a pair, they have their own lease
+	if trader.alerts != nil {
+		lease := leader.NewLease(kr, "LEADER_TRADER_ALERTS", config)
+		go lease.Run(make(chan struct{}), nil)
+		trader.startAlerts(lease)
+	}
+}
+
+// startAlerts checks the alerts while lease is held, always when nil.
+func (trader *Trader) startAlerts(lease *leader.Lease) {
+	if trader.alerts == nil {
+		return
+	}
+	if lease != nil {
+		trader.alerts.SetLease(lease)
+	}
+	go trader.alerts.Run(make(chan struct{}))
+}
+
+// leaseHandler starts the pairs when their lease is taken and keeps them
+// in sync with the leader while on standby.
+func (trader *Trader) leaseHandler(tFsms []*TradeFsm) func(held bool) {
+	leading := false
+
+	return func(held bool) {
+		switch {
+		case held && !leading:
+			for _, tFsm := range tFsms {
+				log.Warnf("Taking over pair %s", tFsm.pairID)
+				trader.startPair(tFsm)
+			}
+		case !held && leading:
+			for _, tFsm := range tFsms {
+				log.Warnf("Pair %s on standby", tFsm.pairID)
+			}
+		case !held:
+			for _, tFsm := range tFsms {
+				if err := tFsm.Sync(); err != nil {
+					log.Error(err.Error())
+				}
+			}
+		}
+		leading = held
+	}
+}
+
+func (trader *Trader) reconcile(tFsm *TradeFsm, since time.Time) {
+	mismatches, err := tFsm.Reconcile(since)
+	if err != nil {
+		log.Errorf("Reconciling orders of %s: %s", tFsm.pairID, err.Error())
+		return
+	}
+	log.Infof("Orders of %s reconciled since %s, %d mismatches", tFsm.pairID, since, len(mismatches))
+}
+
+// reconcileOrders compares the orders of the leading pairs with the
+// exchange every execution.reconcile_interval. Each pass overlaps the
+// previous one so orders final by then are checked again.
+func (trader *Trader) reconcileOrders() {
 
+	interval := viper.GetDuration("execution.reconcile_interval")
+	if interval <= 0 {
+		interval = defaultReconcileInterval
 	}
 
+	for {
+		time.Sleep(interval)
+
+		since := time.Now().Add(-2 * interval)
+		for _, pair := range trader.pairs {
+			tFsm := trader.tFsmExchangeMap["CEXIO"][pair]
+			if tFsm.submitter == nil || !tFsm.Leading() {
+				continue
+			}
+			trader.reconcile(tFsm, since)
+		}
+	}
 }
 
 func (trader *Trader) monitorSubscriptions() {
@@ -187,6 +510,19 @@ func (trader *Trader) monitorSubscriptions() {
 
 		tFsm := tFsmMap[pair]
 
+		// ------------------------------
+		// <EX>_<pair> carries the price
+		// ------------------------------
+		if len(messageSlice) == 2 {
+			price, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				log.Errorf("Bad price for %s: %s", key, val)
+				continue
+			}
+			tFsm.PriceUpdate(price)
+			continue
+		}
+
 		chansMap := tFsm.SignalChannelsMap()
 
 		signalChannel, ok := chansMap[key]
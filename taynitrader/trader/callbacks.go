@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/notify"
 	"github.com/looplab/fsm"
 	log "github.com/sirupsen/logrus"
 )
@@ -13,12 +15,9 @@ import (
 func (tf *TradeFsm) CallBackInGenericState(e *fsm.Event) {
 	log.Infof("In state %s --> %s:", tf.FSM.Current(), tf.pairID)
 
-	key := fmt.Sprintf("%s_TRADE_FSM_STATE", tf.pairID)
-	tf.kr.Set(key, tf.FSM.Current())
-
 	switch {
 
-	case tf.FSM.Current() == Minute30BuyState:
+	case tf.FSM.Current() == tf.lastBuyState():
 		{
 
 			done := func() {
@@ -33,7 +32,7 @@ func (tf *TradeFsm) CallBackInGenericState(e *fsm.Event) {
 
 		}
 
-	case tf.FSM.Current() == Minute30SellState:
+	case tf.FSM.Current() == tf.lastSellState():
 		{
 			log.Infof("In state %s --> %s:", tf.FSM.Current(), tf.pairID)
 			//log.Info("In state :", tf.FSM.Current())
@@ -59,136 +58,23 @@ func (tf *TradeFsm) CallBackInGenericState(e *fsm.Event) {
 func (tf *TradeFsm) CallBackInDoSellState(e *fsm.Event) {
 	log.Infof("In state %s --> %s:", tf.FSM.Current(), tf.pairID)
 	//log.Info("In state :", tf.FSM.Current())
+	completeEvent, _ := tf.sellEvents()
 	done := func() {
-		if err := tf.FSM.Event(SellCompleteEvent); err != nil {
+		if err := tf.FSM.Event(completeEvent); err != nil {
 			log.Warn(err.Error())
 		}
 	}
 
-	if tf.pairID != "TEST" {
-
-		t := time.Now().UTC()
-		theTime := fmt.Sprint(t.String())
-
-		indicators := tf.indicatorsGetter(0)
-
-		ema := indicators.Ema
-		sma := indicators.Sma
-		last := indicators.LastValue
-		atrp := indicators.ATRP
-		pDmi := indicators.PDI
-		mDmi := indicators.MDI
-
-		var twitMessage string
-
-		switch {
-
-		case tf.pairID == "ETHBTC":
-			{
-
-				twitMessage = `
-		TayniBot (beta tests) says: ETH is downperforming BTC.
-		Watch for BTC buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-			}
-
-		case tf.pairID == "BCHBTC":
-			{
-
-				twitMessage = `
-		TayniBot (beta tests) says: BCH is downperforming BTC.
-		Watch for BTC buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-			}
-		case tf.pairID == "DASHBTC":
-			{
-
-				twitMessage = `
-		TayniBot (beta tests) says: DASH is downperforming BTC.
-		Watch for BTC buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-			}
-		case tf.pairID == "ZECBTC":
-			{
-
-				twitMessage = `
-		TayniBot (beta tests) says: ZEC is downperforming BTC.
-		Watch for BTC buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-			}
-
-		case tf.pairID == "XRPBTC":
-			{
-
-				twitMessage = `
-		TayniBot (beta tests) says: XRP is downperforming BTC.
-		Watch for BTC buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-			}
-
-		default:
-			{
-				twitMessage = `
-		TayniBot (beta tests) says: SELL %s
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-			}
-
-		}
-
-		twit := fmt.Sprintf(twitMessage, tf.pairID, ema, sma, last, atrp, pDmi, mDmi, theTime)
-
-		if err := tf.tc.Twit(twit); err != nil {
-			log.Error(err.Error())
-			log.Info(twit)
-		}
-
-		sellKey := fmt.Sprintf("CEXIO_%s_SELL", tf.pairID)
-		if err := tf.kr.Publish(sellKey, "true"); err != nil {
-			log.Errorf("Publishing to: %s -> %s ", sellKey, "true")
-		}
+	// The order announces its fill
+	if tf.executor != nil {
+		go tf.executeOrder(execution.Sell)
+		return
+	}
 
+	// Without executor the signal is the trade
+	if tf.pairID != "TEST" {
+		data := tf.notifyData(notify.EventSell, notify.Transition{Event: e.Event, From: e.Src, To: e.Dst})
+		tf.announce(execution.Sell, data, e.Dst)
 	}
 
 	message := `
@@ -201,6 +87,27 @@ func (tf *TradeFsm) CallBackInDoSellState(e *fsm.Event) {
 	go done()
 }
 
+// CallBackBeforeEvent cancels every event of a standby, the leader moves
+// the FSM and its transitions reach the standby through Sync.
+func (tf *TradeFsm) CallBackBeforeEvent(e *fsm.Event) {
+	if !tf.Leading() {
+		e.Cancel(fmt.Errorf("%s is on standby", tf.pairID))
+	}
+}
+
+// CallBackBeforeDoBuy cancels the buy while the breaker refuses new
+// positions. The FSM stays at the end of the buy cascade.
+func (tf *TradeFsm) CallBackBeforeDoBuy(e *fsm.Event) {
+	if tf.breaker == nil {
+		return
+	}
+
+	if err := tf.breaker.Allow(tf.pairID); err != nil {
+		log.Warnf("Buy of %s refused: %s", tf.pairID, err.Error())
+		e.Cancel(err)
+	}
+}
+
 func (tf *TradeFsm) CallBackInDoBuyState(e *fsm.Event) {
 	log.Infof("In state %s --> %s:", tf.FSM.Current(), tf.pairID)
 	//log.Info("In state :", tf.FSM.Current())
@@ -211,134 +118,15 @@ func (tf *TradeFsm) CallBackInDoBuyState(e *fsm.Event) {
 		}
 	}
 
-	//if tf.pairID != "TEST" {
-
-	t := time.Now().UTC()
-
-	theTime := fmt.Sprint(t.String())
-
-	indicators := tf.indicatorsGetter(0)
-
-	ema := indicators.Ema
-	sma := indicators.Sma
-	last := indicators.LastValue
-	atrp := indicators.ATRP
-	pDmi := indicators.PDI
-	mDmi := indicators.MDI
-
-	var twitMessage string
-
-	switch {
-
-	case tf.pairID == "ETHBTC":
-		{
-
-			twitMessage = `
-		TayniBot (beta tests) says: ETH is outperforming BTC.
-		Watch for ETH buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-		}
-
-	case tf.pairID == "BCHBTC":
-		{
-
-			twitMessage = `
-		TayniBot (beta tests) says: BCH is outperforming BTC.
-		Watch for BCH buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-		}
-	case tf.pairID == "DASHBTC":
-		{
-
-			twitMessage = `
-		TayniBot (beta tests) says: DASH is outperforming BTC.
-		Watch for DASH buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-		}
-	case tf.pairID == "ZECBTC":
-		{
-
-			twitMessage = `
-		TayniBot (beta tests) says: ZEC is outperforming BTC.
-		Watch for ZEC buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-		}
-
-	case tf.pairID == "XRPBTC":
-		{
-
-			twitMessage = `
-		TayniBot (beta tests) says: XRP is outperforming BTC.
-		Watch for XRP buy signal
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-		}
-
-	default:
-		{
-			twitMessage = `
-		TayniBot (beta tests) says: BUY %s
-		ema : %f
-		sma : %f
-		last: %f
-		ATRP: %f
-		PDMI: %f
-		MDMI: %f
-		time: %s
-		`
-		}
-
-	}
-
-	twit := fmt.Sprintf(twitMessage, tf.pairID, ema, sma, last, atrp, pDmi, mDmi, theTime)
-
-	if err := tf.tc.Twit(twit); err != nil {
-		log.Error(err.Error())
-		log.Info(twit)
-	}
-
-	buyKey := fmt.Sprintf("CEXIO_%s_BUY", tf.pairID)
-	if err := tf.kr.Publish(buyKey, "true"); err != nil {
-		log.Errorf("Publishing to: %s -> %s ", buyKey, "true")
+	// The order announces its fill
+	if tf.executor != nil {
+		go tf.executeOrder(execution.Buy)
+		return
 	}
 
-	//} else {
-
-	//}
+	// Without executor the signal is the trade
+	data := tf.notifyData(notify.EventBuy, notify.Transition{Event: e.Event, From: e.Src, To: e.Dst})
+	tf.announce(execution.Buy, data, e.Dst)
 
 	message := `
 	----------------------------------------------------
@@ -377,10 +165,63 @@ func (tf *TradeFsm) CallBackInTestSellCompleteState(e *fsm.Event) {
 	//log.Info("In state :", tf.FSM.Current())
 }
 
+// notifyData is what the message templates of an event of the pair use.
+// The PnL is the one of the position at the last price.
+func (tf *TradeFsm) notifyData(event string, transition notify.Transition) notify.Data {
+	indicators := tf.indicatorsGetter(0)
+
+	data := notify.NewData(tf.exchange, tf.pairID, event, indicators)
+	data.Transition = transition
+
+	tf.positionMu.Lock()
+	if tf.position > 0 {
+		data.PnL = (indicators.LastValue - tf.entry) * tf.position
+	}
+	tf.positionMu.Unlock()
+
+	return data
+}
+
+// announce notifies a trade of the pair and publishes it on the
+// <EX>_<pair>_BUY or _SELL key, which the crypto selector takes as a fact.
+// With an executor it is only called once the order is filled, data then
+// holds the fill.
+func (tf *TradeFsm) announce(side execution.Side, data notify.Data, state string) {
+
+	message, err := tf.templates.Render(data)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	price := data.Price
+	if price == 0 {
+		price = data.Indicators.LastValue
+	}
+
+	tf.notify(notify.Event{Type: data.Event, Pair: tf.pairID,
+		Title: fmt.Sprintf("%s %s", sideName(side), tf.pairID), Message: message,
+		Price: price, Amount: data.Amount, State: state})
+
+	key := fmt.Sprintf("%s_%s_%s", tf.exchange, tf.pairID, sideName(side))
+	if err := tf.kr.Publish(key, "true"); err != nil {
+		log.Errorf("Publishing to: %s -> %s ", key, "true")
+	}
+}
+
+// notify sends an event of the pair, failures are only logged
+func (tf *TradeFsm) notify(event notify.Event) {
+	if tf.notifier == nil {
+		return
+	}
+	if err := tf.notifier.Notify(event); err != nil {
+		log.Error(err.Error())
+	}
+}
+
 //TODO: This does not go here
 func (tf *TradeFsm) indicatorsGetter(index int) (indicators movingstats.Indicators) {
 
-	key := fmt.Sprintf("CEXIO_%s_MS_120_INDICATORS", tf.pairID)
+	key := fmt.Sprintf("%s_%s_MS_%d_INDICATORS", tf.exchange, tf.pairID, tf.timeframes[0])
 	indicatorsJson, err := tf.kr.GetRawString(key, index)
 
 	if err != nil {
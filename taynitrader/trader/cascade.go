@@ -0,0 +1,128 @@
+package trader
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultTimeframes is the cascade used when none is configured
+var DefaultTimeframes = []int{120, 60, 30}
+
+// CascadeConfig is the ordered list of minute strategy timeframes a pair
+// walks down before buying or selling, from the slowest to the fastest,
+// and the exchange publishing their signals.
+type CascadeConfig struct {
+	Exchange   string
+	Timeframes []int
+}
+
+// BuyState is the name of the buy state of a timeframe
+func BuyState(timeframe int) string {
+	return fmt.Sprintf("Minute%dBuyState", timeframe)
+}
+
+// SellState is the name of the sell state of a timeframe
+func SellState(timeframe int) string {
+	return fmt.Sprintf("Minute%dSellState", timeframe)
+}
+
+// BuyEvent is the name of the buy event of a timeframe
+func BuyEvent(timeframe int) string {
+	return fmt.Sprintf("Minute%dBuyEvent", timeframe)
+}
+
+// SellEvent is the name of the sell event of a timeframe
+func SellEvent(timeframe int) string {
+	return fmt.Sprintf("Minute%dSellEvent", timeframe)
+}
+
+// NotBuyEvent is the name of the event sent when the buy signal of a
+// timeframe goes away
+func NotBuyEvent(timeframe int) string {
+	return fmt.Sprintf("NotMinute%dBuyEvent", timeframe)
+}
+
+// NotSellEvent is the name of the event sent when the sell signal of a
+// timeframe goes away
+func NotSellEvent(timeframe int) string {
+	return fmt.Sprintf("NotMinute%dSellEvent", timeframe)
+}
+
+// BuySignalKey is the redis key of the buy signal of a timeframe
+func BuySignalKey(exchange, pairID string, timeframe int) string {
+	return fmt.Sprintf("%s_%s_MS_%d_BUY", exchange, pairID, timeframe)
+}
+
+// SellSignalKey is the redis key of the sell signal of a timeframe
+func SellSignalKey(exchange, pairID string, timeframe int) string {
+	return fmt.Sprintf("%s_%s_MS_%d_SELL", exchange, pairID, timeframe)
+}
+
+// Validate checks the cascade has at least one level and no repeated or
+// non positive timeframes.
+func (config CascadeConfig) Validate() error {
+	if config.Exchange == "" {
+		return fmt.Errorf("cascade without exchange")
+	}
+
+	if len(config.Timeframes) == 0 {
+		return fmt.Errorf("empty cascade for %s", config.Exchange)
+	}
+
+	seen := make(map[int]bool)
+	for _, timeframe := range config.Timeframes {
+		if timeframe <= 0 {
+			return fmt.Errorf("bad cascade timeframe %d", timeframe)
+		}
+		if seen[timeframe] {
+			return fmt.Errorf("repeated cascade timeframe %d", timeframe)
+		}
+		seen[timeframe] = true
+	}
+
+	return nil
+}
+
+// LoadCascadeConfig reads the cascade of a pair. A cascade under
+// trader.pairs.<PAIR> overrides the trader cascade, DefaultTimeframes is
+// used when neither is set.
+//
+//	[trader]
+//	cascade = [240, 60, 15, 5]
+//
+//	[trader.pairs.ETHBTC]
+//	cascade = [120, 30]
+func LoadCascadeConfig(exchange, pairID string) (CascadeConfig, error) {
+	config := CascadeConfig{}
+	config.Exchange = strings.ToUpper(exchange)
+	config.Timeframes = DefaultTimeframes
+
+	key := "trader.cascade"
+	pairKey := fmt.Sprintf("trader.pairs.%s.cascade", strings.ToLower(pairID))
+	if viper.IsSet(pairKey) {
+		key = pairKey
+	}
+
+	if viper.IsSet(key) {
+		timeframesInt, ok := viper.Get(key).([]interface{})
+		if !ok {
+			return config, fmt.Errorf("%s is not a list", key)
+		}
+
+		config.Timeframes = make([]int, len(timeframesInt))
+		for i, timeframe := range timeframesInt {
+			switch tf := timeframe.(type) {
+			case int64:
+				config.Timeframes[i] = int(tf)
+			case int:
+				config.Timeframes[i] = tf
+			default:
+				return config, fmt.Errorf("bad timeframe in %s: %v", key, timeframe)
+			}
+		}
+	}
+
+	return config, config.Validate()
+}
@@ -0,0 +1,287 @@
+package trader
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/journal"
+	"github.com/lagarciag/tayni/risk"
+	"github.com/looplab/fsm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signal is the last value received for a cascade signal
+type Signal struct {
+	Value bool      `json:"value"`
+	Date  time.Time `json:"date"`
+}
+
+// Context is the trader state of a pair, saved in <pair>_TRADE_FSM_CONTEXT
+// on every transition so a restarted trader continues where it stopped.
+type Context struct {
+	Pair       string            `json:"pair"`
+	State      string            `json:"state"`
+	Updated    time.Time         `json:"updated"`
+	Position   float64           `json:"position"`
+	Entry      float64           `json:"entry"`
+	OpenOrders []string          `json:"open_orders,omitempty"`
+	Sequence   int               `json:"sequence,omitempty"`
+	ClientID   string            `json:"client_id,omitempty"`
+	ResumeHold bool              `json:"resume_hold,omitempty"`
+	PausedSell bool              `json:"paused_sell,omitempty"`
+	Signals    map[string]Signal `json:"signals,omitempty"`
+	Risk       *risk.Position    `json:"risk,omitempty"`
+}
+
+func (tf *TradeFsm) contextKey() string {
+	return fmt.Sprintf("%s_TRADE_FSM_CONTEXT", tf.pairID)
+}
+
+// Context returns the current trader context of the pair.
+func (tf *TradeFsm) Context() Context {
+	tf.positionMu.Lock()
+	defer tf.positionMu.Unlock()
+
+	ctx := Context{}
+	ctx.Pair = tf.pairID
+	ctx.State = tf.FSM.Current()
+	ctx.Updated = tf.clock.Now()
+	ctx.Position = tf.position
+	ctx.Entry = tf.entry
+
+	ctx.OpenOrders = make([]string, len(tf.openOrders))
+	copy(ctx.OpenOrders, tf.openOrders)
+	ctx.Sequence = tf.sequence
+	ctx.ClientID = tf.clientID
+	ctx.ResumeHold = tf.resumeHold
+	ctx.PausedSell = tf.pausedSell
+
+	ctx.Signals = make(map[string]Signal)
+	for event, signal := range tf.signals {
+		ctx.Signals[event] = signal
+	}
+
+	if tf.risk != nil {
+		if pos, ok := tf.risk.Position(tf.pairID); ok {
+			ctx.Risk = &pos
+		}
+	}
+
+	return ctx
+}
+
+// CallBackSaveContext runs on entering any state
+func (tf *TradeFsm) CallBackSaveContext(e *fsm.Event) {
+	tf.saveContext()
+	tf.journalTransition(e)
+}
+
+func (tf *TradeFsm) journalTransition(e *fsm.Event) {
+	if tf.journal == nil {
+		return
+	}
+
+	entry := journal.Entry{Kind: journal.KindTransition, Date: tf.clock.Now(), Pair: tf.pairID,
+		Event: e.Event, From: e.Src, To: e.Dst, Signals: make(map[string]bool)}
+
+	tf.positionMu.Lock()
+	for event, signal := range tf.signals {
+		entry.Signals[event] = signal.Value
+	}
+	tf.positionMu.Unlock()
+
+	if err := tf.journal.Append(entry); err != nil {
+		log.Error("Journaling transition: ", err.Error())
+	}
+}
+
+func (tf *TradeFsm) saveContext() {
+	ctx := tf.Context()
+
+	key := fmt.Sprintf("%s_TRADE_FSM_STATE", tf.pairID)
+	if err := tf.kr.Set(key, ctx.State); err != nil {
+		log.Errorf("Saving state of %s: %s", tf.pairID, err.Error())
+	}
+
+	ctxJSON, err := json.Marshal(ctx)
+	if err != nil {
+		log.Error("Marshaling trader context: ", err.Error())
+		return
+	}
+
+	if err := tf.kr.Set(tf.contextKey(), string(ctxJSON)); err != nil {
+		log.Errorf("Saving context of %s: %s", tf.pairID, err.Error())
+	}
+}
+
+func (tf *TradeFsm) recordSignal(event string, value bool) {
+	tf.positionMu.Lock()
+	defer tf.positionMu.Unlock()
+	tf.signals[event] = Signal{Value: value, Date: tf.clock.Now()}
+}
+
+func (tf *TradeFsm) setOpenOrders(IDs ...string) {
+	tf.positionMu.Lock()
+	tf.openOrders = IDs
+	tf.positionMu.Unlock()
+	tf.saveContext()
+}
+
+// readContext reads the saved context. It returns false when there is no
+// context to continue from.
+func (tf *TradeFsm) readContext() (Context, bool, error) {
+
+	ctx := Context{}
+
+	ctxJSON, err := tf.kr.GetString(tf.contextKey())
+	if err != nil || ctxJSON == "" {
+		return ctx, false, nil
+	}
+
+	if err := json.Unmarshal([]byte(ctxJSON), &ctx); err != nil {
+		return ctx, false, fmt.Errorf("restoring context of %s: %s", tf.pairID, err.Error())
+	}
+
+	known := false
+	for _, state := range tf.AllStates {
+		if state == ctx.State {
+			known = true
+		}
+	}
+
+	if !known {
+		return ctx, false, fmt.Errorf("restoring context of %s: state %s not in the cascade", tf.pairID, ctx.State)
+	}
+
+	if ctx.State == StartState || ctx.State == ShutdownState {
+		return ctx, false, nil
+	}
+
+	return ctx, true, nil
+}
+
+// applyContext sets the FSM to ctx without running any callback
+func (tf *TradeFsm) applyContext(ctx Context) {
+	tf.positionMu.Lock()
+	tf.position = ctx.Position
+	tf.entry = ctx.Entry
+	tf.openOrders = ctx.OpenOrders
+	tf.sequence = ctx.Sequence
+	tf.clientID = ctx.ClientID
+	tf.resumeHold = ctx.ResumeHold
+	tf.pausedSell = ctx.PausedSell
+	for event, signal := range ctx.Signals {
+		tf.signals[event] = signal
+	}
+	tf.positionMu.Unlock()
+
+	if tf.risk != nil && ctx.Risk != nil {
+		tf.risk.Restore(*ctx.Risk)
+	}
+
+	tf.FSM.SetState(ctx.State)
+}
+
+// Restore puts the FSM back in the context saved by a previous run. Orders
+// in flight when it stopped are tracked again with the exchange, and their
+// buy or sell is completed or failed as if there had been no restart. It
+// returns false when there is nothing to restore.
+func (tf *TradeFsm) Restore() (bool, error) {
+
+	ctx, ok, err := tf.readContext()
+	if !ok {
+		return false, err
+	}
+
+	tf.applyContext(ctx)
+
+	log.Infof("Restored %s in %s, position %f at %f, open orders %v", tf.pairID, ctx.State, ctx.Position, ctx.Entry, ctx.OpenOrders)
+
+	// -------------------------------
+	// Resume the actions of the state
+	// -------------------------------
+	switch ctx.State {
+	case DoBuyState:
+		go tf.resumeOrder(execution.Buy, ctx.OpenOrders)
+	case DoSellState:
+		go tf.resumeOrder(execution.Sell, ctx.OpenOrders)
+	case tf.lastBuyState():
+		go tf.fire(DoBuyEvent)
+	case tf.lastSellState():
+		go tf.fire(DoSellEvent)
+	}
+
+	return true, nil
+}
+
+// Sync follows the context saved by the leader without acting on it, so a
+// standby is ready to take over.
+func (tf *TradeFsm) Sync() error {
+
+	ctx, ok, err := tf.readContext()
+	if !ok {
+		return err
+	}
+
+	tf.applyContext(ctx)
+
+	return nil
+}
+
+func (tf *TradeFsm) fire(event string) {
+	if err := tf.FSM.Event(event); err != nil {
+		log.Warn(err.Error())
+	}
+}
+
+// resumeOrder finishes a DoBuy or DoSell state interrupted by a restart
+func (tf *TradeFsm) resumeOrder(side execution.Side, IDs []string) {
+
+	completeEvent, failedEvent := BuyCompleteEvent, BuyFailedEvent
+	if side == execution.Sell {
+		completeEvent, failedEvent = tf.sellEvents()
+	}
+
+	if tf.executor == nil {
+		tf.fire(completeEvent)
+		return
+	}
+
+	if len(IDs) == 0 {
+		// The order may have been placed without confirmation
+		if order, found := tf.recoverOrder(); found {
+			log.Infof("Resuming %s order %s for %s", sideName(side), order.ID, tf.pairID)
+			tf.finishOrder(side, order)
+			return
+		}
+		log.Warnf("No %s order was placed for %s before the restart", sideName(side), tf.pairID)
+		tf.fire(failedEvent)
+		return
+	}
+
+	// The FSM places one order per DoBuy or DoSell state
+	ID := IDs[len(IDs)-1]
+	log.Infof("Resuming %s order %s for %s", sideName(side), ID, tf.pairID)
+	tf.finishOrder(side, execution.Order{ID: ID, Pair: tf.pairID, Side: side, Status: execution.StatusNew})
+}
+
+// recoverOrder looks for the order of the pending client ID on the exchange
+func (tf *TradeFsm) recoverOrder() (execution.Order, bool) {
+	tf.positionMu.Lock()
+	clientID := tf.clientID
+	tf.positionMu.Unlock()
+
+	if tf.submitter == nil || clientID == "" {
+		return execution.Order{}, false
+	}
+
+	order, found, err := tf.submitter.Recover(clientID)
+	if err != nil {
+		log.Errorf("Recovering order %s of %s: %s", clientID, tf.pairID, err.Error())
+		return execution.Order{}, false
+	}
+
+	return order, found
+}
@@ -0,0 +1,201 @@
+package trader
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/lagarciag/tayni/control"
+	"github.com/looplab/fsm"
+	log "github.com/sirupsen/logrus"
+)
+
+func (tf *TradeFsm) isSellState(state string) bool {
+	for _, sellState := range tf.SellStates {
+		if state == sellState {
+			return true
+		}
+	}
+	return false
+}
+
+func (tf *TradeFsm) operatorEvent(event string) error {
+	if !tf.Leading() {
+		return fmt.Errorf("%s is on standby, the leader is %s", tf.pairID, tf.lease.Holder())
+	}
+
+	state := tf.FSM.Current()
+
+	if state == DoBuyState || state == DoSellState {
+		return fmt.Errorf("%s has an order in flight in %s", tf.pairID, state)
+	}
+
+	// FSM.Can races with the transitions of the controller, the event
+	// itself tells if it is valid
+	if err := tf.FSM.Event(event); err != nil {
+		if _, invalid := err.(fsm.InvalidEventError); invalid {
+			return fmt.Errorf("%s can not do %s in %s", tf.pairID, event, state)
+		}
+		return err
+	}
+
+	log.Warnf("Operator %s for %s from %s", event, tf.pairID, state)
+
+	return nil
+}
+
+// Pause stops following the signals. The pair waits in the idle state
+// until resumed, remembering if it was holding.
+func (tf *TradeFsm) Pause() error {
+	state := tf.FSM.Current()
+
+	if state == IdleState {
+		return fmt.Errorf("%s is already paused", tf.pairID)
+	}
+
+	if err := tf.operatorEvent(StopEvent); err != nil {
+		return err
+	}
+
+	tf.positionMu.Lock()
+	tf.resumeHold = state == HoldState || tf.isSellState(state)
+	tf.positionMu.Unlock()
+	tf.saveContext()
+
+	return nil
+}
+
+// Resume goes back to holding or trading after a pause.
+func (tf *TradeFsm) Resume() error {
+	if tf.FSM.Current() != IdleState {
+		return fmt.Errorf("%s is not paused: %s", tf.pairID, tf.FSM.Current())
+	}
+
+	tf.positionMu.Lock()
+	hold := tf.resumeHold || tf.position > 0
+	tf.resumeHold = false
+	tf.positionMu.Unlock()
+
+	if hold {
+		return tf.operatorEvent(HoldEvent)
+	}
+	return tf.operatorEvent(TradeEvent)
+}
+
+// ForceHold moves the pair to the hold state, whatever the signals say.
+func (tf *TradeFsm) ForceHold() error {
+	return tf.operatorEvent(ForceHoldEvent)
+}
+
+// ForceTrade moves the pair to the trading state, whatever the signals say.
+func (tf *TradeFsm) ForceTrade() error {
+	return tf.operatorEvent(ForceTradeEvent)
+}
+
+// ForceSell sells the held position now. A paused pair is sold too, and
+// stays paused once the sell completes or fails.
+func (tf *TradeFsm) ForceSell() error {
+	paused := tf.FSM.Current() == IdleState
+
+	if paused {
+		tf.positionMu.Lock()
+		holding := tf.resumeHold || tf.position > 0
+		tf.positionMu.Unlock()
+
+		if !holding {
+			return fmt.Errorf("%s is paused without a position to sell", tf.pairID)
+		}
+	}
+
+	// Set before the event, the sell may complete within it
+	tf.positionMu.Lock()
+	tf.pausedSell = paused
+	tf.positionMu.Unlock()
+
+	if err := tf.operatorEvent(ForceSellEvent); err != nil {
+		tf.positionMu.Lock()
+		tf.pausedSell = false
+		tf.positionMu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// sellEvents returns the events completing and failing a sell. A sell
+// forced while paused goes back to the idle state.
+func (tf *TradeFsm) sellEvents() (complete string, failed string) {
+	tf.positionMu.Lock()
+	defer tf.positionMu.Unlock()
+
+	if tf.pausedSell {
+		return PausedSellCompleteEvent, PausedSellFailedEvent
+	}
+	return SellCompleteEvent, SellFailedEvent
+}
+
+// CallBackPausedSellDone runs once a sell forced while paused is done, the
+// pair resumes holding if it still has a position.
+func (tf *TradeFsm) CallBackPausedSellDone(e *fsm.Event) {
+	tf.positionMu.Lock()
+	tf.pausedSell = false
+	tf.resumeHold = tf.position > 0
+	tf.positionMu.Unlock()
+	tf.saveContext()
+}
+
+// ---------------------------------
+// control.Controller implementation
+// ---------------------------------
+
+func (trader *Trader) tFsm(pair string) (*TradeFsm, error) {
+	for exKey := range trader.tFsmExchangeMap {
+		if tFsm, ok := trader.tFsmExchangeMap[exKey][pair]; ok {
+			return tFsm, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown pair: %s", pair)
+}
+
+// Pairs returns the traded pairs.
+func (trader *Trader) Pairs() []string {
+	var pairs []string
+	for exKey := range trader.tFsmExchangeMap {
+		for pair := range trader.tFsmExchangeMap[exKey] {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// Status returns the trader context of pair.
+func (trader *Trader) Status(pair string) (interface{}, error) {
+	tFsm, err := trader.tFsm(pair)
+	if err != nil {
+		return nil, err
+	}
+	return tFsm.Context(), nil
+}
+
+// Command runs a control action on pair.
+func (trader *Trader) Command(pair, action string) error {
+	tFsm, err := trader.tFsm(pair)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case control.ActionPause:
+		return tFsm.Pause()
+	case control.ActionResume:
+		return tFsm.Resume()
+	case control.ActionHold:
+		return tFsm.ForceHold()
+	case control.ActionTrade:
+		return tFsm.ForceTrade()
+	case control.ActionSell:
+		return tFsm.ForceSell()
+	}
+
+	return fmt.Errorf("unknown action: %s", action)
+}
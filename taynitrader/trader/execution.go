@@ -0,0 +1,314 @@
+package trader
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/journal"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/looplab/fsm"
+	log "github.com/sirupsen/logrus"
+)
+
+// OrderAlertsKey is the channel where order mismatches are published
+const OrderAlertsKey = "ORDER_ALERTS"
+
+// executeOrder places the order for a DoBuy or DoSell state and tracks it.
+// The complete event is fired once the exchange confirms a fill, partial
+// fills included. Orders that fail or are cancelled without any fill fire
+// the failed event, which returns the FSM to the state it came from.
+func (tf *TradeFsm) executeOrder(side execution.Side) {
+
+	failedEvent := BuyFailedEvent
+	if side == execution.Sell {
+		_, failedEvent = tf.sellEvents()
+	}
+
+	request := execution.NewRequest(tf.pairID, side, tf.execConfig, tf.indicatorsGetter(0).LastValue)
+
+	if position := tf.Position(); side == execution.Sell && position > 0 {
+		request.Amount = position
+	}
+
+	if tf.risk != nil && side == execution.Buy {
+		amount, err := tf.risk.Size(tf.pairID, request.Price, tf.quoteBalance())
+		if err != nil {
+			log.Error(err.Error())
+			tf.fire(failedEvent)
+			return
+		}
+		request.Amount = amount
+	}
+
+	if request.Amount <= 0 {
+		log.Errorf("No amount to %s for pair %s", side, tf.pairID)
+		tf.fire(failedEvent)
+		return
+	}
+
+	// ------------------------------------
+	// The client ID is saved before the
+	// order is placed, so a restart finds
+	// the order even if it was not answered
+	// ------------------------------------
+	transition := DoBuyState
+	if side == execution.Sell {
+		transition = DoSellState
+	}
+
+	tf.positionMu.Lock()
+	tf.sequence++
+	tf.clientID = execution.ClientOrderID(tf.pairID, transition, tf.sequence)
+	request.ClientID = tf.clientID
+	tf.positionMu.Unlock()
+	tf.saveContext()
+
+	log.Infof("Placing %s %s order %s for %s: amount %f, price %f", request.Type, side, request.ClientID, tf.pairID, request.Amount, request.Price)
+
+	order, err := tf.orders().Place(request)
+	if err != nil {
+		log.Errorf("Placing %s order for %s: %s", side, tf.pairID, err.Error())
+		tf.notify(notify.Event{Type: notify.EventOrder, Severity: notify.Critical, Pair: tf.pairID,
+			Title: fmt.Sprintf("%s order failed", sideName(side)), Message: err.Error()})
+		tf.positionMu.Lock()
+		tf.clientID = ""
+		tf.positionMu.Unlock()
+		tf.fire(failedEvent)
+		return
+	}
+
+	tf.setOpenOrders(order.ID)
+
+	tf.finishOrder(side, order)
+}
+
+// finishOrder tracks a placed order until it is final and completes or
+// fails the DoBuy or DoSell state with its fills.
+func (tf *TradeFsm) finishOrder(side execution.Side, order execution.Order) {
+
+	completeEvent, failedEvent := BuyCompleteEvent, BuyFailedEvent
+	if side == execution.Sell {
+		completeEvent, failedEvent = tf.sellEvents()
+	}
+
+	order, err := execution.Track(tf.orders(), order, tf.execConfig, tf.clock)
+	if err != nil {
+		log.Errorf("Tracking %s order %s for %s: %s", side, order.ID, tf.pairID, err.Error())
+		tf.notify(notify.Event{Type: notify.EventOrder, Severity: notify.Critical, Pair: tf.pairID,
+			Title: fmt.Sprintf("%s order %s not tracked", sideName(side), order.ID), Message: err.Error()})
+	}
+
+	tf.positionMu.Lock()
+	tf.openOrders = nil
+	tf.clientID = ""
+	tf.positionMu.Unlock()
+
+	if order.Filled <= 0 {
+		log.Warnf("%s order %s for %s ended %s without fills", side, order.ID, tf.pairID, order.Status)
+		tf.fire(failedEvent)
+		return
+	}
+
+	if order.Filled < order.Amount {
+		log.Warnf("%s order %s for %s partially filled: %f of %f", side, order.ID, tf.pairID, order.Filled, order.Amount)
+	}
+
+	tf.positionMu.Lock()
+	realized := (order.Price-tf.entry)*order.Filled - order.Fee
+	if side == execution.Buy {
+		tf.entry = (tf.entry*tf.position + order.Price*order.Filled) / (tf.position + order.Filled)
+		tf.position += order.Filled
+	} else {
+		tf.position -= order.Filled
+		if tf.position <= 0 {
+			tf.position = 0
+			tf.entry = 0
+		}
+	}
+	tf.positionMu.Unlock()
+
+	if tf.journal != nil {
+		_, simulated := tf.executor.(*execution.Paper)
+		entry := journal.Entry{Kind: journal.KindTrade, Date: tf.clock.Now(), Pair: tf.pairID,
+			Side: side, Price: order.Price, Amount: order.Filled, Fee: order.Fee, OrderID: order.ID,
+			Simulated: simulated}
+		if err := tf.journal.Append(entry); err != nil {
+			log.Error("Journaling trade: ", err.Error())
+		}
+	}
+
+	if tf.risk != nil {
+		if side == execution.Buy {
+			tf.risk.Open(tf.pairID, order.Filled, order.Price, tf.clock.Now())
+		} else {
+			tf.risk.Reduce(tf.pairID, order.Filled)
+		}
+	}
+
+	if tf.breaker != nil && side == execution.Sell {
+		_, quote, _ := execution.SplitPair(tf.pairID)
+		if err := tf.breaker.RecordTrade(quote, realized); err != nil {
+			log.Error("Recording trade in breaker: ", err.Error())
+		}
+	}
+
+	message := `
+	----------------------------------------------------
+	%s COMPLETE for PAIR: %s, order %s, filled %f
+	----------------------------------------------------
+	`
+	log.Infof(message, sideName(side), tf.pairID, order.ID, order.Filled)
+
+	// -----------------------------------
+	// Announce the fill, not the signal
+	// -----------------------------------
+	state := tf.FSM.Current()
+
+	event := notify.EventBuy
+	if side == execution.Sell {
+		event = notify.EventSell
+	}
+
+	data := tf.notifyData(event, notify.Transition{Event: completeEvent, From: state})
+	data.Amount = order.Filled
+	data.Price = order.Price
+	if side == execution.Sell {
+		data.PnL = realized
+	}
+
+	tf.fire(completeEvent)
+
+	data.Transition.To = tf.FSM.Current()
+	tf.announce(side, data, state)
+}
+
+// orders returns the executor, through the submitter when there is one,
+// counting its requests in the breaker.
+func (tf *TradeFsm) orders() execution.Executor {
+	var executor execution.Executor = tf.executor
+	if tf.submitter != nil {
+		executor = tf.submitter
+	}
+	if tf.breaker == nil {
+		return executor
+	}
+	return tf.breaker.Watch(executor)
+}
+
+// Reconcile compares the orders of the pair on the exchange since a date
+// with the journaled trades. Every mismatch is logged, notified and
+// published once as an alert on OrderAlertsKey.
+func (tf *TradeFsm) Reconcile(since time.Time) ([]execution.Mismatch, error) {
+
+	if tf.submitter == nil {
+		return nil, fmt.Errorf("no client orders to reconcile for %s", tf.pairID)
+	}
+
+	fills := make(map[string]float64)
+	if tf.journal != nil {
+		trades, err := journal.Read(tf.journal.Path(), journal.Query{Pair: tf.pairID, Kind: journal.KindTrade, Since: since})
+		if err != nil {
+			return nil, err
+		}
+		for _, trade := range trades {
+			fills[trade.OrderID] += trade.Amount
+		}
+	}
+
+	mismatches, err := tf.submitter.Reconcile(since, fills)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mismatch := range mismatches {
+		alert := mismatch.Kind + mismatch.ClientID + mismatch.OrderID
+		tf.positionMu.Lock()
+		alerted := tf.alerted[alert]
+		tf.alerted[alert] = true
+		tf.positionMu.Unlock()
+		if alerted {
+			continue
+		}
+
+		message := `
+	----------------------------------------------------
+	ORDER MISMATCH: %s
+	----------------------------------------------------
+	`
+		log.Errorf(message, mismatch)
+
+		tf.notify(notify.Event{Type: notify.EventReconcile, Severity: notify.Critical, Pair: tf.pairID,
+			Title: fmt.Sprintf("Order mismatch: %s", mismatch.Kind), Message: mismatch.String()})
+
+		mismatchJSON, err := json.Marshal(mismatch)
+		if err != nil {
+			log.Error("Marshaling mismatch: ", err.Error())
+			continue
+		}
+		if err := tf.kr.Publish(OrderAlertsKey, string(mismatchJSON)); err != nil {
+			log.Error("Publishing order alert: ", err.Error())
+		}
+	}
+
+	return mismatches, nil
+}
+
+func sideName(side execution.Side) string {
+	if side == execution.Buy {
+		return "BUY"
+	}
+	return "SELL"
+}
+
+// quoteBalance returns the free quote currency balance, or -1 when the
+// executor can not report balances.
+func (tf *TradeFsm) quoteBalance() float64 {
+	balancer, ok := tf.executor.(execution.Balancer)
+	if !ok {
+		return -1
+	}
+
+	_, quote, err := execution.SplitPair(tf.pairID)
+	if err != nil {
+		return -1
+	}
+
+	return balancer.Balances()[quote]
+}
+
+// PriceUpdate checks the risk stops of the held position against a new
+// price and sells when one is hit.
+func (tf *TradeFsm) PriceUpdate(price float64) {
+	if tf.breaker != nil {
+		tf.breaker.RecordPrice(tf.pairID)
+	}
+
+	if tf.risk == nil || !tf.Leading() {
+		return
+	}
+
+	reason, exit := tf.risk.Check(tf.pairID, price)
+	if !exit {
+		return
+	}
+
+	// Only held positions can exit
+	if err := tf.FSM.Event(RiskExitEvent); err != nil {
+		if _, invalid := err.(fsm.InvalidEventError); !invalid {
+			log.Warn(err.Error())
+		}
+		return
+	}
+
+	log.Warnf("Risk exit for %s at %f: %s", tf.pairID, price, reason)
+}
+
+// Position returns the base currency amount bought by the executor and not
+// sold yet.
+func (tf *TradeFsm) Position() float64 {
+	tf.positionMu.Lock()
+	defer tf.positionMu.Unlock()
+	return tf.position
+}
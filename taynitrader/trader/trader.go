@@ -2,12 +2,20 @@ package trader
 
 import (
 	"fmt"
+	"reflect"
+	"sync"
 
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/journal"
 	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	"github.com/lagarciag/tayni/notify"
+	"github.com/lagarciag/tayni/risk"
 	"github.com/lagarciag/tayni/twitter"
 	"github.com/looplab/fsm"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 const (
@@ -26,7 +34,7 @@ const (
 	Minute1BuyState   = "Minute1BuyState"
 	Minute120BuyState = "Minute120BuyState"
 	Minute60BuyState  = "Minute60BuyState"
-	Minute30BuyState  = "Minute30BuySate"
+	Minute30BuyState  = "Minute30BuyState"
 
 	DoBuyState     = "DoBuyState"
 	TestDoBuyState = "TestDoBuyState"
@@ -58,12 +66,12 @@ const (
 	Minute1BuyEvent   = "Minute1BuyEvent"
 	Minute120BuyEvent = "Minute120BuyEvent"
 	Minute60BuyEvent  = "Minute60BuyEvent"
-	Minute30BuyEvent  = "Minute30BuySate"
+	Minute30BuyEvent  = "Minute30BuyEvent"
 
 	NotMinute1BuyEvent   = "NotMinute1BuyEvent"
 	NotMinute120BuyEvent = "NotMinute120BuyEvent"
 	NotMinute60BuyEvent  = "NotMinute60BuyEvent"
-	NotMinute30BuyEvent  = "NotMinute30BuySate"
+	NotMinute30BuyEvent  = "NotMinute30BuyEvent"
 
 	DoBuyEvent            = "DoBuyEvent"
 	TestDoBuyEvent        = "TestDoBuyEvent"
@@ -73,6 +81,15 @@ const (
 	TestBuyCompleteEvent  = "TestBuyCompleteEvent"
 	SellCompleteEvent     = "SellCompleteEvent"
 	TestSellCompleteEvent = "TestSellCompleteEvent"
+	BuyFailedEvent        = "BuyFailedEvent"
+	SellFailedEvent       = "SellFailedEvent"
+	RiskExitEvent         = "RiskExitEvent"
+	ForceHoldEvent        = "ForceHoldEvent"
+	ForceTradeEvent       = "ForceTradeEvent"
+	ForceSellEvent        = "ForceSellEvent"
+	// A sell forced while paused ends in the idle state
+	PausedSellCompleteEvent = "PausedSellCompleteEvent"
+	PausedSellFailedEvent   = "PausedSellFailedEvent"
 
 	// -------------
 	//   Sell Sates
@@ -91,12 +108,38 @@ const (
 
 type TradeFsm struct {
 	tc           *twitter.TwitterClient
+	notifier     notify.Notifier
+	templates    *notify.Templates
 	kr           *kredis.Kredis
 	To           string
 	FSM          *fsm.FSM
 	pairID       string
+	exchange     string
+	timeframes   []int
 	holdingFunds bool
 
+	// ----------------
+	// Order execution
+	// ----------------
+	executor   execution.Executor
+	execConfig execution.Config
+	submitter  *execution.Submitter
+	position   float64
+	entry      float64
+	openOrders []string
+	sequence   int
+	clientID   string
+	alerted    map[string]bool
+	resumeHold bool
+	pausedSell bool
+	signals    map[string]Signal
+	positionMu *sync.Mutex // guards the trader context fields
+	clock      clock.Clock
+	risk       *risk.Manager
+	journal    *journal.Journal
+	breaker    *breaker.Breaker
+	lease      *leader.Lease
+
 	BuyStates     []string
 	SellStates    []string
 	ControlStates []string
@@ -125,30 +168,19 @@ type TradeFsm struct {
 	tradeEvent    fsm.EventDesc
 	holdEvent     fsm.EventDesc
 
-	minute1BuyEvent   fsm.EventDesc
-	minute120BuyEvent fsm.EventDesc
-	minute60BuyEvent  fsm.EventDesc
-	minute30BuyEvent  fsm.EventDesc
-
-	notMinute1BuyEvent   fsm.EventDesc
-	notMinute120BuyEvent fsm.EventDesc
-	notMinute60BuyEvent  fsm.EventDesc
-	notMinute30BuyEvent  fsm.EventDesc
-
-	minute1SellEvent   fsm.EventDesc
-	minute120SellEvent fsm.EventDesc
-	minute60SellEvent  fsm.EventDesc
-	minute30SellEvent  fsm.EventDesc
-
-	notMinute1SellEvent   fsm.EventDesc
-	notMinute120SellEvent fsm.EventDesc
-	notMinute60SellEvent  fsm.EventDesc
-	notMinute30SellEvent  fsm.EventDesc
-
 	doBuyEvent        fsm.EventDesc
 	doSellEvent       fsm.EventDesc
 	buyCompleteEvent  fsm.EventDesc
 	sellCompleteEvent fsm.EventDesc
+	buyFailedEvent    fsm.EventDesc
+	sellFailedEvent   fsm.EventDesc
+	riskExitEvent     fsm.EventDesc
+	forceHoldEvent    fsm.EventDesc
+	forceTradeEvent   fsm.EventDesc
+	forceSellEvent    fsm.EventDesc
+
+	pausedSellCompleteEvent fsm.EventDesc
+	pausedSellFailedEvent   fsm.EventDesc
 
 	testDoBuyEvent        fsm.EventDesc
 	testDoSellEvent       fsm.EventDesc
@@ -170,29 +202,22 @@ type TradeFsm struct {
 	ChanTradeEvent    chan bool
 	ChanHoldEvent     chan bool
 
-	// --------------
-	// Buy Events
-	// --------------
-	ChanMinute1BuyEvent   chan bool
+	// ---------------------------------
+	// Cascade signals by timeframe, the
+	// ChanMinuteNNN fields are set when
+	// their timeframe is in the cascade
+	// ---------------------------------
+	BuyChans  map[int]chan bool
+	SellChans map[int]chan bool
+
 	ChanMinute120BuyEvent chan bool
 	ChanMinute60BuyEvent  chan bool
 	ChanMinute30BuyEvent  chan bool
 
-	ChanNotMinute1BuyEvent chan bool
-	//ChanNotMinute120BuyEvent chan bool
-	//ChanNotMinute60BuyEvent  chan bool
-	//ChanNotMinute30BuyEvent  chan bool
-
-	ChanMinute1SellEvent   chan bool
 	ChanMinute120SellEvent chan bool
 	ChanMinute60SellEvent  chan bool
 	ChanMinute30SellEvent  chan bool
 
-	//ChanNotMinute1SellEvent   chan bool
-	//ChanNotMinute120SellEvent chan bool
-	//ChanNotMinute60SellEvent  chan bool
-	//ChanNotMinute30SellEvent  chan bool
-
 	ChanDoBuyEvent        chan bool
 	ChanDoSellEvent       chan bool
 	ChanBuyCompleteEvent  chan bool
@@ -206,17 +231,43 @@ type TradeFsm struct {
 	ChanMap map[string]chan bool
 }
 
+// NewTradeFsm creates the trading fsm of a CEXIO pair with the cascade
+// read from the configuration.
 func NewTradeFsm(pairID string) *TradeFsm {
-	log.Info("Creating new trading fsm for pair: ", pairID)
+	cascade, err := LoadCascadeConfig("CEXIO", pairID)
+	if err != nil {
+		log.Fatalf("Bad cascade for %s: %s", pairID, err.Error())
+	}
+	return NewTradeFsmWithConfig(pairID, cascade)
+}
+
+// NewTradeFsmWithConfig creates the trading fsm of a pair. The buy and sell
+// cascades get one level per timeframe, in the configured order.
+func NewTradeFsmWithConfig(pairID string, cascade CascadeConfig) *TradeFsm {
+	log.Infof("Creating new trading fsm for pair: %s, cascade: %v", pairID, cascade.Timeframes)
+
+	if err := cascade.Validate(); err != nil {
+		log.Fatalf("Bad cascade for %s: %s", pairID, err.Error())
+	}
 
 	tFsm := &TradeFsm{}
+	tFsm.exchange = cascade.Exchange
+	tFsm.timeframes = make([]int, len(cascade.Timeframes))
+	copy(tFsm.timeframes, cascade.Timeframes)
 
 	//---------------------
 	//Event structures
 	//---------------------
 
-	tFsm.BuyStates = []string{Minute120BuyState, Minute60BuyState, Minute30BuyState}
-	tFsm.SellStates = []string{Minute120SellState, Minute60SellState, Minute30SellState}
+	for _, timeframe := range tFsm.timeframes {
+		tFsm.BuyStates = append(tFsm.BuyStates, BuyState(timeframe))
+		tFsm.SellStates = append(tFsm.SellStates, SellState(timeframe))
+		tFsm.BuyEvents = append(tFsm.BuyEvents, BuyEvent(timeframe))
+		tFsm.SellEvents = append(tFsm.SellEvents, SellEvent(timeframe))
+		tFsm.NotBuyEvents = append(tFsm.NotBuyEvents, NotBuyEvent(timeframe))
+		tFsm.NotSellEvents = append(tFsm.NotSellEvents, NotSellEvent(timeframe))
+	}
+
 	tFsm.ControlStates = []string{StartState, IdleState, TradingState, HoldState, ShutdownState}
 	tFsm.TradingStates = []string{DoBuyState, DoSellState}
 
@@ -226,12 +277,6 @@ func NewTradeFsm(pairID string) *TradeFsm {
 	tFsm.AllStates = append(tFsm.AllStates, tFsm.ControlStates...)
 	tFsm.AllStates = append(tFsm.AllStates, tFsm.TradingStates...)
 
-	tFsm.BuyEvents = []string{Minute120BuyEvent, Minute60BuyEvent, Minute30BuyEvent}
-	tFsm.SellEvents = []string{Minute120SellEvent, Minute60SellEvent, Minute30SellEvent}
-
-	tFsm.NotBuyEvents = []string{NotMinute120BuyEvent, NotMinute60BuyEvent, NotMinute30BuyEvent}
-	tFsm.NotSellEvents = []string{NotMinute120SellEvent, NotMinute60SellEvent, NotMinute30SellEvent}
-
 	tFsm.ControlEvents = []string{StartEvent, StopEvent, TradeEvent, HoldEvent, ShutdownEvent}
 	tFsm.TradingEvents = []string{DoBuyEvent, DoSellEvent}
 
@@ -249,20 +294,14 @@ func NewTradeFsm(pairID string) *TradeFsm {
 
 	// ----------------------
 	// Twitter configuration
-	config := twitter.Config{}
-	vTwitterConfig := viper.Get("twitter").(map[string]interface{})
-	config.Twit = vTwitterConfig["twit"].(bool)
-	config.ConsumerKey = vTwitterConfig["consumer_key"].(string)
-	config.ConsumerSecret = vTwitterConfig["consumer_secret"].(string)
-	config.AccessToken = vTwitterConfig["access_token"].(string)
-	config.AccessTokenSecret = vTwitterConfig["access_token_secret"].(string)
-
-	if config.ConsumerKey == "" {
-		log.Fatal("bad consumerkey")
-	}
-
-	tFsm.tc = twitter.NewTwitterClient(config)
+	tFsm.tc = twitter.NewTwitterClient(twitter.LoadConfig())
+	tFsm.notifier = notify.Default(tFsm.tc)
+	tFsm.templates = notify.DefaultTemplates()
 	tFsm.pairID = pairID
+	tFsm.clock = clock.New()
+	tFsm.positionMu = &sync.Mutex{}
+	tFsm.signals = make(map[string]Signal)
+	tFsm.alerted = make(map[string]bool)
 
 	// ------------
 	// Events
@@ -369,11 +408,11 @@ func NewTradeFsm(pairID string) *TradeFsm {
 	// ----------------------
 
 	doBuyEvent := fsm.EventDesc{Name: DoBuyEvent,
-		Src: []string{Minute30BuyState},
+		Src: []string{tFsm.lastBuyState()},
 		Dst: DoBuyState}
 
 	doSellEvent := fsm.EventDesc{Name: DoSellEvent,
-		Src: []string{Minute30SellState},
+		Src: []string{tFsm.lastSellState()},
 		Dst: DoSellState}
 
 	buyCompleteEvent := fsm.EventDesc{Name: BuyCompleteEvent,
@@ -384,6 +423,47 @@ func NewTradeFsm(pairID string) *TradeFsm {
 		Src: []string{DoSellState},
 		Dst: TradingState}
 
+	buyFailedEvent := fsm.EventDesc{Name: BuyFailedEvent,
+		Src: []string{DoBuyState},
+		Dst: TradingState}
+
+	sellFailedEvent := fsm.EventDesc{Name: SellFailedEvent,
+		Src: []string{DoSellState},
+		Dst: HoldState}
+
+	// Stops sell while holding, whatever the sell cascade says
+	riskExitEvent := fsm.EventDesc{Name: RiskExitEvent,
+		Src: []string{HoldState},
+		Dst: DoSellState}
+	riskExitEvent.Src = append(riskExitEvent.Src, tFsm.SellStates...)
+
+	// ------------------------------
+	// Operator events, see control.go
+	// ------------------------------
+	cascadeStates := append([]string{IdleState}, tFsm.BuyStates...)
+	cascadeStates = append(cascadeStates, tFsm.SellStates...)
+
+	forceHoldEvent := fsm.EventDesc{Name: ForceHoldEvent,
+		Src: append([]string{TradingState}, cascadeStates...),
+		Dst: HoldState}
+
+	forceTradeEvent := fsm.EventDesc{Name: ForceTradeEvent,
+		Src: append([]string{HoldState}, cascadeStates...),
+		Dst: TradingState}
+
+	forceSellEvent := fsm.EventDesc{Name: ForceSellEvent,
+		Src: []string{IdleState, HoldState},
+		Dst: DoSellState}
+	forceSellEvent.Src = append(forceSellEvent.Src, tFsm.SellStates...)
+
+	pausedSellCompleteEvent := fsm.EventDesc{Name: PausedSellCompleteEvent,
+		Src: []string{DoSellState},
+		Dst: IdleState}
+
+	pausedSellFailedEvent := fsm.EventDesc{Name: PausedSellFailedEvent,
+		Src: []string{DoSellState},
+		Dst: IdleState}
+
 	tFsm.startEvent = startEvent
 	tFsm.stopEvent = stopEvent
 	tFsm.tradeEvent = tradeEvent
@@ -394,6 +474,14 @@ func NewTradeFsm(pairID string) *TradeFsm {
 
 	tFsm.buyCompleteEvent = buyCompleteEvent
 	tFsm.sellCompleteEvent = sellCompleteEvent
+	tFsm.buyFailedEvent = buyFailedEvent
+	tFsm.sellFailedEvent = sellFailedEvent
+	tFsm.riskExitEvent = riskExitEvent
+	tFsm.forceHoldEvent = forceHoldEvent
+	tFsm.forceTradeEvent = forceTradeEvent
+	tFsm.forceSellEvent = forceSellEvent
+	tFsm.pausedSellCompleteEvent = pausedSellCompleteEvent
+	tFsm.pausedSellFailedEvent = pausedSellFailedEvent
 
 	tFsm.shutdownEvent = fsm.EventDesc{Name: ShutdownEvent,
 		Src: []string{StartState,
@@ -414,6 +502,14 @@ func NewTradeFsm(pairID string) *TradeFsm {
 
 		tFsm.buyCompleteEvent,
 		tFsm.sellCompleteEvent,
+		tFsm.buyFailedEvent,
+		tFsm.sellFailedEvent,
+		tFsm.riskExitEvent,
+		tFsm.forceHoldEvent,
+		tFsm.forceTradeEvent,
+		tFsm.forceSellEvent,
+		tFsm.pausedSellCompleteEvent,
+		tFsm.pausedSellFailedEvent,
 	}
 
 	tFsm.eventsList = append(tFsm.eventsList, tFsm.fsmBuyEventsDescriptors...)
@@ -430,19 +526,30 @@ func NewTradeFsm(pairID string) *TradeFsm {
 		TradingState:  tFsm.CallBackInGenericState,
 		HoldState:     tFsm.CallBackInGenericState,
 
-		Minute120BuyState: tFsm.CallBackInGenericState,
-		Minute60BuyState:  tFsm.CallBackInGenericState,
-		Minute30BuyState:  tFsm.CallBackInGenericState, //tFsm.CallBackInMinute30BuyState,
-
-		Minute120SellState: tFsm.CallBackInGenericState,
-		Minute60SellState:  tFsm.CallBackInGenericState,
-		Minute30SellState:  tFsm.CallBackInGenericState, //tFsm.CallBackInMinute30SellState,
+		// Any state
+		"enter_state": tFsm.CallBackSaveContext,
+
+		// Only the leader moves, entries are refused
+		// while the breaker is tripped
+		"before_event":         tFsm.CallBackBeforeEvent,
+		"before_" + DoBuyEvent: tFsm.CallBackBeforeDoBuy,
+
+		DoBuyEvent:              tFsm.CallBackInDoBuyState,
+		DoSellEvent:             tFsm.CallBackInDoSellState,
+		RiskExitEvent:           tFsm.CallBackInDoSellState,
+		ForceSellEvent:          tFsm.CallBackInDoSellState,
+		BuyCompleteEvent:        tFsm.CallBackInBuyCompleteState,
+		SellCompleteEvent:       tFsm.CallBackInSellCompleteState,
+		PausedSellCompleteEvent: tFsm.CallBackPausedSellDone,
+		PausedSellFailedEvent:   tFsm.CallBackPausedSellDone,
+		TestSellCompleteEvent:   tFsm.CallBackInTestSellCompleteState,
+	}
 
-		DoBuyEvent:            tFsm.CallBackInDoBuyState,
-		DoSellEvent:           tFsm.CallBackInDoSellState,
-		BuyCompleteEvent:      tFsm.CallBackInBuyCompleteState,
-		SellCompleteEvent:     tFsm.CallBackInSellCompleteState,
-		TestSellCompleteEvent: tFsm.CallBackInTestSellCompleteState,
+	for _, state := range tFsm.BuyStates {
+		tFsm.callbacks[state] = tFsm.CallBackInGenericState
+	}
+	for _, state := range tFsm.SellStates {
+		tFsm.callbacks[state] = tFsm.CallBackInGenericState
 	}
 
 	// ------------------
@@ -455,20 +562,23 @@ func NewTradeFsm(pairID string) *TradeFsm {
 	tFsm.ChanTradeEvent = make(chan bool)
 	tFsm.ChanHoldEvent = make(chan bool)
 
-	// --------------
-	// Buy Events
-	// --------------
-	tFsm.ChanMinute1BuyEvent = make(chan bool)
-	tFsm.ChanMinute120BuyEvent = make(chan bool)
-	tFsm.ChanMinute60BuyEvent = make(chan bool)
-	tFsm.ChanMinute30BuyEvent = make(chan bool)
+	// ---------------
+	// Cascade Events
+	// ---------------
+	tFsm.BuyChans = make(map[int]chan bool)
+	tFsm.SellChans = make(map[int]chan bool)
+	for _, timeframe := range tFsm.timeframes {
+		tFsm.BuyChans[timeframe] = make(chan bool)
+		tFsm.SellChans[timeframe] = make(chan bool)
+	}
 
-	tFsm.ChanNotMinute1BuyEvent = make(chan bool)
+	tFsm.ChanMinute120BuyEvent = tFsm.BuyChans[120]
+	tFsm.ChanMinute60BuyEvent = tFsm.BuyChans[60]
+	tFsm.ChanMinute30BuyEvent = tFsm.BuyChans[30]
 
-	tFsm.ChanMinute1SellEvent = make(chan bool)
-	tFsm.ChanMinute120SellEvent = make(chan bool)
-	tFsm.ChanMinute60SellEvent = make(chan bool)
-	tFsm.ChanMinute30SellEvent = make(chan bool)
+	tFsm.ChanMinute120SellEvent = tFsm.SellChans[120]
+	tFsm.ChanMinute60SellEvent = tFsm.SellChans[60]
+	tFsm.ChanMinute30SellEvent = tFsm.SellChans[30]
 
 	tFsm.ChanDoBuyEvent = make(chan bool, 1)
 	tFsm.ChanDoSellEvent = make(chan bool, 1)
@@ -488,13 +598,10 @@ func NewTradeFsm(pairID string) *TradeFsm {
 		tFsm.callbacks)
 
 	tFsm.ChanMap = make(map[string]chan bool)
-	tFsm.ChanMap[fmt.Sprintf("CEXIO_%s_MS_30_BUY", tFsm.pairID)] = tFsm.ChanMinute30BuyEvent
-	tFsm.ChanMap[fmt.Sprintf("CEXIO_%s_MS_60_BUY", tFsm.pairID)] = tFsm.ChanMinute60BuyEvent
-	tFsm.ChanMap[fmt.Sprintf("CEXIO_%s_MS_120_BUY", tFsm.pairID)] = tFsm.ChanMinute120BuyEvent
-
-	tFsm.ChanMap[fmt.Sprintf("CEXIO_%s_MS_30_SELL", tFsm.pairID)] = tFsm.ChanMinute30SellEvent
-	tFsm.ChanMap[fmt.Sprintf("CEXIO_%s_MS_60_SELL", tFsm.pairID)] = tFsm.ChanMinute60SellEvent
-	tFsm.ChanMap[fmt.Sprintf("CEXIO_%s_MS_120_SELL", tFsm.pairID)] = tFsm.ChanMinute120SellEvent
+	for _, timeframe := range tFsm.timeframes {
+		tFsm.ChanMap[BuySignalKey(tFsm.exchange, tFsm.pairID, timeframe)] = tFsm.BuyChans[timeframe]
+		tFsm.ChanMap[SellSignalKey(tFsm.exchange, tFsm.pairID, timeframe)] = tFsm.SellChans[timeframe]
+	}
 	//ChanDoBuyEvent
 	tFsm.ChanMap[fmt.Sprintf("%s_BUY", tFsm.pairID)] = tFsm.ChanDoBuyEvent
 	tFsm.ChanMap[fmt.Sprintf("%s_SELL", tFsm.pairID)] = tFsm.ChanDoSellEvent
@@ -502,322 +609,172 @@ func NewTradeFsm(pairID string) *TradeFsm {
 	tFsm.ChanMap["TRADE"] = tFsm.ChanTradeEvent
 	tFsm.ChanMap["HOLD"] = tFsm.ChanHoldEvent
 	tFsm.ChanMap["START"] = tFsm.ChanStartEvent
-	tFsm.ChanMap["STOP"] = tFsm.ChanStartEvent
+	tFsm.ChanMap["STOP"] = tFsm.ChanStopEvent
 
 	return tFsm
 
 }
 
+func (tFsm *TradeFsm) lastBuyState() string {
+	return tFsm.BuyStates[len(tFsm.BuyStates)-1]
+}
+
+func (tFsm *TradeFsm) lastSellState() string {
+	return tFsm.SellStates[len(tFsm.SellStates)-1]
+}
+
+// Timeframes returns the cascade timeframes, slowest first.
+func (tFsm *TradeFsm) Timeframes() []int {
+	timeframes := make([]int, len(tFsm.timeframes))
+	copy(timeframes, tFsm.timeframes)
+	return timeframes
+}
+
+// Exchange returns the exchange publishing the cascade signals.
+func (tFsm *TradeFsm) Exchange() string {
+	return tFsm.exchange
+}
+
 func (tFsm *TradeFsm) Kredis() *kredis.Kredis {
 	return tFsm.kr
 }
 
-func (tFsm *TradeFsm) SignalChannelsMap() map[string]chan bool {
-	return tFsm.ChanMap
+// SetExecutor makes the DoBuy and DoSell states place real orders. Without
+// an executor the FSM completes buys and sells as soon as they are signaled.
+func (tFsm *TradeFsm) SetExecutor(executor execution.Executor, config execution.Config) {
+	tFsm.executor = executor
+	tFsm.execConfig = config
 }
 
-func (tFsm *TradeFsm) FsmController() {
+// SetSubmitter makes the FSM place its orders with client IDs through the
+// submitter, which must wrap the executor, so a retried order is never
+// placed twice.
+func (tFsm *TradeFsm) SetSubmitter(sb *execution.Submitter) {
+	tFsm.submitter = sb
+}
 
-	logMap := make(map[string]bool)
-	logMap[Minute120BuyEvent] = false
-	logMap[Minute60BuyEvent] = false
-	logMap[Minute30BuyEvent] = false
+// SetRiskManager makes buys sized by the risk manager and lets its stops
+// sell held positions. Stops need an executor to know the entry price.
+func (tFsm *TradeFsm) SetRiskManager(rm *risk.Manager) {
+	tFsm.risk = rm
+}
 
-	logMap[NotMinute60BuyEvent] = false
-	logMap[NotMinute120BuyEvent] = false
-	logMap[NotMinute30BuyEvent] = false
+// SetJournal makes the FSM record its transitions and trades.
+func (tFsm *TradeFsm) SetJournal(jr *journal.Journal) {
+	tFsm.journal = jr
+}
 
-	logMap[Minute120SellEvent] = false
-	logMap[Minute60SellEvent] = false
-	logMap[Minute30SellEvent] = false
+// SetBreaker makes the FSM refuse new buys while the breaker is tripped and
+// feeds it with prices, trade results and exchange errors.
+func (tFsm *TradeFsm) SetBreaker(brk *breaker.Breaker) {
+	tFsm.breaker = brk
+}
 
-	logMap[NotMinute120SellEvent] = false
-	logMap[NotMinute60SellEvent] = false
-	logMap[NotMinute30SellEvent] = false
+// SetNotifier sets where the trades and order problems are notified, all
+// to Twitter by default.
+func (tFsm *TradeFsm) SetNotifier(notifier notify.Notifier) {
+	tFsm.notifier = notifier
+}
 
-	log.Info("Starting tFsm controlloer for : ", tFsm.pairID)
+// SetTemplates sets the templates of the buy and sell messages.
+func (tFsm *TradeFsm) SetTemplates(tp *notify.Templates) {
+	tFsm.templates = tp
+}
 
-	for {
-		select {
+// SetLease makes the FSM act only while the lease is held. Standbys follow
+// the context saved by the leader with Sync.
+func (tFsm *TradeFsm) SetLease(ls *leader.Lease) {
+	tFsm.lease = ls
+}
 
-		case _ = <-tFsm.ChanStartEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, StartEvent)
-				if err := tFsm.FSM.Event(StartEvent); err != nil {
-					//log.Warn(err.Error())
-				}
+// Leading tells if this instance acts on the pair.
+func (tFsm *TradeFsm) Leading() bool {
+	return tFsm.lease == nil || tFsm.lease.Held()
+}
 
-			}
-		case _ = <-tFsm.ChanShutdownEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, ShutdownEvent)
-				if err := tFsm.FSM.Event(ShutdownEvent); err != nil {
-					//log.Warn(err.Error())
-				}
-			}
+// SetClock sets the clock used to track orders.
+func (tFsm *TradeFsm) SetClock(clk clock.Clock) {
+	tFsm.clock = clk
+}
 
-		case _ = <-tFsm.ChanStopEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, ShutdownEvent)
-				if err := tFsm.FSM.Event(StopEvent); err != nil {
-					//log.Warn(err.Error())
-				}
-			}
+func (tFsm *TradeFsm) SignalChannelsMap() map[string]chan bool {
+	return tFsm.ChanMap
+}
 
-		case _ = <-tFsm.ChanTradeEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, TradeEvent)
-				if err := tFsm.FSM.Event(TradeEvent); err != nil {
-					//log.Warn(err.Error())
-				}
-			}
-		case _ = <-tFsm.ChanHoldEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, HoldEvent)
-				if err := tFsm.FSM.Event(HoldEvent); err != nil {
-					//log.Warn(err.Error())
-				}
-			}
+// FsmController feeds the FSM with the events received on the control,
+// trading and cascade channels.
+func (tFsm *TradeFsm) FsmController() {
 
-		case ev := <-tFsm.ChanMinute120BuyEvent:
-			{
-
-				doLog := false
-				if logMap[Minute120BuyEvent] != ev {
-					doLog = true
-				}
-				logMap[Minute120BuyEvent] = ev
-
-				if ev {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s , %v", tFsm.pairID, Minute120BuyEvent, ev)
-					}
-					if err := tFsm.FSM.Event(Minute120BuyEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				} else {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s , %v", tFsm.pairID, NotMinute120BuyEvent, ev)
-					}
-					if err := tFsm.FSM.Event(NotMinute120BuyEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				}
+	var cases []reflect.SelectCase
+	var handlers []func(ev bool)
 
-			}
-		case ev := <-tFsm.ChanMinute60BuyEvent:
-			{
-
-				doLog := false
-				if logMap[Minute60BuyEvent] != ev {
-					doLog = true
-				}
-				logMap[Minute60BuyEvent] = ev
-
-				if ev {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, Minute60BuyEvent, ev)
-					}
-
-					if err := tFsm.FSM.Event(Minute60BuyEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				} else {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, NotMinute60BuyEvent, ev)
-					}
-
-					if err := tFsm.FSM.Event(NotMinute60BuyEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				}
+	addCase := func(channel chan bool, handler func(ev bool)) {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(channel)})
+		handlers = append(handlers, handler)
+	}
 
+	// ---------------------------
+	// Control and trading events
+	// ---------------------------
+	eventHandler := func(event string) func(ev bool) {
+		return func(ev bool) {
+			log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, event)
+			if err := tFsm.FSM.Event(event); err != nil {
+				log.Debug(err.Error())
 			}
-		case ev := <-tFsm.ChanMinute30BuyEvent:
-			{
-				doLog := false
-				if logMap[Minute30BuyEvent] != ev {
-					doLog = true
-				}
-				logMap[Minute30BuyEvent] = ev
-
-				if ev {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, Minute30BuyEvent, ev)
-					}
-
-					if err := tFsm.FSM.Event(Minute30BuyEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				} else {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, NotMinute30BuyEvent, ev)
-					}
-
-					if err := tFsm.FSM.Event(NotMinute30BuyEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				}
-			}
-			/*
-				case _ = <-tFsm.ChanNotMinute120BuyEvent:
-					{
-						log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, NotMinute120BuyEvent)
-						if err := tFsm.FSM.Event(NotMinute120BuyEvent); err != nil {
-							//log.Warn(err.Error())
-						}
-					}
-				case _ = <-tFsm.ChanNotMinute60BuyEvent:
-					{
-						log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, NotMinute60BuyEvent)
-						if err := tFsm.FSM.Event(NotMinute60BuyEvent); err != nil {
-							//log.Warn(err.Error())
-						}
-					}
-				case _ = <-tFsm.ChanNotMinute30BuyEvent:
-					{
-						log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, NotMinute30BuyEvent)
-						if err := tFsm.FSM.Event(NotMinute30BuyEvent); err != nil {
-							//log.Warn(err.Error())
-						}
-					}
-			*/
-		case ev := <-tFsm.ChanMinute120SellEvent:
-			{
-
-				doLog := false
-				if logMap[Minute120SellEvent] != ev {
-					doLog = true
-				}
-				logMap[Minute120SellEvent] = ev
-
-				if ev {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, Minute120SellEvent, ev)
-					}
-
-					if err := tFsm.FSM.Event(Minute120SellEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				} else {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, NotMinute120SellEvent, ev)
-					}
-					if err := tFsm.FSM.Event(NotMinute120SellEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				}
+		}
+	}
 
+	addCase(tFsm.ChanStartEvent, eventHandler(StartEvent))
+	addCase(tFsm.ChanShutdownEvent, eventHandler(ShutdownEvent))
+	addCase(tFsm.ChanStopEvent, eventHandler(StopEvent))
+	addCase(tFsm.ChanTradeEvent, eventHandler(TradeEvent))
+	addCase(tFsm.ChanHoldEvent, eventHandler(HoldEvent))
+	addCase(tFsm.ChanDoBuyEvent, eventHandler(DoBuyEvent))
+	addCase(tFsm.ChanDoSellEvent, eventHandler(DoSellEvent))
+	addCase(tFsm.ChanBuyCompleteEvent, eventHandler(BuyCompleteEvent))
+	addCase(tFsm.ChanSellCompleteEvent, eventHandler(SellCompleteEvent))
+
+	// ---------------------------------
+	// Cascade signals, only changes of
+	// a signal are logged
+	// ---------------------------------
+	logMap := make(map[string]bool)
+
+	signalHandler := func(event, notEvent string) func(ev bool) {
+		return func(ev bool) {
+			doLog := logMap[event] != ev
+			logMap[event] = ev
+			tFsm.recordSignal(event, ev)
+
+			name := event
+			if !ev {
+				name = notEvent
 			}
-		case ev := <-tFsm.ChanMinute60SellEvent:
-			{
-
-				doLog := false
-				if logMap[Minute60SellEvent] != ev {
-					doLog = true
-				}
-				logMap[Minute60SellEvent] = ev
-
-				if ev {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, Minute60SellEvent, ev)
-					}
-
-					if err := tFsm.FSM.Event(Minute60SellEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-
-				} else {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, NotMinute60SellEvent, ev)
-					}
-
-					if err := tFsm.FSM.Event(NotMinute60SellEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-
-				}
-			}
-		case ev := <-tFsm.ChanMinute30SellEvent:
-			{
-
-				doLog := false
-				if logMap[Minute30SellEvent] != ev {
-					doLog = true
-				}
-				logMap[Minute30SellEvent] = ev
-
-				if ev {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, Minute30SellEvent, ev)
-					}
-
-					if err := tFsm.FSM.Event(Minute30SellEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				} else {
-					if doLog {
-						log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, NotMinute30SellEvent, ev)
-					}
-					if err := tFsm.FSM.Event(NotMinute30SellEvent); err != nil {
-						//log.Warn(err.Error())
-					}
-				}
-			}
-			/*
-				case _ = <-tFsm.ChanNotMinute120SellEvent:
-
-					{
-						log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, NotMinute120SellEvent)
-						if err := tFsm.FSM.Event(NotMinute120SellEvent); err != nil {
-							//log.Warn(err.Error())
-						}
-					}
-				case _ = <-tFsm.ChanNotMinute60SellEvent:
-					{
-						log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, NotMinute30SellEvent)
-						if err := tFsm.FSM.Event(NotMinute30SellEvent); err != nil {
-							//log.Warn(err.Error())
-						}
-					}
-				case _ = <-tFsm.ChanNotMinute30SellEvent:
-					{
-						log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, NotMinute30SellEvent)
-						if err := tFsm.FSM.Event(NotMinute30SellEvent); err != nil {
-							//log.Warn(err.Error())
-						}
-					}
-			*/
-		case _ = <-tFsm.ChanDoBuyEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, DoBuyEvent)
-				if err := tFsm.FSM.Event(DoBuyEvent); err != nil {
-					//log.Warn(err.Error())
-				}
-			}
-		case _ = <-tFsm.ChanDoSellEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, DoSellEvent)
-				if err := tFsm.FSM.Event(DoSellEvent); err != nil {
-					//log.Warn(err.Error())
-				}
-			}
-		case _ = <-tFsm.ChanBuyCompleteEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, BuyCompleteEvent)
-				if err := tFsm.FSM.Event(BuyCompleteEvent); err != nil {
-					//log.Warn(err.Error())
-				}
+
+			if doLog {
+				log.Infof("tFsm %s Controller Event: %s, %v", tFsm.pairID, name, ev)
 			}
-		case _ = <-tFsm.ChanSellCompleteEvent:
-			{
-				log.Infof("tFsm %s Controller Event: %s", tFsm.pairID, SellCompleteEvent)
-				if err := tFsm.FSM.Event(SellCompleteEvent); err != nil {
-					//log.Warn(err.Error())
-				}
+
+			if err := tFsm.FSM.Event(name); err != nil {
+				log.Debug(err.Error())
 			}
+		}
+	}
+
+	for _, timeframe := range tFsm.timeframes {
+		addCase(tFsm.BuyChans[timeframe], signalHandler(BuyEvent(timeframe), NotBuyEvent(timeframe)))
+		addCase(tFsm.SellChans[timeframe], signalHandler(SellEvent(timeframe), NotSellEvent(timeframe)))
+	}
 
+	log.Info("Starting tFsm controlloer for : ", tFsm.pairID)
+
+	for {
+		chosen, value, ok := reflect.Select(cases)
+		if !ok {
+			log.Warnf("tFsm %s controller channel closed", tFsm.pairID)
+			return
 		}
-		//time.Sleep(time.Second)
+		handlers[chosen](value.Bool())
 	}
 }
@@ -1,12 +1,30 @@
 package trader_test
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/lagarciag/movingstats"
+	"github.com/lagarciag/tayni/breaker"
+	"github.com/lagarciag/tayni/clock"
+	"github.com/lagarciag/tayni/execution"
+	"github.com/lagarciag/tayni/journal"
+	"github.com/lagarciag/tayni/kredis"
+	"github.com/lagarciag/tayni/leader"
+	"github.com/lagarciag/tayni/risk"
 	"github.com/lagarciag/tayni/taynitrader/trader"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -492,3 +510,695 @@ func errorExpected(t *testing.T, err error) {
 	}
 
 }
+
+// drivenClock returns a simulated clock that advances whenever the trader
+// waits on it.
+func drivenClock(t *testing.T) clock.Clock {
+	clk := clock.NewSimulated(time.Now())
+	t.Cleanup(clk.Drive())
+	return clk
+}
+
+// fakeExecutor fills every order with the given ratio of its amount
+type fakeExecutor struct {
+	fill   float64
+	orders map[string]execution.Order
+}
+
+func (fe *fakeExecutor) Place(request execution.OrderRequest) (execution.Order, error) {
+	ID := fmt.Sprintf("%d", len(fe.orders)+1)
+	fe.orders[ID] = execution.Order{ID: ID, Pair: request.Pair, Side: request.Side, Type: request.Type,
+		Amount: request.Amount, Price: request.Price, Status: execution.StatusNew}
+	return fe.orders[ID], nil
+}
+
+func (fe *fakeExecutor) Order(ID string) (execution.Order, error) {
+	order := fe.orders[ID]
+	order.Filled = order.Amount * fe.fill
+	if order.Status == execution.StatusCancelled {
+		return order, nil
+	}
+	if fe.fill == 1 {
+		order.Status = execution.StatusFilled
+	} else {
+		order.Status = execution.StatusPartiallyFilled
+	}
+	return order, nil
+}
+
+func (fe *fakeExecutor) Cancel(ID string) error {
+	order := fe.orders[ID]
+	order.Status = execution.StatusCancelled
+	fe.orders[ID] = order
+	return nil
+}
+
+func TestTraderExecution(t *testing.T) {
+
+	tFsm := trader.NewTradeFsm("TEST")
+	tFsm.SetClock(drivenClock(t))
+
+	config := execution.Config{OrderType: execution.Market, Amount: 2, PollInterval: time.Second, Timeout: time.Minute}
+	tFsm.SetExecutor(&fakeExecutor{fill: 1, orders: make(map[string]execution.Order)}, config)
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.TradeEvent))
+
+	fromTradingTo30MinBuy(t, tFsm)
+
+	if tFsm.Position() != 2 {
+		t.Error("Bad position after buy: ", tFsm.Position())
+	}
+}
+
+func TestTraderExecutionFailed(t *testing.T) {
+
+	tFsm := trader.NewTradeFsm("TEST")
+	tFsm.SetClock(drivenClock(t))
+
+	// Never filled, cancelled on timeout
+	config := execution.Config{OrderType: execution.Limit, Amount: 2, PollInterval: time.Second, Timeout: time.Minute}
+	tFsm.SetExecutor(&fakeExecutor{fill: 0, orders: make(map[string]execution.Order)}, config)
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.TradeEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute120BuyEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute60BuyEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute30BuyEvent))
+
+	time.Sleep(time.Second * 2)
+
+	checkState(t, tFsm, trader.TradingState)
+
+	if tFsm.Position() != 0 {
+		t.Error("Bad position after failed buy: ", tFsm.Position())
+	}
+}
+
+func TestTraderRiskExit(t *testing.T) {
+
+	tFsm := trader.NewTradeFsm("TEST")
+	tFsm.SetClock(drivenClock(t))
+
+	config := execution.Config{OrderType: execution.Market, Amount: 1, PollInterval: time.Second, Timeout: time.Minute}
+	tFsm.SetExecutor(&fakeExecutor{fill: 1, orders: make(map[string]execution.Order)}, config)
+
+	rm := risk.NewManager(risk.Config{Sizing: risk.SizeFixed, Amount: 100, StopLoss: 5}, 0)
+	tFsm.SetRiskManager(rm)
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+
+	// No indicators for TEST, so open the position by hand
+	rm.Open("TEST", 1, 100, time.Now())
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.HoldEvent))
+
+	tFsm.PriceUpdate(99)
+	checkState(t, tFsm, trader.HoldState)
+
+	tFsm.PriceUpdate(94)
+	time.Sleep(time.Second)
+
+	checkState(t, tFsm, trader.TradingState)
+
+	if _, ok := rm.Position("TEST"); ok {
+		t.Error("Position should be closed by the stop loss")
+	}
+}
+
+func TestTraderCustomCascade(t *testing.T) {
+
+	cascade := trader.CascadeConfig{Exchange: "TESTEX", Timeframes: []int{240, 60, 15, 5}}
+	tFsm := trader.NewTradeFsmWithConfig("TEST", cascade)
+
+	go tFsm.FsmController()
+
+	chansMap := tFsm.SignalChannelsMap()
+
+	chansMap["START"] <- true
+	chansMap["TRADE"] <- true
+	time.Sleep(time.Millisecond * 100)
+	checkState(t, tFsm, trader.TradingState)
+
+	// ----------------------------------
+	// Legacy channels are only set for
+	// timeframes in the cascade
+	// ----------------------------------
+	if tFsm.ChanMinute60BuyEvent == nil || tFsm.ChanMinute120BuyEvent != nil {
+		t.Error("Bad legacy channels for cascade: ", cascade.Timeframes)
+	}
+
+	buy := func(timeframe int, ev bool) {
+		chansMap[trader.BuySignalKey("TESTEX", "TEST", timeframe)] <- ev
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	sell := func(timeframe int, ev bool) {
+		chansMap[trader.SellSignalKey("TESTEX", "TEST", timeframe)] <- ev
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	buy(240, true)
+	checkState(t, tFsm, trader.BuyState(240))
+
+	buy(60, true)
+	buy(15, true)
+	checkState(t, tFsm, trader.BuyState(15))
+
+	// Losing the slowest signal goes back to trading
+	buy(240, false)
+	checkState(t, tFsm, trader.TradingState)
+
+	buy(240, true)
+	buy(60, true)
+	buy(15, true)
+	buy(5, true)
+	time.Sleep(time.Second)
+	checkState(t, tFsm, trader.HoldState)
+
+	sell(240, true)
+	sell(60, true)
+	sell(15, true)
+	checkState(t, tFsm, trader.SellState(15))
+
+	sell(15, false)
+	checkState(t, tFsm, trader.SellState(60))
+
+	sell(15, true)
+	sell(5, true)
+	time.Sleep(time.Second)
+	checkState(t, tFsm, trader.TradingState)
+}
+
+func TestTraderLoadCascadeConfig(t *testing.T) {
+
+	cascade, err := trader.LoadCascadeConfig("cexio", "BTCUSD")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if cascade.Exchange != "CEXIO" || len(cascade.Timeframes) != len(trader.DefaultTimeframes) {
+		t.Error("Expected default cascade: ", cascade)
+	}
+
+	viper.Set("trader.pairs.ethbtc.cascade", []interface{}{int64(120), int64(30)})
+	defer viper.Set("trader.pairs.ethbtc.cascade", nil)
+
+	cascade, err = trader.LoadCascadeConfig("cexio", "ETHBTC")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(cascade.Timeframes) != 2 || cascade.Timeframes[0] != 120 || cascade.Timeframes[1] != 30 {
+		t.Error("Bad pair cascade: ", cascade.Timeframes)
+	}
+
+	bad := trader.CascadeConfig{Exchange: "CEXIO", Timeframes: []int{60, 60}}
+	if err := bad.Validate(); err == nil {
+		t.Error("Expected error for repeated timeframe")
+	}
+}
+
+func TestTraderRestore(t *testing.T) {
+
+	config := execution.Config{OrderType: execution.Market, Amount: 2, PollInterval: time.Second, Timeout: time.Minute}
+	fe := &fakeExecutor{fill: 1, orders: make(map[string]execution.Order)}
+
+	tFsm := trader.NewTradeFsm("TEST")
+	tFsm.SetClock(drivenClock(t))
+	tFsm.SetExecutor(fe, config)
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.TradeEvent))
+
+	fromTradingTo30MinBuy(t, tFsm)
+
+	// ---------------------------
+	// Restart holding the buy
+	// ---------------------------
+	restarted := trader.NewTradeFsm("TEST")
+	restarted.SetClock(drivenClock(t))
+	restarted.SetExecutor(fe, config)
+
+	restored, err := restarted.Restore()
+	if err != nil || !restored {
+		t.Fatal("Context not restored: ", err)
+	}
+
+	checkState(t, restarted, trader.HoldState)
+
+	if restarted.Position() != 2 {
+		t.Error("Bad restored position: ", restarted.Position())
+	}
+
+	// ---------------------------------
+	// Restart with a sell order placed
+	// ---------------------------------
+	order, err := fe.Place(execution.OrderRequest{Pair: "TEST", Side: execution.Sell, Type: execution.Market, Amount: 2})
+	errorNotExpected(t, err)
+
+	ctx := restarted.Context()
+	ctx.State = trader.DoSellState
+	ctx.OpenOrders = []string{order.ID}
+
+	ctxJSON, err := json.Marshal(ctx)
+	errorNotExpected(t, err)
+	errorNotExpected(t, restarted.Kredis().Set("TEST_TRADE_FSM_CONTEXT", string(ctxJSON)))
+
+	resumed := trader.NewTradeFsm("TEST")
+	resumed.SetClock(drivenClock(t))
+	resumed.SetExecutor(fe, config)
+
+	restored, err = resumed.Restore()
+	if err != nil || !restored {
+		t.Fatal("Context not restored: ", err)
+	}
+
+	time.Sleep(time.Second)
+
+	checkState(t, resumed, trader.TradingState)
+
+	if resumed.Position() != 0 {
+		t.Error("Resumed sell should close the position: ", resumed.Position())
+	}
+
+	if ctx := resumed.Context(); len(ctx.OpenOrders) != 0 {
+		t.Error("No order should be left open: ", ctx.OpenOrders)
+	}
+}
+
+func TestTraderJournal(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "trader")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal.jsonl")
+	jr, err := journal.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tFsm := trader.NewTradeFsm("TEST")
+	tFsm.SetClock(drivenClock(t))
+	tFsm.SetJournal(jr)
+
+	config := execution.Config{OrderType: execution.Market, Amount: 2, PollInterval: time.Second, Timeout: time.Minute}
+	tFsm.SetExecutor(&fakeExecutor{fill: 1, orders: make(map[string]execution.Order)}, config)
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.TradeEvent))
+
+	fromTradingTo30MinBuy(t, tFsm)
+	jr.Close()
+
+	transitions, err := journal.Read(path, journal.Query{Kind: journal.KindTransition})
+	errorNotExpected(t, err)
+
+	// Idle, Trading, three buy levels, DoBuy and Hold
+	if len(transitions) != 7 || transitions[6].To != trader.HoldState || transitions[6].From != trader.DoBuyState {
+		t.Error("Bad journaled transitions: ", transitions)
+	}
+
+	trades, err := journal.Read(path, journal.Query{Kind: journal.KindTrade, Pair: "TEST"})
+	errorNotExpected(t, err)
+
+	if len(trades) != 1 || trades[0].Side != execution.Buy || trades[0].Amount != 2 {
+		t.Error("Bad journaled trades: ", trades)
+	}
+}
+
+func TestTraderControl(t *testing.T) {
+
+	tFsm := trader.NewTradeFsm("TEST")
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.HoldEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute120SellEvent))
+
+	// Paused while selling resumes holding
+	errorNotExpected(t, tFsm.Pause())
+	checkState(t, tFsm, trader.IdleState)
+	errorExpected(t, tFsm.Pause())
+
+	errorNotExpected(t, tFsm.Resume())
+	checkState(t, tFsm, trader.HoldState)
+	errorExpected(t, tFsm.Resume())
+
+	errorNotExpected(t, tFsm.ForceTrade())
+	checkState(t, tFsm, trader.TradingState)
+
+	// Nothing to sell while trading
+	errorExpected(t, tFsm.ForceSell())
+
+	errorNotExpected(t, tFsm.ForceHold())
+	checkState(t, tFsm, trader.HoldState)
+
+	// Without executor the sell completes at once
+	errorNotExpected(t, tFsm.ForceSell())
+	time.Sleep(time.Second)
+	checkState(t, tFsm, trader.TradingState)
+
+	// A paused pair stays paused once flattened
+	errorNotExpected(t, tFsm.ForceHold())
+	errorNotExpected(t, tFsm.Pause())
+	errorNotExpected(t, tFsm.ForceSell())
+	time.Sleep(time.Second)
+	checkState(t, tFsm, trader.IdleState)
+
+	if tFsm.Context().ResumeHold || tFsm.Context().PausedSell {
+		t.Error("Flattened pair should resume trading: ", tFsm.Context())
+	}
+	errorNotExpected(t, tFsm.Resume())
+	checkState(t, tFsm, trader.TradingState)
+}
+
+func TestTraderBreaker(t *testing.T) {
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	brk := breaker.New(breaker.Config{Key: fmt.Sprintf("TEST_BREAKER_%d", rand.Int63())}, kr)
+
+	tFsm := trader.NewTradeFsm("TEST")
+	tFsm.SetClock(drivenClock(t))
+	tFsm.SetBreaker(brk)
+
+	config := execution.Config{OrderType: execution.Market, Amount: 2, PollInterval: time.Second, Timeout: time.Minute}
+	tFsm.SetExecutor(&fakeExecutor{fill: 1, orders: make(map[string]execution.Order)}, config)
+
+	errorNotExpected(t, brk.Kill("test"))
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.TradeEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute120BuyEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute60BuyEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute30BuyEvent))
+
+	time.Sleep(time.Second * 2)
+
+	// The buy is refused at the end of the cascade
+	checkState(t, tFsm, trader.Minute30BuyState)
+	errorExpected(t, tFsm.FSM.Event(trader.DoBuyEvent))
+
+	if tFsm.Position() != 0 {
+		t.Error("No position should be opened while tripped: ", tFsm.Position())
+	}
+
+	errorNotExpected(t, brk.Reset())
+	errorNotExpected(t, tFsm.FSM.Event(trader.DoBuyEvent))
+
+	time.Sleep(time.Second * 2)
+
+	checkState(t, tFsm, trader.HoldState)
+
+	// Exits are still allowed
+	errorNotExpected(t, brk.Kill("test"))
+	errorNotExpected(t, tFsm.ForceSell())
+
+	time.Sleep(time.Second * 2)
+
+	checkState(t, tFsm, trader.TradingState)
+
+	if tFsm.Position() != 0 {
+		t.Error("Position should be sold while tripped: ", tFsm.Position())
+	}
+
+	errorNotExpected(t, brk.Reset())
+}
+
+func TestTraderLeader(t *testing.T) {
+
+	kr := kredis.NewKredis(1)
+	kr.Start()
+
+	key := fmt.Sprintf("TEST_LEADER_%d", rand.Int63())
+
+	configA := leader.Config{TTL: time.Minute, ID: "a"}
+	configB := leader.Config{TTL: time.Minute, ID: "b"}
+	errorNotExpected(t, configA.Validate())
+	errorNotExpected(t, configB.Validate())
+
+	leaseA := leader.NewLease(kr, key, configA)
+	leaseB := leader.NewLease(kr, key, configB)
+
+	a := trader.NewTradeFsm("TEST")
+	a.SetLease(leaseA)
+
+	b := trader.NewTradeFsm("TEST")
+	b.SetLease(leaseB)
+
+	if !leaseA.Acquire() || leaseB.Acquire() {
+		t.Fatal("Only one instance should lead")
+	}
+
+	errorNotExpected(t, a.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, a.FSM.Event(trader.TradeEvent))
+
+	// The standby does not move, nor take operator commands
+	errorExpected(t, b.FSM.Event(trader.StartEvent))
+	errorExpected(t, b.ForceHold())
+
+	if b.FSM.Current() != trader.StartState {
+		t.Error("Standby should not move: ", b.FSM.Current())
+	}
+
+	// It follows the leader instead
+	errorNotExpected(t, a.FSM.Event(trader.Minute120BuyEvent))
+	errorNotExpected(t, b.Sync())
+
+	if b.FSM.Current() != trader.Minute120BuyState {
+		t.Error("Standby should follow the leader: ", b.FSM.Current())
+	}
+
+	// Take over
+	errorNotExpected(t, leaseA.Release())
+
+	if !leaseB.Acquire() {
+		t.Fatal("Standby should take the released lease")
+	}
+
+	errorExpected(t, a.FSM.Event(trader.Minute60BuyEvent))
+	errorNotExpected(t, b.FSM.Event(trader.Minute60BuyEvent))
+	checkState(t, b, trader.Minute60BuyState)
+
+	errorNotExpected(t, leaseB.Release())
+}
+
+// reconcilingExecutor lists the orders of fakeExecutor. With drop the answer
+// to a placement is lost, with hide the orders are not listed.
+type reconcilingExecutor struct {
+	*fakeExecutor
+	drop bool
+	hide bool
+}
+
+func (re *reconcilingExecutor) Place(request execution.OrderRequest) (execution.Order, error) {
+	order, err := re.fakeExecutor.Place(request)
+	order.Created = time.Now()
+	re.orders[order.ID] = order
+	if re.drop {
+		return execution.Order{}, errors.New("connection reset")
+	}
+	return order, err
+}
+
+func (re *reconcilingExecutor) OpenOrders(pair string) ([]execution.Order, error) {
+	return nil, nil
+}
+
+func (re *reconcilingExecutor) History(pair string, since time.Time) ([]execution.Order, error) {
+	var orders []execution.Order
+	if re.hide {
+		return orders, nil
+	}
+	for ID := range re.orders {
+		order, _ := re.Order(ID)
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func TestTraderClientOrders(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "trader")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	jr, err := journal.Open(filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer jr.Close()
+
+	since := time.Now().Add(-time.Hour)
+	exchange := fmt.Sprintf("TESTEX%d", rand.Int63())
+	re := &reconcilingExecutor{fakeExecutor: &fakeExecutor{fill: 1, orders: make(map[string]execution.Order)}}
+	config := execution.Config{OrderType: execution.Market, Amount: 2, PollInterval: time.Second, Timeout: time.Minute}
+
+	tFsm := trader.NewTradeFsm("TEST")
+	tFsm.SetClock(drivenClock(t))
+	tFsm.SetJournal(jr)
+	tFsm.SetExecutor(re, config)
+	tFsm.SetSubmitter(execution.NewSubmitter(exchange, "TEST", re, tFsm.Kredis()))
+
+	// ------------------------------------
+	// A buy placed without answer is found
+	// on the exchange, not placed again
+	// ------------------------------------
+	re.drop = true
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.TradeEvent))
+
+	fromTradingTo30MinBuy(t, tFsm)
+
+	if len(re.orders) != 1 || tFsm.Position() != 2 {
+		t.Error("Dropped buy should be recovered once: ", re.orders, tFsm.Position())
+	}
+
+	if ctx := tFsm.Context(); ctx.Sequence != 1 || ctx.ClientID != "" {
+		t.Error("Bad client order context: ", ctx.Sequence, ctx.ClientID)
+	}
+
+	mismatches, err := tFsm.Reconcile(since)
+	errorNotExpected(t, err)
+
+	if len(mismatches) != 0 {
+		t.Error("Journal and exchange should match: ", mismatches)
+	}
+
+	// ------------------------------------
+	// A sell lost before the restart is
+	// recovered by its client ID
+	// ------------------------------------
+	re.hide = true
+	clientID := execution.ClientOrderID("TEST", trader.DoSellState, 2)
+
+	submitter := execution.NewSubmitter(exchange, "TEST", re, tFsm.Kredis())
+	_, err = submitter.Place(execution.OrderRequest{Pair: "TEST", Side: execution.Sell, Type: execution.Market, Amount: 2, ClientID: clientID})
+	errorExpected(t, err)
+
+	re.drop, re.hide = false, false
+
+	ctx := tFsm.Context()
+	ctx.State = trader.DoSellState
+	ctx.Sequence = 2
+	ctx.ClientID = clientID
+
+	ctxJSON, err := json.Marshal(ctx)
+	errorNotExpected(t, err)
+	errorNotExpected(t, tFsm.Kredis().Set("TEST_TRADE_FSM_CONTEXT", string(ctxJSON)))
+
+	resumed := trader.NewTradeFsm("TEST")
+	resumed.SetClock(drivenClock(t))
+	resumed.SetJournal(jr)
+	resumed.SetExecutor(re, config)
+	resumed.SetSubmitter(execution.NewSubmitter(exchange, "TEST", re, resumed.Kredis()))
+
+	restored, err := resumed.Restore()
+	if err != nil || !restored {
+		t.Fatal("Context not restored: ", err)
+	}
+
+	time.Sleep(time.Second)
+
+	checkState(t, resumed, trader.TradingState)
+
+	if len(re.orders) != 2 || resumed.Position() != 0 {
+		t.Error("Lost sell should be recovered once: ", re.orders, resumed.Position())
+	}
+
+	// ------------------------------------
+	// A trade placed by hand is reported
+	// ------------------------------------
+	re.fakeExecutor.Place(execution.OrderRequest{Pair: "TEST", Side: execution.Buy, Type: execution.Market, Amount: 5})
+
+	mismatches, err = resumed.Reconcile(since)
+	errorNotExpected(t, err)
+
+	if len(mismatches) != 1 || mismatches[0].Kind != execution.MismatchUnknownOrder || mismatches[0].OrderID != "3" {
+		t.Error("Unknown order not reported: ", mismatches)
+	}
+}
+
+// cexioMarket is a CEX.IO private API that fills market buys at fillPrice.
+// Like the exchange, it takes and reports them in the quote currency.
+type cexioMarket struct {
+	mu        sync.Mutex
+	fillPrice float64
+	spent     float64
+}
+
+func (cm *cexioMarket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	r.ParseForm()
+	created := time.Now().UnixNano() / int64(time.Millisecond)
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/place_order/"):
+		cm.spent, _ = strconv.ParseFloat(r.Form.Get("amount"), 64)
+		fmt.Fprintf(w, `{"id":"7","time":%d,"type":"buy","amount":"%f","pending":"%f"}`, created, cm.spent, cm.spent)
+
+	case r.URL.Path == "/get_order/":
+		fmt.Fprintf(w, `{"id":"7","time":%d,"type":"buy","symbol1":"TEST","symbol2":"USD","amount":"%f","price":"0","remains":"0","status":"d","ta:USD":"%f","a:TEST:cds":"%.8f"}`,
+			created, cm.spent, cm.spent, cm.spent/cm.fillPrice)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestTraderCexioMarketBuy(t *testing.T) {
+
+	cm := &cexioMarket{fillPrice: 4100}
+	server := httptest.NewServer(cm)
+	defer server.Close()
+
+	exchange := fmt.Sprintf("TESTEX%d", rand.Int63())
+	tFsm := trader.NewTradeFsmWithConfig("TESTUSD", trader.CascadeConfig{Exchange: exchange, Timeframes: []int{120, 60, 30}})
+	tFsm.SetClock(drivenClock(t))
+
+	// The buy is placed at the last price
+	indicatorsJSON, err := json.Marshal(movingstats.Indicators{LastValue: 4000})
+	errorNotExpected(t, err)
+	indicatorsID := fmt.Sprintf("%s_TESTUSD_MS_120", exchange)
+	errorNotExpected(t, tFsm.Kredis().AddString(indicatorsID, "INDICATORS", indicatorsJSON))
+	defer tFsm.Kredis().DeleteList(indicatorsID, "INDICATORS")
+
+	cx := execution.NewCexio(execution.CexioConfig{Key: "KEY", Secret: "SECRET", UserID: "up123", BaseURL: server.URL})
+	config := execution.Config{OrderType: execution.Market, Amount: 0.5, PollInterval: time.Second, Timeout: time.Minute}
+	tFsm.SetExecutor(cx, config)
+
+	errorNotExpected(t, tFsm.FSM.Event(trader.StartEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.TradeEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute120BuyEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute60BuyEvent))
+	errorNotExpected(t, tFsm.FSM.Event(trader.Minute30BuyEvent))
+
+	time.Sleep(2 * time.Second)
+
+	if tFsm.FSM.Current() != trader.HoldState {
+		t.Fatal("Market buy not complete: ", tFsm.FSM.Current())
+	}
+
+	cm.mu.Lock()
+	spent := cm.spent
+	cm.mu.Unlock()
+
+	if spent != 2000 {
+		t.Error("Market buy should spend the quote currency: ", spent)
+	}
+
+	// Filled in base units at the average fill price
+	ctx := tFsm.Context()
+	if math.Abs(ctx.Position-2000.0/4100) > 1e-6 || math.Abs(ctx.Entry-4100) > 0.01 {
+		t.Error("Bad position after market buy: ", ctx.Position, ctx.Entry)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
@@ -18,6 +19,24 @@ type Config struct {
 	AccessTokenSecret string
 }
 
+// LoadConfig reads the [twitter] configuration.
+func LoadConfig() Config {
+	config := Config{}
+
+	vTwitterConfig := viper.Get("twitter").(map[string]interface{})
+	config.Twit = vTwitterConfig["twit"].(bool)
+	config.ConsumerKey = vTwitterConfig["consumer_key"].(string)
+	config.ConsumerSecret = vTwitterConfig["consumer_secret"].(string)
+	config.AccessToken = vTwitterConfig["access_token"].(string)
+	config.AccessTokenSecret = vTwitterConfig["access_token_secret"].(string)
+
+	if config.ConsumerKey == "" {
+		log.Fatal("bad consumerkey")
+	}
+
+	return config
+}
+
 type TwitterClient struct {
 	consumerKey       string
 	consumerSecret    string
@@ -50,6 +69,11 @@ func NewTwitterClient(config Config) *TwitterClient {
 	return tc
 }
 
+// Enabled tells if the messages are tweeted.
+func (tc *TwitterClient) Enabled() bool {
+	return tc.twit
+}
+
 func (tc *TwitterClient) Twit(message string) error {
 
 	if tc.twit {